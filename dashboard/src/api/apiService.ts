@@ -1,7 +1,6 @@
-import { Device, DeviceSettings, UserPreferences } from 'src/model/model';
+import { AuthTokens, Device, DeviceSettings, User, UserPreferences } from 'src/model/model';
 
 const config = {
-	userID: 'default',
 	api: {
 		baseUrl: 'http://localhost',
 		port: 8080,
@@ -13,7 +12,9 @@ const config = {
 			uploadDeviceIcon: '/devices',
 		},
 
-	}
+	},
+	// Where the tokens of the signed in user are kept between page loads
+	storageKey: 'onestepgps.auth',
 };
 
 interface CheckForUpdatesResponse {
@@ -27,9 +28,21 @@ interface CheckForUpdatesResponse {
 class ApiService {
 	private static instance: ApiService;
 	private baseUrl: string;
+	private tokens: AuthTokens | null = null;
+	private refreshing: Promise<void> | null = null;
+	private sessionEndedHandler: (() => void) | null = null;
 
 	private constructor() {
 		this.baseUrl = `${config.api.baseUrl}:${config.api.port}`;
+		const stored = localStorage.getItem(config.storageKey);
+		if (stored) {
+			try {
+				this.tokens = JSON.parse(stored) as AuthTokens;
+			} catch (error) {
+				console.warn('Ignoring unreadable stored tokens', error);
+				localStorage.removeItem(config.storageKey);
+			}
+		}
 	}
 
 
@@ -40,10 +53,97 @@ class ApiService {
 		return ApiService.instance;
 	}
 
+	isAuthenticated(): boolean {
+		return this.tokens !== null;
+	}
+
+	currentUser(): User | null {
+		return this.tokens?.user ?? null;
+	}
+
+	// Called when the refresh token is rejected and the user has to sign in again
+	onSessionEnded(handler: () => void) {
+		this.sessionEndedHandler = handler;
+	}
+
+	async login(username: string, password: string): Promise<User> {
+		const response = await fetch(`${this.baseUrl}/api/auth/login`, {
+			method: 'POST',
+			headers: { 'Content-Type': 'application/json' },
+			body: JSON.stringify({ username, password }),
+		});
+		if (!response.ok) {
+			throw await this.handleError(response);
+		}
+		const tokens = await response.json() as AuthTokens;
+		this.setTokens(tokens);
+		return tokens.user;
+	}
+
+	async logout(): Promise<void> {
+		try {
+			await this.authFetch(`${this.baseUrl}/api/auth/logout`, { method: 'POST' });
+		} catch (error) {
+			console.warn('Error ending the session on the server', error); // Signed out locally anyway
+		}
+		this.setTokens(null);
+	}
+
+	// Exchanges the refresh token for new tokens. Concurrent callers share one request.
+	async refreshSession(): Promise<void> {
+		if (!this.refreshing) {
+			this.refreshing = (async () => {
+				const response = await fetch(`${this.baseUrl}/api/auth/refresh`, {
+					method: 'POST',
+					headers: { 'Content-Type': 'application/json' },
+					body: JSON.stringify({ refresh_token: this.tokens?.refresh_token }),
+				});
+				if (!response.ok) {
+					this.setTokens(null);
+					this.sessionEndedHandler?.();
+					throw await this.handleError(response);
+				}
+				this.setTokens(await response.json() as AuthTokens);
+			})().finally(() => {
+				this.refreshing = null;
+			});
+		}
+		return this.refreshing;
+	}
+
+	private setTokens(tokens: AuthTokens | null) {
+		this.tokens = tokens;
+		if (tokens) {
+			localStorage.setItem(config.storageKey, JSON.stringify(tokens));
+		} else {
+			localStorage.removeItem(config.storageKey);
+		}
+	}
+
+	// fetch with the access token. An expired access token is refreshed once and the request retried.
+	private async authFetch(url: string, init: RequestInit = {}): Promise<Response> {
+		const send = () => {
+			const headers = new Headers(init.headers);
+			if (this.tokens) {
+				headers.set('Authorization', `Bearer ${this.tokens.access_token}`);
+			}
+			return fetch(url, { ...init, headers });
+		};
+
+		const response = await send();
+		if (response.status !== 401 || !this.tokens) {
+			return response;
+		}
+		await this.refreshSession();
+		return send();
+	}
+
 	async getDevices(): Promise<Device[]> {
-		const url = `${this.baseUrl}/api/devices`; // Use baseUrl and correct endpoint
+		// Only the fields the list and map show, full device documents carry tens of KB each
+		const fields = ['display_name', 'online', 'active_state', 'updated_at', 'version', 'iconUrl', 'latest_device_point', 'latest_accurate_device_point'];
+		const url = `${this.baseUrl}/api/devices?fields=${fields.join(',')}`;
 		try {
-			const response = await fetch(url);
+			const response = await this.authFetch(url);
 			if (!response.ok) {
 				throw await this.handleError(response);
 			}
@@ -57,7 +157,7 @@ class ApiService {
 
 	async refreshDatabase(): Promise<string> {
 		try {
-			const response = await fetch(`${config.api.baseUrl}:${config.api.port}${config.api.endpoints.refreshDatabase}`, { // Use the correct config value for endpoint
+			const response = await this.authFetch(`${config.api.baseUrl}:${config.api.port}${config.api.endpoints.refreshDatabase}`, { // Use the correct config value for endpoint
 				method: 'POST', // POST is usually appropriate for triggering an action
 			});
 
@@ -77,7 +177,7 @@ class ApiService {
         const url = `${this.baseUrl}${config.api.endpoints.updateDevice}/${deviceId}`; // Use deviceId in URL
 
         try {
-            const response = await fetch(url, {
+            const response = await this.authFetch(url, {
                 method: 'PUT',
                 headers: {
                     'Content-Type': 'application/json',
@@ -98,11 +198,12 @@ class ApiService {
     }
 
 
-	async getUserPreferences(userId: string): Promise<UserPreferences> {
-		const url = `${this.baseUrl}/api/users/${userId}/preferences`; // Correct URL structure
+	async getUserPreferences(): Promise<UserPreferences> {
+		const userId = this.currentUser()?.id ?? '';
+		const url = `${this.baseUrl}/api/users/me/preferences`; // Preferences of the signed in user
 	
 		try {
-			const response = await fetch(url);
+			const response = await this.authFetch(url);
 			if (!response.ok) {
 				if (response.status === 404) { 
 					console.log('User preferences not found, creating default...')
@@ -141,9 +242,9 @@ class ApiService {
 	}
 
 	async saveUserPreferences(preferences: UserPreferences): Promise<UserPreferences> {
-		const url = `${this.baseUrl}/api/users/${preferences.userId}/preferences`; 
+		const url = `${this.baseUrl}/api/users/me/preferences`;
 		try {
-			const response = await fetch(url, {
+			const response = await this.authFetch(url, {
 				method: 'POST',
 				headers: { 'Content-Type': 'application/json' },
 				body: JSON.stringify(preferences),
@@ -163,7 +264,7 @@ class ApiService {
 
 	async removeDeviceIcon(deviceId: string): Promise<{iconUrl: string, version: number}> {
 		try {
-			const response = await fetch(`${this.baseUrl}/api/devices/${deviceId}/icon?remove=true`, {
+			const response = await this.authFetch(`${this.baseUrl}/api/devices/${deviceId}/icon?remove=true`, {
 				method: 'POST', //Use POST
 			});
 			if (!response.ok) {
@@ -201,7 +302,7 @@ class ApiService {
 				return await this.removeDeviceIcon(deviceId) as {iconUrl: string, version: number}; //Remove icon and return
 			}
 	
-			const response = await fetch(`${this.baseUrl}/api/devices/${deviceId}/icon`, {
+			const response = await this.authFetch(`${this.baseUrl}/api/devices/${deviceId}/icon`, {
 				method: 'POST',
 				body: formData,
 			});
@@ -230,7 +331,7 @@ class ApiService {
 	// return path of the icon, or null if icon is not found
 	async getIcon(deviceId: string): Promise<string | null> {
 		try {
-			const response = await fetch(`${config.api.baseUrl}:${config.api.port}/icons/${deviceId}`); // Correct URL structure.  Adjust as needed.
+			const response = await this.authFetch(`${config.api.baseUrl}:${config.api.port}/icons/${deviceId}`); // Correct URL structure.  Adjust as needed.
 			if (!response.ok) {
 				if (response.status === 404) { // If no icon exists for this device ID, this is a valid case.
 					return null;  // Return null to indicate no icon, don't throw
@@ -253,7 +354,7 @@ class ApiService {
         const url = `${this.baseUrl}/api/devices/check-updates?lastUpdate=${lastUpdate || '1970-01-01T00:00:00Z'}`; // Provide default timestamp
 
         try {
-            const response = await fetch(url);
+            const response = await this.authFetch(url);
             if (!response.ok) {
                 throw await this.handleError(response); 
             }
@@ -264,6 +365,18 @@ class ApiService {
         }
     }
 
+	// Server-sent events stream of device, settings and icon changes. EventSource reconnects
+	// on its own and sends Last-Event-ID so the server can replay what was missed. It cannot send
+	// headers, so the access token is passed in the URL; once it expires the stream has to be
+	// reopened with lastEventId after refreshSession.
+	openDeviceStream(lastEventId: string | null = null): EventSource {
+		const params = new URLSearchParams({ access_token: this.tokens?.access_token ?? '' });
+		if (lastEventId) {
+			params.set('lastEventId', lastEventId);
+		}
+		return new EventSource(`${this.baseUrl}/api/devices/stream?${params.toString()}`);
+	}
+
 	private async handleError(response: Response): Promise<Error> {
         try {
             const errorData = await response.json(); 
@@ -285,7 +398,7 @@ class ApiService {
         const url = `${this.baseUrl}/api/devices/${deviceId}/settings`; // Correct URL
 		console.log(url);
         try {
-            const response = await fetch(url);
+            const response = await this.authFetch(url);
             if (!response.ok) {
                 throw await this.handleError(response);
             }
@@ -306,7 +419,7 @@ class ApiService {
         const url = `${this.baseUrl}/api/devices/${settings.device_id}/settings`;  // Include deviceId in URL
 		console.log('SAVE device settings');
         try {
-            const response = await fetch(url, {
+            const response = await this.authFetch(url, {
                 method: 'PUT',  
                 headers: {
                     'Content-Type': 'application/json',
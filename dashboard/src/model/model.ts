@@ -129,6 +129,28 @@ export interface DevicePointDetail {
 	speed?: { value: number; unit: string; display: string };
 }
 
+export interface User {
+	id: string;
+	username: string;
+	role: 'viewer' | 'operator' | 'admin';
+	upstream_user_ids: string[] | null;
+	device_ids: string[] | null;
+	hidden_device_ids: string[] | null;
+	version: number;
+	created_at: string;
+	updated_at: string;
+	last_login_at?: string;
+}
+
+// Returned by login and refresh
+export interface AuthTokens {
+	access_token: string;
+	refresh_token: string;
+	token_type: string;
+	expires_in: number;
+	user: User;
+}
+
 export interface UserPreferences {
 	version: number;
 	userId: string;
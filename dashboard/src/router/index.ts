@@ -7,6 +7,7 @@ import {
 } from 'vue-router';
 
 import routes from './routes';
+import { apiService } from 'src/api/apiService';
 
 /*
  * If not building with SSR mode, you can
@@ -32,5 +33,15 @@ export default route(function (/* { store, ssrContext } */) {
     history: createHistory(process.env.VUE_ROUTER_BASE),
   });
 
+  // Every page except the login page needs a signed in user
+  Router.beforeEach((to) => {
+    if (!to.meta.public && !apiService.isAuthenticated()) {
+      return { name: 'Login', query: { redirect: to.fullPath } };
+    }
+  });
+  apiService.onSessionEnded(() => {
+    Router.push({ name: 'Login' });
+  });
+
   return Router;
 });
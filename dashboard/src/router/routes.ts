@@ -1,6 +1,7 @@
 import { RouteRecordRaw } from 'vue-router';
 
 const routes: RouteRecordRaw[] = [
+  { path: '/login', name: 'Login', component: () => import('pages/loginPage.vue'), meta: { public: true } },
   {
     path: '/',
     component: () => import('layouts/MainLayout.vue'),
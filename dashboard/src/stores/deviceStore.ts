@@ -24,6 +24,77 @@ export const useDeviceStore = defineStore('device', () => {
     const deviceSettingsLoaded = ref(false);  
     const deviceSettingsLoading = ref(false);
 	const pollingActive = ref(false);
+	const eventSource = ref<EventSource | null>(null);
+	let lastEventId: string | null = null;
+
+	interface StreamEvent<T> {
+		id: string;
+		type: string;
+		device_id: string;
+		data: T;
+	}
+
+	const parseStreamEvent = <T>(e: Event): StreamEvent<T> => {
+		lastEventId = (e as MessageEvent).lastEventId || lastEventId;
+		return JSON.parse((e as MessageEvent).data) as StreamEvent<T>;
+	};
+
+	const startStream = () => {
+		const source = apiService.openDeviceStream(lastEventId);
+
+		source.addEventListener('device', (e) => {
+			const event = parseStreamEvent<Device>(e);
+			if (!devices.value.some(device => device.device_id === event.device_id)) {
+				loadDevices(); // New device, reload the list
+				return;
+			}
+			mergeUpdatedDevices([event.data], null);
+		});
+
+		source.addEventListener('icon', (e) => {
+			const event = parseStreamEvent<{ iconUrl: string }>(e);
+			const device = devices.value.find(d => d.device_id === event.device_id);
+			if (device) {
+				device.iconUrl = event.data.iconUrl;
+				devices.value = [...devices.value]; // Trigger reactivity
+			}
+		});
+
+		source.addEventListener('settings', (e) => {
+			const event = parseStreamEvent<DeviceSettings>(e);
+			if (deviceSettings.value?.device_id === event.device_id) {
+				deviceSettings.value = event.data;
+			}
+			const device = devices.value.find(d => d.device_id === event.device_id);
+			if (device && event.data.iconUrl !== undefined) {
+				device.iconUrl = event.data.iconUrl;
+				devices.value = [...devices.value];
+			}
+		});
+
+		// The server could not replay what we missed while disconnected
+		source.addEventListener('reset', () => {
+			loadDevices();
+		});
+
+		source.onerror = async (error) => {
+			if (source.readyState !== EventSource.CLOSED) {
+				console.error('Device stream error, the browser will reconnect', error);
+				return;
+			}
+			// The server refused the stream, usually because the access token in its URL expired
+			source.close();
+			if (eventSource.value !== source) return; // Stopped meanwhile
+			try {
+				await apiService.refreshSession();
+				startStream();
+			} catch (refreshError) {
+				console.error('Device stream closed, signing in again is required', refreshError);
+			}
+		};
+
+		eventSource.value = source;
+	};
 
     const mergeUpdatedDevices = (updatedDevices: Device[], iconMap: {[key: string]: string} | null) => {
 		if(iconMap) { 
@@ -107,8 +178,14 @@ export const useDeviceStore = defineStore('device', () => {
 		
 		try {
 		  await loadDevices();
-		  // Initial poll
+		  // Initial poll, also fetches the icon map
 		  await poll();
+
+		  // Prefer the server-sent events stream, fall back to polling check-updates
+		  if (typeof EventSource !== 'undefined') {
+			startStream();
+			return;
+		  }
 		  
 		  // Clear any existing interval
 		  if (pollingInterval.value) {
@@ -126,6 +203,10 @@ export const useDeviceStore = defineStore('device', () => {
 	  };
 	
 	  const stopPolling = () => {
+		if (eventSource.value) {
+		  eventSource.value.close();
+		  eventSource.value = null;
+		}
 		if (pollingInterval.value) {
 		  clearInterval(pollingInterval.value);
 		  pollingInterval.value = null;
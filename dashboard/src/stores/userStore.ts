@@ -11,9 +11,10 @@ export const useUserStore = defineStore('user', () => {
 	const $q = useQuasar();
 	const userLoaded = ref(false);
 	const userLoading = ref(false);
-	const userID = ref('default_user');
+	const user = ref(apiService.currentUser());
+	const userID = ref(user.value?.id ?? '');
 	const userPreferences = ref<UserPreferences>({
-		userId: 'default_user',
+		userId: userID.value,
 		version: 0,
 		DeviceListWidth: 400, 
 		unit: 'original',
@@ -23,11 +24,12 @@ export const useUserStore = defineStore('user', () => {
 		if (userLoading.value) return;
 		userLoading.value = true;
         try {
-            const preferences = await apiService.getUserPreferences(userID.value); // the user is default_user right now
+            const preferences = await apiService.getUserPreferences(); // Preferences of the signed in user
             userPreferences.value = preferences; 
 			userLoaded.value = true; 
 			userLoading.value = false; 
         } catch (error) {
+			userLoading.value = false;
             $q.notify({
                 type: 'negative', 
                 message: 'Error loading user preferences. Please try again later.',
@@ -72,6 +74,19 @@ export const useUserStore = defineStore('user', () => {
 		saveUserPreferences()
 	}
 
+	async function login(username: string, password: string) {
+		user.value = await apiService.login(username, password);
+		userID.value = user.value.id;
+		userLoaded.value = false; // Load the preferences of the new user
+	}
+
+	async function logout() {
+		await apiService.logout();
+		user.value = null;
+		userID.value = '';
+		userLoaded.value = false;
+	}
+
 	const ensurePreferencesLoaded = async () => {
 		if (!userLoaded.value) {
 		  await loadUser();
@@ -81,11 +96,14 @@ export const useUserStore = defineStore('user', () => {
 
 	return {
 		// states
+		user,
 		userID,
 		userPreferences,
 		userLoading,
 		userLoaded,
 		// actions
+		login,
+		logout,
 		loadUser,
 		saveUserPreferences,
 		setDeviceListWidth,
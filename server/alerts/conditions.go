@@ -0,0 +1,360 @@
+/*
+Package alerts evaluates alert rules against ingested points, geofence events and
+online/offline transitions.
+
+Each rule has a condition type. The built-in types are:
+  - speeding: the point speed is above options max_speed (in options unit, default mph).
+    Resolved by a point at or below the limit.
+  - geofence: a geofence event of options event (enter, exit or dwell, default enter) for
+    options geofence_id, or for any geofence if it is empty. Enter and dwell alerts are
+    resolved when the device leaves the geofence, exit alerts when it enters it again.
+  - offline: the device went offline, i.e. it has not reported for longer than its
+    OfflineTimeout. Resolved when the device comes back.
+  - low_battery: params.obd_battery_voltage is below options min_voltage (default 11.8).
+    Resolved by a point with a voltage at or above it.
+  - ignition_hours: the ignition (params.acc) is on outside options start to end (HH:MM,
+    default 07:00 to 19:00) on options days (e.g. "mon,tue,wed,thu,fri", default every day)
+    in options timezone (default UTC). Resolved when the ignition is off or the working
+    hours begin.
+
+Repeated triggers are counted on the unresolved alert, a new alert is only raised once it is
+resolved and the rule cooldown has passed.
+
+Further conditions can be added with Register.
+*/
+package alerts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+// Input is what a rule is evaluated against. Exactly one of Point, GeofenceEvent and Status is set.
+type Input struct {
+	DeviceID      string
+	Time          time.Time
+	Point         *models.DevicePointRecord
+	Settings      models.DeviceSettings
+	GeofenceEvent *models.GeofenceEvent
+	Status        *models.AvailabilityEvent
+}
+
+// Condition decides whether a rule fires for an input and describes why.
+type Condition interface {
+	Evaluate(input Input) (message string, fired bool)
+}
+
+// Resolver is implemented by conditions that can tell when the problem is over. Unresolved
+// alerts of their rules are resolved automatically.
+type Resolver interface {
+	Resolved(input Input) bool
+}
+
+// Factory creates a condition from the rule options.
+type Factory func(options map[string]string) (Condition, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Factory{
+		"speeding":       newSpeeding,
+		"geofence":       newGeofence,
+		"offline":        newOffline,
+		"low_battery":    newLowBattery,
+		"ignition_hours": newIgnitionHours,
+	}
+)
+
+// Register makes a condition type available to alert rules. Registering an existing type replaces it.
+func Register(conditionType string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[conditionType] = factory
+}
+
+// NewCondition creates the condition of a rule.
+func NewCondition(rule models.AlertRule) (Condition, error) {
+	registryMutex.RLock()
+	factory, ok := registry[rule.Type]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown alert rule type %q", rule.Type)
+	}
+	return factory(rule.Options)
+}
+
+// Validate checks that a rule has a name and valid options for its type.
+func Validate(rule models.AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if rule.CooldownSeconds < 0 {
+		return fmt.Errorf("cooldown_seconds must not be negative")
+	}
+	_, err := NewCondition(rule)
+	return err
+}
+
+type speeding struct {
+	limit models.Speed
+}
+
+func newSpeeding(options map[string]string) (Condition, error) {
+	value, err := floatOption(options, "max_speed", -1)
+	if err != nil {
+		return nil, err
+	}
+	if value <= 0 {
+		return nil, fmt.Errorf("max_speed must be positive")
+	}
+	unit := options["unit"]
+	if unit == "" {
+		unit = "mph"
+	}
+	return speeding{limit: models.Speed{Value: value, Unit: unit}}, nil
+}
+
+func (c speeding) Evaluate(input Input) (string, bool) {
+	if input.Point == nil || input.Point.Speed <= c.limit.KilometersPerHour() {
+		return "", false
+	}
+	return fmt.Sprintf("Speed %.0f km/h is above the limit of %v %s", input.Point.Speed, c.limit.Value, c.limit.Unit), true
+}
+
+func (c speeding) Resolved(input Input) bool {
+	return input.Point != nil && input.Point.Speed <= c.limit.KilometersPerHour()
+}
+
+type geofenceCondition struct {
+	geofenceID string
+	event      string
+}
+
+func newGeofence(options map[string]string) (Condition, error) {
+	event := options["event"]
+	if event == "" {
+		event = models.GeofenceEnter
+	}
+	if event != models.GeofenceEnter && event != models.GeofenceExit && event != models.GeofenceDwell {
+		return nil, fmt.Errorf("event must be enter, exit or dwell")
+	}
+	return geofenceCondition{geofenceID: options["geofence_id"], event: event}, nil
+}
+
+func (c geofenceCondition) Evaluate(input Input) (string, bool) {
+	event := input.GeofenceEvent
+	if event == nil || event.Type != c.event || (c.geofenceID != "" && event.GeofenceID != c.geofenceID) {
+		return "", false
+	}
+	switch event.Type {
+	case models.GeofenceEnter:
+		return fmt.Sprintf("Arrived at %s", event.GeofenceName), true
+	case models.GeofenceExit:
+		return fmt.Sprintf("Left %s after %s", event.GeofenceName, formatSeconds(event.InsideSeconds)), true
+	}
+	return fmt.Sprintf("Inside %s for %s", event.GeofenceName, formatSeconds(event.InsideSeconds)), true
+}
+
+// Resolved reports the geofence event that ends the situation of the alert: leaving after enter
+// or dwell, entering again after exit.
+func (c geofenceCondition) Resolved(input Input) bool {
+	event := input.GeofenceEvent
+	if event == nil || (c.geofenceID != "" && event.GeofenceID != c.geofenceID) {
+		return false
+	}
+	if c.event == models.GeofenceExit {
+		return event.Type == models.GeofenceEnter
+	}
+	return event.Type == models.GeofenceExit
+}
+
+type offline struct{}
+
+func newOffline(options map[string]string) (Condition, error) {
+	return offline{}, nil
+}
+
+func (offline) Evaluate(input Input) (string, bool) {
+	if input.Status == nil || input.Status.Online {
+		return "", false
+	}
+	return fmt.Sprintf("Offline since %s, last seen %s", input.Status.Time.Format(time.RFC3339), input.Status.LastSeen.Format(time.RFC3339)), true
+}
+
+func (offline) Resolved(input Input) bool {
+	return input.Status != nil && input.Status.Online
+}
+
+type lowBattery struct {
+	minVoltage float64
+}
+
+func newLowBattery(options map[string]string) (Condition, error) {
+	minVoltage, err := floatOption(options, "min_voltage", 11.8)
+	if err != nil {
+		return nil, err
+	}
+	return lowBattery{minVoltage: minVoltage}, nil
+}
+
+func (c lowBattery) Evaluate(input Input) (string, bool) {
+	if input.Point == nil {
+		return "", false
+	}
+	voltage, ok := pointParam(input.Point, "obd_battery_voltage")
+	if !ok || voltage >= c.minVoltage {
+		return "", false
+	}
+	return fmt.Sprintf("Battery voltage %.2f V is below %.2f V", voltage, c.minVoltage), true
+}
+
+func (c lowBattery) Resolved(input Input) bool {
+	if input.Point == nil {
+		return false
+	}
+	voltage, ok := pointParam(input.Point, "obd_battery_voltage")
+	return ok && voltage >= c.minVoltage
+}
+
+type ignitionHours struct {
+	start, end time.Duration // Offsets from midnight
+	days       map[time.Weekday]bool
+	location   *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func newIgnitionHours(options map[string]string) (Condition, error) {
+	c := ignitionHours{days: make(map[time.Weekday]bool), location: time.UTC}
+	var err error
+	if c.start, err = clockOption(options, "start", "07:00"); err != nil {
+		return nil, err
+	}
+	if c.end, err = clockOption(options, "end", "19:00"); err != nil {
+		return nil, err
+	}
+	if tz := options["timezone"]; tz != "" {
+		if c.location, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+	if days := options["days"]; days != "" {
+		for _, day := range strings.Split(days, ",") {
+			name := strings.ToLower(strings.TrimSpace(day))
+			if len(name) > 3 {
+				name = name[:3] // Accept full names like "monday"
+			}
+			weekday, ok := weekdays[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q", day)
+			}
+			c.days[weekday] = true
+		}
+	} else {
+		for _, weekday := range weekdays {
+			c.days[weekday] = true
+		}
+	}
+	return c, nil
+}
+
+func (c ignitionHours) Evaluate(input Input) (string, bool) {
+	if input.Point == nil {
+		return "", false
+	}
+	acc, ok := pointParam(input.Point, "acc")
+	if !ok || acc != 1 {
+		return "", false
+	}
+	if c.allowed(input.Point.DtTracker) {
+		return "", false
+	}
+	local := input.Point.DtTracker.In(c.location)
+	return fmt.Sprintf("Ignition on at %s, outside working hours", local.Format("Mon 15:04 MST")), true
+}
+
+func (c ignitionHours) Resolved(input Input) bool {
+	if input.Point == nil {
+		return false
+	}
+	acc, ok := pointParam(input.Point, "acc")
+	return (ok && acc != 1) || c.allowed(input.Point.DtTracker)
+}
+
+// allowed reports whether t is inside the working hours. Windows with end before start span midnight.
+func (c ignitionHours) allowed(t time.Time) bool {
+	local := t.In(c.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, c.location)
+	offset := local.Sub(midnight)
+	if c.start <= c.end {
+		return c.days[local.Weekday()] && offset >= c.start && offset < c.end
+	}
+	if offset >= c.start {
+		return c.days[local.Weekday()]
+	}
+	if offset < c.end {
+		return c.days[midnight.AddDate(0, 0, -1).Weekday()] // Continuation of the previous day's shift
+	}
+	return false
+}
+
+// pointParam reads a numeric upstream param, which the OneStepGPS API reports as strings.
+func pointParam(point *models.DevicePointRecord, name string) (float64, bool) {
+	if point.Point == nil {
+		return 0, false
+	}
+	switch v := point.Point.Params[name].(type) {
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// floatOption parses a numeric option. A negative fallback makes the option required.
+func floatOption(options map[string]string, name string, fallback float64) (float64, error) {
+	str, ok := options[name]
+	if !ok || str == "" {
+		if fallback < 0 {
+			return 0, fmt.Errorf("%s is required", name)
+		}
+		return fallback, nil
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number", name)
+	}
+	return value, nil
+}
+
+// clockOption parses an HH:MM option into an offset from midnight.
+func clockOption(options map[string]string, name, fallback string) (time.Duration, error) {
+	str := options[name]
+	if str == "" {
+		str = fallback
+	}
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be HH:MM", name)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
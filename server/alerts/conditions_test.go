@@ -0,0 +1,142 @@
+package alerts
+
+import (
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+// pointInput is a point of device at t with a speed in km/h and the given upstream params.
+func pointInput(t time.Time, speed float64, params map[string]interface{}) Input {
+	return Input{
+		DeviceID: "device",
+		Time:     t,
+		Point: &models.DevicePointRecord{
+			DeviceID:  "device",
+			DtTracker: t,
+			Speed:     speed,
+			Point:     &models.DevicePoint{Params: params},
+		},
+	}
+}
+
+func geofenceInput(eventType, geofenceID string) Input {
+	return Input{
+		DeviceID:      "device",
+		GeofenceEvent: &models.GeofenceEvent{Type: eventType, GeofenceID: geofenceID, GeofenceName: "Depot", InsideSeconds: 600},
+	}
+}
+
+func statusInput(online bool) Input {
+	return Input{DeviceID: "device", Status: &models.AvailabilityEvent{DeviceID: "device", Online: online}}
+}
+
+// Wednesday 2024-11-13 at the given UTC time.
+func wednesday(hour, minute int) time.Time {
+	return time.Date(2024, 11, 13, hour, minute, 0, 0, time.UTC)
+}
+
+func TestConditions(t *testing.T) {
+	noon := wednesday(12, 0)
+	tests := []struct {
+		name     string
+		rule     models.AlertRule
+		input    Input
+		fired    bool
+		resolved bool
+	}{
+		{"speeding above the limit", rule("speeding", "max_speed", "60"), pointInput(noon, 100, nil), true, false},
+		{"speeding at the limit", rule("speeding", "max_speed", "60"), pointInput(noon, 60*1.609344, nil), false, true},
+		{"speeding in km/h", rule("speeding", "max_speed", "100", "unit", "km/h"), pointInput(noon, 99, nil), false, true},
+		{"speeding ignores status", rule("speeding", "max_speed", "60"), statusInput(false), false, false},
+
+		{"geofence enter", rule("geofence"), geofenceInput(models.GeofenceEnter, "a"), true, false},
+		{"geofence enter resolved by exit", rule("geofence"), geofenceInput(models.GeofenceExit, "a"), false, true},
+		{"geofence other geofence", rule("geofence", "geofence_id", "b"), geofenceInput(models.GeofenceEnter, "a"), false, false},
+		{"geofence exit of other geofence", rule("geofence", "geofence_id", "b"), geofenceInput(models.GeofenceExit, "a"), false, false},
+		{"geofence exit", rule("geofence", "event", "exit"), geofenceInput(models.GeofenceExit, "a"), true, false},
+		{"geofence exit resolved by enter", rule("geofence", "event", "exit"), geofenceInput(models.GeofenceEnter, "a"), false, true},
+		{"geofence dwell", rule("geofence", "event", "dwell"), geofenceInput(models.GeofenceDwell, "a"), true, false},
+		{"geofence dwell resolved by exit", rule("geofence", "event", "dwell"), geofenceInput(models.GeofenceExit, "a"), false, true},
+
+		{"offline", rule("offline"), statusInput(false), true, false},
+		{"back online", rule("offline"), statusInput(true), false, true},
+
+		{"battery low", rule("low_battery"), pointInput(noon, 0, map[string]interface{}{"obd_battery_voltage": "11.2"}), true, false},
+		{"battery recovered", rule("low_battery"), pointInput(noon, 0, map[string]interface{}{"obd_battery_voltage": "12.6"}), false, true},
+		{"battery float param", rule("low_battery", "min_voltage", "12"), pointInput(noon, 0, map[string]interface{}{"obd_battery_voltage": 11.5}), true, false},
+		{"battery int param", rule("low_battery", "min_voltage", "12"), pointInput(noon, 0, map[string]interface{}{"obd_battery_voltage": 11}), true, false},
+		{"battery unknown", rule("low_battery"), pointInput(noon, 0, nil), false, false},
+		{"battery unreadable", rule("low_battery"), pointInput(noon, 0, map[string]interface{}{"obd_battery_voltage": "n/a"}), false, false},
+
+		{"ignition during hours", rule("ignition_hours"), pointInput(noon, 0, map[string]interface{}{"acc": "1"}), false, true},
+		{"ignition after hours", rule("ignition_hours"), pointInput(wednesday(22, 0), 0, map[string]interface{}{"acc": "1"}), true, false},
+		{"ignition off after hours", rule("ignition_hours"), pointInput(wednesday(22, 0), 0, map[string]interface{}{"acc": 0}), false, true},
+		{"ignition on a day off", rule("ignition_hours", "days", "mon,tue"), pointInput(noon, 0, map[string]interface{}{"acc": "1"}), true, false},
+		{"ignition in a local timezone", rule("ignition_hours", "timezone", "America/Los_Angeles"), pointInput(noon, 0, map[string]interface{}{"acc": "1"}), true, false},
+		{"ignition in a night shift", rule("ignition_hours", "start", "22:00", "end", "06:00"), pointInput(wednesday(3, 0), 0, map[string]interface{}{"acc": "1"}), false, true},
+		{"ignition after a night shift", rule("ignition_hours", "start", "22:00", "end", "06:00"), pointInput(noon, 0, map[string]interface{}{"acc": "1"}), true, false},
+		{"ignition night shift of a day off", rule("ignition_hours", "start", "22:00", "end", "06:00", "days", "mon"), pointInput(wednesday(3, 0), 0, map[string]interface{}{"acc": "1"}), true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			condition, err := NewCondition(test.rule)
+			if err != nil {
+				t.Fatalf("NewCondition: %v", err)
+			}
+			message, fired := condition.Evaluate(test.input)
+			if fired != test.fired {
+				t.Errorf("fired = %v (%q), want %v", fired, message, test.fired)
+			}
+			if fired && message == "" {
+				t.Errorf("fired without a message")
+			}
+			resolver, ok := condition.(Resolver)
+			if !ok {
+				t.Fatalf("%s does not implement Resolver", test.rule.Type)
+			}
+			if resolved := resolver.Resolved(test.input); resolved != test.resolved {
+				t.Errorf("resolved = %v, want %v", resolved, test.resolved)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  models.AlertRule
+		valid bool
+	}{
+		{"speeding", rule("speeding", "max_speed", "70"), true},
+		{"speeding without max_speed", rule("speeding"), false},
+		{"speeding with zero max_speed", rule("speeding", "max_speed", "0"), false},
+		{"speeding with text max_speed", rule("speeding", "max_speed", "fast"), false},
+		{"geofence with unknown event", rule("geofence", "event", "pass"), false},
+		{"ignition with bad start", rule("ignition_hours", "start", "7am"), false},
+		{"ignition with bad day", rule("ignition_hours", "days", "mon,funday"), false},
+		{"ignition with full day names", rule("ignition_hours", "days", "Monday, Friday"), true},
+		{"ignition with bad timezone", rule("ignition_hours", "timezone", "Mars/Olympus"), false},
+		{"unknown type", rule("teleport"), false},
+		{"without name", models.AlertRule{Type: "offline"}, false},
+		{"negative cooldown", models.AlertRule{Name: "Offline", Type: "offline", CooldownSeconds: -1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Validate(test.rule); (err == nil) != test.valid {
+				t.Errorf("Validate = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+// rule is an enabled rule of a type with options given as name, value pairs.
+func rule(ruleType string, options ...string) models.AlertRule {
+	rule := models.AlertRule{Name: ruleType, Type: ruleType, Enabled: true, Options: make(map[string]string)}
+	for i := 0; i+1 < len(options); i += 2 {
+		rule.Options[options[i]] = options[i+1]
+	}
+	return rule
+}
@@ -0,0 +1,207 @@
+package alerts
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/common"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/groups"
+	"OneStepGPSLeo/models"
+)
+
+// Store loads alert rules and persists alerts.
+type Store interface {
+	GetAlertRules() ([]models.AlertRule, error)
+	GetLatestAlert(ruleID, deviceID string) (*models.Alert, error)
+	CreateAlert(alert models.Alert) (models.Alert, error)
+	RecordAlertTrigger(id string, at time.Time, message string) (models.Alert, error)
+	ResolveAlert(id, by, note string) (models.Alert, error)
+}
+
+// compiledRule is an enabled rule with its condition.
+type compiledRule struct {
+	rule      models.AlertRule
+	condition Condition
+}
+
+// Engine evaluates the enabled rules. Points are passed in by the ingestor, geofence events and
+// online/offline transitions are read from the event hub.
+type Engine struct {
+	Store  Store
+	Hub    *events.Hub
+	Groups *groups.Directory // Server-side groups, next to the upstream ones
+
+	mutex  sync.Mutex
+	rules  []compiledRule
+	loaded bool
+	groups map[string][]string // Upstream group IDs per device
+}
+
+// NewEngine creates an alert engine. Rules are loaded on first use.
+func NewEngine(store Store, hub *events.Hub, directory *groups.Directory) *Engine {
+	return &Engine{Store: store, Hub: hub, Groups: directory, groups: make(map[string][]string)}
+}
+
+// Reload reads the rules from the store again. It must be called after rules change.
+func (e *Engine) Reload() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.load()
+}
+
+// load compiles the enabled rules. Rules with invalid options are logged and skipped.
+// Must be called with the mutex held.
+func (e *Engine) load() error {
+	rules, err := e.Store.GetAlertRules()
+	if err != nil {
+		return err
+	}
+	e.rules = e.rules[:0]
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		condition, err := NewCondition(rule)
+		if err != nil {
+			log.Printf("Skipping alert rule %s: %v", rule.Name, err)
+			continue
+		}
+		e.rules = append(e.rules, compiledRule{rule: rule, condition: condition})
+	}
+	e.loaded = true
+	return nil
+}
+
+// ObserveDevice keeps the upstream group membership of a device for rule scoping.
+func (e *Engine) ObserveDevice(deviceID string, device *models.Device, settings models.DeviceSettings) {
+	groupIDs := device.DeviceGroupsIDList
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.groups[deviceID] = groupIDs
+}
+
+// ProcessPoint evaluates the rules against a new accurate point.
+func (e *Engine) ProcessPoint(point models.DevicePointRecord, settings models.DeviceSettings) {
+	e.evaluate(Input{DeviceID: point.DeviceID, Time: point.DtTracker, Point: &point, Settings: settings})
+}
+
+// Run evaluates the rules against geofence and status events from the hub. It never returns.
+func (e *Engine) Run() {
+	lastEventID := e.Hub.LastEventID()
+	for {
+		sub, missed, _ := e.Hub.Subscribe(lastEventID)
+		for _, event := range missed {
+			e.handleEvent(event)
+			lastEventID = event.ID
+		}
+		for event := range sub.C {
+			e.handleEvent(event)
+			lastEventID = event.ID
+		}
+		// The subscription was dropped for falling behind, resume after the last handled event
+		log.Printf("Alert engine fell behind the event hub, resubscribing")
+	}
+}
+
+func (e *Engine) handleEvent(event events.Event) {
+	switch data := event.Data.(type) {
+	case models.GeofenceEvent:
+		e.evaluate(Input{DeviceID: data.DeviceID, Time: data.Time, GeofenceEvent: &data})
+	case models.AvailabilityEvent:
+		e.evaluate(Input{DeviceID: data.DeviceID, Time: data.Time, Status: &data})
+	}
+}
+
+// evaluate runs every rule in scope of the device against the input.
+func (e *Engine) evaluate(input Input) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.loaded {
+		if err := e.load(); err != nil {
+			log.Printf("Failed to load alert rules: %v", err)
+			return
+		}
+	}
+
+	groupIDs := append(e.Groups.GroupsOf(input.DeviceID), e.groups[input.DeviceID]...)
+	for _, compiled := range e.rules {
+		rule := compiled.rule
+		if !common.InScope(rule.DeviceIDs, rule.GroupIDs, input.DeviceID, groupIDs) {
+			continue
+		}
+		if resolver, ok := compiled.condition.(Resolver); ok && resolver.Resolved(input) {
+			e.resolve(rule, input)
+			continue
+		}
+		if message, fired := compiled.condition.Evaluate(input); fired {
+			e.trigger(rule, input, message)
+		}
+	}
+}
+
+// trigger raises an alert, or counts the trigger on the unresolved alert of the rule and device.
+// New alerts within the rule cooldown of the previous one are suppressed.
+func (e *Engine) trigger(rule models.AlertRule, input Input, message string) {
+	latest, err := e.Store.GetLatestAlert(rule.ID, input.DeviceID)
+	if err != nil {
+		log.Printf("Failed to check alerts of rule %s for device %s: %v", rule.Name, input.DeviceID, err)
+		return
+	}
+
+	if latest != nil && latest.Status != models.AlertResolved {
+		if _, err := e.Store.RecordAlertTrigger(latest.ID, input.Time, message); err != nil {
+			log.Printf("Failed to update alert %s: %v", latest.ID, err)
+		}
+		return
+	}
+	cooldown := time.Duration(rule.CooldownSeconds * float64(time.Second))
+	if latest != nil && input.Time.Sub(latest.LastTriggeredAt) < cooldown {
+		return
+	}
+
+	alert := models.Alert{
+		RuleID:          rule.ID,
+		RuleName:        rule.Name,
+		Type:            rule.Type,
+		DeviceID:        input.DeviceID,
+		Message:         message,
+		Status:          models.AlertOpen,
+		Count:           1,
+		TriggeredAt:     input.Time,
+		LastTriggeredAt: input.Time,
+	}
+	switch {
+	case input.Point != nil:
+		alert.Location = &models.Location{Lat: input.Point.Lat, Lng: input.Point.Lng}
+		alert.DevicePointID = input.Point.DevicePointID
+	case input.GeofenceEvent != nil:
+		alert.Location = &input.GeofenceEvent.Location
+		alert.DevicePointID = input.GeofenceEvent.DevicePointID
+	}
+
+	alert, err = e.Store.CreateAlert(alert)
+	if err != nil {
+		log.Printf("Failed to create alert for rule %s and device %s: %v", rule.Name, input.DeviceID, err)
+		return
+	}
+	log.Printf("Alert %s for device %s: %s", rule.Name, input.DeviceID, message)
+	e.Hub.Publish(events.TypeAlert, input.DeviceID, alert)
+}
+
+// resolve closes the unresolved alert of the rule and device, if there is one.
+func (e *Engine) resolve(rule models.AlertRule, input Input) {
+	latest, err := e.Store.GetLatestAlert(rule.ID, input.DeviceID)
+	if err != nil || latest == nil || latest.Status == models.AlertResolved {
+		return
+	}
+	alert, err := e.Store.ResolveAlert(latest.ID, "system", "")
+	if err != nil {
+		log.Printf("Failed to resolve alert %s: %v", latest.ID, err)
+		return
+	}
+	e.Hub.Publish(events.TypeAlert, input.DeviceID, alert)
+}
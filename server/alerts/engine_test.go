@@ -0,0 +1,260 @@
+package alerts
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/groups"
+	"OneStepGPSLeo/models"
+)
+
+// memoryStore keeps the rules, alerts and device groups of an engine test.
+type memoryStore struct {
+	rules  []models.AlertRule
+	alerts []models.Alert
+	groups []models.DeviceGroup
+}
+
+func (s *memoryStore) GetDeviceGroups() ([]models.DeviceGroup, error) {
+	return s.groups, nil
+}
+
+func (s *memoryStore) CreateAlertRule(rule models.AlertRule) {
+	rule.ID = fmt.Sprintf("rule-%d", len(s.rules))
+	s.rules = append(s.rules, rule)
+}
+
+func (s *memoryStore) GetAlertRules() ([]models.AlertRule, error) {
+	return s.rules, nil
+}
+
+func (s *memoryStore) GetLatestAlert(ruleID, deviceID string) (*models.Alert, error) {
+	for _, alert := range s.sorted(deviceID) {
+		if alert.RuleID == ruleID {
+			return &alert, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) CreateAlert(alert models.Alert) (models.Alert, error) {
+	alert.ID = fmt.Sprintf("alert-%d", len(s.alerts))
+	s.alerts = append(s.alerts, alert)
+	return alert, nil
+}
+
+func (s *memoryStore) RecordAlertTrigger(id string, at time.Time, message string) (models.Alert, error) {
+	alert := s.alert(id)
+	alert.Count++
+	alert.LastTriggeredAt = at
+	alert.Message = message
+	return *alert, nil
+}
+
+func (s *memoryStore) ResolveAlert(id, by, note string) (models.Alert, error) {
+	alert := s.alert(id)
+	alert.Status = models.AlertResolved
+	alert.ResolvedBy = by
+	if note != "" {
+		alert.Note = note
+	}
+	return *alert, nil
+}
+
+func (s *memoryStore) AcknowledgeAlert(id, by, note string) {
+	alert := s.alert(id)
+	alert.Status = models.AlertAcknowledged
+	alert.AcknowledgedBy = by
+	alert.Note = note
+}
+
+func (s *memoryStore) alert(id string) *models.Alert {
+	for i := range s.alerts {
+		if s.alerts[i].ID == id {
+			return &s.alerts[i]
+		}
+	}
+	panic("no alert " + id)
+}
+
+// sorted returns the alerts of a device, or of every device for "", most recently triggered first.
+func (s *memoryStore) sorted(deviceID string) []models.Alert {
+	var alerts []models.Alert
+	for _, alert := range s.alerts {
+		if deviceID == "" || alert.DeviceID == deviceID {
+			alerts = append(alerts, alert)
+		}
+	}
+	sort.SliceStable(alerts, func(i, j int) bool {
+		if !alerts[i].LastTriggeredAt.Equal(alerts[j].LastTriggeredAt) {
+			return alerts[i].LastTriggeredAt.After(alerts[j].LastTriggeredAt)
+		}
+		return alerts[i].ID > alerts[j].ID
+	})
+	return alerts
+}
+
+// engineTest is an alert engine on a memory store.
+type engineTest struct {
+	t      *testing.T
+	db     *memoryStore
+	hub    *events.Hub
+	engine *Engine
+	sub    *events.Subscription
+}
+
+func newEngineTest(t *testing.T, rules ...models.AlertRule) *engineTest {
+	t.Helper()
+	db := &memoryStore{}
+	for _, rule := range rules {
+		db.CreateAlertRule(rule)
+	}
+	hub := events.NewHub(100, clock.System)
+	sub, _, _ := hub.Subscribe("")
+	t.Cleanup(sub.Cancel)
+	return &engineTest{t: t, db: db, hub: hub, engine: NewEngine(db, hub, groups.NewDirectory(db)), sub: sub}
+}
+
+// alerts returns the stored alerts, most recently triggered first.
+func (e *engineTest) alerts() []models.Alert {
+	return e.db.sorted("")
+}
+
+// published returns the alerts published to the hub since the last call.
+func (e *engineTest) published() []models.Alert {
+	var alerts []models.Alert
+	for {
+		select {
+		case event := <-e.sub.C:
+			if alert, ok := event.Data.(models.Alert); ok && event.Type == events.TypeAlert {
+				alerts = append(alerts, alert)
+			}
+		default:
+			return alerts
+		}
+	}
+}
+
+func speed(minute int, kmh float64) Input {
+	return pointInput(wednesday(12, minute), kmh, nil)
+}
+
+func TestAlertLifecycle(t *testing.T) {
+	speedingRule := rule("speeding", "max_speed", "100", "unit", "km/h")
+	speedingRule.CooldownSeconds = 600
+	e := newEngineTest(t, speedingRule)
+
+	// step is an input and the state expected afterwards: the number of stored alerts and the
+	// status, count and hub publications of the most recent one.
+	type step struct {
+		name      string
+		input     Input
+		alerts    int
+		status    string
+		count     int
+		published int
+	}
+	for _, s := range []step{
+		{"below the limit", speed(0, 80), 0, "", 0, 0},
+		{"first trigger", speed(1, 120), 1, models.AlertOpen, 1, 1},
+		{"repeated trigger", speed(2, 130), 1, models.AlertOpen, 2, 0},
+		{"acknowledge", Input{}, 1, models.AlertAcknowledged, 2, 0},
+		{"trigger while acknowledged", speed(3, 125), 1, models.AlertAcknowledged, 3, 0},
+		{"back under the limit", speed(4, 90), 1, models.AlertResolved, 3, 1},
+		{"still under the limit", speed(5, 90), 1, models.AlertResolved, 3, 0},
+		{"trigger within the cooldown", speed(6, 140), 1, models.AlertResolved, 3, 0},
+		{"trigger after the cooldown", speed(14, 140), 2, models.AlertOpen, 1, 1},
+	} {
+		if s.input.Point != nil {
+			e.engine.ProcessPoint(*s.input.Point, models.DeviceSettings{})
+		} else {
+			e.db.AcknowledgeAlert(e.alerts()[0].ID, "operator", "on it")
+		}
+
+		alerts := e.alerts()
+		if len(alerts) != s.alerts {
+			t.Fatalf("%s: %d alerts, want %d", s.name, len(alerts), s.alerts)
+		}
+		if published := e.published(); len(published) != s.published {
+			t.Errorf("%s: published %d alerts, want %d", s.name, len(published), s.published)
+		}
+		if s.alerts == 0 {
+			continue
+		}
+		if latest := alerts[0]; latest.Status != s.status || latest.Count != s.count {
+			t.Errorf("%s: alert is %s with count %d, want %s with count %d", s.name, latest.Status, latest.Count, s.status, s.count)
+		}
+	}
+
+	resolved := e.alerts()[1]
+	if resolved.ResolvedBy != "system" || resolved.AcknowledgedBy != "operator" || resolved.Note != "on it" {
+		t.Errorf("resolved alert = %+v, want acknowledged by operator and resolved by the system", resolved)
+	}
+	if !resolved.TriggeredAt.Equal(wednesday(12, 1)) || !resolved.LastTriggeredAt.Equal(wednesday(12, 3)) {
+		t.Errorf("resolved alert triggered %s to %s, want 12:01 to 12:03", resolved.TriggeredAt, resolved.LastTriggeredAt)
+	}
+}
+
+func TestAlertsFromHubEvents(t *testing.T) {
+	e := newEngineTest(t, rule("offline"), rule("geofence", "event", "dwell"))
+
+	e.engine.handleEvent(events.Event{Type: events.TypeStatus, Data: models.AvailabilityEvent{DeviceID: "device", Online: false, Time: wednesday(12, 0)}})
+	e.engine.handleEvent(events.Event{Type: events.TypeGeofence, Data: models.GeofenceEvent{DeviceID: "device", Type: models.GeofenceDwell, GeofenceName: "Depot", Time: wednesday(12, 1)}})
+	if alerts := e.alerts(); len(alerts) != 2 {
+		t.Fatalf("%d alerts, want offline and dwell", len(alerts))
+	}
+
+	e.engine.handleEvent(events.Event{Type: events.TypeStatus, Data: models.AvailabilityEvent{DeviceID: "device", Online: true, Time: wednesday(12, 2)}})
+	e.engine.handleEvent(events.Event{Type: events.TypeGeofence, Data: models.GeofenceEvent{DeviceID: "device", Type: models.GeofenceExit, GeofenceName: "Depot", Time: wednesday(12, 3)}})
+	for _, alert := range e.alerts() {
+		if alert.Status != models.AlertResolved {
+			t.Errorf("%s alert is %s after the device came back and left, want resolved", alert.Type, alert.Status)
+		}
+	}
+}
+
+func TestAlertRuleScope(t *testing.T) {
+	db := &memoryStore{groups: []models.DeviceGroup{{ID: "trucks", Name: "Trucks", DeviceIDs: []string{"grouped"}}}}
+	byDevice := rule("offline")
+	byDevice.DeviceIDs = []string{"listed"}
+	byGroup := rule("offline")
+	byGroup.GroupIDs = []string{"trucks"}
+	byUpstreamGroup := rule("offline")
+	byUpstreamGroup.GroupIDs = []string{"upstream-group"}
+	disabled := rule("offline")
+	disabled.Enabled = false
+	for _, r := range []models.AlertRule{byDevice, byGroup, byUpstreamGroup, disabled} {
+		db.CreateAlertRule(r)
+	}
+	engine := NewEngine(db, events.NewHub(100, clock.System), groups.NewDirectory(db))
+	engine.ObserveDevice("upstream", &models.Device{DeviceGroupsIDList: []string{"upstream-group"}}, models.DeviceSettings{})
+
+	for deviceID, want := range map[string]int{"listed": 1, "grouped": 1, "upstream": 1, "unlisted": 0} {
+		engine.handleEvent(events.Event{Data: models.AvailabilityEvent{DeviceID: deviceID, Online: false, Time: wednesday(12, 0)}})
+		if alerts := db.sorted(deviceID); len(alerts) != want {
+			t.Errorf("device %s has %d alerts, want %d", deviceID, len(alerts), want)
+		}
+	}
+}
+
+func TestAlertRulesReload(t *testing.T) {
+	e := newEngineTest(t)
+	e.engine.ProcessPoint(*speed(0, 200).Point, models.DeviceSettings{})
+	e.db.CreateAlertRule(rule("speeding", "max_speed", "100", "unit", "km/h"))
+	e.engine.ProcessPoint(*speed(1, 200).Point, models.DeviceSettings{})
+	if alerts := e.alerts(); len(alerts) != 0 {
+		t.Fatalf("%d alerts before Reload, want the loaded rules to apply", len(alerts))
+	}
+
+	if err := e.engine.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	e.engine.ProcessPoint(*speed(2, 200).Point, models.DeviceSettings{})
+	if alerts := e.alerts(); len(alerts) != 1 {
+		t.Errorf("%d alerts after Reload, want 1", len(alerts))
+	}
+}
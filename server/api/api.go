@@ -7,28 +7,69 @@ including fetching device data, updating the database, and checking for updates.
 package api
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"sync"
 	"time"
 
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/clock"
 	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
 	"OneStepGPSLeo/models"
+	"OneStepGPSLeo/sources"
 
 	"github.com/fatih/color"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// DeviceDeltaFields are the device fields sent to clients when a device changes.
+var DeviceDeltaFields = []string{
+	"online",
+	"latest_device_point",
+	"latest_accurate_device_point",
+	"updated_at",
+	"device_id",
+	"active_state",
+	"_id",
+}
+
+// DeviceDelta reduces a device document to DeviceDeltaFields.
+func DeviceDelta(device map[string]interface{}) map[string]interface{} {
+	delta := make(map[string]interface{}, len(DeviceDeltaFields))
+	for _, field := range DeviceDeltaFields {
+		if value, ok := device[field]; ok {
+			delta[field] = value
+		}
+	}
+	return delta
+}
+
+// deviceDeltaOf is DeviceDelta for a typed device. The points are kept typed, they encode to the same JSON.
+func deviceDeltaOf(device *models.Device) map[string]interface{} {
+	delta := map[string]interface{}{
+		"online":       device.Online,
+		"updated_at":   device.UpdatedAt,
+		"device_id":    device.DeviceID,
+		"active_state": device.ActiveState,
+	}
+	if device.LatestDevicePoint != nil {
+		delta["latest_device_point"] = device.LatestDevicePoint
+	}
+	if device.LatestAccurateDevicePoint != nil {
+		delta["latest_accurate_device_point"] = device.LatestAccurateDevicePoint
+	}
+	if device.ID != nil {
+		delta["_id"] = *device.ID
+	}
+	return delta
+}
+
+// maxClockSkew is how far an upstream updated_at may be ahead of the server clock.
+const maxClockSkew = time.Minute
+
 // CheckForUpdatesResponse struct for returning response to checkForUpdates
 type CheckForUpdatesResponse struct {
 	NeedsUpdate    bool                     `json:"needsUpdate"`
@@ -37,105 +78,272 @@ type CheckForUpdatesResponse struct {
 	IconMap        map[string]string        `json:"icon_map"`
 }
 
-func FetchAndStoreDevices(db *database.MongoDB, config models.Config, updateMutex *sync.RWMutex, lastUpdateTimes map[string]time.Time, lastChecked *time.Time) {
-	// Read from local result.json file
-	log.Printf("Reading device data from local result.json file")
-	body, err := ioutil.ReadFile("result.json")
-	if err != nil {
-		log.Printf("Error reading result.json: %v", err)
-		return
+// PointProcessor is notified of every new point added to the history, together with the
+// settings of its device. Processors are called in order from the ingestion goroutine.
+type PointProcessor interface {
+	ProcessPoint(point models.DevicePointRecord, settings models.DeviceSettings)
+}
+
+// DeviceObserver is called with every new or changed device before it is stored and may modify it.
+type DeviceObserver interface {
+	ObserveDevice(deviceID string, device *models.Device, settings models.DeviceSettings)
+}
+
+// Ingestor polls the configured device sources and upserts the devices into the database.
+// It owns the per device last update times shared by the poller, the refresh handler and check-updates.
+type Ingestor struct {
+	DB              database.Repository
+	Config          models.Config
+	Sources         []sources.DeviceSource
+	Hub             *events.Hub
+	Clock           clock.Clock // Time of LastChecked and of devices without updated_at
+	Processors      []PointProcessor
+	Observers       []DeviceObserver
+	UpdateMutex     sync.RWMutex
+	LastUpdateTimes map[string]time.Time
+	LastChecked     time.Time
+	lastPointIDs    map[string]string // Last history point stored per device, guarded by UpdateMutex
+
+	lastAccuratePoints map[string]*models.DevicePoint // Newest accurate point per device, guarded by UpdateMutex
+}
+
+// NewIngestor creates an Ingestor for the given sources, reading the time from clk.
+func NewIngestor(cfg models.Config, db database.Repository, deviceSources []sources.DeviceSource, hub *events.Hub, clk clock.Clock) *Ingestor {
+	return &Ingestor{
+		DB:              db,
+		Config:          cfg,
+		Sources:         deviceSources,
+		Hub:             hub,
+		Clock:           clk,
+		LastUpdateTimes: make(map[string]time.Time),
+		LastChecked:     clk.Now(),
+		lastPointIDs:    make(map[string]string),
+
+		lastAccuratePoints: make(map[string]*models.DevicePoint),
 	}
+}
+
+// AddObserver registers an observer for new and changed devices.
+func (in *Ingestor) AddObserver(observer DeviceObserver) {
+	in.Observers = append(in.Observers, observer)
+}
 
-	var response struct {
-		ResultList []map[string]interface{} `json:"result_list"`
+// observe passes a device to every registered observer.
+func (in *Ingestor) observe(deviceID string, device *models.Device, settings models.DeviceSettings) {
+	for _, observer := range in.Observers {
+		observer.ObserveDevice(deviceID, device, settings)
 	}
-	body = bytes.TrimSpace(body)
-	if err := json.Unmarshal(body, &response); err != nil {
-		log.Printf("Error parsing JSON: %v", err)
-		return
+}
+
+// AddProcessor registers a processor for new points.
+func (in *Ingestor) AddProcessor(processor PointProcessor) {
+	in.Processors = append(in.Processors, processor)
+}
+
+// SourceStatuses reports the health of every configured source.
+func (in *Ingestor) SourceStatuses() []sources.Status {
+	statuses := make([]sources.Status, 0, len(in.Sources))
+	for _, source := range in.Sources {
+		statuses = append(statuses, source.Status())
 	}
+	return statuses
+}
 
-	collection := db.Client.Database(config.DatabaseName).Collection(config.DeviceCollectionName)
+// LastCheck returns the time of the last completed poll.
+func (in *Ingestor) LastCheck() time.Time {
+	in.UpdateMutex.RLock()
+	defer in.UpdateMutex.RUnlock()
+	return in.LastChecked
+}
+
+// LastUpdate returns the updated_at of the last stored change of a device, false if it was not stored yet.
+func (in *Ingestor) LastUpdate(deviceID string) (time.Time, bool) {
+	in.UpdateMutex.RLock()
+	defer in.UpdateMutex.RUnlock()
+	updatedAt, ok := in.LastUpdateTimes[deviceID]
+	return updatedAt, ok
+}
 
-	currentDevices, err := getCurrentDevicesMap(collection)
+// fetchFromSources polls every source concurrently, each with its own timeout of one update interval.
+// A failing source is logged and skipped so the others still get stored.
+func (in *Ingestor) fetchFromSources() []models.Device {
+	timeout := time.Duration(in.Config.UpdateInterval) * time.Second
+
+	results := make([][]models.Device, len(in.Sources)) // Per source, so the order does not depend on timing
+	var wg sync.WaitGroup
+	for i, source := range in.Sources {
+		wg.Add(1)
+		go func(i int, source sources.DeviceSource) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			sourceDevices, err := source.FetchDevices(ctx)
+			if err != nil {
+				log.Printf("Error fetching device data from source %s: %v", source.Name(), err)
+				return
+			}
+			log.Printf("Fetched %d devices from source %s", len(sourceDevices), source.Name())
+			results[i] = sourceDevices
+		}(i, source)
+	}
+	wg.Wait()
+
+	var devices []models.Device
+	for _, sourceDevices := range results {
+		devices = append(devices, sourceDevices...)
+	}
+	return latestDevices(devices)
+}
+
+// latestDevices keeps one entry per device_id, the one with the newest updated_at. A device can
+// be listed twice by a misbehaving upstream or by two sources. Devices without a device_id are
+// kept, they are rejected while storing.
+func latestDevices(devices []models.Device) []models.Device {
+	latest := devices[:0]
+	seen := make(map[string]int, len(devices))
+	for _, device := range devices {
+		i, ok := seen[device.DeviceID]
+		if !ok || device.DeviceID == "" {
+			seen[device.DeviceID] = len(latest)
+			latest = append(latest, device)
+			continue
+		}
+		log.Printf("Device %s is listed more than once, keeping the newest entry", device.DeviceID)
+		if isNewer(device.UpdatedAt, latest[i].UpdatedAt) {
+			latest[i] = device
+		}
+	}
+	return latest
+}
+
+// isNewer reports whether the updated_at a is after b. Unparsable values are never newer.
+func isNewer(a, b string) bool {
+	ta, err := time.Parse(time.RFC3339, a)
+	if err != nil {
+		return false
+	}
+	tb, err := time.Parse(time.RFC3339, b)
+	return err != nil || ta.After(tb)
+}
+
+// FetchAndStoreDevices polls all sources and inserts or replaces the devices that changed since the last poll.
+func (in *Ingestor) FetchAndStoreDevices() {
+	db := in.DB
+	devices := in.fetchFromSources()
+	if len(devices) == 0 {
+		return
+	}
+
+	deviceIDs, err := db.GetDeviceIDs()
 	if err != nil {
 		log.Printf("Failed to get current devices: %v\n", err)
 		return
 	}
+	currentDevices := make(map[string]struct{}, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		currentDevices[deviceID] = struct{}{}
+	}
 
-	for _, device := range response.ResultList {
-		deviceID, ok := device["device_id"].(string)
-		if !ok {
-			log.Printf("Error: device_id not found or not a string in device: %+v", device)
+	for i := range devices {
+		device := &devices[i]
+		deviceID := device.DeviceID
+		if deviceID == "" {
+			log.Printf("Error: device_id not found in device %q", device.DisplayName)
 			continue
 		}
 
 		// Set updated_at to current time if not present
-		updatedAtStr, ok := device["updated_at"].(string)
-		if !ok {
-			updatedAtStr = time.Now().Format(time.RFC3339)
-			device["updated_at"] = updatedAtStr
+		if device.UpdatedAt == "" {
+			device.UpdatedAt = in.Clock.Now().Format(time.RFC3339)
 		}
 
-		updatedAt, err := time.Parse(time.RFC3339, updatedAtStr)
+		updatedAt, err := time.Parse(time.RFC3339, device.UpdatedAt)
 		if err != nil {
-			log.Printf("Error parsing updated_at '%s' for device %s: %v", updatedAtStr, deviceID, err)
+			log.Printf("Error parsing updated_at '%s' for device %s: %v", device.UpdatedAt, deviceID, err)
 			continue
 		}
+		// An upstream clock running ahead would hide the following updates until it is reached
+		if now := in.Clock.Now(); updatedAt.After(now.Add(maxClockSkew)) {
+			log.Printf("updated_at %s of device %s is in the future, using the current time", device.UpdatedAt, deviceID)
+			updatedAt = now.Truncate(time.Second)
+			device.UpdatedAt = updatedAt.Format(time.RFC3339)
+		}
 
-		settingsMap, settingsOK := device["settings"].(map[string]interface{})
-		delete(device, "settings")
-
+		// Settings are stored in their own collection
+		settingsOK := device.Settings != nil
 		var settings models.DeviceSettings
 		if settingsOK {
-			bData, _ := bson.Marshal(settingsMap)
-			bson.Unmarshal(bData, &settings)
+			settings = *device.Settings
 			settings.DeviceID = deviceID
 			settings.UpdatedAt = updatedAt.Format(time.RFC3339)
-			if v, versionOK := settingsMap["version"].(int); versionOK {
-				settings.Version = v
-			}
 		}
+		device.Settings = nil
 
 		_, deviceExists := currentDevices[deviceID]
 
 		if !deviceExists {
+			// New devices are checked against the upstream settings, or the defaults
+			pointSettings := settings
+			if !settingsOK {
+				pointSettings = database.DefaultDeviceSettings(deviceID, in.Clock.Now())
+			}
+			pointQuality := in.applyQuality(deviceID, device, pointSettings)
+			in.observe(deviceID, device, pointSettings)
+
 			// Insert new device
-			_, err := collection.InsertOne(context.TODO(), device)
-			if err != nil {
+			if err := db.InsertDevice(*device); err != nil {
 				log.Printf("Error inserting new device data %s: %v\n", deviceID, err)
 				continue
 			}
+			in.recordHistory(deviceID, device, pointSettings, pointQuality)
+			in.Hub.Publish(events.TypeDevice, deviceID, deviceDeltaOf(device))
+
+			// Without it the next poll would accept any updated_at, even one behind the stored device
+			in.UpdateMutex.Lock()
+			in.LastUpdateTimes[deviceID] = updatedAt
+			in.UpdateMutex.Unlock()
 
 			// For new devices, always insert the settings
 			if settingsOK {
-				_, err := db.SaveDeviceSettings(settings)
+				savedSettings, err := db.SaveDeviceSettings(settings)
 				if err != nil {
 					log.Printf("Failed to insert new device settings for device %s: %v\n", deviceID, err)
 					continue
 				}
+				in.Hub.Publish(events.TypeSettings, deviceID, savedSettings)
 			}
 			log.Printf("Inserted new device: %s, updated_at: %s\n", deviceID, updatedAt)
 		} else {
-			updateMutex.RLock()
-			lastUpdatedAt, _ := lastUpdateTimes[deviceID]
-			updateMutex.RUnlock()
+			in.UpdateMutex.RLock()
+			lastUpdatedAt := in.LastUpdateTimes[deviceID]
+			in.UpdateMutex.RUnlock()
 
 			if updatedAt.After(lastUpdatedAt) {
+				existingSettings, settingsErr := db.GetDeviceSettings(deviceID)
+				pointSettings := existingSettings
+				if settingsErr != nil || existingSettings == (models.DeviceSettings{}) {
+					pointSettings = database.DefaultDeviceSettings(deviceID, in.Clock.Now())
+					if settingsOK {
+						pointSettings = settings
+					}
+				}
+				pointQuality := in.applyQuality(deviceID, device, pointSettings)
+				in.observe(deviceID, device, pointSettings)
+
 				// Update device data
-				_, err := collection.ReplaceOne(context.TODO(), bson.M{"device_id": deviceID}, device)
-				if err != nil {
+				if err := db.ReplaceDevice(*device); err != nil {
 					log.Printf("Failed to replace device %s: %v\n", deviceID, err)
 					continue
 				}
 
 				if settingsOK {
-					existingSettings, err := db.GetDeviceSettings(deviceID)
-					if err != nil || existingSettings == (models.DeviceSettings{}) {
+					if settingsErr != nil || existingSettings == (models.DeviceSettings{}) {
 						settings, err = db.SaveDeviceSettings(settings)
 						if err != nil {
 							log.Printf("Failed to update device settings for device %s: %v\n", deviceID, err)
 						} else {
+							in.Hub.Publish(events.TypeSettings, deviceID, settings)
 							log.Printf("Initialized settings for existing device: %s\n", deviceID)
 						}
 					} else {
@@ -143,12 +351,15 @@ func FetchAndStoreDevices(db *database.MongoDB, config models.Config, updateMute
 					}
 				}
 
-				updateMutex.Lock()
-				lastUpdateTimes[deviceID] = updatedAt
-				updateMutex.Unlock()
+				in.recordHistory(deviceID, device, pointSettings, pointQuality)
+				in.Hub.Publish(events.TypeDevice, deviceID, deviceDeltaOf(device))
+
+				in.UpdateMutex.Lock()
+				in.LastUpdateTimes[deviceID] = updatedAt
+				in.UpdateMutex.Unlock()
 
 				color.Green("Updated device: %s, last update was %s ago, updated_at: %s\n",
-					deviceID, time.Since(lastUpdatedAt).Round(time.Second), updatedAt)
+					deviceID, in.Clock.Now().Sub(lastUpdatedAt).Round(time.Second), updatedAt)
 			} else {
 				log.Printf("Device %s not updated. Current updated_at: %s is before or equal to last updated_at: %s\n",
 					deviceID, updatedAt, lastUpdatedAt)
@@ -156,14 +367,15 @@ func FetchAndStoreDevices(db *database.MongoDB, config models.Config, updateMute
 		}
 	}
 
-	now := time.Now()
-	updateMutex.Lock()
-	*lastChecked = now
-	updateMutex.Unlock()
+	now := in.Clock.Now()
+	in.UpdateMutex.Lock()
+	in.LastChecked = now
+	in.UpdateMutex.Unlock()
 }
 
-// CheckForUpdates checks if any device has been updated since the client's last check and returns updated devices.
-func CheckForUpdates(c *gin.Context, db *database.MongoDB, config models.Config, lastChecked *time.Time, lastUpdateTimes map[string]time.Time) {
+// CheckForUpdates checks if any device in scope has been updated since the client's last check and returns updated devices.
+// lastChecked is the time of the last completed poll, see Ingestor.LastCheck.
+func CheckForUpdates(c *gin.Context, db database.Repository, config models.Config, lastChecked time.Time, scope auth.Scope) {
 	clientLastUpdateStr := c.Query("lastUpdate")
 	if clientLastUpdateStr == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing lastUpdate parameter"})
@@ -176,7 +388,7 @@ func CheckForUpdates(c *gin.Context, db *database.MongoDB, config models.Config,
 		return
 	}
 
-	needsUpdate := clientLastUpdate.Before(*lastChecked)
+	needsUpdate := clientLastUpdate.Before(lastChecked)
 
 	var updatedDevices []map[string]interface{}
 
@@ -189,7 +401,7 @@ func CheckForUpdates(c *gin.Context, db *database.MongoDB, config models.Config,
 	}
 
 	if needsUpdate {
-		updatedDevices, err = fetchUpdatedDevicesSince(db, config, clientLastUpdate, lastUpdateTimes)
+		updatedDevices, err = fetchUpdatedDevicesSince(db, clientLastUpdate)
 		if err != nil {
 			log.Printf("Failed to fetch updated devices: %v", err) // Log error
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch updated devices"})
@@ -198,6 +410,21 @@ func CheckForUpdates(c *gin.Context, db *database.MongoDB, config models.Config,
 
 	}
 
+	if !scope.All() {
+		visible := updatedDevices[:0]
+		for _, device := range updatedDevices {
+			if deviceID, _ := device["device_id"].(string); scope.Contains(deviceID) {
+				visible = append(visible, device)
+			}
+		}
+		updatedDevices = visible
+		for deviceID := range iconMap {
+			if !scope.Contains(deviceID) {
+				delete(iconMap, deviceID)
+			}
+		}
+	}
+
 	response := CheckForUpdatesResponse{
 		NeedsUpdate:    needsUpdate,
 		LastUpdate:     lastChecked.Format(time.RFC3339),
@@ -208,62 +435,16 @@ func CheckForUpdates(c *gin.Context, db *database.MongoDB, config models.Config,
 	c.JSON(http.StatusOK, response)
 }
 
-// New helper function to efficiently build icon map based on updated devices.
-func buildIconMap(db *database.MongoDB, currentDevices map[string]primitive.ObjectID) (map[string]string, error) {
-	iconMap := make(map[string]string) // Initialize an empty iconMap
-
-	for deviceID := range currentDevices { // Iterate through ALL devices
-
-		deviceSettings, err := db.GetDeviceSettings(deviceID)
-		if err != nil { //Handle error for fetching device settings, return early if failed and log the error.
-			if !errors.Is(err, mongo.ErrNoDocuments) {
-
-				return nil, fmt.Errorf("failed to get device settings: %w", err)
-			}
-
-			log.Printf("Settings not found for device: %s. Using default icon\n", deviceID)
-			iconMap[deviceID] = "" // Use empty string if no settings found, frontend should handle null/empty string
-			continue
-		}
-
-		iconMap[deviceID] = deviceSettings.IconURL // Add iconURL to iconMap. No timestamp check here
-	}
-
-	return iconMap, nil
-}
-
-// New helper function to fetch updated devices efficiently. Fetches only the fields you need.
-func fetchUpdatedDevicesSince(db *database.MongoDB, config models.Config, since time.Time, lastUpdateTimes map[string]time.Time) ([]map[string]interface{}, error) {
-
-	collection := db.Client.Database(config.DatabaseName).Collection(config.DeviceCollectionName)
-
-	projection := bson.D{
-		{"online", 1},
-		{"latest_device_point", 1},
-		{"latest_accurate_device_point", 1},
-		{"updated_at", 1},
-		{"device_id", 1},
-		{"active_state", 1},
-		{"_id", 1},
-	}
-
-	//Filter based on timestamp and query
-	filter := bson.M{"updated_at": bson.M{"$gt": since.Format(time.RFC3339)}}
-	opts := options.Find().SetProjection(projection)
-	cursor, err := collection.Find(context.TODO(), filter, opts)
-
+// fetchUpdatedDevicesSince returns the devices updated after since, reduced to DeviceDeltaFields.
+func fetchUpdatedDevicesSince(db database.DeviceRepository, since time.Time) ([]map[string]interface{}, error) {
+	page, err := db.FindDevices(database.DeviceQuery{UpdatedAfter: since, Sort: "device_id", Fields: DeviceDeltaFields})
 	if err != nil {
-		return nil, fmt.Errorf("failed to find updated devices: %w", err) // Wrap and return the error
-
+		return nil, fmt.Errorf("failed to find updated devices: %w", err)
 	}
-	defer cursor.Close(context.TODO())
 
-	var updatedDevices []map[string]interface{}
-
-	if err := cursor.All(context.TODO(), &updatedDevices); err != nil {
-		log.Printf("Found %d updated devices since %s", len(updatedDevices), since.Format(time.RFC3339))
-		return nil, fmt.Errorf("failed to decode updated devices: %w", err) //Wrap the error
+	updatedDevices := make([]map[string]interface{}, 0, len(page.Devices))
+	for _, device := range page.Devices {
+		updatedDevices = append(updatedDevices, device)
 	}
-
 	return updatedDevices, nil
 }
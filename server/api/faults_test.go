@@ -0,0 +1,232 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/common"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/mockserver"
+	"OneStepGPSLeo/models"
+	"OneStepGPSLeo/sources"
+
+	"github.com/gin-gonic/gin"
+)
+
+// faultTest is an Ingestor polling a mock server over HTTP, like mock mode does.
+type faultTest struct {
+	t         *testing.T
+	server    *httptest.Server
+	db        *database.Memory
+	ingestor  *Ingestor
+	clock     *clock.Virtual
+	deviceIDs []string
+}
+
+// newFaultTest serves the devices of result.json, all updated at the start of the virtual clock.
+func newFaultTest(t *testing.T) *faultTest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	start := mockserver.DefaultMockStart
+	devices, err := common.ReadDevicesFromJSON("../result.json")
+	if err != nil {
+		t.Fatalf("failed to read result.json: %v", err)
+	}
+	datastore := mockserver.NewDatastore()
+	var deviceIDs []string
+	for _, device := range devices {
+		device["updated_at"] = start.Format(time.RFC3339)
+		datastore.AddDevice(device)
+		deviceIDs = append(deviceIDs, device["device_id"].(string))
+	}
+	server := httptest.NewServer(mockserver.NewRouter(datastore, mockserver.NewSink()))
+	t.Cleanup(server.Close)
+
+	retries := 1
+	config := models.Config{
+		APIURL:                server.URL + "/api/v1/devices",
+		DataSources:           []string{"api"},
+		UpdateInterval:        5,
+		APITimeoutSeconds:     2,
+		APIMaxRetries:         &retries,
+		APIRetryBackoffMillis: 10,
+	}
+	virtual := clock.NewVirtual(start.Add(time.Second))
+	deviceSources, err := sources.FromConfig(config, virtual)
+	if err != nil {
+		t.Fatalf("FromConfig: %v", err)
+	}
+	db := database.NewMemory()
+	return &faultTest{
+		t:         t,
+		server:    server,
+		db:        db,
+		ingestor:  NewIngestor(config, db, deviceSources, events.NewHub(100, virtual), virtual),
+		clock:     virtual,
+		deviceIDs: deviceIDs,
+	}
+}
+
+// setFaults replaces the faults of the mock server through /mock/control.
+func (f *faultTest) setFaults(faults mockserver.Faults) {
+	f.t.Helper()
+	body, _ := json.Marshal(faults)
+	req, _ := http.NewRequest(http.MethodPut, f.server.URL+"/mock/control", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		f.t.Fatalf("PUT /mock/control: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		f.t.Fatalf("PUT /mock/control answered %d", resp.StatusCode)
+	}
+}
+
+// storedDevices returns the stored devices by device_id.
+func (f *faultTest) storedDevices() map[string]map[string]interface{} {
+	f.t.Helper()
+	page, err := f.db.FindDevices(database.DeviceQuery{})
+	if err != nil {
+		f.t.Fatalf("FindDevices: %v", err)
+	}
+	stored := make(map[string]map[string]interface{}, len(page.Devices))
+	for _, device := range page.Devices {
+		deviceID, _ := device["device_id"].(string)
+		stored[deviceID] = device
+	}
+	return stored
+}
+
+// sourceStatus returns the status of the only source.
+func (f *faultTest) sourceStatus() sources.Status {
+	return f.ingestor.SourceStatuses()[0]
+}
+
+func TestIngestionSkipsBrokenBodies(t *testing.T) {
+	for _, body := range []string{mockserver.BodyTruncated, mockserver.BodyMalformed} {
+		t.Run(body, func(t *testing.T) {
+			f := newFaultTest(t)
+			f.setFaults(mockserver.Faults{Body: body})
+			f.ingestor.FetchAndStoreDevices()
+
+			if stored := f.storedDevices(); len(stored) != 0 {
+				t.Errorf("stored %d devices from a %s body", len(stored), body)
+			}
+			if status := f.sourceStatus(); status.Healthy || status.LastError == "" {
+				t.Errorf("source status after a %s body = %+v, want an error", body, status)
+			}
+
+			// The next clean poll recovers
+			f.setFaults(mockserver.Faults{})
+			f.ingestor.FetchAndStoreDevices()
+			if stored := f.storedDevices(); len(stored) != len(f.deviceIDs) {
+				t.Errorf("stored %d devices after recovering, want %d", len(stored), len(f.deviceIDs))
+			}
+			if status := f.sourceStatus(); !status.Healthy {
+				t.Errorf("source status after recovering = %+v, want healthy", status)
+			}
+		})
+	}
+}
+
+func TestIngestionHonorsRetryAfter(t *testing.T) {
+	t.Run("within the poll", func(t *testing.T) {
+		f := newFaultTest(t)
+		f.setFaults(mockserver.Faults{Status: http.StatusTooManyRequests, RetryAfterSeconds: 1, Requests: 1})
+		started := time.Now()
+		f.ingestor.FetchAndStoreDevices()
+
+		if elapsed := time.Since(started); elapsed < time.Second {
+			t.Errorf("retried after %s, want the Retry-After of 1s", elapsed)
+		}
+		if stored := f.storedDevices(); len(stored) != len(f.deviceIDs) {
+			t.Errorf("stored %d devices after the retry, want %d", len(stored), len(f.deviceIDs))
+		}
+	})
+
+	t.Run("past the poll", func(t *testing.T) {
+		f := newFaultTest(t)
+		f.setFaults(mockserver.Faults{Status: http.StatusTooManyRequests, RetryAfterSeconds: 60})
+		started := time.Now()
+		f.ingestor.FetchAndStoreDevices()
+
+		// Waiting would outlast the update interval, the poll gives up instead
+		if elapsed := time.Since(started); elapsed > 2*time.Second {
+			t.Errorf("poll took %s, want it to give up without waiting", elapsed)
+		}
+		if stored := f.storedDevices(); len(stored) != 0 {
+			t.Errorf("stored %d devices from a 429", len(stored))
+		}
+		if status := f.sourceStatus(); status.Healthy {
+			t.Errorf("source status after a 429 = %+v, want an error", status)
+		}
+	})
+}
+
+func TestIngestionDeduplicatesDevices(t *testing.T) {
+	f := newFaultTest(t)
+	f.setFaults(mockserver.Faults{DuplicateDevices: 3})
+	f.ingestor.FetchAndStoreDevices()
+
+	stored := f.storedDevices()
+	if len(stored) != len(f.deviceIDs) {
+		t.Errorf("stored %d devices, want each of the %d devices once", len(stored), len(f.deviceIDs))
+	}
+	page, _ := f.db.FindDevices(database.DeviceQuery{})
+	if page.Total != int64(len(f.deviceIDs)) {
+		t.Errorf("%d device documents, want %d", page.Total, len(f.deviceIDs))
+	}
+}
+
+func TestIngestionSkipsDevicesWithoutID(t *testing.T) {
+	f := newFaultTest(t)
+	f.setFaults(mockserver.Faults{MissingDeviceID: 2})
+	f.ingestor.FetchAndStoreDevices()
+
+	stored := f.storedDevices()
+	if len(stored) != len(f.deviceIDs)-2 {
+		t.Errorf("stored %d devices, want the %d that have a device_id", len(stored), len(f.deviceIDs)-2)
+	}
+	for _, deviceID := range f.deviceIDs[:2] {
+		if _, ok := stored[deviceID]; ok {
+			t.Errorf("device %s was sent without device_id but stored", deviceID)
+		}
+	}
+	if _, ok := stored[""]; ok {
+		t.Errorf("a device without device_id was stored")
+	}
+}
+
+func TestIngestionClampsSkewedUpdatedAt(t *testing.T) {
+	f := newFaultTest(t)
+	f.setFaults(mockserver.Faults{ClockSkewSeconds: 3600})
+	f.ingestor.FetchAndStoreDevices()
+
+	now := f.clock.Now().Truncate(time.Second).Format(time.RFC3339)
+	stored := f.storedDevices()
+	if len(stored) != len(f.deviceIDs) {
+		t.Fatalf("stored %d devices, want %d", len(stored), len(f.deviceIDs))
+	}
+	for deviceID, device := range stored {
+		if device["updated_at"] != now {
+			t.Errorf("device %s has updated_at %v an hour ahead, want it clamped to %s", deviceID, device["updated_at"], now)
+		}
+	}
+
+	// A clock running behind is not clamped, the devices are simply not newer
+	f.setFaults(mockserver.Faults{ClockSkewSeconds: -3600})
+	f.ingestor.FetchAndStoreDevices()
+	for deviceID, device := range f.storedDevices() {
+		if device["updated_at"] != now {
+			t.Errorf("device %s went back to updated_at %v", deviceID, device["updated_at"])
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Device point history: every latest_device_point seen during ingestion is appended to the
+// history collection so previous positions are kept when the device document is replaced.
+
+package api
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"OneStepGPSLeo/models"
+	"OneStepGPSLeo/quality"
+)
+
+// recordHistory appends the device's latest_device_point to the history collection, flagged
+// with its quality result. Points already recorded (same device_point_id) are skipped and
+// only accurate points are passed to the processors.
+func (in *Ingestor) recordHistory(deviceID string, device *models.Device, settings models.DeviceSettings, result quality.Result) {
+	point := device.LatestDevicePoint
+	if point == nil {
+		return
+	}
+
+	record, err := devicePointRecord(deviceID, point)
+	if err != nil {
+		log.Printf("Skipping history for device %s: %v", deviceID, err)
+		return
+	}
+	record.Accurate = result.Accurate
+	record.RejectReasons = result.RejectReasons
+
+	in.UpdateMutex.RLock()
+	lastPointID := in.lastPointIDs[deviceID]
+	in.UpdateMutex.RUnlock()
+	if lastPointID == record.DevicePointID {
+		return // Same point as the previous poll, no need to ask the database
+	}
+
+	inserted, err := in.DB.AppendDevicePoint(record)
+	if err != nil {
+		log.Printf("Failed to append history for device %s: %v", deviceID, err)
+		return
+	}
+
+	in.UpdateMutex.Lock()
+	in.lastPointIDs[deviceID] = record.DevicePointID
+	in.UpdateMutex.Unlock()
+
+	if !inserted {
+		return
+	}
+	log.Printf("Recorded point %s for device %s at %s", record.DevicePointID, deviceID, record.DtTracker.Format(time.RFC3339))
+
+	if !record.Accurate {
+		return
+	}
+	for _, processor := range in.Processors {
+		processor.ProcessPoint(record, settings)
+	}
+}
+
+// devicePointRecord converts an upstream device point into a history record.
+func devicePointRecord(deviceID string, point *models.DevicePoint) (models.DevicePointRecord, error) {
+	if point.DevicePointID == "" {
+		return models.DevicePointRecord{}, fmt.Errorf("device_point_id is missing")
+	}
+
+	dtTracker, err := parsePointTime(point.DtTracker)
+	if err != nil {
+		return models.DevicePointRecord{}, fmt.Errorf("invalid dt_tracker: %w", err)
+	}
+	dtServer, err := parsePointTime(point.DtServer)
+	if err != nil {
+		dtServer = dtTracker
+	}
+
+	return models.DevicePointRecord{
+		DeviceID:      deviceID,
+		DevicePointID: point.DevicePointID,
+		DtTracker:     dtTracker,
+		DtServer:      dtServer,
+		Lat:           point.Lat,
+		Lng:           point.Lng,
+		Angle:         point.Angle,
+		Speed:         point.Speed,
+		Point:         point,
+	}, nil
+}
+
+func parsePointTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("missing timestamp")
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
@@ -0,0 +1,69 @@
+// GPS quality checks run during ingestion: the latest_device_point of every device is evaluated
+// against its settings. When the upstream omits latest_accurate_device_point, it is filled in
+// with the newest point that passed the checks.
+
+package api
+
+import (
+	"log"
+	"strings"
+
+	"OneStepGPSLeo/models"
+	"OneStepGPSLeo/quality"
+)
+
+// applyQuality evaluates the device's latest point, adds the result to the device as
+// latest_point_quality and fills in latest_accurate_device_point if the upstream did not.
+func (in *Ingestor) applyQuality(deviceID string, device *models.Device, settings models.DeviceSettings) quality.Result {
+	point := device.LatestDevicePoint
+	if point == nil {
+		return quality.Result{}
+	}
+
+	result := quality.Evaluate(point, settings)
+	device.LatestPointQuality = &result
+	if !result.Accurate {
+		log.Printf("Inaccurate point for device %s: %s", deviceID, strings.Join(result.RejectReasons, "; "))
+	}
+
+	if upstream := device.LatestAccurateDevicePoint; upstream != nil {
+		in.setLastAccuratePoint(deviceID, upstream)
+		return result
+	}
+
+	if result.Accurate {
+		device.LatestAccurateDevicePoint = point
+		in.setLastAccuratePoint(deviceID, point)
+		return result
+	}
+
+	if previous := in.lastAccuratePoint(deviceID); previous != nil {
+		device.LatestAccurateDevicePoint = previous
+	}
+	return result
+}
+
+// lastAccuratePoint returns the newest accurate point of a device, loading it from the
+// stored device the first time.
+func (in *Ingestor) lastAccuratePoint(deviceID string) *models.DevicePoint {
+	in.UpdateMutex.RLock()
+	point, cached := in.lastAccuratePoints[deviceID]
+	in.UpdateMutex.RUnlock()
+	if cached {
+		return point
+	}
+
+	point, err := in.DB.GetLatestAccuratePoint(deviceID)
+	if err != nil {
+		log.Printf("Failed to load latest accurate point for device %s: %v", deviceID, err)
+		return nil
+	}
+	in.setLastAccuratePoint(deviceID, point)
+	return point
+}
+
+func (in *Ingestor) setLastAccuratePoint(deviceID string, point *models.DevicePoint) {
+	in.UpdateMutex.Lock()
+	in.lastAccuratePoints[deviceID] = point
+	in.UpdateMutex.Unlock()
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/mockserver"
+	"OneStepGPSLeo/models"
+	"OneStepGPSLeo/sources"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkUpdatesRun ingests a seeded mock session for steps polls and returns the check-updates
+// response after each poll, asked for the changes since the poll before, together with the
+// events published and the source status of the poll.
+func checkUpdatesRun(t *testing.T, seed int64, steps int) []string {
+	t.Helper()
+	session, err := mockserver.NewSession(mockserver.NewDatastore(), models.Config{MockSeed: seed, MockDataFile: "../result.json"}, 0.5, 2)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	server := httptest.NewServer(mockserver.NewRouter(session.Datastore, mockserver.NewSink()))
+	defer server.Close()
+
+	config := models.Config{
+		APIURL:         server.URL + "/api/v1/devices",
+		DataSources:    []string{"api"},
+		UpdateInterval: 5,
+	}
+	deviceSources, err := sources.FromConfig(config, session.Clock)
+	if err != nil {
+		t.Fatalf("FromConfig: %v", err)
+	}
+	db := database.NewMemory()
+	db.Clock = session.Clock
+	hub := events.NewHub(100, session.Clock)
+	sub, _, _ := hub.Subscribe("")
+	defer sub.Cancel()
+	ingestor := NewIngestor(config, db, deviceSources, hub, session.Clock)
+
+	var responses []string
+	lastUpdate := session.Clock.Now()
+	for i := 0; i < steps; i++ {
+		session.Advance(time.Duration(config.UpdateInterval) * time.Second)
+		ingestor.FetchAndStoreDevices()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/check-updates?lastUpdate="+lastUpdate.Format(time.RFC3339), nil)
+		CheckForUpdates(c, db, config, ingestor.LastCheck(), auth.AllDevices())
+		if w.Code != http.StatusOK {
+			t.Fatalf("check-updates answered %d: %s", w.Code, w.Body.String())
+		}
+
+		var response CheckForUpdatesResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("failed to decode the check-updates response: %v", err)
+		}
+		if status := deviceSources[0].Status(); status.LastSuccess != session.Clock.Now().Format(time.RFC3339) {
+			t.Fatalf("source last succeeded at %s, want the session time %s", status.LastSuccess, session.Clock.Now().Format(time.RFC3339))
+		}
+		// Event IDs start with the server run, only their content is part of the session
+		var published []string
+		for len(sub.C) > 0 {
+			event := <-sub.C
+			published = append(published, event.Type+" "+event.DeviceID+" "+event.Time)
+		}
+		data, _ := json.Marshal(struct {
+			Response CheckForUpdatesResponse
+			Events   []string
+			Source   sources.Status
+		}{response, published, deviceSources[0].Status()})
+		responses = append(responses, string(data))
+		lastUpdate = ingestor.LastCheck()
+	}
+	return responses
+}
+
+func TestCheckForUpdatesReplaysWithTheSameSeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const steps = 20
+	first := checkUpdatesRun(t, 42, steps)
+	second := checkUpdatesRun(t, 42, steps)
+
+	updated := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("check-updates responses differ after poll %d:\n%s\n%s", i+1, first[i], second[i])
+		}
+		var poll struct{ Response CheckForUpdatesResponse }
+		json.Unmarshal([]byte(first[i]), &poll)
+		updated += len(poll.Response.UpdatedDevices)
+	}
+	if updated == 0 {
+		t.Errorf("no poll reported an updated device in %d steps", steps)
+	}
+}
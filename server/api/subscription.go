@@ -0,0 +1,139 @@
+// Device filters of per-client subscriptions: a DeviceFilter selects devices by ID and/or by the
+// position of their latest point, both when querying the current state from the database and
+// when deciding whether a live device event is relevant to a client.
+
+package api
+
+import (
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BoundingBox is a map viewport. MinLng > MaxLng describes a box crossing the antimeridian.
+type BoundingBox = database.BoundingBox
+
+// DeviceFilter selects the devices a client is interested in. A device matches when its ID is
+// listed or its latest point is inside the bounding box. An empty filter matches every device.
+type DeviceFilter struct {
+	DeviceIDs []string     `json:"device_ids,omitempty"`
+	BBox      *BoundingBox `json:"bbox,omitempty"`
+}
+
+// IsEmpty reports whether the filter matches every device.
+func (f DeviceFilter) IsEmpty() bool {
+	return len(f.DeviceIDs) == 0 && f.BBox == nil
+}
+
+// MatchesID reports whether the device is selected by ID.
+func (f DeviceFilter) MatchesID(deviceID string) bool {
+	for _, id := range f.DeviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether a device (or a delta produced by DeviceDelta) is selected by the filter.
+func (f DeviceFilter) Matches(device map[string]interface{}) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	deviceID, _ := device["device_id"].(string)
+	if f.MatchesID(deviceID) {
+		return true
+	}
+	if f.BBox == nil {
+		return false
+	}
+	lat, lng, ok := latestPosition(device)
+	return ok && f.BBox.Contains(lat, lng)
+}
+
+// FetchDeviceDeltas returns the current state of the devices selected by the filter and visible in
+// the scope, reduced to DeviceDeltaFields like check-updates. The database applies the whole
+// filter, a bounding box included.
+func FetchDeviceDeltas(db database.DeviceRepository, filter DeviceFilter, scope auth.Scope) ([]map[string]interface{}, error) {
+	query := database.DeviceQuery{DeviceIDs: filter.queryDeviceIDs(scope), Sort: "device_id", Fields: DeviceDeltaFields}
+	if filter.BBox != nil {
+		query.BBox = filter.BBox
+		query.BBoxDeviceIDs = filter.DeviceIDs
+	}
+	page, err := db.FindDevices(query)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]map[string]interface{}, 0, len(page.Devices))
+	for _, device := range page.Devices {
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// queryDeviceIDs returns the devices the database query can be restricted to, nil for every device.
+// The filter's IDs only restrict it without a bounding box, which also selects devices by position.
+func (f DeviceFilter) queryDeviceIDs(scope auth.Scope) []string {
+	var filterIDs []string
+	if len(f.DeviceIDs) > 0 && f.BBox == nil {
+		filterIDs = f.DeviceIDs
+	}
+	if scope.All() {
+		return filterIDs
+	}
+	if filterIDs == nil {
+		return scope.DeviceIDs()
+	}
+	ids := []string{}
+	for _, id := range filterIDs {
+		if scope.Contains(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// latestPosition reads lat/lng from a device's latest_device_point. Deltas published during
+// ingestion carry typed points, documents read from the database carry maps.
+func latestPosition(device map[string]interface{}) (float64, float64, bool) {
+	var point map[string]interface{}
+	switch p := device["latest_device_point"].(type) {
+	case *models.DevicePoint:
+		if p == nil {
+			return 0, 0, false
+		}
+		return p.Lat, p.Lng, true
+	case bson.M:
+		point = p
+	case map[string]interface{}:
+		point = p
+	default:
+		return 0, 0, false
+	}
+	_, hasLat := point["lat"]
+	_, hasLng := point["lng"]
+	if !hasLat || !hasLng {
+		return 0, 0, false
+	}
+	return toFloat(point["lat"]), toFloat(point["lng"]), true
+}
+
+// toFloat converts the numeric types produced by JSON and BSON decoding to float64.
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/models"
+)
+
+func TestQueryDeviceIDs(t *testing.T) {
+	viewer := auth.NewScope(models.User{Role: models.RoleViewer, DeviceIDs: []string{"truck-1", "truck-2"}}, nil, nil)
+	nothing := auth.NewScope(models.User{Role: models.RoleViewer}, nil, nil)
+	bbox := &BoundingBox{MinLat: 34, MinLng: -119, MaxLat: 35, MaxLng: -118}
+
+	tests := []struct {
+		name   string
+		filter DeviceFilter
+		scope  auth.Scope
+		want   []string
+	}{
+		{"every device", DeviceFilter{}, auth.AllDevices(), nil},
+		{"filter IDs", DeviceFilter{DeviceIDs: []string{"van-1"}}, auth.AllDevices(), []string{"van-1"}},
+		{"bounding box", DeviceFilter{BBox: bbox}, auth.AllDevices(), nil},
+		{"filter IDs or bounding box", DeviceFilter{DeviceIDs: []string{"van-1"}, BBox: bbox}, auth.AllDevices(), nil},
+		{"scope", DeviceFilter{}, viewer, []string{"truck-1", "truck-2"}},
+		{"filter IDs in the scope", DeviceFilter{DeviceIDs: []string{"truck-2", "van-1"}}, viewer, []string{"truck-2"}},
+		{"filter IDs outside the scope", DeviceFilter{DeviceIDs: []string{"van-1"}}, viewer, []string{}},
+		{"bounding box in the scope", DeviceFilter{DeviceIDs: []string{"van-1"}, BBox: bbox}, viewer, []string{"truck-1", "truck-2"}},
+		{"empty scope", DeviceFilter{}, nothing, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.filter.queryDeviceIDs(test.scope)
+			if (got == nil) != (test.want == nil) || fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("queryDeviceIDs = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
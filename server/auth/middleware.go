@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextKey is where Middleware stores the claims of the request in the gin context.
+const contextKey = "auth.claims"
+
+// Middleware rejects requests without a valid access token with 401. The token is read from the
+// Authorization header ("Bearer <token>"), or from the access_token query parameter for clients
+// that cannot set headers, like EventSource and WebSocket.
+func Middleware(tokens *Tokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c.GetHeader("Authorization"))
+		if token == "" {
+			token = c.Query("access_token")
+		}
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+
+		claims, err := tokens.Parse(token, TypeAccess)
+		if err != nil {
+			message := "Invalid access token"
+			if errors.Is(err, ErrExpiredToken) {
+				message = "Access token has expired"
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+			return
+		}
+		c.Set(contextKey, claims)
+		c.Next()
+	}
+}
+
+// CurrentUser returns the claims of the authenticated user. ok is false on routes without Middleware.
+func CurrentUser(c *gin.Context) (Claims, bool) {
+	value, exists := c.Get(contextKey)
+	if !exists {
+		return Claims{}, false
+	}
+	claims, ok := value.(Claims)
+	return claims, ok
+}
+
+func bearerToken(header string) string {
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
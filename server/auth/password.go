@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the shortest password accepted for new accounts and password changes.
+const MinPasswordLength = 8
+
+// unknownUserHash is the bcrypt hash, at bcrypt.DefaultCost, that passwords of unknown users
+// are compared against.
+const unknownUserHash = "$2a$10$SZAMywHRpfmPrIPnLrfK/.G9n.eLLGTLujyNknBRp7gz4wKMQ8rfq"
+
+// HashPassword returns the bcrypt hash of a password.
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether a password matches a bcrypt hash.
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// RejectPassword compares a password of an unknown user against a fixed hash and returns false.
+// It takes as long as CheckPassword, so the response time of a login does not reveal whether
+// the username exists.
+func RejectPassword(password string) bool {
+	bcrypt.CompareHashAndPassword([]byte(unknownUserHash), []byte(password))
+	return false
+}
+
+// RandomPassword generates a password for accounts created without one.
+func RandomPassword() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
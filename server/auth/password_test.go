@@ -0,0 +1,17 @@
+package auth
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRejectPassword(t *testing.T) {
+	// Unknown users must cost a login as much as known ones
+	if cost, err := bcrypt.Cost([]byte(unknownUserHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("cost of the unknown user hash = %d, %v, want %d", cost, err, bcrypt.DefaultCost)
+	}
+	if RejectPassword("unknown user") {
+		t.Errorf("RejectPassword accepted the password of its own hash")
+	}
+}
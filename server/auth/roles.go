@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"net/http"
+
+	"OneStepGPSLeo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// roleRanks orders the roles, every role may do what the lower ones may.
+var roleRanks = map[string]int{
+	models.RoleViewer:   1,
+	models.RoleOperator: 2,
+	models.RoleAdmin:    3,
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole reports whether role includes the permissions of required.
+func HasRole(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required] && roleRanks[role] > 0
+}
+
+// RequireRole rejects requests of users below the required role with 403. It must run after Middleware.
+// The role is taken from the access token, so a role change applies once the token is refreshed.
+func RequireRole(required string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := CurrentUser(c)
+		if !ok || !HasRole(claims.Role, required) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This requires the " + required + " role"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"OneStepGPSLeo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scopeContextKey is where the Scope of a request is cached in the gin context.
+const scopeContextKey = "auth.scope"
+
+// ScopeStore loads what device visibility is computed from.
+type ScopeStore interface {
+	GetUser(id string) (models.User, error)
+	// GetDeviceOwners returns the upstream user_id_list per device_id, and the device_id per MongoDB _id.
+	GetDeviceOwners() (owners map[string][]string, objectIDs map[string]string, err error)
+}
+
+// Scope is the set of devices a user may see.
+type Scope struct {
+	all       bool
+	deviceIDs map[string]bool
+	objectIDs map[string]bool // MongoDB _id (hex) of the visible devices, used by PUT /api/devices/:id
+}
+
+// AllDevices is the scope of admins.
+func AllDevices() Scope {
+	return Scope{all: true}
+}
+
+// NewScope computes the devices visible to a non-admin user: devices whose user_id_list contains one
+// of the user's UpstreamUserIDs, plus the user's DeviceIDs, minus the user's HiddenDeviceIDs.
+func NewScope(user models.User, owners map[string][]string, objectIDs map[string]string) Scope {
+	if user.Role == models.RoleAdmin {
+		return AllDevices()
+	}
+
+	upstream := make(map[string]bool, len(user.UpstreamUserIDs))
+	for _, id := range user.UpstreamUserIDs {
+		upstream[id] = true
+	}
+	scope := Scope{deviceIDs: make(map[string]bool), objectIDs: make(map[string]bool)}
+	for deviceID, userIDs := range owners {
+		for _, userID := range userIDs {
+			if upstream[userID] {
+				scope.deviceIDs[deviceID] = true
+				break
+			}
+		}
+	}
+	for _, deviceID := range user.DeviceIDs {
+		scope.deviceIDs[deviceID] = true
+	}
+	for _, deviceID := range user.HiddenDeviceIDs {
+		delete(scope.deviceIDs, deviceID)
+	}
+	for objectID, deviceID := range objectIDs {
+		if scope.deviceIDs[deviceID] {
+			scope.objectIDs[objectID] = true
+		}
+	}
+	return scope
+}
+
+// All reports whether the scope contains every device, including ones added later.
+func (s Scope) All() bool {
+	return s.all
+}
+
+// Contains reports whether a device is visible. id is a device_id or the MongoDB _id of the device.
+func (s Scope) Contains(id string) bool {
+	return s.all || s.deviceIDs[id] || s.objectIDs[id]
+}
+
+// DeviceIDs returns the visible device_ids in order. It is nil for a scope with all devices.
+func (s Scope) DeviceIDs() []string {
+	if s.all {
+		return nil
+	}
+	ids := make([]string, 0, len(s.deviceIDs))
+	for id := range s.deviceIDs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Scopes resolves the device scope of authenticated users.
+type Scopes struct {
+	Store ScopeStore
+}
+
+// NewScopes creates a scope resolver.
+func NewScopes(store ScopeStore) *Scopes {
+	return &Scopes{Store: store}
+}
+
+// ForRequest returns the scope of the authenticated user, loading it once per request. Overrides and
+// upstream ownership are read from the store, so changes apply to the next request.
+func (s *Scopes) ForRequest(c *gin.Context) (Scope, error) {
+	if value, ok := c.Get(scopeContextKey); ok {
+		return value.(Scope), nil
+	}
+	claims, ok := CurrentUser(c)
+	if !ok {
+		return Scope{}, errors.New("request is not authenticated")
+	}
+
+	scope := AllDevices()
+	if claims.Role != models.RoleAdmin {
+		user, err := s.Store.GetUser(claims.Subject)
+		if err != nil {
+			return Scope{}, err
+		}
+		owners, objectIDs, err := s.Store.GetDeviceOwners()
+		if err != nil {
+			return Scope{}, err
+		}
+		scope = NewScope(user, owners, objectIDs)
+	}
+	c.Set(scopeContextKey, scope)
+	return scope, nil
+}
+
+// RequireDevice responds 404 to requests for a device (the :id path parameter) outside the user's
+// scope, so hidden devices cannot be told apart from missing ones. It must run after Middleware.
+func (s *Scopes) RequireDevice() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope, err := s.ForRequest(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !scope.Contains(c.Param("id")) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+
+	"OneStepGPSLeo/models"
+)
+
+// owners maps the devices to their upstream user_id_list.
+var owners = map[string][]string{
+	"truck-1": {"fleet-a"},
+	"truck-2": {"fleet-a", "fleet-b"},
+	"van-1":   {"fleet-b"},
+	"van-2":   {},
+}
+
+// objectIDs maps the MongoDB _id of the devices to their device_id.
+var objectIDs = map[string]string{
+	"oid-truck-1": "truck-1",
+	"oid-truck-2": "truck-2",
+	"oid-van-1":   "van-1",
+	"oid-van-2":   "van-2",
+}
+
+func TestNewScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      models.User
+		all       bool
+		deviceIDs []string
+	}{
+		{"admin sees every device", models.User{Role: models.RoleAdmin, HiddenDeviceIDs: []string{"truck-1"}}, true, nil},
+		{"upstream user", models.User{Role: models.RoleViewer, UpstreamUserIDs: []string{"fleet-a"}}, false, []string{"truck-1", "truck-2"}},
+		{"several upstream users", models.User{Role: models.RoleOperator, UpstreamUserIDs: []string{"fleet-a", "fleet-b"}}, false, []string{"truck-1", "truck-2", "van-1"}},
+		{"granted devices", models.User{Role: models.RoleViewer, UpstreamUserIDs: []string{"fleet-b"}, DeviceIDs: []string{"van-2"}}, false, []string{"truck-2", "van-1", "van-2"}},
+		{"hidden devices", models.User{Role: models.RoleOperator, UpstreamUserIDs: []string{"fleet-a"}, HiddenDeviceIDs: []string{"truck-2"}}, false, []string{"truck-1"}},
+		{"hidden wins over granted", models.User{Role: models.RoleViewer, DeviceIDs: []string{"van-2"}, HiddenDeviceIDs: []string{"van-2"}}, false, []string{}},
+		{"granted device not upstream yet", models.User{Role: models.RoleViewer, DeviceIDs: []string{"new-device"}}, false, []string{"new-device"}},
+		{"no upstream user", models.User{Role: models.RoleViewer}, false, []string{}},
+		{"unknown upstream user", models.User{Role: models.RoleViewer, UpstreamUserIDs: []string{"fleet-c"}}, false, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scope := NewScope(test.user, owners, objectIDs)
+			if scope.All() != test.all {
+				t.Errorf("All = %v, want %v", scope.All(), test.all)
+			}
+			if got, want := fmt.Sprint(scope.DeviceIDs()), fmt.Sprint(test.deviceIDs); got != want {
+				t.Errorf("DeviceIDs = %s, want %s", got, want)
+			}
+
+			visible := map[string]bool{}
+			for _, id := range test.deviceIDs {
+				visible[id] = true
+			}
+			for objectID, deviceID := range objectIDs {
+				want := test.all || visible[deviceID]
+				if scope.Contains(deviceID) != want || scope.Contains(objectID) != want {
+					t.Errorf("Contains(%s) = %v, Contains(%s) = %v, want %v",
+						deviceID, scope.Contains(deviceID), objectID, scope.Contains(objectID), want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminScopeIncludesNewDevices(t *testing.T) {
+	scope := NewScope(models.User{Role: models.RoleAdmin}, owners, objectIDs)
+	if !scope.Contains("added-later") || scope.DeviceIDs() != nil {
+		t.Errorf("admin scope = %+v, want every device", scope)
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		role, required string
+		allowed        bool
+	}{
+		{models.RoleAdmin, models.RoleViewer, true},
+		{models.RoleAdmin, models.RoleAdmin, true},
+		{models.RoleOperator, models.RoleViewer, true},
+		{models.RoleOperator, models.RoleAdmin, false},
+		{models.RoleViewer, models.RoleOperator, false},
+		{"", models.RoleViewer, false},
+		{"owner", "", false},
+	}
+	for _, test := range tests {
+		if allowed := HasRole(test.role, test.required); allowed != test.allowed {
+			t.Errorf("HasRole(%q, %q) = %v, want %v", test.role, test.required, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Package auth authenticates and authorizes API requests.
+
+Users sign in with a username and password (stored as bcrypt hashes) and receive a short-lived
+access token and a refresh token, both HS256 JSON Web Tokens. Every login creates a session;
+refresh tokens carry the session ID and stop working when the session is revoked on logout.
+Access tokens are not checked against the session, they simply expire after their TTL.
+
+Middleware verifies the access token of a request and stores its claims in the gin context,
+where handlers read them with CurrentUser. RequireRole limits routes to a minimum role, and
+RequireDevice limits device routes to the devices in the user's Scope.
+*/
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+// Token types, stored in the typ claim so a refresh token cannot be used as an access token.
+const (
+	TypeAccess  = "access"
+	TypeRefresh = "refresh"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+// Claims are the contents of a token.
+type Claims struct {
+	Subject   string `json:"sub"`  // User ID
+	Username  string `json:"name"` // Username at the time the token was issued
+	Role      string `json:"role"` // Role at the time the token was issued, updated on refresh
+	SessionID string `json:"sid"`
+	Type      string `json:"typ"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenPair is returned on login and refresh.
+type TokenPair struct {
+	AccessToken  string      `json:"access_token"`
+	RefreshToken string      `json:"refresh_token"`
+	TokenType    string      `json:"token_type"`
+	ExpiresIn    int64       `json:"expires_in"` // Seconds until the access token expires
+	User         models.User `json:"user"`
+}
+
+// Tokens issues and verifies tokens.
+type Tokens struct {
+	secret     []byte
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// NewTokens creates a token issuer. An empty secret is replaced by a random one, which
+// invalidates every token when the server restarts.
+func NewTokens(secret string, accessTTL, refreshTTL time.Duration) (*Tokens, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate token secret: %w", err)
+		}
+	}
+	return &Tokens{secret: key, AccessTTL: accessTTL, RefreshTTL: refreshTTL}, nil
+}
+
+// Issue creates an access and refresh token for a session of the user.
+func (t *Tokens) Issue(user models.User, sessionID string) (TokenPair, error) {
+	now := time.Now()
+	access, err := t.sign(Claims{
+		Subject:   user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		SessionID: sessionID,
+		Type:      TypeAccess,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(t.AccessTTL).Unix(),
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, err := t.sign(Claims{
+		Subject:   user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		SessionID: sessionID,
+		Type:      TypeRefresh,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(t.RefreshTTL).Unix(),
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(t.AccessTTL / time.Second),
+		User:         user,
+	}, nil
+}
+
+// Parse verifies the signature, expiry and type of a token and returns its claims.
+func (t *Tokens) Parse(token, tokenType string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, t.signature(parts[0]+"."+parts[1])) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if claims.Type != tokenType || claims.Subject == "" {
+		return Claims{}, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func (t *Tokens) sign(claims Claims) (string, error) {
+	header, err := encodeSegment(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + payload
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(t.signature(unsigned)), nil
+}
+
+func (t *Tokens) signature(unsigned string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func encodeSegment(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+var operator = models.User{ID: "user-1", Username: "dispatch", Role: models.RoleOperator}
+
+func newTestTokens(t *testing.T, secret string) *Tokens {
+	t.Helper()
+	tokens, err := NewTokens(secret, 15*time.Minute, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+	return tokens
+}
+
+func TestIssueAndParse(t *testing.T) {
+	tokens := newTestTokens(t, "secret")
+	pair, err := tokens.Issue(operator, "session-1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if pair.TokenType != "Bearer" || pair.ExpiresIn != 900 {
+		t.Errorf("pair = %s, expires in %d, want Bearer expiring in 900", pair.TokenType, pair.ExpiresIn)
+	}
+
+	claims, err := tokens.Parse(pair.AccessToken, TypeAccess)
+	if err != nil {
+		t.Fatalf("Parse access token: %v", err)
+	}
+	if claims.Subject != "user-1" || claims.Username != "dispatch" || claims.Role != models.RoleOperator ||
+		claims.SessionID != "session-1" || claims.ExpiresAt-claims.IssuedAt != 900 {
+		t.Errorf("access claims = %+v", claims)
+	}
+
+	claims, err = tokens.Parse(pair.RefreshToken, TypeRefresh)
+	if err != nil {
+		t.Fatalf("Parse refresh token: %v", err)
+	}
+	if claims.SessionID != "session-1" || claims.ExpiresAt-claims.IssuedAt != 24*3600 {
+		t.Errorf("refresh claims = %+v", claims)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tokens := newTestTokens(t, "secret")
+	pair, err := tokens.Issue(operator, "session-1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	parts := strings.Split(pair.AccessToken, ".")
+
+	sign := func(claims Claims) string {
+		token, err := tokens.sign(claims)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return token
+	}
+	// withHeader signs the payload of the access token under another header
+	withHeader := func(header string) string {
+		unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + parts[1]
+		return unsigned + "." + base64.RawURLEncoding.EncodeToString(tokens.signature(unsigned))
+	}
+	now := time.Now().Unix()
+	otherSecret, _ := newTestTokens(t, "other").Issue(operator, "session-1")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1","role":"admin","typ":"access","exp":9999999999}`)) + "." + parts[2]
+
+	tests := []struct {
+		name      string
+		token     string
+		tokenType string
+		err       error
+	}{
+		{"refresh token as access token", pair.RefreshToken, TypeAccess, ErrInvalidToken},
+		{"access token as refresh token", pair.AccessToken, TypeRefresh, ErrInvalidToken},
+		{"other secret", otherSecret.AccessToken, TypeAccess, ErrInvalidToken},
+		{"tampered payload", tampered, TypeAccess, ErrInvalidToken},
+		{"missing signature", parts[0] + "." + parts[1] + ".", TypeAccess, ErrInvalidToken},
+		{"signature not base64", parts[0] + "." + parts[1] + ".!!!", TypeAccess, ErrInvalidToken},
+		{"two segments", parts[0] + "." + parts[1], TypeAccess, ErrInvalidToken},
+		{"empty", "", TypeAccess, ErrInvalidToken},
+		{"alg none", withHeader(`{"alg":"none","typ":"JWT"}`), TypeAccess, ErrInvalidToken},
+		{"header not JSON", withHeader(`HS256`), TypeAccess, ErrInvalidToken},
+		{"without subject", sign(Claims{Type: TypeAccess, ExpiresAt: now + 60}), TypeAccess, ErrInvalidToken},
+		{"expired", sign(Claims{Subject: "user-1", Type: TypeAccess, IssuedAt: now - 120, ExpiresAt: now - 60}), TypeAccess, ErrExpiredToken},
+		{"expiring now", sign(Claims{Subject: "user-1", Type: TypeAccess, ExpiresAt: now}), TypeAccess, ErrExpiredToken},
+		{"expired refresh token", sign(Claims{Subject: "user-1", Type: TypeRefresh, ExpiresAt: now - 1}), TypeRefresh, ErrExpiredToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := tokens.Parse(test.token, test.tokenType); !errors.Is(err, test.err) {
+				t.Errorf("Parse = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRandomSecret(t *testing.T) {
+	pair, err := newTestTokens(t, "").Issue(operator, "session-1")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	// A restarted server has a new secret, tokens of the previous one are invalid
+	if _, err := newTestTokens(t, "").Parse(pair.AccessToken, TypeAccess); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Parse with another random secret = %v, want %v", err, ErrInvalidToken)
+	}
+}
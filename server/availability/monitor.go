@@ -0,0 +1,231 @@
+/*
+Package availability derives the online/offline status of devices and keeps an availability log.
+
+A device is online while its last report (the later of dt_tracker and dt_server of its
+latest_device_point) is no older than its OfflineTimeout setting. The Monitor re-derives the
+status on every ingested device and periodically checks for devices that stopped reporting.
+Every transition is saved to the availability log and published to the event hub.
+*/
+package availability
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/models"
+)
+
+// Store persists transitions and the online flag of devices.
+type Store interface {
+	SaveAvailabilityEvent(event models.AvailabilityEvent) error
+	GetLatestAvailabilityEvent(deviceID string, t time.Time) (*models.AvailabilityEvent, error)
+	SetDeviceOnline(deviceID string, online bool, updatedAt time.Time) (map[string]interface{}, error)
+}
+
+// DeltaFunc reduces a device document to the fields published in device events.
+type DeltaFunc func(device map[string]interface{}) map[string]interface{}
+
+// deviceStatus is the last known status of one device.
+type deviceStatus struct {
+	online         bool
+	since          time.Time // Time of the last transition
+	lastSeen       time.Time
+	offlineTimeout time.Duration
+}
+
+// Monitor tracks the status of every ingested device.
+type Monitor struct {
+	Store    Store
+	Hub      *events.Hub
+	Delta    DeltaFunc
+	Interval time.Duration
+	Clock    clock.Clock
+
+	mutex    sync.Mutex
+	statuses map[string]*deviceStatus
+}
+
+// NewMonitor creates a monitor checking for offline devices every interval, reading the time from clk.
+func NewMonitor(store Store, hub *events.Hub, delta DeltaFunc, interval time.Duration, clk clock.Clock) *Monitor {
+	return &Monitor{
+		Store:    store,
+		Hub:      hub,
+		Delta:    delta,
+		Interval: interval,
+		Clock:    clk,
+		statuses: make(map[string]*deviceStatus),
+	}
+}
+
+// ObserveDevice derives the status of an ingested device before it is stored and overwrites
+// its online flag. Devices without a usable latest_device_point keep the upstream flag.
+func (m *Monitor) ObserveDevice(deviceID string, device *models.Device, settings models.DeviceSettings) {
+	if device.LatestDevicePoint == nil {
+		return
+	}
+	lastSeen, ok := LastSeen(device.LatestDevicePoint)
+	if !ok {
+		return
+	}
+
+	now := m.Clock.Now()
+	timeout := offlineTimeout(settings)
+	online := IsOnline(lastSeen, timeout, now)
+	device.Online = online
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status := m.status(deviceID, now)
+	if status != nil && lastSeen.Before(status.lastSeen) {
+		lastSeen = status.lastSeen // Out of order report, the device was seen more recently
+		online = IsOnline(lastSeen, timeout, now)
+		device.Online = online
+	}
+	m.transition(deviceID, status, online, lastSeen, timeout, now)
+}
+
+// Run checks for offline devices every Interval. It never returns.
+func (m *Monitor) Run() {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.Check(m.Clock.Now())
+	}
+}
+
+// Check marks devices whose last report is older than their OfflineTimeout as offline.
+func (m *Monitor) Check(now time.Time) {
+	m.mutex.Lock()
+	var wentOffline []string
+	for deviceID, status := range m.statuses {
+		if status.online && !IsOnline(status.lastSeen, status.offlineTimeout, now) {
+			m.transition(deviceID, status, false, status.lastSeen, status.offlineTimeout, now)
+			wentOffline = append(wentOffline, deviceID)
+		}
+	}
+	m.mutex.Unlock()
+
+	// The stored device is not replaced until the upstream reports it again
+	for _, deviceID := range wentOffline {
+		device, err := m.Store.SetDeviceOnline(deviceID, false, now)
+		if err != nil {
+			log.Printf("Failed to mark device %s offline: %v", deviceID, err)
+			continue
+		}
+		if device != nil && m.Hub != nil {
+			m.Hub.Publish(events.TypeDevice, deviceID, m.Delta(device))
+		}
+	}
+}
+
+// Status returns the current status of a device, if it has been seen since the server started.
+func (m *Monitor) Status(deviceID string) (online bool, since time.Time, lastSeen time.Time, ok bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status, ok := m.statuses[deviceID]
+	if !ok {
+		return false, time.Time{}, time.Time{}, false
+	}
+	return status.online, status.since, status.lastSeen, true
+}
+
+// status returns the tracked status of a device, restoring it from the availability log
+// the first time the device is seen. It returns nil for devices without any history.
+func (m *Monitor) status(deviceID string, now time.Time) *deviceStatus {
+	if status, ok := m.statuses[deviceID]; ok {
+		return status
+	}
+	last, err := m.Store.GetLatestAvailabilityEvent(deviceID, now)
+	if err != nil {
+		log.Printf("Failed to load availability of device %s: %v", deviceID, err)
+		return nil
+	}
+	if last == nil {
+		return nil
+	}
+	status := &deviceStatus{online: last.Online, since: last.Time, lastSeen: last.LastSeen}
+	m.statuses[deviceID] = status
+	return status
+}
+
+// transition updates the tracked status and logs a transition if the status changed.
+// Must be called with the mutex held.
+func (m *Monitor) transition(deviceID string, status *deviceStatus, online bool, lastSeen time.Time, timeout time.Duration, now time.Time) {
+	if status == nil {
+		status = &deviceStatus{online: !online} // First sighting, always log the initial status
+		m.statuses[deviceID] = status
+	}
+	status.lastSeen = lastSeen
+	status.offlineTimeout = timeout
+	if status.online == online && !status.since.IsZero() {
+		return
+	}
+
+	// Date the transition when it actually happened rather than when it was noticed
+	at := lastSeen
+	if !online {
+		at = lastSeen.Add(timeout)
+	}
+	if at.Before(status.since) {
+		at = status.since
+	}
+	if at.After(now) {
+		at = now
+	}
+
+	status.online = online
+	status.since = at
+
+	event := models.AvailabilityEvent{DeviceID: deviceID, Online: online, Time: at, DetectedAt: now, LastSeen: lastSeen}
+	if err := m.Store.SaveAvailabilityEvent(event); err != nil {
+		log.Printf("Failed to save availability of device %s: %v", deviceID, err)
+	}
+	if m.Hub != nil {
+		m.Hub.Publish(events.TypeStatus, deviceID, event)
+	}
+	log.Printf("Device %s is %s since %s", deviceID, statusName(online), at.Format(time.RFC3339))
+}
+
+// LastSeen returns the later of dt_tracker and dt_server of a device point.
+func LastSeen(point *models.DevicePoint) (time.Time, bool) {
+	var lastSeen time.Time
+	for _, str := range []string{point.DtTracker, point.DtServer} {
+		if str == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			continue
+		}
+		if t.After(lastSeen) {
+			lastSeen = t
+		}
+	}
+	return lastSeen, !lastSeen.IsZero()
+}
+
+// IsOnline reports whether a device last seen at lastSeen is still online at now.
+func IsOnline(lastSeen time.Time, timeout time.Duration, now time.Time) bool {
+	return now.Sub(lastSeen) <= timeout
+}
+
+// offlineTimeout returns the OfflineTimeout setting, falling back to the default for unset values.
+func offlineTimeout(settings models.DeviceSettings) time.Duration {
+	seconds := settings.OfflineTimeout.Seconds()
+	if seconds <= 0 {
+		seconds = 3900
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func statusName(online bool) string {
+	if online {
+		return "online"
+	}
+	return "offline"
+}
@@ -0,0 +1,145 @@
+package availability
+
+import (
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/models"
+)
+
+var start = time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+
+// hourTimeout sets the OfflineTimeout to an hour.
+var hourTimeout = models.DeviceSettings{OfflineTimeout: models.Speed{Value: 1, Unit: "h"}}
+
+// reported is a device whose latest point was received at the given time.
+func reported(at time.Time) *models.Device {
+	return &models.Device{LatestDevicePoint: &models.DevicePoint{
+		DtTracker: at.Add(-time.Second).Format(time.RFC3339),
+		DtServer:  at.Format(time.RFC3339),
+	}}
+}
+
+// transitions returns the logged transitions of the device.
+func transitions(t *testing.T, db *database.Memory) []models.AvailabilityEvent {
+	t.Helper()
+	events, err := db.GetAvailabilityEvents("device", start.Add(-24*time.Hour), start.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("GetAvailabilityEvents: %v", err)
+	}
+	return events
+}
+
+func TestTransitionsAreDatedFromPointTimes(t *testing.T) {
+	db := database.NewMemory()
+	virtual := clock.NewVirtual(start)
+	monitor := NewMonitor(db, nil, nil, time.Minute, virtual)
+
+	// Seen 5 minutes ago: online since then, not since the monitor noticed
+	device := reported(start.Add(-5 * time.Minute))
+	monitor.ObserveDevice("device", device, hourTimeout)
+	if !device.Online {
+		t.Errorf("device reported 5 minutes ago is offline")
+	}
+
+	// Silent for longer than the timeout: offline from the end of the timeout, noticed later
+	virtual.Advance(2 * time.Hour)
+	monitor.Check(virtual.Now())
+
+	// Reports again
+	virtual.Advance(10 * time.Minute)
+	monitor.ObserveDevice("device", reported(virtual.Now().Add(-30*time.Second)), hourTimeout)
+
+	want := []models.AvailabilityEvent{
+		{Online: true, Time: start.Add(-5 * time.Minute), DetectedAt: start},
+		{Online: false, Time: start.Add(55 * time.Minute), DetectedAt: start.Add(2 * time.Hour)},
+		{Online: true, Time: start.Add(2*time.Hour + 9*time.Minute + 30*time.Second), DetectedAt: start.Add(2*time.Hour + 10*time.Minute)},
+	}
+	got := transitions(t, db)
+	if len(got) != len(want) {
+		t.Fatalf("logged %d transitions, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Online != want[i].Online || !got[i].Time.Equal(want[i].Time) || !got[i].DetectedAt.Equal(want[i].DetectedAt) {
+			t.Errorf("transition %d = online %v at %s detected %s, want online %v at %s detected %s", i,
+				got[i].Online, got[i].Time, got[i].DetectedAt, want[i].Online, want[i].Time, want[i].DetectedAt)
+		}
+	}
+
+	online, since, lastSeen, ok := monitor.Status("device")
+	if !ok || !online || !since.Equal(want[2].Time) || !lastSeen.Equal(want[2].Time) {
+		t.Errorf("status = online %v since %s last seen %s, want online since %s", online, since, lastSeen, want[2].Time)
+	}
+}
+
+func TestFirstSightingOfAStaleDevice(t *testing.T) {
+	db := database.NewMemory()
+	monitor := NewMonitor(db, nil, nil, time.Minute, clock.NewVirtual(start))
+
+	device := reported(start.Add(-3 * time.Hour))
+	device.Online = true // The upstream flag is overwritten
+	monitor.ObserveDevice("device", device, hourTimeout)
+	if device.Online {
+		t.Errorf("device last seen 3 hours ago is online")
+	}
+	got := transitions(t, db)
+	if len(got) != 1 || got[0].Online || !got[0].Time.Equal(start.Add(-2*time.Hour)) {
+		t.Errorf("transitions = %+v, want offline since the timeout ran out 2 hours ago", got)
+	}
+}
+
+func TestOutOfOrderReportsKeepTheLatestSighting(t *testing.T) {
+	db := database.NewMemory()
+	virtual := clock.NewVirtual(start)
+	monitor := NewMonitor(db, nil, nil, time.Minute, virtual)
+
+	monitor.ObserveDevice("device", reported(start.Add(-time.Minute)), hourTimeout)
+	virtual.Advance(30 * time.Minute)
+	late := reported(start.Add(-2 * time.Hour)) // A delayed report from before
+	monitor.ObserveDevice("device", late, hourTimeout)
+
+	if !late.Online {
+		t.Errorf("an old report took the device offline")
+	}
+	if _, _, lastSeen, _ := monitor.Status("device"); !lastSeen.Equal(start.Add(-time.Minute)) {
+		t.Errorf("last seen %s, want the more recent %s", lastSeen, start.Add(-time.Minute))
+	}
+	if got := transitions(t, db); len(got) != 1 {
+		t.Errorf("logged %d transitions, want 1", len(got))
+	}
+}
+
+func TestStatusIsRestoredFromTheLog(t *testing.T) {
+	db := database.NewMemory()
+	NewMonitor(db, nil, nil, time.Minute, clock.NewVirtual(start)).
+		ObserveDevice("device", reported(start.Add(-time.Minute)), hourTimeout)
+
+	// After a restart the device is still online, no new transition is logged
+	virtual := clock.NewVirtual(start.Add(10 * time.Minute))
+	restarted := NewMonitor(db, nil, nil, time.Minute, virtual)
+	restarted.ObserveDevice("device", reported(virtual.Now()), hourTimeout)
+	if got := transitions(t, db); len(got) != 1 {
+		t.Errorf("logged %d transitions after the restart, want 1", len(got))
+	}
+	if _, since, _, _ := restarted.Status("device"); !since.Equal(start.Add(-time.Minute)) {
+		t.Errorf("online since %s after the restart, want %s", since, start.Add(-time.Minute))
+	}
+}
+
+func TestDefaultOfflineTimeout(t *testing.T) {
+	db := database.NewMemory()
+	monitor := NewMonitor(db, nil, nil, time.Minute, clock.NewVirtual(start))
+
+	// Without an OfflineTimeout setting devices stay online for 65 minutes
+	device := reported(start.Add(-64 * time.Minute))
+	monitor.ObserveDevice("device", device, models.DeviceSettings{})
+	if !device.Online {
+		t.Errorf("device seen 64 minutes ago is offline with the default timeout")
+	}
+	monitor.Check(start.Add(2 * time.Minute))
+	if got := transitions(t, db); len(got) != 2 || !got[1].Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("transitions = %+v, want offline 65 minutes after the last report", got)
+	}
+}
@@ -0,0 +1,68 @@
+package availability
+
+import (
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+// DailyUptime splits [from, to) into UTC days and sums the time spent online and offline in each.
+// initial is the last transition before from (nil if unknown) and transitions are the ones in
+// the range, oldest first. Time after now is counted as unknown.
+func DailyUptime(initial *models.AvailabilityEvent, transitions []models.AvailabilityEvent, from, to, now time.Time) []models.DailyUptime {
+	from, to = from.UTC(), to.UTC()
+	days := []models.DailyUptime{}
+
+	for dayStart := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC); dayStart.Before(to); dayStart = dayStart.AddDate(0, 0, 1) {
+		dayEnd := dayStart.AddDate(0, 0, 1)
+		day := models.DailyUptime{Date: dayStart.Format("2006-01-02")}
+
+		// The state at any instant is the one of the last transition before it
+		state := initial
+		next := 0
+		cursor := dayStart
+		for cursor.Before(dayEnd) {
+			for next < len(transitions) && !transitions[next].Time.After(cursor) {
+				state = &transitions[next]
+				next++
+			}
+			segmentEnd := dayEnd
+			if next < len(transitions) && transitions[next].Time.Before(segmentEnd) {
+				segmentEnd = transitions[next].Time
+			}
+
+			start, end := clamp(cursor, from, to, now), clamp(segmentEnd, from, to, now)
+			known := end.Sub(start).Seconds()
+			switch {
+			case state == nil:
+				day.UnknownSeconds += known
+			case state.Online:
+				day.OnlineSeconds += known
+			default:
+				day.OfflineSeconds += known
+			}
+			cursor = segmentEnd
+		}
+
+		day.UnknownSeconds += dayEnd.Sub(dayStart).Seconds() - day.OnlineSeconds - day.OfflineSeconds - day.UnknownSeconds
+		if total := day.OnlineSeconds + day.OfflineSeconds; total > 0 {
+			day.UptimePercent = day.OnlineSeconds / total * 100
+		}
+		days = append(days, day)
+	}
+	return days
+}
+
+// clamp limits t to the requested range and to now.
+func clamp(t, from, to, now time.Time) time.Time {
+	if now.Before(to) {
+		to = now
+	}
+	if t.Before(from) {
+		return from
+	}
+	if t.After(to) {
+		return to
+	}
+	return t
+}
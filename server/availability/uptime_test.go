@@ -0,0 +1,107 @@
+package availability
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+func day(d, hour int) time.Time {
+	return time.Date(2024, 11, d, hour, 0, 0, 0, time.UTC)
+}
+
+func went(online bool, at time.Time) models.AvailabilityEvent {
+	return models.AvailabilityEvent{DeviceID: "device", Online: online, Time: at}
+}
+
+func TestDailyUptime(t *testing.T) {
+	const hour = 3600.0
+	online := went(true, day(1, 0))
+
+	tests := []struct {
+		name        string
+		initial     *models.AvailabilityEvent
+		transitions []models.AvailabilityEvent
+		from, to    time.Time
+		now         time.Time
+		want        []models.DailyUptime
+	}{
+		{
+			name:        "one day",
+			initial:     &online,
+			transitions: []models.AvailabilityEvent{went(false, day(13, 6)), went(true, day(13, 18))},
+			from:        day(13, 0), to: day(14, 0), now: day(20, 0),
+			want: []models.DailyUptime{{Date: "2024-11-13", OnlineSeconds: 12 * hour, OfflineSeconds: 12 * hour, UptimePercent: 50}},
+		},
+		{
+			name:        "offline across midnight",
+			transitions: []models.AvailabilityEvent{went(true, day(13, 12)), went(false, day(13, 20)), went(true, day(14, 2))},
+			from:        day(13, 0), to: day(15, 0), now: day(20, 0),
+			want: []models.DailyUptime{
+				{Date: "2024-11-13", OnlineSeconds: 8 * hour, OfflineSeconds: 4 * hour, UnknownSeconds: 12 * hour, UptimePercent: 8.0 / 12 * 100},
+				{Date: "2024-11-14", OnlineSeconds: 22 * hour, OfflineSeconds: 2 * hour, UptimePercent: 22.0 / 24 * 100},
+			},
+		},
+		{
+			name:    "no transitions in the range",
+			initial: &online,
+			from:    day(13, 0), to: day(15, 0), now: day(20, 0),
+			want: []models.DailyUptime{
+				{Date: "2024-11-13", OnlineSeconds: 24 * hour, UptimePercent: 100},
+				{Date: "2024-11-14", OnlineSeconds: 24 * hour, UptimePercent: 100},
+			},
+		},
+		{
+			name: "nothing known",
+			from: day(13, 0), to: day(14, 0), now: day(20, 0),
+			want: []models.DailyUptime{{Date: "2024-11-13", UnknownSeconds: 24 * hour}},
+		},
+		{
+			name:        "partial days at both ends",
+			initial:     &online,
+			transitions: []models.AvailabilityEvent{went(false, day(14, 12))},
+			from:        day(13, 18), to: day(14, 18), now: day(20, 0),
+			want: []models.DailyUptime{
+				{Date: "2024-11-13", OnlineSeconds: 6 * hour, UnknownSeconds: 18 * hour, UptimePercent: 100},
+				{Date: "2024-11-14", OnlineSeconds: 12 * hour, OfflineSeconds: 6 * hour, UnknownSeconds: 6 * hour, UptimePercent: 12.0 / 18 * 100},
+			},
+		},
+		{
+			name:        "the future is unknown",
+			initial:     &online,
+			transitions: []models.AvailabilityEvent{went(false, day(14, 6))},
+			from:        day(13, 0), to: day(16, 0), now: day(14, 12),
+			want: []models.DailyUptime{
+				{Date: "2024-11-13", OnlineSeconds: 24 * hour, UptimePercent: 100},
+				{Date: "2024-11-14", OnlineSeconds: 6 * hour, OfflineSeconds: 6 * hour, UnknownSeconds: 12 * hour, UptimePercent: 50},
+				{Date: "2024-11-15", UnknownSeconds: 24 * hour},
+			},
+		},
+		{
+			name:        "days are UTC",
+			initial:     &online,
+			transitions: []models.AvailabilityEvent{went(false, day(13, 12))},
+			from:        day(13, 0).In(time.FixedZone("PST", -8*3600)), to: day(14, 0), now: day(20, 0),
+			want: []models.DailyUptime{{Date: "2024-11-13", OnlineSeconds: 12 * hour, OfflineSeconds: 12 * hour, UptimePercent: 50}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := DailyUptime(test.initial, test.transitions, test.from, test.to, test.now)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d days, want %d: %+v", len(got), len(test.want), got)
+			}
+			for i := range got {
+				percent := got[i].UptimePercent
+				got[i].UptimePercent = test.want[i].UptimePercent
+				if got[i] != test.want[i] || math.Abs(percent-test.want[i].UptimePercent) > 1e-9 {
+					got[i].UptimePercent = percent
+					t.Errorf("day %d = %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Package clock abstracts the current time.
+
+The mock server, the poller, the source health, the event hub, the availability
+monitor, the retention worker, the storage backends (for device settings) and the default
+time ranges of the REST handlers read the time from a Clock. Normally that is the System clock; the deterministic mock mode uses a
+Virtual clock that only moves when the mock session advances it, so a session
+produces the same timestamps on every run.
+*/
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// System is the clock of the operating system.
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Virtual is a clock that stands still until it is advanced. It is safe for concurrent use.
+type Virtual struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewVirtual creates a virtual clock showing start.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+// Now returns the time of the clock.
+func (v *Virtual) Now() time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.now
+}
+
+// Advance moves the clock forward by d and returns the new time.
+func (v *Virtual) Advance(d time.Duration) time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.now = v.now.Add(d)
+	return v.now
+}
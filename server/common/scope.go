@@ -0,0 +1,22 @@
+package common
+
+// InScope reports whether a device is targeted by a list of device IDs and group IDs, either
+// directly or through one of its groups. Empty lists target every device.
+func InScope(deviceIDs, groupIDs []string, deviceID string, deviceGroupIDs []string) bool {
+	if len(deviceIDs) == 0 && len(groupIDs) == 0 {
+		return true
+	}
+	for _, id := range deviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+	for _, id := range groupIDs {
+		for _, groupID := range deviceGroupIDs {
+			if id == groupID {
+				return true
+			}
+		}
+	}
+	return false
+}
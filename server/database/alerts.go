@@ -0,0 +1,294 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrAlertRuleNotFound        = errors.New("alert rule not found")
+	ErrOutdatedAlertRuleVersion = errors.New("outdated alert rule version")
+	ErrAlertNotFound            = errors.New("alert not found")
+	ErrAlertStatus              = errors.New("alert is not in a state that allows this change")
+)
+
+// AlertFilter selects alerts. Zero values do not filter.
+type AlertFilter struct {
+	Status    string
+	DeviceID  string
+	DeviceIDs []string // Restricts the alerts to these devices when not nil
+	RuleID    string
+	From      time.Time
+	To        time.Time
+	Limit     int64
+}
+
+// GetAlertRules returns every alert rule, ordered by name.
+func (db *MongoDB) GetAlertRules() ([]models.AlertRule, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertRuleCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find alert rules: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	rules := []models.AlertRule{}
+	if err := cursor.All(ctx, &rules); err != nil {
+		return nil, fmt.Errorf("failed to decode alert rules: %w", err)
+	}
+	return rules, nil
+}
+
+// GetAlertRule returns an alert rule by ID.
+func (db *MongoDB) GetAlertRule(id string) (models.AlertRule, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertRuleCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var rule models.AlertRule
+	if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&rule); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.AlertRule{}, ErrAlertRuleNotFound
+		}
+		return models.AlertRule{}, fmt.Errorf("failed to get alert rule: %w", err)
+	}
+	return rule, nil
+}
+
+// CreateAlertRule inserts a new alert rule with a generated ID.
+func (db *MongoDB) CreateAlertRule(rule models.AlertRule) (models.AlertRule, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertRuleCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	rule.ID = primitive.NewObjectID().Hex()
+	rule.Version = 1
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+	if _, err := collection.InsertOne(ctx, rule); err != nil {
+		return models.AlertRule{}, fmt.Errorf("failed to create alert rule: %w", err)
+	}
+	return rule, nil
+}
+
+// UpdateAlertRule replaces an alert rule if its stored version still matches rule.Version.
+// On a version mismatch the stored rule is returned with ErrOutdatedAlertRuleVersion.
+func (db *MongoDB) UpdateAlertRule(rule models.AlertRule) (models.AlertRule, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertRuleCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	existing, err := db.GetAlertRule(rule.ID)
+	if err != nil {
+		return models.AlertRule{}, err
+	}
+	if existing.Version != rule.Version {
+		return existing, ErrOutdatedAlertRuleVersion
+	}
+
+	filter := bson.M{"_id": rule.ID, "version": rule.Version}
+	rule.CreatedAt = existing.CreatedAt
+	rule.UpdatedAt = time.Now().UTC()
+	rule.Version++
+	result, err := collection.ReplaceOne(ctx, filter, rule)
+	if err != nil {
+		return models.AlertRule{}, fmt.Errorf("failed to update alert rule: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return existing, ErrOutdatedAlertRuleVersion // Changed between the read and the replace
+	}
+	return rule, nil
+}
+
+// DeleteAlertRule deletes an alert rule. Its alerts are kept.
+func (db *MongoDB) DeleteAlertRule(id string) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertRuleCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete alert rule: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrAlertRuleNotFound
+	}
+	return nil
+}
+
+// GetLatestAlert returns the most recently triggered alert of a rule for a device, or nil if there is none.
+func (db *MongoDB) GetLatestAlert(ruleID, deviceID string) (*models.Alert, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.FindOne().SetSort(bson.D{{Key: "last_triggered_at", Value: -1}})
+	var alert models.Alert
+	err := collection.FindOne(ctx, bson.M{"rule_id": ruleID, "device_id": deviceID}, opts).Decode(&alert)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get latest alert: %w", err)
+	}
+	return &alert, nil
+}
+
+// CreateAlert inserts a new alert with a generated ID.
+func (db *MongoDB) CreateAlert(alert models.Alert) (models.Alert, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	alert.ID = primitive.NewObjectID().Hex()
+	if _, err := collection.InsertOne(ctx, alert); err != nil {
+		return models.Alert{}, fmt.Errorf("failed to create alert: %w", err)
+	}
+	return alert, nil
+}
+
+// RecordAlertTrigger counts another trigger of an unresolved alert.
+func (db *MongoDB) RecordAlertTrigger(id string, at time.Time, message string) (models.Alert, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$inc": bson.M{"count": 1},
+		"$set": bson.M{"last_triggered_at": at, "message": message},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var alert models.Alert
+	if err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&alert); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.Alert{}, ErrAlertNotFound
+		}
+		return models.Alert{}, fmt.Errorf("failed to record alert trigger: %w", err)
+	}
+	return alert, nil
+}
+
+// GetAlert returns an alert by ID.
+func (db *MongoDB) GetAlert(id string) (models.Alert, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var alert models.Alert
+	if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&alert); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.Alert{}, ErrAlertNotFound
+		}
+		return models.Alert{}, fmt.Errorf("failed to get alert: %w", err)
+	}
+	return alert, nil
+}
+
+// GetAlerts returns the alerts matching the filter, most recently triggered first.
+func (db *MongoDB) GetAlerts(filter AlertFilter) ([]models.Alert, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := bson.M{}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	deviceQuery := bson.M{}
+	if filter.DeviceID != "" {
+		deviceQuery["$eq"] = filter.DeviceID
+	}
+	if filter.DeviceIDs != nil {
+		deviceQuery["$in"] = filter.DeviceIDs
+	}
+	if len(deviceQuery) > 0 {
+		query["device_id"] = deviceQuery
+	}
+	if filter.RuleID != "" {
+		query["rule_id"] = filter.RuleID
+	}
+	triggered := bson.M{}
+	if !filter.From.IsZero() {
+		triggered["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		triggered["$lte"] = filter.To
+	}
+	if len(triggered) > 0 {
+		query["last_triggered_at"] = triggered
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "last_triggered_at", Value: -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find alerts: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	alerts := []models.Alert{}
+	if err := cursor.All(ctx, &alerts); err != nil {
+		return nil, fmt.Errorf("failed to decode alerts: %w", err)
+	}
+	return alerts, nil
+}
+
+// AcknowledgeAlert marks an open alert as acknowledged.
+func (db *MongoDB) AcknowledgeAlert(id, by, note string) (models.Alert, error) {
+	now := time.Now().UTC()
+	set := bson.M{"status": models.AlertAcknowledged, "acknowledged_at": now, "acknowledged_by": by}
+	if note != "" {
+		set["note"] = note
+	}
+	return db.changeAlertStatus(id, []string{models.AlertOpen}, set)
+}
+
+// ResolveAlert marks an open or acknowledged alert as resolved.
+func (db *MongoDB) ResolveAlert(id, by, note string) (models.Alert, error) {
+	now := time.Now().UTC()
+	set := bson.M{"status": models.AlertResolved, "resolved_at": now, "resolved_by": by}
+	if note != "" {
+		set["note"] = note
+	}
+	return db.changeAlertStatus(id, []string{models.AlertOpen, models.AlertAcknowledged}, set)
+}
+
+// changeAlertStatus applies set to an alert whose status is one of from. If the alert exists in
+// another status, it is returned unchanged with ErrAlertStatus.
+func (db *MongoDB) changeAlertStatus(id string, from []string, set bson.M) (models.Alert, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AlertCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "status": bson.M{"$in": from}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var alert models.Alert
+	err := collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&alert)
+	if err == nil {
+		return alert, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return models.Alert{}, fmt.Errorf("failed to update alert: %w", err)
+	}
+
+	current, err := db.GetAlert(id)
+	if err != nil {
+		return models.Alert{}, err
+	}
+	return current, ErrAlertStatus
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SaveAvailabilityEvent appends an online/offline transition to the availability log.
+func (db *MongoDB) SaveAvailabilityEvent(event models.AvailabilityEvent) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AvailabilityCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, event); err != nil {
+		return fmt.Errorf("failed to save availability event: %w", err)
+	}
+	return nil
+}
+
+// GetLatestAvailabilityEvent returns the newest transition of a device at or before t, or nil if there is none.
+func (db *MongoDB) GetLatestAvailabilityEvent(deviceID string, t time.Time) (*models.AvailabilityEvent, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AvailabilityCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"device_id": deviceID, "time": bson.M{"$lte": t}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "detected_at", Value: -1}})
+
+	var event models.AvailabilityEvent
+	err := collection.FindOne(ctx, filter, opts).Decode(&event)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get latest availability event: %w", err)
+	}
+	return &event, nil
+}
+
+// GetAvailabilityEvents returns the transitions of a device with from <= time <= to, oldest first.
+func (db *MongoDB) GetAvailabilityEvents(deviceID string, from, to time.Time) ([]models.AvailabilityEvent, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AvailabilityCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"device_id": deviceID, "time": bson.M{"$gte": from, "$lte": to}}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}, {Key: "detected_at", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find availability events: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	availability := []models.AvailabilityEvent{}
+	if err := cursor.All(ctx, &availability); err != nil {
+		return nil, fmt.Errorf("failed to decode availability events: %w", err)
+	}
+	return availability, nil
+}
+
+// SetDeviceOnline updates the online flag of a stored device and bumps its updated_at so
+// polling clients pick up the change.
+func (db *MongoDB) SetDeviceOnline(deviceID string, online bool, updatedAt time.Time) (map[string]interface{}, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"online": online, "updated_at": updatedAt.Format(time.RFC3339)}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var device map[string]interface{}
+	err := collection.FindOneAndUpdate(ctx, bson.M{"device_id": deviceID}, update, opts).Decode(&device)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to set device online status: %w", err)
+	}
+	return device, nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"time"
 
+	"OneStepGPSLeo/clock"
 	"OneStepGPSLeo/models" // Import your models package
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,12 +16,26 @@ import (
 )
 
 type MongoDB struct {
-	Client                 *mongo.Client
-	DatabaseName           string
-	Config                 models.Config
-	DeviceCollectionName   string
-	UserCollectionName     string
-	SettingsCollectionName string
+	Client                        *mongo.Client
+	DatabaseName                  string
+	Config                        models.Config
+	DeviceCollectionName          string
+	UserCollectionName            string
+	SettingsCollectionName        string
+	HistoryCollectionName         string
+	TripCollectionName            string
+	StopCollectionName            string
+	AvailabilityCollectionName    string
+	GeofenceCollectionName        string
+	GeofenceEventCollectionName   string
+	AlertRuleCollectionName       string
+	AlertCollectionName           string
+	NotificationLogCollectionName string
+	AccountCollectionName         string
+	SessionCollectionName         string
+	GroupCollectionName           string
+	MigrationCollectionName       string
+	Clock                         clock.Clock // Time of settings updates
 }
 
 func NewMongoDB(cfg models.Config) (*MongoDB, error) {
@@ -70,13 +85,79 @@ func NewMongoDB(cfg models.Config) (*MongoDB, error) {
 		return nil, fmt.Errorf("failed to create settings collection: %w", err)
 	}
 
+	if err := createHistoryCollectionIfNotExists(db, cfg.HistoryCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create history collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.TripCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create trips collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.StopCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create stops collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.AvailabilityCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create availability collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.GeofenceCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create geofences collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.GeofenceEventCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create geofence events collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.AlertRuleCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create alert rules collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.AlertCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create alerts collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.NotificationLogCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create notification log collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.AccountCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create accounts collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.SessionCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create sessions collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.GroupCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create device group collection: %w", err)
+	}
+
+	if err := createCollectionIfNotExists(db, cfg.MigrationCollectionName); err != nil {
+		return nil, fmt.Errorf("failed to create migration collection: %w", err)
+	}
+
 	return &MongoDB{
-		Client:                 client,
-		DatabaseName:           cfg.DatabaseName,
-		DeviceCollectionName:   cfg.DeviceCollectionName,
-		UserCollectionName:     cfg.UserCollectionName,
-		SettingsCollectionName: cfg.SettingsCollectionName,
-		Config:                 cfg,
+		Client:                        client,
+		DatabaseName:                  cfg.DatabaseName,
+		DeviceCollectionName:          cfg.DeviceCollectionName,
+		UserCollectionName:            cfg.UserCollectionName,
+		SettingsCollectionName:        cfg.SettingsCollectionName,
+		HistoryCollectionName:         cfg.HistoryCollectionName,
+		TripCollectionName:            cfg.TripCollectionName,
+		StopCollectionName:            cfg.StopCollectionName,
+		AvailabilityCollectionName:    cfg.AvailabilityCollectionName,
+		GeofenceCollectionName:        cfg.GeofenceCollectionName,
+		GeofenceEventCollectionName:   cfg.GeofenceEventCollectionName,
+		AlertRuleCollectionName:       cfg.AlertRuleCollectionName,
+		AlertCollectionName:           cfg.AlertCollectionName,
+		NotificationLogCollectionName: cfg.NotificationLogCollectionName,
+		AccountCollectionName:         cfg.AccountCollectionName,
+		SessionCollectionName:         cfg.SessionCollectionName,
+		GroupCollectionName:           cfg.GroupCollectionName,
+		MigrationCollectionName:       cfg.MigrationCollectionName,
+		Config:                        cfg,
+		Clock:                         clock.System,
 	}, nil
 }
 
@@ -120,23 +201,6 @@ func createCollectionIfNotExists(db *mongo.Database, collectionName string) erro
 	return nil
 }
 
-func (db *MongoDB) GetDevices() ([]bson.M, error) {
-	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
-
-	cursor, err := collection.Find(context.TODO(), bson.D{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to find devices: %w", err)
-	}
-	defer cursor.Close(context.TODO())
-
-	var devices []bson.M // Use []bson.M to store the results
-	if err = cursor.All(context.TODO(), &devices); err != nil {
-		return nil, fmt.Errorf("failed to decode devices: %w", err)
-	}
-
-	return devices, nil
-}
-
 func (db *MongoDB) UpdateDevice(deviceID primitive.ObjectID, updatedDevice map[string]interface{}, deviceVersion int) error {
 	filter := bson.M{"_id": deviceID, "version": deviceVersion}
 
@@ -154,7 +218,7 @@ func (db *MongoDB) UpdateDevice(deviceID primitive.ObjectID, updatedDevice map[s
 
 	if result.Err() != nil {
 		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
-			return fmt.Errorf("outdated device version") // Specific error for version mismatch
+			return ErrOutdatedDeviceVersion // Specific error for version mismatch
 		}
 		return fmt.Errorf("failed to update device: %w", result.Err())
 	}
@@ -189,7 +253,7 @@ func (db *MongoDB) GetUserPreferences(userID string) (models.UserPreferences, er
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			// Handle the case where no matching document is found.
-			return models.UserPreferences{}, fmt.Errorf("user preferences not found: %w", err)
+			return models.UserPreferences{}, ErrPreferencesNotFound
 		} else {
 			// Handle other errors that might occur during the query.
 			return models.UserPreferences{}, fmt.Errorf("failed to get user preferences: %w", err)
@@ -289,35 +353,7 @@ func (db *MongoDB) GetDeviceSettings(deviceID string) (models.DeviceSettings, er
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			// Handle "not found" by creating a new document if needed.
-			currentTime := time.Now().Format(time.RFC3339)
-			settings = models.DeviceSettings{
-				DeviceID:              deviceID,
-				IconURL:               "",
-				Version:               1,
-				UpdatedAt:             currentTime,
-				BeginMovingSpeed:      models.Speed{Value: 0, Unit: "mph", Display: "0 mph"},
-				BeginStoppedSpeed:     models.Speed{Value: 0, Unit: "mph", Display: "0 mph"},
-				MaxDriftDistance:      models.Speed{Value: 350, Unit: "m", Display: "350 m"},
-				MinNumSatellites:      8,
-				IgnoreUnsetMinNumSats: true,
-				MaxHdop:               3.5,
-				DriveTimeout:          models.Speed{Value: 1800, Unit: "s", Display: "30m"},
-				StopTimeout:           models.Speed{Value: 14400, Unit: "s", Display: "4h"},
-				OfflineTimeout:        models.Speed{Value: 3900, Unit: "s", Display: "1h 5m"},
-				HistoryCalcDuration:   models.Speed{Value: 86400, Unit: "s", Display: "24h"},
-				FuelConsumption: models.FuelConsumption{
-					CalculationMethod: "fuel_sensor",
-					Measurement:       "mpg",
-					FuelType:          "",
-					FuelCost:          0,
-					FuelEconomy:       0,
-				},
-				InitialDevicePointDeleteCutoffTime: "2024-06-21T17:45:09.284403Z",
-				EngineHoursCounterConfig:           "best",
-				UseV3EngineHours:                   true,
-				HistoryRetentionDays:               1095,
-				HarshEventMinSpeed:                 models.Speed{Value: 0, Unit: "mph", Display: "0 mph"},
-			}
+			settings = DefaultDeviceSettings(deviceID, db.Clock.Now())
 			if _, err := db.Client.Database(db.DatabaseName).Collection(db.SettingsCollectionName).InsertOne(context.TODO(), settings); err != nil {
 				return models.DeviceSettings{}, fmt.Errorf("error creating default device settings: %w", err) // Return error if default creation fails.
 			}
@@ -330,12 +366,44 @@ func (db *MongoDB) GetDeviceSettings(deviceID string) (models.DeviceSettings, er
 	return settings, nil
 }
 
+// DefaultDeviceSettings returns the settings used for devices that have none stored, updated at now.
+func DefaultDeviceSettings(deviceID string, now time.Time) models.DeviceSettings {
+	return models.DeviceSettings{
+		DeviceID:              deviceID,
+		IconURL:               "",
+		Version:               1,
+		UpdatedAt:             now.Format(time.RFC3339),
+		BeginMovingSpeed:      models.Speed{Value: 0, Unit: "mph", Display: "0 mph"},
+		BeginStoppedSpeed:     models.Speed{Value: 0, Unit: "mph", Display: "0 mph"},
+		MaxDriftDistance:      models.Speed{Value: 350, Unit: "m", Display: "350 m"},
+		MinNumSatellites:      8,
+		IgnoreUnsetMinNumSats: true,
+		MaxHdop:               3.5,
+		DriveTimeout:          models.Speed{Value: 1800, Unit: "s", Display: "30m"},
+		StopTimeout:           models.Speed{Value: 14400, Unit: "s", Display: "4h"},
+		OfflineTimeout:        models.Speed{Value: 3900, Unit: "s", Display: "1h 5m"},
+		HistoryCalcDuration:   models.Speed{Value: 86400, Unit: "s", Display: "24h"},
+		FuelConsumption: models.FuelConsumption{
+			CalculationMethod: "fuel_sensor",
+			Measurement:       "mpg",
+			FuelType:          "",
+			FuelCost:          0,
+			FuelEconomy:       0,
+		},
+		InitialDevicePointDeleteCutoffTime: "2024-06-21T17:45:09.284403Z",
+		EngineHoursCounterConfig:           "best",
+		UseV3EngineHours:                   true,
+		HistoryRetentionDays:               1095,
+		HarshEventMinSpeed:                 models.Speed{Value: 0, Unit: "mph", Display: "0 mph"},
+	}
+}
+
 func (db *MongoDB) SaveDeviceSettings(settings models.DeviceSettings) (models.DeviceSettings, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	// Set current timestamp
-	settings.UpdatedAt = time.Now().Format(time.RFC3339)
+	settings.UpdatedAt = db.Clock.Now().Format(time.RFC3339)
 
 	// Filter to match only device ID
 	filter := bson.M{"device_id": settings.DeviceID}
@@ -346,22 +414,9 @@ func (db *MongoDB) SaveDeviceSettings(settings models.DeviceSettings) (models.De
 	err := collection.FindOne(ctx, filter).Decode(&existingSettings)
 
 	if err == nil { // Existing settings found
-		if settings.Version == 0 {
-			settings.Version = 1
-		} else if settings.Version == existingSettings.Version { // Versions match - check timestamp
-			incomingTimestamp, err := time.Parse(time.RFC3339, settings.UpdatedAt)
-			if err != nil {
-				return models.DeviceSettings{}, fmt.Errorf("invalid incoming timestamp: %w", err)
-			}
-
-			currentTimestamp, err := time.Parse(time.RFC3339, existingSettings.UpdatedAt)
-			if err != nil {
-				return models.DeviceSettings{}, fmt.Errorf("invalid current timestamp: %w", err)
-			}
-
-			if incomingTimestamp.Before(currentTimestamp) || incomingTimestamp.Equal(currentTimestamp) {
-				return existingSettings, nil // Return existing settings without updating - no changes
-			}
+		// Version 0 saves unconditionally, any other version has to be the stored one
+		if settings.Version != 0 && settings.Version != existingSettings.Version {
+			return existingSettings, ErrOutdatedSettingsVersion
 		}
 
 		// Construct update operation - include all relevant fields
@@ -391,14 +446,14 @@ func (db *MongoDB) SaveDeviceSettings(settings models.DeviceSettings) (models.De
 
 		// FindOneAndUpdate handles both updates and inserts
 		opts := options.FindOneAndUpdate().SetReturnDocument(options.After) //Return updated document
-		result := collection.FindOneAndUpdate(ctx, filter, update, opts)
+		versionFilter := bson.M{"device_id": settings.DeviceID, "version": existingSettings.Version}
+		result := collection.FindOneAndUpdate(ctx, versionFilter, update, opts)
 
 		if result.Err() != nil { //Handle error from FindOneAndUpdate
 			if errors.Is(result.Err(), mongo.ErrNoDocuments) {
-				//Handle no document found for whatever reason
-
+				return existingSettings, ErrOutdatedSettingsVersion // Changed between the read and the update
 			}
-			//Handle other database errors
+			return models.DeviceSettings{}, fmt.Errorf("failed to update device settings: %w", result.Err())
 		}
 
 		// Decode updated document and return
@@ -422,8 +477,6 @@ func (db *MongoDB) SaveDeviceSettings(settings models.DeviceSettings) (models.De
 		return models.DeviceSettings{}, fmt.Errorf("failed to get existing settings: %w", err) //Handle or log error
 
 	}
-
-	return settings, nil // Return updated/inserted settings
 }
 
 func (db *MongoDB) GetIconMap() (map[string]string, error) {
@@ -457,3 +510,47 @@ func (db *MongoDB) GetIconMap() (map[string]string, error) {
 
 	return iconMap, nil
 }
+
+// GetAllDeviceSettings returns the settings of every device, keyed by device ID.
+func (db *MongoDB) GetAllDeviceSettings() (map[string]models.DeviceSettings, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.SettingsCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find device settings: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var settingsList []models.DeviceSettings
+	if err := cursor.All(ctx, &settingsList); err != nil {
+		return nil, fmt.Errorf("failed to decode device settings: %w", err)
+	}
+
+	settingsMap := make(map[string]models.DeviceSettings, len(settingsList))
+	for _, settings := range settingsList {
+		settingsMap[settings.DeviceID] = settings
+	}
+	return settingsMap, nil
+}
+
+// GetLatestAccuratePoint returns the stored latest_accurate_device_point of a device, or nil if it has none.
+func (db *MongoDB) GetLatestAccuratePoint(deviceID string) (*models.DevicePoint, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var device struct {
+		Point *models.DevicePoint `bson:"latest_accurate_device_point"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"latest_accurate_device_point": 1})
+	err := collection.FindOne(ctx, bson.M{"device_id": deviceID}, opts).Decode(&device)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get latest accurate point: %w", err)
+	}
+	return device.Point, nil
+}
@@ -0,0 +1,348 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxDevicePageSize is the largest page FindDevices returns.
+const MaxDevicePageSize = 1000
+
+// DeviceSortFields are the fields devices can be sorted by. Each has an index together with _id.
+var DeviceSortFields = []string{"display_name", "device_id", "updated_at", "created_at", "active_state", "make", "online"}
+
+var (
+	ErrInvalidCursor           = errors.New("invalid cursor")
+	ErrDeviceNotFound          = errors.New("device not found")
+	ErrOutdatedDeviceVersion   = errors.New("outdated device version")
+	ErrOutdatedSettingsVersion = errors.New("outdated device settings version")
+	ErrDeviceExists            = errors.New("a device with this device_id already exists")
+)
+
+// fieldPattern matches a (dotted) document field name.
+var fieldPattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// DeviceQuery selects, orders and shapes a page of devices.
+type DeviceQuery struct {
+	DeviceIDs      []string // Restricts the devices to these when not nil
+	GroupID        string   // Devices whose upstream device_groups_id_list contains it, or that are in GroupDeviceIDs
+	GroupDeviceIDs []string // Members of the server-side group GroupID, including its subgroups
+	Online         *bool
+	ActiveStates   []string
+	Makes          []string
+	Search         string       // Case-insensitive substring of display_name
+	UpdatedAfter   time.Time    // Devices whose updated_at is later, ignored when zero
+	BBox           *BoundingBox // Devices whose latest point is inside it, or that are in BBoxDeviceIDs
+	BBoxDeviceIDs  []string     // Devices selected by ID next to the ones selected by position
+	Sort           string       // One of DeviceSortFields, default display_name
+	Descending     bool         // Sort order, _id breaks ties in the same direction
+	Fields         []string     // Projection, _id, device_id and the sort field are always included. Empty returns every field
+	Limit          int64        // Page size, 0 returns every matching device
+	Cursor         string       // NextCursor of the previous page
+}
+
+// BoundingBox is an area of latest point positions, e.g. a map viewport. MinLng > MaxLng
+// describes a box crossing the antimeridian.
+type BoundingBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLng float64 `json:"min_lng"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLng float64 `json:"max_lng"`
+}
+
+// Contains reports whether the point lies inside the box.
+func (b BoundingBox) Contains(lat, lng float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLng <= b.MaxLng {
+		return lng >= b.MinLng && lng <= b.MaxLng
+	}
+	return lng >= b.MinLng || lng <= b.MaxLng
+}
+
+// Validate checks the box coordinates.
+func (b BoundingBox) Validate() error {
+	if b.MinLat > b.MaxLat {
+		return fmt.Errorf("min_lat must not be greater than max_lat")
+	}
+	if b.MinLat < -90 || b.MaxLat > 90 || b.MinLng < -180 || b.MaxLng > 180 {
+		return fmt.Errorf("bounding box is out of range")
+	}
+	return nil
+}
+
+// DevicePage is one page of devices. NextCursor is empty on the last page.
+type DevicePage struct {
+	Devices    []bson.M
+	NextCursor string
+	Total      int64 // Matching devices across all pages
+}
+
+// ValidDeviceField reports whether a name can be used in a device projection.
+func ValidDeviceField(field string) bool {
+	return fieldPattern.MatchString(field)
+}
+
+// FindDevices returns a page of the devices matching the query.
+func (db *MongoDB) FindDevices(query DeviceQuery) (DevicePage, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if query.Sort == "" {
+		query.Sort = "display_name"
+	}
+	filter := deviceFilter(query)
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return DevicePage{}, fmt.Errorf("failed to count devices: %w", err)
+	}
+
+	if query.Cursor != "" {
+		after, err := cursorFilter(query)
+		if err != nil {
+			return DevicePage{}, err
+		}
+		filter = bson.M{"$and": bson.A{filter, after}}
+	}
+
+	direction := 1
+	if query.Descending {
+		direction = -1
+	}
+	opts := options.Find().SetSort(bson.D{{Key: query.Sort, Value: direction}, {Key: "_id", Value: direction}})
+	if len(query.Fields) > 0 {
+		opts.SetProjection(deviceProjection(query.Fields, query.Sort))
+	}
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit + 1) // One more to know whether there is a next page
+	}
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return DevicePage{}, fmt.Errorf("failed to find devices: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	devices := []bson.M{}
+	if err := cursor.All(ctx, &devices); err != nil {
+		return DevicePage{}, fmt.Errorf("failed to decode devices: %w", err)
+	}
+
+	page := DevicePage{Devices: devices, Total: total}
+	if query.Limit > 0 && int64(len(devices)) > query.Limit {
+		page.Devices = devices[:query.Limit]
+		last := page.Devices[len(page.Devices)-1]
+		if page.NextCursor, err = encodeCursor(last[query.Sort], last["_id"]); err != nil {
+			return DevicePage{}, err
+		}
+	}
+	return page, nil
+}
+
+// GetDeviceIDs returns the device_id of every stored device.
+func (db *MongoDB) GetDeviceIDs() ([]string, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	values, err := collection.Distinct(ctx, "device_id", bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device IDs: %w", err)
+	}
+	deviceIDs := make([]string, 0, len(values))
+	for _, value := range values {
+		if deviceID, ok := value.(string); ok {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	return deviceIDs, nil
+}
+
+// DeviceExists reports whether a device with the given device_id is stored.
+func (db *MongoDB) DeviceExists(deviceID string) (bool, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{"device_id": deviceID}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("failed to check device: %w", err)
+	}
+	return count > 0, nil
+}
+
+// InsertDevice stores a new device, or returns ErrDeviceExists if its device_id is taken.
+func (db *MongoDB) InsertDevice(device models.Device) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, device); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDeviceExists
+		}
+		return fmt.Errorf("failed to insert device: %w", err)
+	}
+	return nil
+}
+
+// ReplaceDevice replaces the stored device with the same device_id.
+func (db *MongoDB) ReplaceDevice(device models.Device) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := collection.ReplaceOne(ctx, bson.M{"device_id": device.DeviceID}, device); err != nil {
+		return fmt.Errorf("failed to replace device: %w", err)
+	}
+	return nil
+}
+
+// deviceFilter builds the MongoDB filter of a query, without the cursor.
+func deviceFilter(query DeviceQuery) bson.M {
+	conditions := bson.A{}
+	if query.DeviceIDs != nil {
+		conditions = append(conditions, bson.M{"device_id": bson.M{"$in": query.DeviceIDs}})
+	}
+	if query.GroupID != "" {
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			bson.M{"device_groups_id_list": query.GroupID},
+			bson.M{"device_id": bson.M{"$in": append([]string{}, query.GroupDeviceIDs...)}},
+		}})
+	}
+	if query.Online != nil {
+		conditions = append(conditions, bson.M{"online": *query.Online})
+	}
+	if len(query.ActiveStates) > 0 {
+		conditions = append(conditions, bson.M{"active_state": bson.M{"$in": query.ActiveStates}})
+	}
+	if len(query.Makes) > 0 {
+		conditions = append(conditions, bson.M{"make": bson.M{"$in": query.Makes}})
+	}
+	if query.Search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(query.Search), Options: "i"}
+		conditions = append(conditions, bson.M{"display_name": pattern})
+	}
+	if !query.UpdatedAfter.IsZero() {
+		conditions = append(conditions, bson.M{"updated_at": bson.M{"$gt": query.UpdatedAfter.Format(time.RFC3339)}})
+	}
+	if query.BBox != nil {
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			positionFilter(*query.BBox),
+			bson.M{"device_id": bson.M{"$in": append([]string{}, query.BBoxDeviceIDs...)}},
+		}})
+	}
+	if len(conditions) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": conditions}
+}
+
+// positionFilter selects the devices whose latest point is inside the box, with range conditions
+// on the indexed latest_device_point.lat and lng.
+func positionFilter(box BoundingBox) bson.M {
+	lat := bson.M{"latest_device_point.lat": bson.M{"$gte": box.MinLat, "$lte": box.MaxLat}}
+	if box.MinLng <= box.MaxLng {
+		return bson.M{"$and": bson.A{lat, bson.M{"latest_device_point.lng": bson.M{"$gte": box.MinLng, "$lte": box.MaxLng}}}}
+	}
+	return bson.M{"$and": bson.A{lat, bson.M{"$or": bson.A{
+		bson.M{"latest_device_point.lng": bson.M{"$gte": box.MinLng}},
+		bson.M{"latest_device_point.lng": bson.M{"$lte": box.MaxLng}},
+	}}}}
+}
+
+// cursorFilter selects the devices after the cursor in the sort order. Devices without the sort
+// field sort before all others, so they come first ascending and last descending.
+func cursorFilter(query DeviceQuery) (bson.M, error) {
+	value, id, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	after, idAfter := "$gt", bson.M{"$gt": id}
+	if query.Descending {
+		after, idAfter = "$lt", bson.M{"$lt": id}
+	}
+	if value == nil {
+		sameValue := bson.M{query.Sort: nil, "_id": idAfter}
+		if query.Descending {
+			return sameValue, nil
+		}
+		return bson.M{"$or": bson.A{sameValue, bson.M{query.Sort: bson.M{"$ne": nil}}}}, nil
+	}
+
+	next := bson.A{
+		bson.M{query.Sort: bson.M{after: value}},
+		bson.M{query.Sort: value, "_id": idAfter},
+	}
+	if query.Descending {
+		next = append(next, bson.M{query.Sort: nil})
+	}
+	return bson.M{"$or": next}, nil
+}
+
+// deviceProjection includes the requested fields plus the ones needed for scoping and paging.
+// Fields inside an already included field are dropped, MongoDB rejects such path collisions.
+func deviceProjection(fields []string, sortField string) bson.M {
+	fields = append([]string{"_id", "device_id", sortField}, fields...)
+	projection := bson.M{}
+	for _, field := range fields {
+		covered := false
+		for other := range projection {
+			if field == other || strings.HasPrefix(field, other+".") {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		for other := range projection {
+			if strings.HasPrefix(other, field+".") {
+				delete(projection, other)
+			}
+		}
+		projection[field] = 1
+	}
+	return projection
+}
+
+// encodeCursor packs the sort value and _id of the last device of a page. Extended JSON keeps
+// the BSON types, so the values compare the same way when the cursor comes back.
+func encodeCursor(value, id interface{}) (string, error) {
+	data, err := bson.MarshalExtJSON(bson.M{"v": value, "id": id}, true, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string) (value, id interface{}, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, nil, ErrInvalidCursor
+	}
+	var fields bson.M
+	if err := bson.UnmarshalExtJSON(data, true, &fields); err != nil {
+		return nil, nil, ErrInvalidCursor
+	}
+	id, ok := fields["id"]
+	if !ok {
+		return nil, nil, ErrInvalidCursor
+	}
+	return fields["v"], id, nil
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrGeofenceNotFound        = errors.New("geofence not found")
+	ErrOutdatedGeofenceVersion = errors.New("outdated geofence version")
+)
+
+// GetGeofences returns every geofence, ordered by name.
+func (db *MongoDB) GetGeofences() ([]models.Geofence, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GeofenceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find geofences: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	geofences := []models.Geofence{}
+	if err := cursor.All(ctx, &geofences); err != nil {
+		return nil, fmt.Errorf("failed to decode geofences: %w", err)
+	}
+	return geofences, nil
+}
+
+// GetGeofence returns a geofence by ID.
+func (db *MongoDB) GetGeofence(id string) (models.Geofence, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GeofenceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var geofence models.Geofence
+	if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&geofence); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.Geofence{}, ErrGeofenceNotFound
+		}
+		return models.Geofence{}, fmt.Errorf("failed to get geofence: %w", err)
+	}
+	return geofence, nil
+}
+
+// CreateGeofence inserts a new geofence with a generated ID.
+func (db *MongoDB) CreateGeofence(geofence models.Geofence) (models.Geofence, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GeofenceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	geofence.ID = primitive.NewObjectID().Hex()
+	geofence.Version = 1
+	geofence.CreatedAt = now
+	geofence.UpdatedAt = now
+	if _, err := collection.InsertOne(ctx, geofence); err != nil {
+		return models.Geofence{}, fmt.Errorf("failed to create geofence: %w", err)
+	}
+	return geofence, nil
+}
+
+// UpdateGeofence replaces a geofence if its stored version still matches geofence.Version.
+// On a version mismatch the stored geofence is returned with ErrOutdatedGeofenceVersion.
+func (db *MongoDB) UpdateGeofence(geofence models.Geofence) (models.Geofence, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GeofenceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	existing, err := db.GetGeofence(geofence.ID)
+	if err != nil {
+		return models.Geofence{}, err
+	}
+
+	if existing.Version != geofence.Version {
+		return existing, ErrOutdatedGeofenceVersion
+	}
+
+	filter := bson.M{"_id": geofence.ID, "version": geofence.Version}
+	geofence.CreatedAt = existing.CreatedAt
+	geofence.UpdatedAt = time.Now().UTC()
+	geofence.Version++
+	result, err := collection.ReplaceOne(ctx, filter, geofence)
+	if err != nil {
+		return models.Geofence{}, fmt.Errorf("failed to update geofence: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return existing, ErrOutdatedGeofenceVersion // Changed between the read and the replace
+	}
+	return geofence, nil
+}
+
+// DeleteGeofence deletes a geofence. Its events are kept.
+func (db *MongoDB) DeleteGeofence(id string) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GeofenceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete geofence: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrGeofenceNotFound
+	}
+	return nil
+}
+
+// SaveGeofenceEvent inserts or replaces a geofence event. Event IDs are derived from the
+// device, geofence, type and time, so reprocessing the same points does not create duplicates.
+func (db *MongoDB) SaveGeofenceEvent(event models.GeofenceEvent) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GeofenceEventCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": event.ID}, event, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save geofence event: %w", err)
+	}
+	return nil
+}
+
+// GetGeofenceEvents returns the geofence events with from <= time <= to, oldest first, optionally
+// limited to one device and/or one geofence.
+func (db *MongoDB) GetGeofenceEvents(deviceID, geofenceID string, from, to time.Time) ([]models.GeofenceEvent, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GeofenceEventCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"time": bson.M{"$gte": from, "$lte": to}}
+	if deviceID != "" {
+		filter["device_id"] = deviceID
+	}
+	if geofenceID != "" {
+		filter["geofence_id"] = geofenceID
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "time", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find geofence events: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	geofenceEvents := []models.GeofenceEvent{}
+	if err := cursor.All(ctx, &geofenceEvents); err != nil {
+		return nil, fmt.Errorf("failed to decode geofence events: %w", err)
+	}
+	return geofenceEvents, nil
+}
+
+// GetLatestGeofenceEvents returns the newest event of a device for each geofence, keyed by geofence ID.
+func (db *MongoDB) GetLatestGeofenceEvents(deviceID string) (map[string]models.GeofenceEvent, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GeofenceEventCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"device_id": deviceID}}},
+		{{Key: "$sort", Value: bson.D{{Key: "time", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$geofence_id", "event": bson.M{"$first": "$$ROOT"}}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate geofence events: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Event models.GeofenceEvent `bson:"event"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode geofence events: %w", err)
+	}
+
+	latest := make(map[string]models.GeofenceEvent, len(results))
+	for _, result := range results {
+		latest[result.Event.GeofenceID] = result.Event
+	}
+	return latest, nil
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrGroupNotFound        = errors.New("device group not found")
+	ErrOutdatedGroupVersion = errors.New("outdated device group version")
+	ErrGroupHasChildren     = errors.New("device group has subgroups")
+)
+
+// GetDeviceGroups returns every device group, ordered by name.
+func (db *MongoDB) GetDeviceGroups() ([]models.DeviceGroup, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GroupCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find device groups: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	groups := []models.DeviceGroup{}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, fmt.Errorf("failed to decode device groups: %w", err)
+	}
+	return groups, nil
+}
+
+// GetDeviceGroup returns a device group by ID.
+func (db *MongoDB) GetDeviceGroup(id string) (models.DeviceGroup, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GroupCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var group models.DeviceGroup
+	if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&group); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.DeviceGroup{}, ErrGroupNotFound
+		}
+		return models.DeviceGroup{}, fmt.Errorf("failed to get device group: %w", err)
+	}
+	return group, nil
+}
+
+// CreateDeviceGroup inserts a new device group with a generated ID.
+func (db *MongoDB) CreateDeviceGroup(group models.DeviceGroup) (models.DeviceGroup, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GroupCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	group.ID = primitive.NewObjectID().Hex()
+	group.Version = 1
+	group.CreatedAt = now
+	group.UpdatedAt = now
+	if group.DeviceIDs == nil {
+		group.DeviceIDs = []string{}
+	}
+	if _, err := collection.InsertOne(ctx, group); err != nil {
+		return models.DeviceGroup{}, fmt.Errorf("failed to create device group: %w", err)
+	}
+	return group, nil
+}
+
+// UpdateDeviceGroup replaces a device group if its stored version still matches group.Version.
+// On a version mismatch the stored group is returned with ErrOutdatedGroupVersion.
+func (db *MongoDB) UpdateDeviceGroup(group models.DeviceGroup) (models.DeviceGroup, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GroupCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	existing, err := db.GetDeviceGroup(group.ID)
+	if err != nil {
+		return models.DeviceGroup{}, err
+	}
+
+	if existing.Version != group.Version {
+		return existing, ErrOutdatedGroupVersion
+	}
+
+	filter := bson.M{"_id": group.ID, "version": group.Version}
+	group.CreatedAt = existing.CreatedAt
+	group.UpdatedAt = time.Now().UTC()
+	group.Version++
+	if group.DeviceIDs == nil {
+		group.DeviceIDs = []string{}
+	}
+	result, err := collection.ReplaceOne(ctx, filter, group)
+	if err != nil {
+		return models.DeviceGroup{}, fmt.Errorf("failed to update device group: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return existing, ErrOutdatedGroupVersion // Changed between the read and the replace
+	}
+	return group, nil
+}
+
+// AddDevicesToGroup adds devices to a group, ignoring the ones already in it.
+func (db *MongoDB) AddDevicesToGroup(id string, deviceIDs []string) (models.DeviceGroup, error) {
+	update := bson.M{"$addToSet": bson.M{"device_ids": bson.M{"$each": deviceIDs}}}
+	return db.changeGroupDevices(id, update)
+}
+
+// RemoveDeviceFromGroup removes a device from a group. Removing a device that is not in it is not an error.
+func (db *MongoDB) RemoveDeviceFromGroup(id, deviceID string) (models.DeviceGroup, error) {
+	update := bson.M{"$pull": bson.M{"device_ids": deviceID}}
+	return db.changeGroupDevices(id, update)
+}
+
+// changeGroupDevices applies a membership update to a group and bumps its version.
+func (db *MongoDB) changeGroupDevices(id string, update bson.M) (models.DeviceGroup, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GroupCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update["$set"] = bson.M{"updated_at": time.Now().UTC()}
+	update["$inc"] = bson.M{"version": 1}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var group models.DeviceGroup
+	if err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&group); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.DeviceGroup{}, ErrGroupNotFound
+		}
+		return models.DeviceGroup{}, fmt.Errorf("failed to update device group: %w", err)
+	}
+	return group, nil
+}
+
+// DeleteDeviceGroup deletes a device group. Groups with subgroups cannot be deleted. Geofences and
+// alert rules targeting the group keep its ID and no longer match any device through it.
+func (db *MongoDB) DeleteDeviceGroup(id string) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.GroupCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	children, err := collection.CountDocuments(ctx, bson.M{"parent_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to count subgroups: %w", err)
+	}
+	if children > 0 {
+		return ErrGroupHasChildren
+	}
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete device group: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrGroupNotFound
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// createHistoryCollectionIfNotExists creates the device point history as a MongoDB time-series
+// collection (MongoDB 5.0+), bucketed by device_id and ordered by dt_tracker.
+func createHistoryCollectionIfNotExists(db *mongo.Database, collectionName string) error {
+	list, err := db.ListCollectionNames(context.TODO(), bson.M{"name": collectionName})
+	if err != nil {
+		return fmt.Errorf("failed to list collection names: %w", err)
+	}
+	if len(list) > 0 {
+		return nil
+	}
+
+	tsOpts := options.TimeSeries().
+		SetTimeField("dt_tracker").
+		SetMetaField("device_id").
+		SetGranularity("seconds")
+	if err := db.CreateCollection(context.TODO(), collectionName, options.CreateCollection().SetTimeSeriesOptions(tsOpts)); err != nil {
+		return fmt.Errorf("failed to create time-series collection: %w", err)
+	}
+	log.Printf("Created time-series collection %s", collectionName)
+	return nil
+}
+
+// AppendDevicePoint stores a point in the history unless a point with the same device_point_id
+// and dt_tracker was already stored. It reports whether the point was inserted.
+func (db *MongoDB) AppendDevicePoint(record models.DevicePointRecord) (bool, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.HistoryCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"device_id":       record.DeviceID,
+		"device_point_id": record.DevicePointID,
+		"dt_tracker":      record.DtTracker,
+	}
+	count, err := collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("failed to check for existing device point: %w", err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	if _, err := collection.InsertOne(ctx, record); err != nil {
+		return false, fmt.Errorf("failed to insert device point: %w", err)
+	}
+	return true, nil
+}
+
+// GetDeviceHistory returns the points of a device with from <= dt_tracker <= to, oldest first.
+// A limit of 0 returns every point in the range. When accurate is set, only points with that
+// quality flag are returned (points recorded before quality checks existed count as accurate).
+func (db *MongoDB) GetDeviceHistory(deviceID string, from, to time.Time, limit int64, accurate *bool) ([]models.DevicePointRecord, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.HistoryCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"device_id":  deviceID,
+		"dt_tracker": bson.M{"$gte": from, "$lte": to},
+	}
+	if accurate != nil {
+		if *accurate {
+			filter["accurate"] = bson.M{"$ne": false}
+		} else {
+			filter["accurate"] = false
+		}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "dt_tracker", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find device history: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	points := []models.DevicePointRecord{}
+	if err := cursor.All(ctx, &points); err != nil {
+		return nil, fmt.Errorf("failed to decode device history: %w", err)
+	}
+	return points, nil
+}
+
+// GetHistoryDeviceIDs returns the ids of all devices that have recorded points.
+func (db *MongoDB) GetHistoryDeviceIDs() ([]string, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.HistoryCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	values, err := collection.Distinct(ctx, "device_id", bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history devices: %w", err)
+	}
+
+	deviceIDs := make([]string, 0, len(values))
+	for _, value := range values {
+		if deviceID, ok := value.(string); ok {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	return deviceIDs, nil
+}
+
+// CountDevicePointsBefore counts the points of a device recorded before the cutoff.
+func (db *MongoDB) CountDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.HistoryCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{"device_id": deviceID, "dt_tracker": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count device points: %w", err)
+	}
+	return count, nil
+}
+
+// DeleteDevicePointsBefore removes the points of a device recorded before the cutoff.
+// Deleting by dt_tracker on a time-series collection requires MongoDB 7.0+.
+func (db *MongoDB) DeleteDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.HistoryCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	result, err := collection.DeleteMany(ctx, bson.M{"device_id": deviceID, "dt_tracker": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete device points: %w", err)
+	}
+	return result.DeletedCount, nil
+}
@@ -0,0 +1,390 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Memory is a Repository that keeps everything in the process. Nothing survives a restart, it is
+// meant for running the server and mock mode without MongoDB, and for tests.
+//
+// Documents go through the same BSON encoding as with MongoDB, so devices come back as bson.M with
+// the same types and times are truncated to milliseconds in UTC.
+type Memory struct {
+	Clock clock.Clock // Time of settings updates and of the _id of new devices
+
+	mu sync.RWMutex
+
+	devices       []bson.M // Insertion order, like a collection scan
+	settings      map[string]models.DeviceSettings
+	preferences   map[string]models.UserPreferences
+	history       map[string][]models.DevicePointRecord // Per device, ordered by dt_tracker
+	users         map[string]models.User
+	sessions      map[string]models.Session
+	groups        map[string]models.DeviceGroup
+	geofences     map[string]models.Geofence
+	geofenceEvent map[string]models.GeofenceEvent
+	alertRules    map[string]models.AlertRule
+	alerts        map[string]models.Alert
+	trips         map[string]models.Trip
+	stops         map[string]models.Stop
+	availability  []models.AvailabilityEvent
+	deliveries    map[string]models.NotificationDelivery
+}
+
+// NewMemory creates an empty in-memory repository.
+func NewMemory() *Memory {
+	return &Memory{
+		Clock:         clock.System,
+		settings:      make(map[string]models.DeviceSettings),
+		preferences:   make(map[string]models.UserPreferences),
+		history:       make(map[string][]models.DevicePointRecord),
+		users:         make(map[string]models.User),
+		sessions:      make(map[string]models.Session),
+		groups:        make(map[string]models.DeviceGroup),
+		geofences:     make(map[string]models.Geofence),
+		geofenceEvent: make(map[string]models.GeofenceEvent),
+		alertRules:    make(map[string]models.AlertRule),
+		alerts:        make(map[string]models.Alert),
+		trips:         make(map[string]models.Trip),
+		stops:         make(map[string]models.Stop),
+		deliveries:    make(map[string]models.NotificationDelivery),
+	}
+}
+
+// clone copies src into dst through BSON, which deep copies it and normalizes it the way a
+// MongoDB round trip would.
+func clone(src, dst interface{}) error {
+	data, err := bson.Marshal(src)
+	if err != nil {
+		return fmt.Errorf("failed to encode document: %w", err)
+	}
+	if err := bson.Unmarshal(data, dst); err != nil {
+		return fmt.Errorf("failed to decode document: %w", err)
+	}
+	return nil
+}
+
+// deviceObjectID generates the _id of a new device from the time it is stored and its device_id
+// instead of randomly, so a mock session replayed on a virtual clock stores its devices under the
+// same _ids.
+func deviceObjectID(deviceID string, at time.Time) primitive.ObjectID {
+	id := primitive.NewObjectIDFromTimestamp(at)
+	hash := fnv.New64a()
+	hash.Write([]byte(deviceID))
+	binary.BigEndian.PutUint64(id[4:], hash.Sum64())
+	return id
+}
+
+// findDevice returns the index of the device with the given field value, or -1.
+func (m *Memory) findDevice(field string, value interface{}) int {
+	for i, device := range m.devices {
+		if device[field] == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetDeviceIDs returns the device_id of every stored device.
+func (m *Memory) GetDeviceIDs() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := make(map[string]bool, len(m.devices))
+	deviceIDs := make([]string, 0, len(m.devices))
+	for _, device := range m.devices {
+		if deviceID, ok := device["device_id"].(string); ok && !seen[deviceID] {
+			seen[deviceID] = true
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	return deviceIDs, nil
+}
+
+// DeviceExists reports whether a device with the given device_id is stored.
+func (m *Memory) DeviceExists(deviceID string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.findDevice("device_id", deviceID) >= 0, nil
+}
+
+// InsertDevice stores a new device, with a generated _id if it has none. The device_id must be unused.
+func (m *Memory) InsertDevice(device models.Device) error {
+	var doc bson.M
+	if err := clone(device, &doc); err != nil {
+		return fmt.Errorf("failed to insert device: %w", err)
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = deviceObjectID(device.DeviceID, m.Clock.Now())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.findDevice("device_id", device.DeviceID) >= 0 {
+		return ErrDeviceExists
+	}
+	if m.findDevice("_id", doc["_id"]) >= 0 {
+		return fmt.Errorf("failed to insert device: duplicate _id %v", doc["_id"])
+	}
+	m.devices = append(m.devices, doc)
+	return nil
+}
+
+// ReplaceDevice replaces the stored device with the same device_id, keeping its _id.
+func (m *Memory) ReplaceDevice(device models.Device) error {
+	var doc bson.M
+	if err := clone(device, &doc); err != nil {
+		return fmt.Errorf("failed to replace device: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findDevice("device_id", device.DeviceID)
+	if i < 0 {
+		return nil // Like ReplaceOne without upsert
+	}
+	doc["_id"] = m.devices[i]["_id"]
+	m.devices[i] = doc
+	return nil
+}
+
+// UpdateDevice sets the given fields on a device if its version matches and increments the version.
+func (m *Memory) UpdateDevice(deviceID primitive.ObjectID, updatedDevice map[string]interface{}, deviceVersion int) error {
+	fields := bson.M{}
+	for k, v := range updatedDevice {
+		if k != "_id" && k != "version" {
+			fields[k] = v
+		}
+	}
+	var set bson.M
+	if err := clone(fields, &set); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findDevice("_id", deviceID)
+	if i < 0 || !numberEquals(m.devices[i]["version"], deviceVersion) {
+		return ErrOutdatedDeviceVersion
+	}
+	for path, value := range set {
+		setPath(m.devices[i], path, value)
+	}
+	m.devices[i]["version"] = incrementNumber(m.devices[i]["version"])
+	return nil
+}
+
+// UpdateDeviceIconURL sets the iconUrl field of a device.
+func (m *Memory) UpdateDeviceIconURL(deviceID primitive.ObjectID, iconURL string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findDevice("_id", deviceID)
+	if i < 0 || m.devices[i]["iconUrl"] == iconURL {
+		return fmt.Errorf("device not found or iconURL not updated")
+	}
+	m.devices[i]["iconUrl"] = iconURL
+	return nil
+}
+
+// SetDeviceOnline updates the online flag and updated_at of a device and returns it, or nil if it is not stored.
+func (m *Memory) SetDeviceOnline(deviceID string, online bool, updatedAt time.Time) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findDevice("device_id", deviceID)
+	if i < 0 {
+		return nil, nil
+	}
+	m.devices[i]["online"] = online
+	m.devices[i]["updated_at"] = updatedAt.Format(time.RFC3339)
+
+	var device map[string]interface{}
+	if err := clone(m.devices[i], &device); err != nil {
+		return nil, fmt.Errorf("failed to set device online status: %w", err)
+	}
+	return device, nil
+}
+
+// GetLatestAccuratePoint returns the stored latest_accurate_device_point of a device, or nil if it has none.
+func (m *Memory) GetLatestAccuratePoint(deviceID string) (*models.DevicePoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i := m.findDevice("device_id", deviceID)
+	if i < 0 {
+		return nil, nil
+	}
+	var device struct {
+		Point *models.DevicePoint `bson:"latest_accurate_device_point"`
+	}
+	if err := clone(m.devices[i], &device); err != nil {
+		return nil, fmt.Errorf("failed to get latest accurate point: %w", err)
+	}
+	return device.Point, nil
+}
+
+// GetDeviceOwners returns the upstream user_id_list of every device, keyed by device_id, and the
+// device_id of every _id (hex).
+func (m *Memory) GetDeviceOwners() (owners map[string][]string, objectIDs map[string]string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	owners = make(map[string][]string, len(m.devices))
+	objectIDs = make(map[string]string, len(m.devices))
+	for _, doc := range m.devices {
+		var device struct {
+			ID         primitive.ObjectID `bson:"_id"`
+			DeviceID   string             `bson:"device_id"`
+			UserIDList []string           `bson:"user_id_list"`
+		}
+		if err := clone(doc, &device); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode device owners: %w", err)
+		}
+		owners[device.DeviceID] = device.UserIDList
+		objectIDs[device.ID.Hex()] = device.DeviceID
+	}
+	return owners, objectIDs, nil
+}
+
+// ClearCollections removes every device and all user preferences.
+func (m *Memory) ClearCollections() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.devices = nil
+	m.preferences = make(map[string]models.UserPreferences)
+	return nil
+}
+
+// GetDeviceSettings returns the settings of a device, storing DefaultDeviceSettings if it has none.
+func (m *Memory) GetDeviceSettings(deviceID string) (models.DeviceSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	settings, ok := m.settings[deviceID]
+	if !ok {
+		settings = DefaultDeviceSettings(deviceID, m.Clock.Now())
+		m.settings[deviceID] = settings
+	}
+	return settings, nil
+}
+
+// SaveDeviceSettings stores the settings of a device. It follows MongoDB.SaveDeviceSettings: a
+// save with another non-zero version returns the stored settings with ErrOutdatedSettingsVersion,
+// anything else overwrites them and increments the version.
+func (m *Memory) SaveDeviceSettings(settings models.DeviceSettings) (models.DeviceSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	settings.UpdatedAt = m.Clock.Now().Format(time.RFC3339)
+	existing, ok := m.settings[settings.DeviceID]
+	if !ok {
+		settings.Version = 1
+		m.settings[settings.DeviceID] = settings
+		return settings, nil
+	}
+	if settings.Version != 0 && settings.Version != existing.Version {
+		return existing, ErrOutdatedSettingsVersion
+	}
+
+	settings.Version = existing.Version + 1
+	m.settings[settings.DeviceID] = settings
+	return settings, nil
+}
+
+// GetAllDeviceSettings returns the settings of every device, keyed by device ID.
+func (m *Memory) GetAllDeviceSettings() (map[string]models.DeviceSettings, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	settingsMap := make(map[string]models.DeviceSettings, len(m.settings))
+	for deviceID, settings := range m.settings {
+		settingsMap[deviceID] = settings
+	}
+	return settingsMap, nil
+}
+
+// GetIconMap returns the icon URL of every device with settings, keyed by device ID.
+func (m *Memory) GetIconMap() (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	iconMap := make(map[string]string, len(m.settings))
+	for deviceID, settings := range m.settings {
+		iconMap[deviceID] = settings.IconURL
+	}
+	return iconMap, nil
+}
+
+// GetUserPreferences returns the preferences of a user, or ErrPreferencesNotFound.
+func (m *Memory) GetUserPreferences(userID string) (models.UserPreferences, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	prefs, ok := m.preferences[userID]
+	if !ok {
+		return models.UserPreferences{}, ErrPreferencesNotFound
+	}
+	return prefs, nil
+}
+
+// SaveUserPreferences stores the preferences of a user if prefs.Version matches the stored version.
+// Otherwise the stored preferences are returned with ErrOutdatedVersion.
+func (m *Memory) SaveUserPreferences(prefs models.UserPreferences) (models.UserPreferences, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.preferences[prefs.UserID]
+	if !ok {
+		prefs.Version = 1
+	} else if existing.Version != prefs.Version {
+		return existing, ErrOutdatedVersion
+	} else {
+		prefs.Version++
+	}
+	m.preferences[prefs.UserID] = prefs
+	return prefs, nil
+}
+
+// numberEquals compares a stored BSON number with an int. Missing fields never match.
+func numberEquals(value interface{}, n int) bool {
+	switch v := value.(type) {
+	case int32:
+		return int(v) == n
+	case int64:
+		return v == int64(n)
+	case float64:
+		return v == float64(n)
+	}
+	return false
+}
+
+// incrementNumber is $inc by one. A missing field becomes 1.
+func incrementNumber(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int32:
+		return v + 1
+	case int64:
+		return v + 1
+	case float64:
+		return v + 1
+	}
+	return int32(1)
+}
+
+// setPath is $set for a possibly dotted field name, creating the intermediate documents.
+func setPath(doc bson.M, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(bson.M)
+		if !ok {
+			next = bson.M{}
+			doc[part] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = value
+}
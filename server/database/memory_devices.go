@@ -0,0 +1,293 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FindDevices returns a page of the devices matching the query, with the same filters, order,
+// projection and cursors as MongoDB.FindDevices.
+func (m *Memory) FindDevices(query DeviceQuery) (DevicePage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return findDevicePage(m.devices, query)
+}
+
+// findDevicePage evaluates a device query on stored documents in insertion order. The documents
+// are not modified, the page holds copies.
+func findDevicePage(devices []bson.M, query DeviceQuery) (DevicePage, error) {
+	if query.Sort == "" {
+		query.Sort = "display_name"
+	}
+	direction := 1
+	if query.Descending {
+		direction = -1
+	}
+
+	var afterValue, afterID interface{}
+	if query.Cursor != "" {
+		var err error
+		if afterValue, afterID, err = decodeCursor(query.Cursor); err != nil {
+			return DevicePage{}, err
+		}
+	}
+
+	var matching []bson.M
+	for _, device := range devices {
+		if deviceMatches(device, query) {
+			matching = append(matching, device)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return compareDevices(matching[i], matching[j], query.Sort)*direction < 0
+	})
+
+	page := DevicePage{Devices: []bson.M{}, Total: int64(len(matching))}
+	for _, device := range matching {
+		if query.Cursor != "" && compareSortKeys(device[query.Sort], device["_id"], afterValue, afterID)*direction <= 0 {
+			continue
+		}
+		if query.Limit > 0 && int64(len(page.Devices)) == query.Limit {
+			last := page.Devices[len(page.Devices)-1]
+			var err error
+			if page.NextCursor, err = encodeCursor(last[query.Sort], last["_id"]); err != nil {
+				return DevicePage{}, err
+			}
+			break
+		}
+		var doc bson.M
+		if err := clone(device, &doc); err != nil {
+			return DevicePage{}, fmt.Errorf("failed to decode devices: %w", err)
+		}
+		if len(query.Fields) > 0 {
+			doc = projectDevice(doc, deviceProjection(query.Fields, query.Sort))
+		}
+		page.Devices = append(page.Devices, doc)
+	}
+	return page, nil
+}
+
+// deviceMatches is deviceFilter evaluated on a stored device.
+func deviceMatches(device bson.M, query DeviceQuery) bool {
+	deviceID, _ := device["device_id"].(string)
+	if query.DeviceIDs != nil && !containsString(query.DeviceIDs, deviceID) {
+		return false
+	}
+	if query.GroupID != "" && !fieldContains(device["device_groups_id_list"], query.GroupID) && !containsString(query.GroupDeviceIDs, deviceID) {
+		return false
+	}
+	if query.Online != nil && device["online"] != *query.Online {
+		return false
+	}
+	if len(query.ActiveStates) > 0 && !fieldIn(device["active_state"], query.ActiveStates) {
+		return false
+	}
+	if len(query.Makes) > 0 && !fieldIn(device["make"], query.Makes) {
+		return false
+	}
+	if query.Search != "" {
+		name, ok := device["display_name"].(string)
+		if !ok || !strings.Contains(strings.ToLower(name), strings.ToLower(query.Search)) {
+			return false
+		}
+	}
+	if !query.UpdatedAfter.IsZero() {
+		updatedAt, ok := device["updated_at"].(string)
+		if !ok || updatedAt <= query.UpdatedAfter.Format(time.RFC3339) {
+			return false
+		}
+	}
+	if query.BBox != nil && !containsString(query.BBoxDeviceIDs, deviceID) {
+		lat, lng, ok := devicePosition(device)
+		if !ok || !query.BBox.Contains(lat, lng) {
+			return false
+		}
+	}
+	return true
+}
+
+// devicePosition returns the lat and lng of a device's latest point, false if it has none.
+func devicePosition(device bson.M) (float64, float64, bool) {
+	point, _ := device["latest_device_point"].(bson.M)
+	lat, latOK := toFloat(point["lat"])
+	lng, lngOK := toFloat(point["lng"])
+	return lat, lng, latOK && lngOK
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldContains matches like {field: value} in MongoDB: the field equals value or is an array containing it.
+func fieldContains(field interface{}, value string) bool {
+	if list, ok := field.(primitive.A); ok {
+		for _, item := range list {
+			if item == value {
+				return true
+			}
+		}
+		return false
+	}
+	return field == value
+}
+
+// fieldIn matches like {field: {$in: values}} in MongoDB.
+func fieldIn(field interface{}, values []string) bool {
+	for _, value := range values {
+		if fieldContains(field, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareDevices orders two devices by the sort field, then by _id.
+func compareDevices(a, b bson.M, sortField string) int {
+	return compareSortKeys(a[sortField], a["_id"], b[sortField], b["_id"])
+}
+
+func compareSortKeys(aValue, aID, bValue, bID interface{}) int {
+	if c := compareValues(aValue, bValue); c != 0 {
+		return c
+	}
+	return compareValues(aID, bID)
+}
+
+// compareValues orders values the way MongoDB sorts them: missing and null first, then numbers,
+// strings, documents, arrays, ObjectIDs, booleans and dates.
+func compareValues(a, b interface{}) int {
+	if rank(a) != rank(b) {
+		if rank(a) < rank(b) {
+			return -1
+		}
+		return 1
+	}
+	switch av := a.(type) {
+	case string:
+		return strings.Compare(av, b.(string))
+	case primitive.ObjectID:
+		bv := b.(primitive.ObjectID)
+		return bytes.Compare(av[:], bv[:])
+	case bool:
+		if av == b.(bool) {
+			return 0
+		}
+		if !av {
+			return -1
+		}
+		return 1
+	case primitive.DateTime:
+		return compareFloats(float64(av), float64(b.(primitive.DateTime)))
+	}
+	if an, ok := toFloat(a); ok {
+		bn, _ := toFloat(b)
+		return compareFloats(an, bn)
+	}
+	return 0 // Documents and arrays are not used as sort fields
+}
+
+func rank(value interface{}) int {
+	switch value.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 0
+	case int32, int64, float64, primitive.Decimal128:
+		return 1
+	case string, primitive.Symbol:
+		return 2
+	case bson.M, bson.D:
+		return 3
+	case primitive.A:
+		return 4
+	case primitive.Binary:
+		return 5
+	case primitive.ObjectID:
+		return 6
+	case bool:
+		return 7
+	case primitive.DateTime:
+		return 8
+	}
+	return 9
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// projectDevice keeps the fields of an inclusion projection built by deviceProjection.
+func projectDevice(device bson.M, projection bson.M) bson.M {
+	projected := bson.M{}
+	for path := range projection {
+		copyPath(device, projected, strings.Split(path, "."))
+	}
+	return projected
+}
+
+// copyPath copies a dotted field from src to dst. Like MongoDB, a path through an array projects
+// the field of every document in it.
+func copyPath(src, dst bson.M, parts []string) {
+	value, ok := src[parts[0]]
+	if !ok {
+		return
+	}
+	if len(parts) == 1 {
+		dst[parts[0]] = value
+		return
+	}
+	switch v := value.(type) {
+	case bson.M:
+		next, ok := dst[parts[0]].(bson.M)
+		if !ok {
+			next = bson.M{}
+			dst[parts[0]] = next
+		}
+		copyPath(v, next, parts[1:])
+	case primitive.A:
+		existing, _ := dst[parts[0]].(primitive.A)
+		list := primitive.A{}
+		for _, item := range v {
+			doc, ok := item.(bson.M)
+			if !ok {
+				continue
+			}
+			next := bson.M{}
+			if len(list) < len(existing) {
+				if previous, ok := existing[len(list)].(bson.M); ok {
+					next = previous
+				}
+			}
+			copyPath(doc, next, parts[1:])
+			list = append(list, next)
+		}
+		dst[parts[0]] = list
+	}
+}
@@ -0,0 +1,1029 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// storedTime is a time as MongoDB stores it, in milliseconds, so range queries include and
+// exclude the same documents.
+func storedTime(t time.Time) time.Time {
+	return time.UnixMilli(t.UnixMilli()).UTC()
+}
+
+// inRange reports whether from <= t <= to.
+func inRange(t, from, to time.Time) bool {
+	return !t.Before(storedTime(from)) && !t.After(storedTime(to))
+}
+
+// AppendDevicePoint stores a point in the history unless a point with the same device_point_id
+// and dt_tracker was already stored. It reports whether the point was inserted.
+func (m *Memory) AppendDevicePoint(record models.DevicePointRecord) (bool, error) {
+	var stored models.DevicePointRecord
+	if err := clone(record, &stored); err != nil {
+		return false, fmt.Errorf("failed to insert device point: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	points := m.history[stored.DeviceID]
+	for _, point := range points {
+		if point.DevicePointID == stored.DevicePointID && point.DtTracker.Equal(stored.DtTracker) {
+			return false, nil
+		}
+	}
+	i := sort.Search(len(points), func(i int) bool { return points[i].DtTracker.After(stored.DtTracker) })
+	points = append(points, models.DevicePointRecord{})
+	copy(points[i+1:], points[i:])
+	points[i] = stored
+	m.history[stored.DeviceID] = points
+	return true, nil
+}
+
+// GetDeviceHistory returns the points of a device with from <= dt_tracker <= to, oldest first.
+// A limit of 0 returns every point in the range. When accurate is set, only points with that
+// quality flag are returned.
+func (m *Memory) GetDeviceHistory(deviceID string, from, to time.Time, limit int64, accurate *bool) ([]models.DevicePointRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	points := []models.DevicePointRecord{}
+	for _, point := range m.history[deviceID] {
+		if limit > 0 && int64(len(points)) == limit {
+			break
+		}
+		if !inRange(point.DtTracker, from, to) || (accurate != nil && point.Accurate != *accurate) {
+			continue
+		}
+		var record models.DevicePointRecord
+		if err := clone(point, &record); err != nil {
+			return nil, fmt.Errorf("failed to decode device history: %w", err)
+		}
+		points = append(points, record)
+	}
+	return points, nil
+}
+
+// GetHistoryDeviceIDs returns the ids of all devices that have recorded points.
+func (m *Memory) GetHistoryDeviceIDs() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deviceIDs := make([]string, 0, len(m.history))
+	for deviceID, points := range m.history {
+		if len(points) > 0 {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	sort.Strings(deviceIDs)
+	return deviceIDs, nil
+}
+
+// CountDevicePointsBefore counts the points of a device recorded before the cutoff.
+func (m *Memory) CountDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(m.pointsBefore(deviceID, cutoff)), nil
+}
+
+// DeleteDevicePointsBefore removes the points of a device recorded before the cutoff.
+func (m *Memory) DeleteDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.pointsBefore(deviceID, cutoff)
+	m.history[deviceID] = append([]models.DevicePointRecord(nil), m.history[deviceID][n:]...)
+	return int64(n), nil
+}
+
+// pointsBefore returns the number of points of a device before the cutoff, they are the first ones.
+func (m *Memory) pointsBefore(deviceID string, cutoff time.Time) int {
+	points := m.history[deviceID]
+	cutoff = storedTime(cutoff)
+	return sort.Search(len(points), func(i int) bool { return !points[i].DtTracker.Before(cutoff) })
+}
+
+// CountUsers returns the number of accounts.
+func (m *Memory) CountUsers() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.users)), nil
+}
+
+// GetUsers returns every account, ordered by username.
+func (m *Memory) GetUsers() ([]models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := make([]models.User, 0, len(m.users))
+	for _, stored := range m.users {
+		var user models.User
+		if err := clone(stored, &user); err != nil {
+			return nil, fmt.Errorf("failed to decode users: %w", err)
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return usernameKey(users[i].Username) < usernameKey(users[j].Username) })
+	return users, nil
+}
+
+// GetUser returns an account by ID.
+func (m *Memory) GetUser(id string) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.copyUser(id)
+}
+
+// GetUserByUsername returns an account by username, ignoring case.
+func (m *Memory) GetUserByUsername(username string) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for id, user := range m.users {
+		if usernameKey(user.Username) == usernameKey(username) {
+			return m.copyUser(id)
+		}
+	}
+	return models.User{}, ErrUserNotFound
+}
+
+func (m *Memory) copyUser(id string) (models.User, error) {
+	stored, ok := m.users[id]
+	if !ok {
+		return models.User{}, ErrUserNotFound
+	}
+	var user models.User
+	if err := clone(stored, &user); err != nil {
+		return models.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	return user, nil
+}
+
+// CountAdmins returns the number of accounts with the admin role.
+func (m *Memory) CountAdmins() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var count int64
+	for _, user := range m.users {
+		if user.Role == models.RoleAdmin {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// CreateUser inserts a new account with a generated ID. Accounts without a role are viewers.
+func (m *Memory) CreateUser(user models.User) (models.User, error) {
+	now := time.Now().UTC()
+	user.ID = primitive.NewObjectID().Hex()
+	user.Username = strings.TrimSpace(user.Username)
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Version = 1
+	if user.Role == "" {
+		user.Role = models.RoleViewer
+	}
+	var stored models.User
+	if err := clone(user, &stored); err != nil {
+		return models.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.users {
+		if usernameKey(existing.Username) == usernameKey(user.Username) {
+			return models.User{}, ErrUsernameTaken
+		}
+	}
+	m.users[stored.ID] = stored
+	return user, nil
+}
+
+// UpdateUserAccess replaces the role and device overrides of an account. The version must match the
+// stored one, otherwise the current account is returned with ErrOutdatedUserVersion.
+func (m *Memory) UpdateUserAccess(user models.User) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[user.ID]
+	if !ok {
+		return models.User{}, ErrUserNotFound
+	}
+	if stored.Version != user.Version {
+		existing, err := m.copyUser(user.ID)
+		if err != nil {
+			return models.User{}, err
+		}
+		return existing, ErrOutdatedUserVersion
+	}
+
+	var access models.User
+	if err := clone(user, &access); err != nil {
+		return models.User{}, fmt.Errorf("failed to update user: %w", err)
+	}
+	stored.Role = access.Role
+	stored.UpstreamUserIDs = access.UpstreamUserIDs
+	stored.DeviceIDs = access.DeviceIDs
+	stored.HiddenDeviceIDs = access.HiddenDeviceIDs
+	stored.UpdatedAt = storedTime(time.Now())
+	stored.Version++
+	m.users[user.ID] = stored
+	return m.copyUser(user.ID)
+}
+
+// SetUserRole changes the role of an account without checking or changing its version.
+func (m *Memory) SetUserRole(id, role string) error {
+	return m.updateUser(id, func(user *models.User) { user.Role = role })
+}
+
+// SetUserPassword replaces the password hash of an account.
+func (m *Memory) SetUserPassword(id, passwordHash string) error {
+	return m.updateUser(id, func(user *models.User) { user.PasswordHash = passwordHash })
+}
+
+// RecordLogin stores the time of a successful login.
+func (m *Memory) RecordLogin(id string, at time.Time) error {
+	at = storedTime(at)
+	return m.updateUser(id, func(user *models.User) { user.LastLoginAt = &at })
+}
+
+func (m *Memory) updateUser(id string, update func(user *models.User)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	update(&user)
+	user.UpdatedAt = storedTime(time.Now())
+	m.users[id] = user
+	return nil
+}
+
+// CreateSession stores a new login session with a generated ID.
+func (m *Memory) CreateSession(session models.Session) (models.Session, error) {
+	session.ID = primitive.NewObjectID().Hex()
+	session.CreatedAt = time.Now().UTC()
+	var stored models.Session
+	if err := clone(session, &stored); err != nil {
+		return models.Session{}, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[stored.ID] = stored
+	return session, nil
+}
+
+// GetSession returns a session by ID. Expired sessions are returned like with MongoDB, where they
+// are only removed eventually.
+func (m *Memory) GetSession(id string) (models.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return models.Session{}, ErrSessionNotFound
+	}
+	if session.RevokedAt != nil {
+		revokedAt := *session.RevokedAt
+		session.RevokedAt = &revokedAt
+	}
+	return session, nil
+}
+
+// RevokeSession ends a session. It returns ErrSessionNotFound if there is no such session or it
+// was revoked already, so of two concurrent calls only one ends the session.
+func (m *Memory) RevokeSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok || session.RevokedAt != nil {
+		return ErrSessionNotFound
+	}
+	now := storedTime(time.Now())
+	session.RevokedAt = &now
+	m.sessions[id] = session
+	return nil
+}
+
+// RevokeUserSessions ends every session of a user except keepID, which may be empty.
+func (m *Memory) RevokeUserSessions(userID, keepID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := storedTime(time.Now())
+	for id, session := range m.sessions {
+		if session.UserID == userID && id != keepID && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			m.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+// GetDeviceGroups returns every device group, ordered by name.
+func (m *Memory) GetDeviceGroups() ([]models.DeviceGroup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	groups := make([]models.DeviceGroup, 0, len(m.groups))
+	for _, stored := range m.groups {
+		var group models.DeviceGroup
+		if err := clone(stored, &group); err != nil {
+			return nil, fmt.Errorf("failed to decode device groups: %w", err)
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Name != groups[j].Name {
+			return groups[i].Name < groups[j].Name
+		}
+		return groups[i].ID < groups[j].ID
+	})
+	return groups, nil
+}
+
+// GetDeviceGroup returns a device group by ID.
+func (m *Memory) GetDeviceGroup(id string) (models.DeviceGroup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.copyGroup(id)
+}
+
+func (m *Memory) copyGroup(id string) (models.DeviceGroup, error) {
+	stored, ok := m.groups[id]
+	if !ok {
+		return models.DeviceGroup{}, ErrGroupNotFound
+	}
+	var group models.DeviceGroup
+	if err := clone(stored, &group); err != nil {
+		return models.DeviceGroup{}, fmt.Errorf("failed to get device group: %w", err)
+	}
+	return group, nil
+}
+
+// CreateDeviceGroup inserts a new device group with a generated ID.
+func (m *Memory) CreateDeviceGroup(group models.DeviceGroup) (models.DeviceGroup, error) {
+	now := time.Now().UTC()
+	group.ID = primitive.NewObjectID().Hex()
+	group.Version = 1
+	group.CreatedAt = now
+	group.UpdatedAt = now
+	if group.DeviceIDs == nil {
+		group.DeviceIDs = []string{}
+	}
+	var stored models.DeviceGroup
+	if err := clone(group, &stored); err != nil {
+		return models.DeviceGroup{}, fmt.Errorf("failed to create device group: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groups[stored.ID] = stored
+	return group, nil
+}
+
+// UpdateDeviceGroup replaces a device group if its stored version still matches group.Version.
+// On a version mismatch the stored group is returned with ErrOutdatedGroupVersion.
+func (m *Memory) UpdateDeviceGroup(group models.DeviceGroup) (models.DeviceGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, err := m.copyGroup(group.ID)
+	if err != nil {
+		return models.DeviceGroup{}, err
+	}
+	if existing.Version != group.Version {
+		return existing, ErrOutdatedGroupVersion
+	}
+
+	group.CreatedAt = existing.CreatedAt
+	group.UpdatedAt = time.Now().UTC()
+	group.Version++
+	if group.DeviceIDs == nil {
+		group.DeviceIDs = []string{}
+	}
+	var stored models.DeviceGroup
+	if err := clone(group, &stored); err != nil {
+		return models.DeviceGroup{}, fmt.Errorf("failed to update device group: %w", err)
+	}
+	m.groups[group.ID] = stored
+	return group, nil
+}
+
+// AddDevicesToGroup adds devices to a group, ignoring the ones already in it.
+func (m *Memory) AddDevicesToGroup(id string, deviceIDs []string) (models.DeviceGroup, error) {
+	return m.changeGroupDevices(id, func(members []string) []string {
+		for _, deviceID := range deviceIDs {
+			if !containsString(members, deviceID) {
+				members = append(members, deviceID)
+			}
+		}
+		return members
+	})
+}
+
+// RemoveDeviceFromGroup removes a device from a group. Removing a device that is not in it is not an error.
+func (m *Memory) RemoveDeviceFromGroup(id, deviceID string) (models.DeviceGroup, error) {
+	return m.changeGroupDevices(id, func(members []string) []string {
+		kept := []string{}
+		for _, member := range members {
+			if member != deviceID {
+				kept = append(kept, member)
+			}
+		}
+		return kept
+	})
+}
+
+// changeGroupDevices applies a membership change to a group and bumps its version.
+func (m *Memory) changeGroupDevices(id string, change func(members []string) []string) (models.DeviceGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	group, ok := m.groups[id]
+	if !ok {
+		return models.DeviceGroup{}, ErrGroupNotFound
+	}
+	group.DeviceIDs = change(append([]string{}, group.DeviceIDs...))
+	group.UpdatedAt = storedTime(time.Now())
+	group.Version++
+	m.groups[id] = group
+	return m.copyGroup(id)
+}
+
+// DeleteDeviceGroup deletes a device group. Groups with subgroups cannot be deleted.
+func (m *Memory) DeleteDeviceGroup(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, group := range m.groups {
+		if group.ParentID == id {
+			return ErrGroupHasChildren
+		}
+	}
+	if _, ok := m.groups[id]; !ok {
+		return ErrGroupNotFound
+	}
+	delete(m.groups, id)
+	return nil
+}
+
+// GetGeofences returns every geofence, ordered by name.
+func (m *Memory) GetGeofences() ([]models.Geofence, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	geofences := make([]models.Geofence, 0, len(m.geofences))
+	for _, stored := range m.geofences {
+		var geofence models.Geofence
+		if err := clone(stored, &geofence); err != nil {
+			return nil, fmt.Errorf("failed to decode geofences: %w", err)
+		}
+		geofences = append(geofences, geofence)
+	}
+	sort.Slice(geofences, func(i, j int) bool {
+		if geofences[i].Name != geofences[j].Name {
+			return geofences[i].Name < geofences[j].Name
+		}
+		return geofences[i].ID < geofences[j].ID
+	})
+	return geofences, nil
+}
+
+// GetGeofence returns a geofence by ID.
+func (m *Memory) GetGeofence(id string) (models.Geofence, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.copyGeofence(id)
+}
+
+func (m *Memory) copyGeofence(id string) (models.Geofence, error) {
+	stored, ok := m.geofences[id]
+	if !ok {
+		return models.Geofence{}, ErrGeofenceNotFound
+	}
+	var geofence models.Geofence
+	if err := clone(stored, &geofence); err != nil {
+		return models.Geofence{}, fmt.Errorf("failed to get geofence: %w", err)
+	}
+	return geofence, nil
+}
+
+// CreateGeofence inserts a new geofence with a generated ID.
+func (m *Memory) CreateGeofence(geofence models.Geofence) (models.Geofence, error) {
+	now := time.Now().UTC()
+	geofence.ID = primitive.NewObjectID().Hex()
+	geofence.Version = 1
+	geofence.CreatedAt = now
+	geofence.UpdatedAt = now
+	var stored models.Geofence
+	if err := clone(geofence, &stored); err != nil {
+		return models.Geofence{}, fmt.Errorf("failed to create geofence: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.geofences[stored.ID] = stored
+	return geofence, nil
+}
+
+// UpdateGeofence replaces a geofence if its stored version still matches geofence.Version.
+// On a version mismatch the stored geofence is returned with ErrOutdatedGeofenceVersion.
+func (m *Memory) UpdateGeofence(geofence models.Geofence) (models.Geofence, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, err := m.copyGeofence(geofence.ID)
+	if err != nil {
+		return models.Geofence{}, err
+	}
+	if existing.Version != geofence.Version {
+		return existing, ErrOutdatedGeofenceVersion
+	}
+
+	geofence.CreatedAt = existing.CreatedAt
+	geofence.UpdatedAt = time.Now().UTC()
+	geofence.Version++
+	var stored models.Geofence
+	if err := clone(geofence, &stored); err != nil {
+		return models.Geofence{}, fmt.Errorf("failed to update geofence: %w", err)
+	}
+	m.geofences[geofence.ID] = stored
+	return geofence, nil
+}
+
+// DeleteGeofence deletes a geofence. Its events are kept.
+func (m *Memory) DeleteGeofence(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.geofences[id]; !ok {
+		return ErrGeofenceNotFound
+	}
+	delete(m.geofences, id)
+	return nil
+}
+
+// SaveGeofenceEvent inserts or replaces a geofence event.
+func (m *Memory) SaveGeofenceEvent(event models.GeofenceEvent) error {
+	var stored models.GeofenceEvent
+	if err := clone(event, &stored); err != nil {
+		return fmt.Errorf("failed to save geofence event: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.geofenceEvent[stored.ID] = stored
+	return nil
+}
+
+// GetGeofenceEvents returns the geofence events with from <= time <= to, oldest first, optionally
+// limited to one device and/or one geofence.
+func (m *Memory) GetGeofenceEvents(deviceID, geofenceID string, from, to time.Time) ([]models.GeofenceEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	geofenceEvents := []models.GeofenceEvent{}
+	for _, event := range m.geofenceEvent {
+		if (deviceID == "" || event.DeviceID == deviceID) && (geofenceID == "" || event.GeofenceID == geofenceID) && inRange(event.Time, from, to) {
+			geofenceEvents = append(geofenceEvents, event)
+		}
+	}
+	sort.Slice(geofenceEvents, func(i, j int) bool {
+		if !geofenceEvents[i].Time.Equal(geofenceEvents[j].Time) {
+			return geofenceEvents[i].Time.Before(geofenceEvents[j].Time)
+		}
+		return geofenceEvents[i].ID < geofenceEvents[j].ID
+	})
+	return geofenceEvents, nil
+}
+
+// GetLatestGeofenceEvents returns the newest event of a device for each geofence, keyed by geofence ID.
+func (m *Memory) GetLatestGeofenceEvents(deviceID string) (map[string]models.GeofenceEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	latest := make(map[string]models.GeofenceEvent)
+	for _, event := range m.geofenceEvent {
+		if event.DeviceID != deviceID {
+			continue
+		}
+		if current, ok := latest[event.GeofenceID]; !ok || event.Time.After(current.Time) {
+			latest[event.GeofenceID] = event
+		}
+	}
+	return latest, nil
+}
+
+// GetAlertRules returns every alert rule, ordered by name.
+func (m *Memory) GetAlertRules() ([]models.AlertRule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rules := make([]models.AlertRule, 0, len(m.alertRules))
+	for _, stored := range m.alertRules {
+		var rule models.AlertRule
+		if err := clone(stored, &rule); err != nil {
+			return nil, fmt.Errorf("failed to decode alert rules: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Name != rules[j].Name {
+			return rules[i].Name < rules[j].Name
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	return rules, nil
+}
+
+// GetAlertRule returns an alert rule by ID.
+func (m *Memory) GetAlertRule(id string) (models.AlertRule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.copyAlertRule(id)
+}
+
+func (m *Memory) copyAlertRule(id string) (models.AlertRule, error) {
+	stored, ok := m.alertRules[id]
+	if !ok {
+		return models.AlertRule{}, ErrAlertRuleNotFound
+	}
+	var rule models.AlertRule
+	if err := clone(stored, &rule); err != nil {
+		return models.AlertRule{}, fmt.Errorf("failed to get alert rule: %w", err)
+	}
+	return rule, nil
+}
+
+// CreateAlertRule inserts a new alert rule with a generated ID.
+func (m *Memory) CreateAlertRule(rule models.AlertRule) (models.AlertRule, error) {
+	now := time.Now().UTC()
+	rule.ID = primitive.NewObjectID().Hex()
+	rule.Version = 1
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+	var stored models.AlertRule
+	if err := clone(rule, &stored); err != nil {
+		return models.AlertRule{}, fmt.Errorf("failed to create alert rule: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.alertRules[stored.ID] = stored
+	return rule, nil
+}
+
+// UpdateAlertRule replaces an alert rule if its stored version still matches rule.Version.
+// On a version mismatch the stored rule is returned with ErrOutdatedAlertRuleVersion.
+func (m *Memory) UpdateAlertRule(rule models.AlertRule) (models.AlertRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, err := m.copyAlertRule(rule.ID)
+	if err != nil {
+		return models.AlertRule{}, err
+	}
+	if existing.Version != rule.Version {
+		return existing, ErrOutdatedAlertRuleVersion
+	}
+
+	rule.CreatedAt = existing.CreatedAt
+	rule.UpdatedAt = time.Now().UTC()
+	rule.Version++
+	var stored models.AlertRule
+	if err := clone(rule, &stored); err != nil {
+		return models.AlertRule{}, fmt.Errorf("failed to update alert rule: %w", err)
+	}
+	m.alertRules[rule.ID] = stored
+	return rule, nil
+}
+
+// DeleteAlertRule deletes an alert rule. Its alerts are kept.
+func (m *Memory) DeleteAlertRule(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.alertRules[id]; !ok {
+		return ErrAlertRuleNotFound
+	}
+	delete(m.alertRules, id)
+	return nil
+}
+
+// GetLatestAlert returns the most recently triggered alert of a rule for a device, or nil if there is none.
+func (m *Memory) GetLatestAlert(ruleID, deviceID string) (*models.Alert, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	latestID := ""
+	for id, alert := range m.alerts {
+		if alert.RuleID == ruleID && alert.DeviceID == deviceID &&
+			(latestID == "" || alert.LastTriggeredAt.After(m.alerts[latestID].LastTriggeredAt)) {
+			latestID = id
+		}
+	}
+	if latestID == "" {
+		return nil, nil
+	}
+	alert, err := m.copyAlert(latestID)
+	if err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+func (m *Memory) copyAlert(id string) (models.Alert, error) {
+	stored, ok := m.alerts[id]
+	if !ok {
+		return models.Alert{}, ErrAlertNotFound
+	}
+	var alert models.Alert
+	if err := clone(stored, &alert); err != nil {
+		return models.Alert{}, fmt.Errorf("failed to get alert: %w", err)
+	}
+	return alert, nil
+}
+
+// CreateAlert inserts a new alert with a generated ID.
+func (m *Memory) CreateAlert(alert models.Alert) (models.Alert, error) {
+	alert.ID = primitive.NewObjectID().Hex()
+	var stored models.Alert
+	if err := clone(alert, &stored); err != nil {
+		return models.Alert{}, fmt.Errorf("failed to create alert: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.alerts[stored.ID] = stored
+	return alert, nil
+}
+
+// RecordAlertTrigger counts another trigger of an unresolved alert.
+func (m *Memory) RecordAlertTrigger(id string, at time.Time, message string) (models.Alert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alert, ok := m.alerts[id]
+	if !ok {
+		return models.Alert{}, ErrAlertNotFound
+	}
+	alert.Count++
+	alert.LastTriggeredAt = storedTime(at)
+	alert.Message = message
+	m.alerts[id] = alert
+	return m.copyAlert(id)
+}
+
+// GetAlert returns an alert by ID.
+func (m *Memory) GetAlert(id string) (models.Alert, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.copyAlert(id)
+}
+
+// GetAlerts returns the alerts matching the filter, most recently triggered first.
+func (m *Memory) GetAlerts(filter AlertFilter) ([]models.Alert, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for id, alert := range m.alerts {
+		switch {
+		case filter.Status != "" && alert.Status != filter.Status,
+			filter.DeviceID != "" && alert.DeviceID != filter.DeviceID,
+			filter.DeviceIDs != nil && !containsString(filter.DeviceIDs, alert.DeviceID),
+			filter.RuleID != "" && alert.RuleID != filter.RuleID,
+			!filter.From.IsZero() && alert.LastTriggeredAt.Before(storedTime(filter.From)),
+			!filter.To.IsZero() && alert.LastTriggeredAt.After(storedTime(filter.To)):
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := m.alerts[ids[i]], m.alerts[ids[j]]
+		if !a.LastTriggeredAt.Equal(b.LastTriggeredAt) {
+			return a.LastTriggeredAt.After(b.LastTriggeredAt)
+		}
+		return a.ID > b.ID
+	})
+	if filter.Limit > 0 && int64(len(ids)) > filter.Limit {
+		ids = ids[:filter.Limit]
+	}
+
+	alerts := make([]models.Alert, 0, len(ids))
+	for _, id := range ids {
+		alert, err := m.copyAlert(id)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, nil
+}
+
+// AcknowledgeAlert marks an open alert as acknowledged.
+func (m *Memory) AcknowledgeAlert(id, by, note string) (models.Alert, error) {
+	now := storedTime(time.Now())
+	return m.changeAlertStatus(id, []string{models.AlertOpen}, func(alert *models.Alert) {
+		alert.Status = models.AlertAcknowledged
+		alert.AcknowledgedAt = &now
+		alert.AcknowledgedBy = by
+		if note != "" {
+			alert.Note = note
+		}
+	})
+}
+
+// ResolveAlert marks an open or acknowledged alert as resolved.
+func (m *Memory) ResolveAlert(id, by, note string) (models.Alert, error) {
+	now := storedTime(time.Now())
+	return m.changeAlertStatus(id, []string{models.AlertOpen, models.AlertAcknowledged}, func(alert *models.Alert) {
+		alert.Status = models.AlertResolved
+		alert.ResolvedAt = &now
+		alert.ResolvedBy = by
+		if note != "" {
+			alert.Note = note
+		}
+	})
+}
+
+// changeAlertStatus applies change to an alert whose status is one of from. If the alert exists in
+// another status, it is returned unchanged with ErrAlertStatus.
+func (m *Memory) changeAlertStatus(id string, from []string, change func(alert *models.Alert)) (models.Alert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alert, ok := m.alerts[id]
+	if !ok {
+		return models.Alert{}, ErrAlertNotFound
+	}
+	if !containsString(from, alert.Status) {
+		current, err := m.copyAlert(id)
+		if err != nil {
+			return models.Alert{}, err
+		}
+		return current, ErrAlertStatus
+	}
+	change(&alert)
+	m.alerts[id] = alert
+	return m.copyAlert(id)
+}
+
+// SaveTrip inserts or replaces a trip.
+func (m *Memory) SaveTrip(trip models.Trip) error {
+	var stored models.Trip
+	if err := clone(trip, &stored); err != nil {
+		return fmt.Errorf("failed to save trip: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trips[stored.ID] = stored
+	return nil
+}
+
+// SaveStop inserts or replaces a stop.
+func (m *Memory) SaveStop(stop models.Stop) error {
+	var stored models.Stop
+	if err := clone(stop, &stored); err != nil {
+		return fmt.Errorf("failed to save stop: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stops[stored.ID] = stored
+	return nil
+}
+
+// GetTrips returns the trips of a device overlapping [from, to], oldest first.
+func (m *Memory) GetTrips(deviceID string, from, to time.Time) ([]models.Trip, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	trips := []models.Trip{}
+	for _, trip := range m.trips {
+		if trip.DeviceID == deviceID && overlaps(trip.StartTime, trip.EndTime, from, to) {
+			trips = append(trips, trip)
+		}
+	}
+	sort.Slice(trips, func(i, j int) bool { return trips[i].StartTime.Before(trips[j].StartTime) })
+	return trips, nil
+}
+
+// GetStops returns the stops of a device overlapping [from, to], oldest first.
+func (m *Memory) GetStops(deviceID string, from, to time.Time) ([]models.Stop, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stops := []models.Stop{}
+	for _, stop := range m.stops {
+		if stop.DeviceID == deviceID && overlaps(stop.StartTime, stop.EndTime, from, to) {
+			stops = append(stops, stop)
+		}
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].StartTime.Before(stops[j].StartTime) })
+	return stops, nil
+}
+
+// overlaps reports whether [start, end] overlaps [from, to].
+func overlaps(start, end, from, to time.Time) bool {
+	return !start.After(storedTime(to)) && !end.Before(storedTime(from))
+}
+
+// SaveAvailabilityEvent appends an online/offline transition to the availability log.
+func (m *Memory) SaveAvailabilityEvent(event models.AvailabilityEvent) error {
+	var stored models.AvailabilityEvent
+	if err := clone(event, &stored); err != nil {
+		return fmt.Errorf("failed to save availability event: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.availability = append(m.availability, stored)
+	return nil
+}
+
+// GetLatestAvailabilityEvent returns the newest transition of a device at or before t, or nil if there is none.
+func (m *Memory) GetLatestAvailabilityEvent(deviceID string, t time.Time) (*models.AvailabilityEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var latest *models.AvailabilityEvent
+	for i, event := range m.availability {
+		if event.DeviceID != deviceID || event.Time.After(storedTime(t)) {
+			continue
+		}
+		if latest == nil || availabilityBefore(*latest, event) {
+			latest = &m.availability[i]
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	event := *latest
+	return &event, nil
+}
+
+// GetAvailabilityEvents returns the transitions of a device with from <= time <= to, oldest first.
+func (m *Memory) GetAvailabilityEvents(deviceID string, from, to time.Time) ([]models.AvailabilityEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	availability := []models.AvailabilityEvent{}
+	for _, event := range m.availability {
+		if event.DeviceID == deviceID && inRange(event.Time, from, to) {
+			availability = append(availability, event)
+		}
+	}
+	sort.SliceStable(availability, func(i, j int) bool { return availabilityBefore(availability[i], availability[j]) })
+	return availability, nil
+}
+
+// availabilityBefore orders transitions by time, then by detection time.
+func availabilityBefore(a, b models.AvailabilityEvent) bool {
+	if !a.Time.Equal(b.Time) {
+		return a.Time.Before(b.Time)
+	}
+	return a.DetectedAt.Before(b.DetectedAt)
+}
+
+// SaveNotificationDelivery inserts or replaces a delivery log entry.
+func (m *Memory) SaveNotificationDelivery(delivery models.NotificationDelivery) error {
+	var stored models.NotificationDelivery
+	if err := clone(delivery, &stored); err != nil {
+		return fmt.Errorf("failed to save notification delivery: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries[stored.ID] = stored
+	return nil
+}
+
+// GetNotificationDeliveries returns delivery log entries, newest first, optionally filtered by
+// channel, alert and status. A limit of 0 returns every entry.
+func (m *Memory) GetNotificationDeliveries(channel, alertID, status string, limit int64) ([]models.NotificationDelivery, error) {
+	deliveries, err := m.findDeliveries(func(delivery models.NotificationDelivery) bool {
+		return (channel == "" || delivery.Channel == channel) &&
+			(alertID == "" || delivery.AlertID == alertID) &&
+			(status == "" || delivery.Status == status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+	if limit > 0 && int64(len(deliveries)) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+// GetUnfinishedNotificationDeliveries returns the deliveries that are still pending or waiting
+// for a retry, oldest first.
+func (m *Memory) GetUnfinishedNotificationDeliveries() ([]models.NotificationDelivery, error) {
+	deliveries, err := m.findDeliveries(func(delivery models.NotificationDelivery) bool {
+		return delivery.Status == models.DeliveryPending || delivery.Status == models.DeliveryRetrying
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt) })
+	return deliveries, nil
+}
+
+// findDeliveries returns copies of the deliveries matching a condition, ordered by ID.
+func (m *Memory) findDeliveries(match func(delivery models.NotificationDelivery) bool) ([]models.NotificationDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deliveries := []models.NotificationDelivery{}
+	for _, stored := range m.deliveries {
+		if !match(stored) {
+			continue
+		}
+		var delivery models.NotificationDelivery
+		if err := clone(stored, &delivery); err != nil {
+			return nil, fmt.Errorf("failed to decode notification deliveries: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, nil
+}
@@ -0,0 +1,251 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migrator is implemented by the backends with a versioned schema. Open applies the pending
+// migrations unless skip_migrations is set, the migrate command runs and lists them on demand.
+type Migrator interface {
+	// Migrations returns every migration this server knows, oldest first.
+	Migrations() ([]MigrationStatus, error)
+	// Migrate applies the pending migrations in order and returns the ones it applied.
+	Migrate() ([]MigrationStatus, error)
+}
+
+// MigrationStatus is a schema migration and when it was applied, nil while it is pending.
+type MigrationStatus struct {
+	Version     int        `bson:"_id" json:"version"`
+	Description string     `bson:"description" json:"description"`
+	AppliedAt   *time.Time `bson:"applied_at,omitempty" json:"applied_at,omitempty"`
+}
+
+// mongoMigration is one versioned change of the MongoDB collections. Migrations may run again if
+// a server stops before recording them, or when two servers start at once, so Up must be idempotent.
+type mongoMigration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *MongoDB) error
+}
+
+// mongoMigrations are applied in order. Append new migrations instead of editing applied ones.
+var mongoMigrations = []mongoMigration{
+	{1, "Create the device list indexes, including updated_at", func(ctx context.Context, db *MongoDB) error {
+		indexes := []mongo.IndexModel{
+			{Keys: bson.D{{Key: "online", Value: 1}}},
+			{Keys: bson.D{{Key: "active_state", Value: 1}}},
+			{Keys: bson.D{{Key: "make", Value: 1}}},
+			{Keys: bson.D{{Key: "device_groups_id_list", Value: 1}}},
+			{Keys: bson.D{{Key: "user_id_list", Value: 1}}},
+		}
+		for _, field := range DeviceSortFields {
+			indexes = append(indexes, mongo.IndexModel{Keys: bson.D{{Key: field, Value: 1}, {Key: "_id", Value: 1}}})
+		}
+		_, err := db.collection(db.DeviceCollectionName).Indexes().CreateMany(ctx, indexes)
+		return err
+	}},
+	{2, "Create the unique username and session expiry indexes", func(ctx context.Context, db *MongoDB) error {
+		// Usernames are unique ignoring case, MongoDB removes sessions once they expire
+		usernameIndex := mongo.IndexModel{
+			Keys:    bson.D{{Key: "username_key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		}
+		if _, err := db.collection(db.AccountCollectionName).Indexes().CreateOne(ctx, usernameIndex); err != nil {
+			return err
+		}
+		expiryIndex := mongo.IndexModel{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}
+		_, err := db.collection(db.SessionCollectionName).Indexes().CreateOne(ctx, expiryIndex)
+		return err
+	}},
+	{3, "Create the device point de-duplication index", func(ctx context.Context, db *MongoDB) error {
+		// Time-series collections cannot have unique indexes, this index backs the de-duplication lookup instead
+		index := mongo.IndexModel{Keys: bson.D{{Key: "device_id", Value: 1}, {Key: "device_point_id", Value: 1}}}
+		_, err := db.collection(db.HistoryCollectionName).Indexes().CreateOne(ctx, index)
+		return err
+	}},
+	{4, "Make device_id unique in devices", func(ctx context.Context, db *MongoDB) error {
+		return createUniqueIndex(ctx, db.collection(db.DeviceCollectionName), "device_id")
+	}},
+	{5, "Make device_id unique in device settings", func(ctx context.Context, db *MongoDB) error {
+		return createUniqueIndex(ctx, db.collection(db.SettingsCollectionName), "device_id")
+	}},
+	{6, "Make user_id unique in user preferences", func(ctx context.Context, db *MongoDB) error {
+		return createUniqueIndex(ctx, db.collection(db.UserCollectionName), "user_id")
+	}},
+	{7, "Backfill version in user preferences, version and updated_at in device settings", func(ctx context.Context, db *MongoDB) error {
+		// Without a version these documents never match the versioned updates
+		missingVersion := bson.M{"version": bson.M{"$exists": false}}
+		if _, err := db.collection(db.UserCollectionName).UpdateMany(ctx, missingVersion, bson.M{"$set": bson.M{"version": 1}}); err != nil {
+			return err
+		}
+		settings := db.collection(db.SettingsCollectionName)
+		if _, err := settings.UpdateMany(ctx, missingVersion, bson.M{"$set": bson.M{"version": 1}}); err != nil {
+			return err
+		}
+		missingUpdatedAt := bson.M{"$or": bson.A{bson.M{"updated_at": bson.M{"$exists": false}}, bson.M{"updated_at": ""}}}
+		_, err := settings.UpdateMany(ctx, missingUpdatedAt, bson.M{"$set": bson.M{"updated_at": time.Now().Format(time.RFC3339)}})
+		return err
+	}},
+	{8, "Create the device position index for bounding box queries", func(ctx context.Context, db *MongoDB) error {
+		index := mongo.IndexModel{Keys: bson.D{{Key: "latest_device_point.lat", Value: 1}, {Key: "latest_device_point.lng", Value: 1}}}
+		_, err := db.collection(db.DeviceCollectionName).Indexes().CreateOne(ctx, index)
+		return err
+	}},
+}
+
+func (db *MongoDB) collection(name string) *mongo.Collection {
+	return db.Client.Database(db.DatabaseName).Collection(name)
+}
+
+// createUniqueIndex creates a unique index on field. Duplicates are removed first, keeping the
+// document chosen by duplicatesToRemove. Documents without the field are left alone, more than
+// one of them fails the index build.
+func createUniqueIndex(ctx context.Context, collection *mongo.Collection, field string) error {
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{field: bson.M{"$exists": true}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       "$" + field,
+			"documents": bson.M{"$push": bson.M{"_id": "$_id", "version": "$version"}},
+			"count":     bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to find duplicate %s: %w", field, err)
+	}
+	var duplicates []struct {
+		Value     interface{}         `bson:"_id"`
+		Documents []versionedDocument `bson:"documents"`
+	}
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return fmt.Errorf("failed to decode duplicate %s: %w", field, err)
+	}
+	for _, duplicate := range duplicates {
+		result, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": duplicatesToRemove(duplicate.Documents)}})
+		if err != nil {
+			return fmt.Errorf("failed to remove duplicate %s %v: %w", field, duplicate.Value, err)
+		}
+		log.Printf("Removed %d duplicate documents with %s %v from %s", result.DeletedCount, field, duplicate.Value, collection.Name())
+	}
+
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetUnique(true).SetName(field + "_unique"),
+	}
+	_, err = collection.Indexes().CreateOne(ctx, index)
+	return err
+}
+
+// versionedDocument identifies one of several documents sharing a value that must become unique.
+type versionedDocument struct {
+	ID      interface{} `bson:"_id"`
+	Version int         `bson:"version"` // 0 for documents stored before versioning
+}
+
+// duplicatesToRemove returns the IDs of every document except the one to keep: the one with the
+// highest version, then the newest one. ObjectIDs start with their creation time, so the greatest
+// ID is the newest.
+func duplicatesToRemove(documents []versionedDocument) []interface{} {
+	if len(documents) == 0 {
+		return nil
+	}
+	keep := 0
+	for i, document := range documents[1:] {
+		kept := documents[keep]
+		if document.Version > kept.Version || document.Version == kept.Version && idAfter(document.ID, kept.ID) {
+			keep = i + 1
+		}
+	}
+	ids := make([]interface{}, 0, len(documents)-1)
+	for i, document := range documents {
+		if i != keep {
+			ids = append(ids, document.ID)
+		}
+	}
+	return ids
+}
+
+// idAfter reports whether the document ID a sorts after b.
+func idAfter(a, b interface{}) bool {
+	objectA, okA := a.(primitive.ObjectID)
+	objectB, okB := b.(primitive.ObjectID)
+	if okA && okB {
+		return objectA.Hex() > objectB.Hex()
+	}
+	if okA != okB {
+		return okA // Mongo sorts ObjectIDs after strings and numbers
+	}
+	return fmt.Sprint(a) > fmt.Sprint(b)
+}
+
+// Migrations returns every MongoDB migration, with the time it was applied.
+func (db *MongoDB) Migrations() ([]MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := db.collection(db.MigrationCollectionName).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find applied migrations: %w", err)
+	}
+	var recorded []MigrationStatus
+	if err := cursor.All(ctx, &recorded); err != nil {
+		return nil, fmt.Errorf("failed to decode applied migrations: %w", err)
+	}
+	appliedAt := make(map[int]*time.Time, len(recorded))
+	for _, status := range recorded {
+		appliedAt[status.Version] = status.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, 0, len(mongoMigrations))
+	for _, migration := range mongoMigrations {
+		statuses = append(statuses, MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   appliedAt[migration.Version],
+		})
+	}
+	return statuses, nil
+}
+
+// Migrate applies the pending MongoDB migrations and records them in the migration collection.
+func (db *MongoDB) Migrate() ([]MigrationStatus, error) {
+	statuses, err := db.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []MigrationStatus{}
+	for i, migration := range mongoMigrations {
+		if statuses[i].AppliedAt != nil {
+			continue
+		}
+		// Backfills and index builds may take a while on large collections
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		err := migration.Up(ctx, db)
+		if err == nil {
+			now := time.Now().UTC()
+			statuses[i].AppliedAt = &now
+			_, err = db.collection(db.MigrationCollectionName).InsertOne(ctx, statuses[i])
+			if mongo.IsDuplicateKeyError(err) {
+				err = nil // Applied by another server at the same time
+			}
+		}
+		cancel()
+		if err != nil {
+			return applied, fmt.Errorf("failed to apply migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		applied = append(applied, statuses[i])
+	}
+	return applied, nil
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDuplicatesToRemove(t *testing.T) {
+	older := primitive.NewObjectIDFromTimestamp(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	newer := primitive.NewObjectIDFromTimestamp(time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC))
+	newest := primitive.NewObjectIDFromTimestamp(time.Date(2024, 11, 13, 0, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		name      string
+		documents []versionedDocument
+		keep      interface{}
+	}{
+		{
+			name:      "highest version",
+			documents: []versionedDocument{{ID: newest, Version: 1}, {ID: older, Version: 3}, {ID: newer, Version: 2}},
+			keep:      older,
+		},
+		{
+			name:      "newest of the same version",
+			documents: []versionedDocument{{ID: older, Version: 2}, {ID: newest, Version: 2}, {ID: newer, Version: 2}},
+			keep:      newest,
+		},
+		{
+			name:      "unversioned documents",
+			documents: []versionedDocument{{ID: newer}, {ID: older}},
+			keep:      newer,
+		},
+		{
+			name:      "versioned before unversioned",
+			documents: []versionedDocument{{ID: newest}, {ID: older, Version: 1}},
+			keep:      older,
+		},
+		{
+			name:      "object ID after other IDs",
+			documents: []versionedDocument{{ID: older}, {ID: "device-1"}, {ID: int32(7)}},
+			keep:      older,
+		},
+		{
+			name:      "greatest string ID",
+			documents: []versionedDocument{{ID: "device-2"}, {ID: "device-10"}, {ID: "device-1"}},
+			keep:      "device-2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			removed := duplicatesToRemove(test.documents)
+			if len(removed) != len(test.documents)-1 {
+				t.Fatalf("removes %v, want all but %v", removed, test.keep)
+			}
+			for _, id := range removed {
+				if id == test.keep {
+					t.Errorf("removes %v, want it kept", test.keep)
+				}
+			}
+		})
+	}
+
+	if removed := duplicatesToRemove(nil); len(removed) != 0 {
+		t.Errorf("removes %v without documents, want nothing", removed)
+	}
+	if got := fmt.Sprint(duplicatesToRemove([]versionedDocument{{ID: "only"}})); got != "[]" {
+		t.Errorf("removes %s of a single document, want nothing", got)
+	}
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SaveNotificationDelivery inserts or replaces a delivery log entry.
+func (db *MongoDB) SaveNotificationDelivery(delivery models.NotificationDelivery) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.NotificationLogCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": delivery.ID}, delivery, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save notification delivery: %w", err)
+	}
+	return nil
+}
+
+// GetNotificationDeliveries returns delivery log entries, newest first, optionally filtered by
+// channel, alert and status. A limit of 0 returns every entry.
+func (db *MongoDB) GetNotificationDeliveries(channel, alertID, status string, limit int64) ([]models.NotificationDelivery, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.NotificationLogCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if channel != "" {
+		filter["channel"] = channel
+	}
+	if alertID != "" {
+		filter["alert_id"] = alertID
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find notification deliveries: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []models.NotificationDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, fmt.Errorf("failed to decode notification deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// GetUnfinishedNotificationDeliveries returns the deliveries that are still pending or waiting
+// for a retry, oldest first, so they can be queued again after a restart.
+func (db *MongoDB) GetUnfinishedNotificationDeliveries() ([]models.NotificationDelivery, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.NotificationLogCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"status": bson.M{"$in": []string{models.DeliveryPending, models.DeliveryRetrying}}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find unfinished notification deliveries: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []models.NotificationDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, fmt.Errorf("failed to decode notification deliveries: %w", err)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,350 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// forEachBackend runs a test against every backend that needs no server, so Memory and SQLite
+// are held to the same semantics. MongoDB is left out, it needs a running server.
+func forEachBackend(t *testing.T, test func(t *testing.T, db Repository)) {
+	t.Run(StorageMemory, func(t *testing.T) {
+		test(t, NewMemory())
+	})
+	t.Run(StorageSQLite, func(t *testing.T) {
+		db, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("NewSQLite: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if _, err := db.Migrate(); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		test(t, db)
+	})
+}
+
+func TestSaveUserPreferencesVersioning(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Repository) {
+		if _, err := db.GetUserPreferences("user"); !errors.Is(err, ErrPreferencesNotFound) {
+			t.Fatalf("GetUserPreferences before saving: err = %v, want ErrPreferencesNotFound", err)
+		}
+
+		saved, err := db.SaveUserPreferences(models.UserPreferences{UserID: "user", Unit: "km"})
+		if err != nil || saved.Version != 1 {
+			t.Fatalf("first save = version %d, %v, want version 1", saved.Version, err)
+		}
+		saved, err = db.SaveUserPreferences(models.UserPreferences{UserID: "user", Unit: "mi", Version: 1})
+		if err != nil || saved.Version != 2 || saved.Unit != "mi" {
+			t.Fatalf("save with the stored version = %+v, %v, want version 2 in mi", saved, err)
+		}
+
+		current, err := db.SaveUserPreferences(models.UserPreferences{UserID: "user", Unit: "km", Version: 1})
+		if !errors.Is(err, ErrOutdatedVersion) {
+			t.Fatalf("save with an outdated version: err = %v, want ErrOutdatedVersion", err)
+		}
+		if current.Version != 2 || current.Unit != "mi" {
+			t.Errorf("outdated save returned %+v, want the stored preferences", current)
+		}
+		stored, err := db.GetUserPreferences("user")
+		if err != nil || stored.Unit != "mi" {
+			t.Errorf("stored preferences = %+v, %v, want mi to survive the outdated save", stored, err)
+		}
+	})
+}
+
+func TestSaveDeviceSettingsVersioning(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Repository) {
+		settings := DefaultDeviceSettings("device", time.Now())
+		settings.IconURL = "first.png"
+		saved, err := db.SaveDeviceSettings(settings)
+		if err != nil || saved.Version != 1 {
+			t.Fatalf("first save = version %d, %v, want version 1", saved.Version, err)
+		}
+
+		settings.IconURL = "second.png"
+		settings.Version = 1
+		saved, err = db.SaveDeviceSettings(settings)
+		if err != nil || saved.Version != 2 {
+			t.Fatalf("save with the stored version = version %d, %v, want version 2", saved.Version, err)
+		}
+
+		settings.IconURL = "stale.png"
+		current, err := db.SaveDeviceSettings(settings)
+		if !errors.Is(err, ErrOutdatedSettingsVersion) {
+			t.Fatalf("save with an outdated version: err = %v, want ErrOutdatedSettingsVersion", err)
+		}
+		if current.Version != 2 || current.IconURL != "second.png" {
+			t.Errorf("outdated save returned version %d with %q, want the stored settings", current.Version, current.IconURL)
+		}
+
+		settings.IconURL = "unconditional.png"
+		settings.Version = 0
+		saved, err = db.SaveDeviceSettings(settings)
+		if err != nil || saved.Version != 3 || saved.IconURL != "unconditional.png" {
+			t.Errorf("save without a version = version %d with %q, %v, want version 3", saved.Version, saved.IconURL, err)
+		}
+	})
+}
+
+func TestUpdateDeviceVersioning(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Repository) {
+		if err := db.InsertDevice(models.Device{DeviceID: "device", DisplayName: "Before", Version: 1}); err != nil {
+			t.Fatalf("InsertDevice: %v", err)
+		}
+		if err := db.InsertDevice(models.Device{DeviceID: "device"}); !errors.Is(err, ErrDeviceExists) {
+			t.Fatalf("inserting a taken device_id: err = %v, want ErrDeviceExists", err)
+		}
+		page, err := db.FindDevices(DeviceQuery{})
+		if err != nil || len(page.Devices) != 1 {
+			t.Fatalf("FindDevices = %d devices, %v", len(page.Devices), err)
+		}
+		id, ok := page.Devices[0]["_id"].(primitive.ObjectID)
+		if !ok {
+			t.Fatalf("_id is a %T, want an ObjectID", page.Devices[0]["_id"])
+		}
+
+		if err := db.UpdateDevice(id, map[string]interface{}{"display_name": "After", "version": 7}, 1); err != nil {
+			t.Fatalf("update with the stored version: %v", err)
+		}
+		if err := db.UpdateDevice(id, map[string]interface{}{"display_name": "Stale"}, 1); !errors.Is(err, ErrOutdatedDeviceVersion) {
+			t.Fatalf("update with an outdated version: err = %v, want ErrOutdatedDeviceVersion", err)
+		}
+		if err := db.UpdateDevice(primitive.NewObjectID(), map[string]interface{}{"display_name": "Missing"}, 1); !errors.Is(err, ErrOutdatedDeviceVersion) {
+			t.Fatalf("update of a missing device: err = %v, want ErrOutdatedDeviceVersion", err)
+		}
+
+		page, err = db.FindDevices(DeviceQuery{DeviceIDs: []string{"device"}})
+		if err != nil || len(page.Devices) != 1 {
+			t.Fatalf("FindDevices = %d devices, %v", len(page.Devices), err)
+		}
+		device := page.Devices[0]
+		if device["display_name"] != "After" || fmt.Sprint(device["version"]) != "2" {
+			t.Errorf("stored device has display_name %v and version %v, want After and 2", device["display_name"], device["version"])
+		}
+	})
+}
+
+func TestFindDevicesPaging(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Repository) {
+		// Two devices share every display name, so the pages have to break ties by _id
+		for i := 0; i < 9; i++ {
+			device := models.Device{
+				DeviceID:    fmt.Sprintf("device-%d", i),
+				DisplayName: fmt.Sprintf("Truck %d", i/2),
+				Online:      i%3 == 0,
+				UpdatedAt:   fmt.Sprintf("2024-11-13T06:00:%02dZ", i),
+			}
+			if err := db.InsertDevice(device); err != nil {
+				t.Fatalf("InsertDevice: %v", err)
+			}
+		}
+
+		for _, descending := range []bool{false, true} {
+			var names []string
+			seen := make(map[string]bool)
+			query := DeviceQuery{Sort: "display_name", Descending: descending, Limit: 4, Fields: []string{"display_name"}}
+			for pages := 0; ; pages++ {
+				if pages > 3 {
+					t.Fatalf("descending %v: more than 3 pages of 4 for 9 devices", descending)
+				}
+				page, err := db.FindDevices(query)
+				if err != nil {
+					t.Fatalf("FindDevices: %v", err)
+				}
+				if page.Total != 9 {
+					t.Errorf("descending %v: total = %d, want 9", descending, page.Total)
+				}
+				for _, device := range page.Devices {
+					deviceID, _ := device["device_id"].(string)
+					if seen[deviceID] {
+						t.Errorf("descending %v: %s is on two pages", descending, deviceID)
+					}
+					seen[deviceID] = true
+					if _, ok := device["updated_at"]; ok {
+						t.Errorf("descending %v: updated_at is not in the projection", descending)
+					}
+					names = append(names, device["display_name"].(string))
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				query.Cursor = page.NextCursor
+			}
+			if len(seen) != 9 {
+				t.Errorf("descending %v: paged through %d devices, want 9", descending, len(seen))
+			}
+			for i := 1; i < len(names); i++ {
+				if (names[i] < names[i-1]) != descending && names[i] != names[i-1] {
+					t.Errorf("descending %v: %q follows %q", descending, names[i], names[i-1])
+				}
+			}
+		}
+
+		online := true
+		page, err := db.FindDevices(DeviceQuery{Online: &online, Sort: "device_id"})
+		if err != nil || page.Total != 3 || len(page.Devices) != 3 {
+			t.Errorf("online filter = %d of %d devices, %v, want 3", len(page.Devices), page.Total, err)
+		}
+		if _, err := db.FindDevices(DeviceQuery{Cursor: "not-a-cursor"}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("invalid cursor: err = %v, want ErrInvalidCursor", err)
+		}
+	})
+}
+
+func TestFindDevicesInBoundingBox(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Repository) {
+		positions := map[string]*models.DevicePoint{
+			"los-angeles": {Lat: 34.05, Lng: -118.24},
+			"san-diego":   {Lat: 32.72, Lng: -117.16},
+			"fiji":        {Lat: -17.71, Lng: 178.06},
+			"samoa":       {Lat: -13.76, Lng: -172.10},
+			"no-point":    nil,
+		}
+		for deviceID, point := range positions {
+			if err := db.InsertDevice(models.Device{DeviceID: deviceID, LatestDevicePoint: point}); err != nil {
+				t.Fatalf("InsertDevice: %v", err)
+			}
+		}
+
+		tests := []struct {
+			name      string
+			box       BoundingBox
+			deviceIDs []string
+			want      string
+		}{
+			{"box", BoundingBox{MinLat: 33, MinLng: -119, MaxLat: 35, MaxLng: -118}, nil, "[los-angeles]"},
+			{"box or listed", BoundingBox{MinLat: 33, MinLng: -119, MaxLat: 35, MaxLng: -118}, []string{"no-point", "san-diego"}, "[los-angeles no-point san-diego]"},
+			{"across the antimeridian", BoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170}, nil, "[fiji samoa]"},
+			{"empty box", BoundingBox{MinLat: 0, MinLng: 0, MaxLat: 1, MaxLng: 1}, nil, "[]"},
+		}
+		for _, test := range tests {
+			page, err := db.FindDevices(DeviceQuery{BBox: &test.box, BBoxDeviceIDs: test.deviceIDs, Sort: "device_id", Fields: []string{"device_id"}})
+			if err != nil {
+				t.Fatalf("%s: FindDevices: %v", test.name, err)
+			}
+			deviceIDs := []string{}
+			for _, device := range page.Devices {
+				deviceIDs = append(deviceIDs, device["device_id"].(string))
+			}
+			if got := fmt.Sprint(deviceIDs); got != test.want || page.Total != int64(len(deviceIDs)) {
+				t.Errorf("%s: found %s of %d devices, want %s", test.name, got, page.Total, test.want)
+			}
+		}
+
+		// A moved device is found at its new position
+		moved := models.Device{DeviceID: "san-diego", LatestDevicePoint: &models.DevicePoint{Lat: 34.1, Lng: -118.3}}
+		if err := db.ReplaceDevice(moved); err != nil {
+			t.Fatalf("ReplaceDevice: %v", err)
+		}
+		page, err := db.FindDevices(DeviceQuery{BBox: &BoundingBox{MinLat: 33, MinLng: -119, MaxLat: 35, MaxLng: -118}})
+		if err != nil || page.Total != 2 {
+			t.Errorf("after moving a device into the box found %d devices, %v, want 2", page.Total, err)
+		}
+	})
+}
+
+func TestRevokeSessionOnce(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Repository) {
+		session, err := db.CreateSession(models.Session{UserID: "user", ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+		if err := db.RevokeSession(session.ID); err != nil {
+			t.Fatalf("first RevokeSession: %v", err)
+		}
+		if err := db.RevokeSession(session.ID); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("second RevokeSession: err = %v, want ErrSessionNotFound", err)
+		}
+		if err := db.RevokeSession("missing"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("RevokeSession of a missing session: err = %v, want ErrSessionNotFound", err)
+		}
+	})
+}
+
+// connectWithClock connects to a new embedded backend running on clk.
+func connectWithClock(t *testing.T, storage string, clk clock.Clock) Repository {
+	t.Helper()
+	db, err := Connect(models.Config{Storage: storage, SQLitePath: filepath.Join(t.TempDir(), "test.db")}, clk)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if sqlite, ok := db.(*SQLite); ok {
+		t.Cleanup(func() { sqlite.Close() })
+	}
+	if migrator, ok := db.(Migrator); ok {
+		if _, err := migrator.Migrate(); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+	}
+	return db
+}
+
+func TestDeviceSettingsAreDatedByTheClock(t *testing.T) {
+	start := time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+	for _, storage := range []string{StorageMemory, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			virtual := clock.NewVirtual(start)
+			db := connectWithClock(t, storage, virtual)
+
+			defaults, err := db.GetDeviceSettings("device")
+			if err != nil || defaults.UpdatedAt != start.Format(time.RFC3339) {
+				t.Errorf("default settings updated at %s, %v, want %s", defaults.UpdatedAt, err, start.Format(time.RFC3339))
+			}
+			later := virtual.Advance(time.Hour)
+			saved, err := db.SaveDeviceSettings(defaults)
+			if err != nil || saved.UpdatedAt != later.Format(time.RFC3339) {
+				t.Errorf("saved settings updated at %s, %v, want %s", saved.UpdatedAt, err, later.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestDeviceIDsFollowTheClock(t *testing.T) {
+	start := time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+	for _, storage := range []string{StorageMemory, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			// objectIDs stores two devices a minute apart and returns their _ids by device_id
+			objectIDs := func() map[string]string {
+				virtual := clock.NewVirtual(start)
+				db := connectWithClock(t, storage, virtual)
+				for _, deviceID := range []string{"truck-1", "truck-2"} {
+					if err := db.InsertDevice(models.Device{DeviceID: deviceID}); err != nil {
+						t.Fatalf("InsertDevice: %v", err)
+					}
+					virtual.Advance(time.Minute)
+				}
+				_, stored, err := db.GetDeviceOwners()
+				if err != nil {
+					t.Fatalf("GetDeviceOwners: %v", err)
+				}
+				ids := make(map[string]string)
+				for objectID, deviceID := range stored {
+					ids[deviceID] = objectID
+				}
+				return ids
+			}
+
+			first, second := objectIDs(), objectIDs()
+			if len(first) != 2 || first["truck-1"] == first["truck-2"] {
+				t.Fatalf("_ids = %v, want one per device", first)
+			}
+			for deviceID, objectID := range first {
+				if second[deviceID] != objectID {
+					t.Errorf("%s is stored as %s and %s on the same clock", deviceID, objectID, second[deviceID])
+				}
+			}
+			if id, err := primitive.ObjectIDFromHex(first["truck-2"]); err != nil || !id.Timestamp().Equal(start.Add(time.Minute)) {
+				t.Errorf("_id of truck-2 = %s, %v, want the time it was stored", first["truck-2"], err)
+			}
+		})
+	}
+}
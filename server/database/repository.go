@@ -0,0 +1,236 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Storage backends selected by the storage setting.
+const (
+	StorageMongoDB = "mongodb"
+	StorageMemory  = "memory"
+	StorageSQLite  = "sqlite"
+)
+
+// Open connects to the storage backend selected in the config, MongoDB when none is set, and applies
+// its pending schema migrations unless skip_migrations is set.
+func Open(cfg models.Config, clk clock.Clock) (Repository, error) {
+	repo, err := Connect(cfg, clk)
+	if err != nil {
+		return nil, err
+	}
+	migrator, ok := repo.(Migrator)
+	if !ok {
+		return repo, nil
+	}
+
+	if cfg.SkipMigrations {
+		statuses, err := migrator.Migrations()
+		if err != nil {
+			return nil, err
+		}
+		for _, status := range statuses {
+			if status.AppliedAt == nil {
+				log.Printf("Migration %d is pending: %s (run the migrate command)", status.Version, status.Description)
+			}
+		}
+		return repo, nil
+	}
+	applied, err := migrator.Migrate()
+	for _, status := range applied {
+		log.Printf("Applied migration %d: %s", status.Version, status.Description)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// Connect connects to the storage backend selected in the config without migrating its schema.
+// Settings updates are timestamped with clk.
+func Connect(cfg models.Config, clk clock.Clock) (Repository, error) {
+	switch cfg.Storage {
+	case "", StorageMongoDB:
+		db, err := NewMongoDB(cfg)
+		if err != nil {
+			return nil, err
+		}
+		db.Clock = clk
+		return db, nil
+	case StorageMemory:
+		db := NewMemory()
+		db.Clock = clk
+		return db, nil
+	case StorageSQLite:
+		db, err := NewSQLite(cfg.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		db.Clock = clk
+		return db, nil
+	}
+	return nil, fmt.Errorf("unknown storage %q, use %s, %s or %s", cfg.Storage, StorageMongoDB, StorageMemory, StorageSQLite)
+}
+
+// Repository is the storage used by the server. MongoDB is the production backend, SQLite stores
+// everything in a local file for single-box deployments, and Memory keeps everything in the process
+// for running without a database and for tests. All of them return the same sentinel errors, so
+// callers can check them with errors.Is regardless of the backend.
+type Repository interface {
+	DeviceRepository
+	SettingsRepository
+	PreferenceRepository
+	IconRepository
+	HistoryRepository
+	UserRepository
+	GroupRepository
+	GeofenceRepository
+	AlertRepository
+	TripRepository
+	AvailabilityRepository
+	NotificationRepository
+}
+
+// DeviceRepository stores the ingested devices. Devices are read back as documents (maps) because
+// list queries project arbitrary fields.
+type DeviceRepository interface {
+	FindDevices(query DeviceQuery) (DevicePage, error)
+	GetDeviceIDs() ([]string, error)
+	DeviceExists(deviceID string) (bool, error)
+	// InsertDevice stores a new device, or returns ErrDeviceExists if its device_id is taken.
+	InsertDevice(device models.Device) error
+	// ReplaceDevice replaces the device with the same device_id, keeping its _id.
+	ReplaceDevice(device models.Device) error
+	// UpdateDevice sets fields on the device with the given _id if its version matches, otherwise
+	// it returns ErrOutdatedDeviceVersion.
+	UpdateDevice(deviceID primitive.ObjectID, updatedDevice map[string]interface{}, deviceVersion int) error
+	SetDeviceOnline(deviceID string, online bool, updatedAt time.Time) (map[string]interface{}, error)
+	GetLatestAccuratePoint(deviceID string) (*models.DevicePoint, error)
+	GetDeviceOwners() (owners map[string][]string, objectIDs map[string]string, err error)
+	// ClearCollections removes every device and all user preferences.
+	ClearCollections() error
+}
+
+// SettingsRepository stores the per device settings.
+type SettingsRepository interface {
+	// GetDeviceSettings returns the settings of a device, storing DefaultDeviceSettings if it has none.
+	GetDeviceSettings(deviceID string) (models.DeviceSettings, error)
+	// SaveDeviceSettings stores the settings of a device. Unless settings.Version is 0 it has to be
+	// the stored version, otherwise the stored settings are returned with ErrOutdatedSettingsVersion.
+	SaveDeviceSettings(settings models.DeviceSettings) (models.DeviceSettings, error)
+	GetAllDeviceSettings() (map[string]models.DeviceSettings, error)
+}
+
+// PreferenceRepository stores the dashboard preferences of each user.
+type PreferenceRepository interface {
+	// GetUserPreferences returns ErrPreferencesNotFound if the user has not saved any.
+	GetUserPreferences(userID string) (models.UserPreferences, error)
+	SaveUserPreferences(prefs models.UserPreferences) (models.UserPreferences, error)
+}
+
+// IconRepository reads and writes the device icons kept in the settings.
+type IconRepository interface {
+	GetIconMap() (map[string]string, error)
+	UpdateDeviceIconURL(deviceID primitive.ObjectID, iconURL string) error
+}
+
+// HistoryRepository stores the point history of the devices.
+type HistoryRepository interface {
+	AppendDevicePoint(record models.DevicePointRecord) (bool, error)
+	GetDeviceHistory(deviceID string, from, to time.Time, limit int64, accurate *bool) ([]models.DevicePointRecord, error)
+	GetHistoryDeviceIDs() ([]string, error)
+	CountDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error)
+	DeleteDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error)
+}
+
+// UserRepository stores the accounts and their login sessions.
+type UserRepository interface {
+	CountUsers() (int64, error)
+	GetUsers() ([]models.User, error)
+	GetUser(id string) (models.User, error)
+	GetUserByUsername(username string) (models.User, error)
+	CountAdmins() (int64, error)
+	CreateUser(user models.User) (models.User, error)
+	UpdateUserAccess(user models.User) (models.User, error)
+	SetUserRole(id, role string) error
+	SetUserPassword(id, passwordHash string) error
+	RecordLogin(id string, at time.Time) error
+	CreateSession(session models.Session) (models.Session, error)
+	GetSession(id string) (models.Session, error)
+	// RevokeSession returns ErrSessionNotFound unless this call ended the session.
+	RevokeSession(id string) error
+	RevokeUserSessions(userID, keepID string) error
+}
+
+// GroupRepository stores the server-side device groups.
+type GroupRepository interface {
+	GetDeviceGroups() ([]models.DeviceGroup, error)
+	GetDeviceGroup(id string) (models.DeviceGroup, error)
+	CreateDeviceGroup(group models.DeviceGroup) (models.DeviceGroup, error)
+	UpdateDeviceGroup(group models.DeviceGroup) (models.DeviceGroup, error)
+	AddDevicesToGroup(id string, deviceIDs []string) (models.DeviceGroup, error)
+	RemoveDeviceFromGroup(id, deviceID string) (models.DeviceGroup, error)
+	DeleteDeviceGroup(id string) error
+}
+
+// GeofenceRepository stores the geofences and the events they produced.
+type GeofenceRepository interface {
+	GetGeofences() ([]models.Geofence, error)
+	GetGeofence(id string) (models.Geofence, error)
+	CreateGeofence(geofence models.Geofence) (models.Geofence, error)
+	UpdateGeofence(geofence models.Geofence) (models.Geofence, error)
+	DeleteGeofence(id string) error
+	SaveGeofenceEvent(event models.GeofenceEvent) error
+	GetGeofenceEvents(deviceID, geofenceID string, from, to time.Time) ([]models.GeofenceEvent, error)
+	GetLatestGeofenceEvents(deviceID string) (map[string]models.GeofenceEvent, error)
+}
+
+// AlertRepository stores the alert rules and the alerts they raised.
+type AlertRepository interface {
+	GetAlertRules() ([]models.AlertRule, error)
+	GetAlertRule(id string) (models.AlertRule, error)
+	CreateAlertRule(rule models.AlertRule) (models.AlertRule, error)
+	UpdateAlertRule(rule models.AlertRule) (models.AlertRule, error)
+	DeleteAlertRule(id string) error
+	GetLatestAlert(ruleID, deviceID string) (*models.Alert, error)
+	CreateAlert(alert models.Alert) (models.Alert, error)
+	RecordAlertTrigger(id string, at time.Time, message string) (models.Alert, error)
+	GetAlert(id string) (models.Alert, error)
+	GetAlerts(filter AlertFilter) ([]models.Alert, error)
+	AcknowledgeAlert(id, by, note string) (models.Alert, error)
+	ResolveAlert(id, by, note string) (models.Alert, error)
+}
+
+// TripRepository stores the detected trips and stops.
+type TripRepository interface {
+	SaveTrip(trip models.Trip) error
+	SaveStop(stop models.Stop) error
+	GetTrips(deviceID string, from, to time.Time) ([]models.Trip, error)
+	GetStops(deviceID string, from, to time.Time) ([]models.Stop, error)
+}
+
+// AvailabilityRepository stores the online/offline transitions of the devices.
+type AvailabilityRepository interface {
+	SaveAvailabilityEvent(event models.AvailabilityEvent) error
+	GetLatestAvailabilityEvent(deviceID string, t time.Time) (*models.AvailabilityEvent, error)
+	GetAvailabilityEvents(deviceID string, from, to time.Time) ([]models.AvailabilityEvent, error)
+}
+
+// NotificationRepository stores the notification delivery log.
+type NotificationRepository interface {
+	SaveNotificationDelivery(delivery models.NotificationDelivery) error
+	GetNotificationDeliveries(channel, alertID, status string, limit int64) ([]models.NotificationDelivery, error)
+	GetUnfinishedNotificationDeliveries() ([]models.NotificationDelivery, error)
+}
+
+var _ Repository = (*MongoDB)(nil)
+var _ Repository = (*Memory)(nil)
+var _ Repository = (*SQLite)(nil)
+var _ Migrator = (*MongoDB)(nil)
+var _ Migrator = (*SQLite)(nil)
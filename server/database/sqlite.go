@@ -0,0 +1,797 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+
+	"github.com/mattn/go-sqlite3" // Registers the sqlite3 driver
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SQLite is a Repository stored in an embedded SQLite file, for single-box deployments without
+// MongoDB.
+//
+// Every record is kept as a BSON document in a doc column, next to the columns it is looked up,
+// filtered and ordered by, so documents and devices come back exactly as they do from MongoDB.
+// Times in these columns are Unix milliseconds. Versioned records (preferences, settings, users,
+// groups, geofences and alert rules) also have a version column and are only overwritten by an
+// UPDATE that still matches the version they were read with.
+type SQLite struct {
+	DB    *sql.DB
+	Path  string
+	Clock clock.Clock // Time of settings updates and of the _id of new devices
+}
+
+// sqlQuerier is implemented by *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// NewSQLite opens or creates the SQLite database at path. The schema is created by its migrations,
+// see Migrate.
+func NewSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=10000&_journal_mode=WAL", path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	// SQLite allows one writer at a time. A single connection serializes every statement and
+	// transaction of this process instead of failing them with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("SQLite ping failed: %w", err)
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return &SQLite{DB: db, Path: path, Clock: clock.System}, nil
+}
+
+// Close closes the database file.
+func (s *SQLite) Close() error {
+	return s.DB.Close()
+}
+
+// sqliteMigration is one versioned change of the schema, run in a transaction.
+type sqliteMigration struct {
+	Description string
+	SQL         string
+	Backfill    func(tx *sql.Tx) error // Runs after SQL for data it cannot compute, may be nil
+}
+
+// sqliteMigrations create and change the schema, their version is their position starting at 1.
+// Append new migrations instead of editing applied ones.
+var sqliteMigrations = []sqliteMigration{
+	{"Create the tables", `CREATE TABLE devices (
+		id        TEXT PRIMARY KEY, -- _id as hex
+		device_id TEXT NOT NULL,
+		doc       BLOB NOT NULL
+	);
+	CREATE INDEX devices_device_id ON devices (device_id);
+
+	CREATE TABLE device_settings (
+		device_id TEXT PRIMARY KEY,
+		version   INTEGER NOT NULL,
+		doc       BLOB NOT NULL
+	);
+
+	CREATE TABLE user_preferences (
+		user_id TEXT PRIMARY KEY,
+		version INTEGER NOT NULL,
+		doc     BLOB NOT NULL
+	);
+
+	CREATE TABLE device_points (
+		id              INTEGER PRIMARY KEY,
+		device_id       TEXT NOT NULL,
+		device_point_id TEXT NOT NULL,
+		dt_tracker      INTEGER NOT NULL,
+		accurate        INTEGER NOT NULL,
+		doc             BLOB NOT NULL,
+		UNIQUE (device_id, device_point_id, dt_tracker)
+	);
+	CREATE INDEX device_points_device_id_dt_tracker ON device_points (device_id, dt_tracker);
+
+	CREATE TABLE users (
+		id           TEXT PRIMARY KEY,
+		username_key TEXT NOT NULL UNIQUE, -- Lowercase username
+		role         TEXT NOT NULL,
+		version      INTEGER NOT NULL,
+		doc          BLOB NOT NULL
+	);
+
+	CREATE TABLE sessions (
+		id      TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		doc     BLOB NOT NULL
+	);
+	CREATE INDEX sessions_user_id ON sessions (user_id);
+
+	CREATE TABLE device_groups (
+		id        TEXT PRIMARY KEY,
+		name      TEXT NOT NULL,
+		parent_id TEXT NOT NULL,
+		version   INTEGER NOT NULL,
+		doc       BLOB NOT NULL
+	);
+	CREATE INDEX device_groups_parent_id ON device_groups (parent_id);
+
+	CREATE TABLE geofences (
+		id      TEXT PRIMARY KEY,
+		name    TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		doc     BLOB NOT NULL
+	);
+
+	CREATE TABLE geofence_events (
+		id          TEXT PRIMARY KEY,
+		device_id   TEXT NOT NULL,
+		geofence_id TEXT NOT NULL,
+		time        INTEGER NOT NULL,
+		doc         BLOB NOT NULL
+	);
+	CREATE INDEX geofence_events_device_id_time ON geofence_events (device_id, time);
+
+	CREATE TABLE alert_rules (
+		id      TEXT PRIMARY KEY,
+		name    TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		doc     BLOB NOT NULL
+	);
+
+	CREATE TABLE alerts (
+		id                TEXT PRIMARY KEY,
+		rule_id           TEXT NOT NULL,
+		device_id         TEXT NOT NULL,
+		status            TEXT NOT NULL,
+		last_triggered_at INTEGER NOT NULL,
+		doc               BLOB NOT NULL
+	);
+	CREATE INDEX alerts_rule_id_device_id ON alerts (rule_id, device_id);
+	CREATE INDEX alerts_last_triggered_at ON alerts (last_triggered_at);
+
+	CREATE TABLE trips (
+		id         TEXT PRIMARY KEY,
+		device_id  TEXT NOT NULL,
+		start_time INTEGER NOT NULL,
+		end_time   INTEGER NOT NULL,
+		doc        BLOB NOT NULL
+	);
+	CREATE INDEX trips_device_id_start_time ON trips (device_id, start_time);
+
+	CREATE TABLE stops (
+		id         TEXT PRIMARY KEY,
+		device_id  TEXT NOT NULL,
+		start_time INTEGER NOT NULL,
+		end_time   INTEGER NOT NULL,
+		doc        BLOB NOT NULL
+	);
+	CREATE INDEX stops_device_id_start_time ON stops (device_id, start_time);
+
+	CREATE TABLE availability_events (
+		id          INTEGER PRIMARY KEY,
+		device_id   TEXT NOT NULL,
+		time        INTEGER NOT NULL,
+		detected_at INTEGER NOT NULL,
+		doc         BLOB NOT NULL
+	);
+	CREATE INDEX availability_events_device_id_time ON availability_events (device_id, time);
+
+	CREATE TABLE notification_deliveries (
+		id         TEXT PRIMARY KEY,
+		channel    TEXT NOT NULL,
+		alert_id   TEXT NOT NULL,
+		status     TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		doc        BLOB NOT NULL
+	);
+	CREATE INDEX notification_deliveries_status_created_at ON notification_deliveries (status, created_at);`, nil},
+	{"Make device_id unique in devices, keeping the newest duplicate", `DELETE FROM devices WHERE rowid NOT IN (SELECT MAX(rowid) FROM devices GROUP BY device_id);
+	DROP INDEX devices_device_id;
+	CREATE UNIQUE INDEX devices_device_id ON devices (device_id);`, nil},
+	{"Add the latest point position to devices for bounding box queries", `ALTER TABLE devices ADD COLUMN lat REAL;
+	ALTER TABLE devices ADD COLUMN lng REAL;
+	CREATE INDEX devices_lat_lng ON devices (lat, lng);`, backfillDevicePositions},
+}
+
+// backfillDevicePositions fills the position columns of the stored devices from their documents.
+func backfillDevicePositions(tx *sql.Tx) error {
+	devices, err := loadDevices(tx, "")
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		id, _ := device["_id"].(primitive.ObjectID)
+		lat, lng := positionColumns(device)
+		if _, err := tx.Exec(`UPDATE devices SET lat = ?, lng = ? WHERE id = ?`, lat, lng, id.Hex()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrations returns every schema migration, with the time it was applied.
+func (s *SQLite) Migrations() ([]MigrationStatus, error) {
+	rows, err := s.DB.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find applied migrations: %w", err)
+	}
+	defer rows.Close()
+	appliedAt := make(map[int]*time.Time)
+	for rows.Next() {
+		var version int
+		var millis int64
+		if err := rows.Scan(&version, &millis); err != nil {
+			return nil, fmt.Errorf("failed to decode applied migrations: %w", err)
+		}
+		at := time.UnixMilli(millis).UTC()
+		appliedAt[version] = &at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to decode applied migrations: %w", err)
+	}
+
+	statuses := make([]MigrationStatus, 0, len(sqliteMigrations))
+	for i, migration := range sqliteMigrations {
+		statuses = append(statuses, MigrationStatus{Version: i + 1, Description: migration.Description, AppliedAt: appliedAt[i+1]})
+	}
+	return statuses, nil
+}
+
+// Migrate applies the pending schema migrations and records them in schema_migrations.
+func (s *SQLite) Migrate() ([]MigrationStatus, error) {
+	statuses, err := s.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []MigrationStatus{}
+	for i, migration := range sqliteMigrations {
+		if statuses[i].AppliedAt != nil {
+			continue
+		}
+		now := time.Now().UTC()
+		err := s.inTx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(migration.SQL); err != nil {
+				return err
+			}
+			if migration.Backfill != nil {
+				if err := migration.Backfill(tx); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, statuses[i].Version, now.UnixMilli())
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("failed to apply migration %d (%s): %w", statuses[i].Version, migration.Description, err)
+		}
+		statuses[i].AppliedAt = &now
+		applied = append(applied, statuses[i])
+	}
+	return applied, nil
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds.
+func (s *SQLite) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// getDoc decodes the doc selected by a query returning one row into dst. It returns sql.ErrNoRows
+// if there is no row.
+func getDoc(q sqlQuerier, dst interface{}, query string, args ...interface{}) error {
+	var data []byte
+	if err := q.QueryRow(query, args...).Scan(&data); err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, dst)
+}
+
+// forEachDoc calls fn with every doc selected by a query. The rows are read before returning, so fn
+// must not query the database itself.
+func forEachDoc(q sqlQuerier, fn func(doc bson.Raw) error, query string, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		if err := fn(bson.Raw(data)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// updated reports whether a statement changed a row.
+func updated(result sql.Result) (bool, error) {
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// unixMillis is the value of a time column.
+func unixMillis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// boolInt is the value of a boolean column.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// loadDevices returns the device documents matching an SQL condition, every one if it is
+// empty, in insertion order.
+func loadDevices(q sqlQuerier, where string, args ...interface{}) ([]bson.M, error) {
+	query := `SELECT doc FROM devices`
+	if where != "" {
+		query += ` WHERE ` + where
+	}
+	devices := []bson.M{}
+	err := forEachDoc(q, func(doc bson.Raw) error {
+		var device bson.M
+		if err := bson.Unmarshal(doc, &device); err != nil {
+			return err
+		}
+		devices = append(devices, device)
+		return nil
+	}, query+` ORDER BY rowid`, args...)
+	return devices, err
+}
+
+// positionCondition is the SQL condition selecting the devices whose latest point is inside the box
+// or whose device_id is listed, on the indexed position columns.
+func positionCondition(box BoundingBox, deviceIDs []string) (string, []interface{}) {
+	where := `lat BETWEEN ? AND ? AND lng BETWEEN ? AND ?`
+	args := []interface{}{box.MinLat, box.MaxLat, box.MinLng, box.MaxLng}
+	if box.MinLng > box.MaxLng {
+		where = `lat BETWEEN ? AND ? AND (lng >= ? OR lng <= ?)`
+	}
+	if len(deviceIDs) > 0 {
+		where = `(` + where + `) OR device_id IN (?` + strings.Repeat(`, ?`, len(deviceIDs)-1) + `)`
+		for _, deviceID := range deviceIDs {
+			args = append(args, deviceID)
+		}
+	}
+	return where, args
+}
+
+// positionColumns returns the values of the lat and lng columns of a device, NULL without a
+// latest point.
+func positionColumns(device bson.M) (interface{}, interface{}) {
+	lat, lng, ok := devicePosition(device)
+	if !ok {
+		return nil, nil
+	}
+	return lat, lng
+}
+
+// FindDevices returns a page of the devices matching the query, with the same filters, order,
+// projection and cursors as MongoDB.FindDevices. A bounding box is applied in SQL, the rest of the
+// query is evaluated on the decoded devices, which is fine for the fleet sizes this backend is
+// meant for.
+func (s *SQLite) FindDevices(query DeviceQuery) (DevicePage, error) {
+	var where string
+	var args []interface{}
+	if query.BBox != nil {
+		where, args = positionCondition(*query.BBox, query.BBoxDeviceIDs)
+	}
+	devices, err := loadDevices(s.DB, where, args...)
+	if err != nil {
+		return DevicePage{}, fmt.Errorf("failed to find devices: %w", err)
+	}
+	return findDevicePage(devices, query)
+}
+
+// GetDeviceIDs returns the device_id of every stored device.
+func (s *SQLite) GetDeviceIDs() ([]string, error) {
+	rows, err := s.DB.Query(`SELECT DISTINCT device_id FROM devices`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device IDs: %w", err)
+	}
+	defer rows.Close()
+
+	deviceIDs := []string{}
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, fmt.Errorf("failed to get device IDs: %w", err)
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs, rows.Err()
+}
+
+// DeviceExists reports whether a device with the given device_id is stored.
+func (s *SQLite) DeviceExists(deviceID string) (bool, error) {
+	var exists bool
+	if err := s.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM devices WHERE device_id = ?)`, deviceID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check device: %w", err)
+	}
+	return exists, nil
+}
+
+// InsertDevice stores a new device, with a generated _id if it has none. The device_id must be unused.
+func (s *SQLite) InsertDevice(device models.Device) error {
+	var doc bson.M
+	if err := clone(device, &doc); err != nil {
+		return fmt.Errorf("failed to insert device: %w", err)
+	}
+	id, ok := doc["_id"].(primitive.ObjectID)
+	if !ok {
+		id = deviceObjectID(device.DeviceID, s.Clock.Now())
+		doc["_id"] = id
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to insert device: %w", err)
+	}
+	lat, lng := positionColumns(doc)
+	if _, err := s.DB.Exec(`INSERT INTO devices (id, device_id, lat, lng, doc) VALUES (?, ?, ?, ?, ?)`, id.Hex(), device.DeviceID, lat, lng, data); err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return ErrDeviceExists
+		}
+		return fmt.Errorf("failed to insert device: %w", err)
+	}
+	return nil
+}
+
+// ReplaceDevice replaces the stored device with the same device_id, keeping its _id.
+func (s *SQLite) ReplaceDevice(device models.Device) error {
+	var doc bson.M
+	if err := clone(device, &doc); err != nil {
+		return fmt.Errorf("failed to replace device: %w", err)
+	}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		var id string
+		err := tx.QueryRow(`SELECT id FROM devices WHERE device_id = ? ORDER BY rowid LIMIT 1`, device.DeviceID).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil // Like ReplaceOne without upsert
+		}
+		if err != nil {
+			return err
+		}
+		if doc["_id"], err = primitive.ObjectIDFromHex(id); err != nil {
+			return err
+		}
+		return writeDevice(tx, id, doc)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace device: %w", err)
+	}
+	return nil
+}
+
+// writeDevice overwrites the document of the device with the given _id.
+func writeDevice(q sqlQuerier, id string, doc bson.M) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	deviceID, _ := doc["device_id"].(string)
+	lat, lng := positionColumns(doc)
+	_, err = q.Exec(`UPDATE devices SET device_id = ?, lat = ?, lng = ?, doc = ? WHERE id = ?`, deviceID, lat, lng, data, id)
+	return err
+}
+
+// changeDevice applies change to the device found by a query on one column, in a transaction. It
+// returns sql.ErrNoRows if there is no such device.
+func (s *SQLite) changeDevice(column string, value interface{}, change func(device bson.M) error) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var id string
+		var data []byte
+		err := tx.QueryRow(`SELECT id, doc FROM devices WHERE `+column+` = ? ORDER BY rowid LIMIT 1`, value).Scan(&id, &data)
+		if err != nil {
+			return err
+		}
+		var device bson.M
+		if err := bson.Unmarshal(data, &device); err != nil {
+			return err
+		}
+		if err := change(device); err != nil {
+			return err
+		}
+		return writeDevice(tx, id, device)
+	})
+}
+
+// UpdateDevice sets the given fields on a device if its version matches and increments the version.
+func (s *SQLite) UpdateDevice(deviceID primitive.ObjectID, updatedDevice map[string]interface{}, deviceVersion int) error {
+	fields := bson.M{}
+	for k, v := range updatedDevice {
+		if k != "_id" && k != "version" {
+			fields[k] = v
+		}
+	}
+	var set bson.M
+	if err := clone(fields, &set); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+
+	err := s.changeDevice("id", deviceID.Hex(), func(device bson.M) error {
+		if !numberEquals(device["version"], deviceVersion) {
+			return ErrOutdatedDeviceVersion
+		}
+		for path, value := range set {
+			setPath(device, path, value)
+		}
+		device["version"] = incrementNumber(device["version"])
+		return nil
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, ErrOutdatedDeviceVersion):
+		return ErrOutdatedDeviceVersion
+	case err != nil:
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+	return nil
+}
+
+// UpdateDeviceIconURL sets the iconUrl field of a device.
+func (s *SQLite) UpdateDeviceIconURL(deviceID primitive.ObjectID, iconURL string) error {
+	errNotUpdated := fmt.Errorf("device not found or iconURL not updated")
+	err := s.changeDevice("id", deviceID.Hex(), func(device bson.M) error {
+		if device["iconUrl"] == iconURL {
+			return errNotUpdated
+		}
+		device["iconUrl"] = iconURL
+		return nil
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, errNotUpdated):
+		return errNotUpdated
+	case err != nil:
+		return fmt.Errorf("failed to update iconURL: %v", err)
+	}
+	return nil
+}
+
+// SetDeviceOnline updates the online flag and updated_at of a device and returns it, or nil if it is not stored.
+func (s *SQLite) SetDeviceOnline(deviceID string, online bool, updatedAt time.Time) (map[string]interface{}, error) {
+	var device map[string]interface{}
+	err := s.changeDevice("device_id", deviceID, func(doc bson.M) error {
+		doc["online"] = online
+		doc["updated_at"] = updatedAt.Format(time.RFC3339)
+		return clone(doc, &device)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to set device online status: %w", err)
+	}
+	return device, nil
+}
+
+// GetLatestAccuratePoint returns the stored latest_accurate_device_point of a device, or nil if it has none.
+func (s *SQLite) GetLatestAccuratePoint(deviceID string) (*models.DevicePoint, error) {
+	var device struct {
+		Point *models.DevicePoint `bson:"latest_accurate_device_point"`
+	}
+	err := getDoc(s.DB, &device, `SELECT doc FROM devices WHERE device_id = ? ORDER BY rowid LIMIT 1`, deviceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest accurate point: %w", err)
+	}
+	return device.Point, nil
+}
+
+// GetDeviceOwners returns the upstream user_id_list of every device, keyed by device_id, and the
+// device_id of every _id (hex).
+func (s *SQLite) GetDeviceOwners() (owners map[string][]string, objectIDs map[string]string, err error) {
+	owners = make(map[string][]string)
+	objectIDs = make(map[string]string)
+	err = forEachDoc(s.DB, func(doc bson.Raw) error {
+		var device struct {
+			ID         primitive.ObjectID `bson:"_id"`
+			DeviceID   string             `bson:"device_id"`
+			UserIDList []string           `bson:"user_id_list"`
+		}
+		if err := bson.Unmarshal(doc, &device); err != nil {
+			return err
+		}
+		owners[device.DeviceID] = device.UserIDList
+		objectIDs[device.ID.Hex()] = device.DeviceID
+		return nil
+	}, `SELECT doc FROM devices`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode device owners: %w", err)
+	}
+	return owners, objectIDs, nil
+}
+
+// ClearCollections removes every device and all user preferences.
+func (s *SQLite) ClearCollections() error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM devices`); err != nil {
+			return fmt.Errorf("failed to clear devices: %w", err)
+		}
+		if _, err := tx.Exec(`DELETE FROM user_preferences`); err != nil {
+			return fmt.Errorf("failed to clear user preferences: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetDeviceSettings returns the settings of a device, storing DefaultDeviceSettings if it has none.
+func (s *SQLite) GetDeviceSettings(deviceID string) (models.DeviceSettings, error) {
+	var settings models.DeviceSettings
+	err := getDoc(s.DB, &settings, `SELECT doc FROM device_settings WHERE device_id = ?`, deviceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		settings = DefaultDeviceSettings(deviceID, s.Clock.Now())
+		if err := insertDeviceSettings(s.DB, settings); err != nil {
+			return models.DeviceSettings{}, fmt.Errorf("error creating default device settings: %w", err)
+		}
+		return settings, nil
+	}
+	if err != nil {
+		return models.DeviceSettings{}, fmt.Errorf("failed to get device settings: %w", err)
+	}
+	return settings, nil
+}
+
+func insertDeviceSettings(q sqlQuerier, settings models.DeviceSettings) error {
+	data, err := bson.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`INSERT INTO device_settings (device_id, version, doc) VALUES (?, ?, ?)`, settings.DeviceID, settings.Version, data)
+	return err
+}
+
+// SaveDeviceSettings stores the settings of a device. It follows MongoDB.SaveDeviceSettings: a
+// save with another non-zero version returns the stored settings with ErrOutdatedSettingsVersion,
+// anything else overwrites them and increments the version.
+func (s *SQLite) SaveDeviceSettings(settings models.DeviceSettings) (models.DeviceSettings, error) {
+	settings.UpdatedAt = s.Clock.Now().Format(time.RFC3339)
+	var existing models.DeviceSettings
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := getDoc(tx, &existing, `SELECT doc FROM device_settings WHERE device_id = ?`, settings.DeviceID)
+		if errors.Is(err, sql.ErrNoRows) {
+			settings.Version = 1
+			return insertDeviceSettings(tx, settings)
+		}
+		if err != nil {
+			return err
+		}
+		if settings.Version != 0 && settings.Version != existing.Version {
+			return ErrOutdatedSettingsVersion
+		}
+
+		settings.Version = existing.Version + 1
+		data, err := bson.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE device_settings SET version = ?, doc = ? WHERE device_id = ? AND version = ?`,
+			settings.Version, data, settings.DeviceID, existing.Version)
+		return err
+	})
+	if errors.Is(err, ErrOutdatedSettingsVersion) {
+		return existing, ErrOutdatedSettingsVersion
+	}
+	if err != nil {
+		return models.DeviceSettings{}, fmt.Errorf("failed to save device settings: %w", err)
+	}
+	return settings, nil
+}
+
+// GetAllDeviceSettings returns the settings of every device, keyed by device ID.
+func (s *SQLite) GetAllDeviceSettings() (map[string]models.DeviceSettings, error) {
+	settingsMap := make(map[string]models.DeviceSettings)
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var settings models.DeviceSettings
+		if err := bson.Unmarshal(doc, &settings); err != nil {
+			return err
+		}
+		settingsMap[settings.DeviceID] = settings
+		return nil
+	}, `SELECT doc FROM device_settings`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all device settings: %w", err)
+	}
+	return settingsMap, nil
+}
+
+// GetIconMap returns the icon URL of every device with settings, keyed by device ID.
+func (s *SQLite) GetIconMap() (map[string]string, error) {
+	settingsMap, err := s.GetAllDeviceSettings()
+	if err != nil {
+		return nil, err
+	}
+	iconMap := make(map[string]string, len(settingsMap))
+	for deviceID, settings := range settingsMap {
+		iconMap[deviceID] = settings.IconURL
+	}
+	return iconMap, nil
+}
+
+// GetUserPreferences returns the preferences of a user, or ErrPreferencesNotFound.
+func (s *SQLite) GetUserPreferences(userID string) (models.UserPreferences, error) {
+	var prefs models.UserPreferences
+	err := getDoc(s.DB, &prefs, `SELECT doc FROM user_preferences WHERE user_id = ?`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserPreferences{}, ErrPreferencesNotFound
+	}
+	if err != nil {
+		return models.UserPreferences{}, fmt.Errorf("failed to get user preferences: %w", err)
+	}
+	return prefs, nil
+}
+
+// SaveUserPreferences stores the preferences of a user if prefs.Version matches the stored version.
+// Otherwise the stored preferences are returned with ErrOutdatedVersion.
+func (s *SQLite) SaveUserPreferences(prefs models.UserPreferences) (models.UserPreferences, error) {
+	var existing models.UserPreferences
+	err := s.inTx(func(tx *sql.Tx) error {
+		saved := prefs
+		saved.Version++
+		data, err := bson.Marshal(saved)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(`UPDATE user_preferences SET version = ?, doc = ? WHERE user_id = ? AND version = ?`,
+			saved.Version, data, prefs.UserID, prefs.Version)
+		if err != nil {
+			return err
+		}
+		if ok, err := updated(result); ok || err != nil {
+			prefs = saved
+			return err
+		}
+
+		// Either the version did not match or the user has no preferences yet
+		err = getDoc(tx, &existing, `SELECT doc FROM user_preferences WHERE user_id = ?`, prefs.UserID)
+		if err == nil {
+			return ErrOutdatedVersion
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		prefs.Version = 1
+		if data, err = bson.Marshal(prefs); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO user_preferences (user_id, version, doc) VALUES (?, ?, ?)`, prefs.UserID, prefs.Version, data)
+		return err
+	})
+	if errors.Is(err, ErrOutdatedVersion) {
+		return existing, ErrOutdatedVersion
+	}
+	if err != nil {
+		return models.UserPreferences{}, fmt.Errorf("failed to save user preferences: %w", err)
+	}
+	return prefs, nil
+}
@@ -0,0 +1,1103 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AppendDevicePoint stores a point in the history unless a point with the same device_point_id
+// and dt_tracker was already stored. It reports whether the point was inserted.
+func (s *SQLite) AppendDevicePoint(record models.DevicePointRecord) (bool, error) {
+	data, err := bson.Marshal(record)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert device point: %w", err)
+	}
+	result, err := s.DB.Exec(`INSERT OR IGNORE INTO device_points (device_id, device_point_id, dt_tracker, accurate, doc)
+		VALUES (?, ?, ?, ?, ?)`, record.DeviceID, record.DevicePointID, unixMillis(record.DtTracker), boolInt(record.Accurate), data)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert device point: %w", err)
+	}
+	return updated(result)
+}
+
+// GetDeviceHistory returns the points of a device with from <= dt_tracker <= to, oldest first.
+// A limit of 0 returns every point in the range. When accurate is set, only points with that
+// quality flag are returned.
+func (s *SQLite) GetDeviceHistory(deviceID string, from, to time.Time, limit int64, accurate *bool) ([]models.DevicePointRecord, error) {
+	query := `SELECT doc FROM device_points WHERE device_id = ? AND dt_tracker BETWEEN ? AND ?`
+	args := []interface{}{deviceID, unixMillis(from), unixMillis(to)}
+	if accurate != nil {
+		query += ` AND accurate = ?`
+		args = append(args, boolInt(*accurate))
+	}
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+	query += ` ORDER BY dt_tracker, id LIMIT ?`
+	args = append(args, limit)
+
+	points := []models.DevicePointRecord{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var point models.DevicePointRecord
+		if err := bson.Unmarshal(doc, &point); err != nil {
+			return err
+		}
+		points = append(points, point)
+		return nil
+	}, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode device history: %w", err)
+	}
+	return points, nil
+}
+
+// GetHistoryDeviceIDs returns the ids of all devices that have recorded points.
+func (s *SQLite) GetHistoryDeviceIDs() ([]string, error) {
+	rows, err := s.DB.Query(`SELECT DISTINCT device_id FROM device_points ORDER BY device_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history device IDs: %w", err)
+	}
+	defer rows.Close()
+
+	deviceIDs := []string{}
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, fmt.Errorf("failed to get history device IDs: %w", err)
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs, rows.Err()
+}
+
+// CountDevicePointsBefore counts the points of a device recorded before the cutoff.
+func (s *SQLite) CountDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error) {
+	var count int64
+	err := s.DB.QueryRow(`SELECT COUNT(*) FROM device_points WHERE device_id = ? AND dt_tracker < ?`, deviceID, unixMillis(cutoff)).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count device points: %w", err)
+	}
+	return count, nil
+}
+
+// DeleteDevicePointsBefore removes the points of a device recorded before the cutoff.
+func (s *SQLite) DeleteDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error) {
+	result, err := s.DB.Exec(`DELETE FROM device_points WHERE device_id = ? AND dt_tracker < ?`, deviceID, unixMillis(cutoff))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete device points: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// CountUsers returns the number of accounts.
+func (s *SQLite) CountUsers() (int64, error) {
+	var count int64
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count, nil
+}
+
+// GetUsers returns every account, ordered by username.
+func (s *SQLite) GetUsers() ([]models.User, error) {
+	users := []models.User{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var user models.User
+		if err := bson.Unmarshal(doc, &user); err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	}, `SELECT doc FROM users ORDER BY username_key`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return users, nil
+}
+
+// GetUser returns an account by ID.
+func (s *SQLite) GetUser(id string) (models.User, error) {
+	return getUser(s.DB, `SELECT doc FROM users WHERE id = ?`, id)
+}
+
+// GetUserByUsername returns an account by username, ignoring case.
+func (s *SQLite) GetUserByUsername(username string) (models.User, error) {
+	return getUser(s.DB, `SELECT doc FROM users WHERE username_key = ?`, usernameKey(username))
+}
+
+func getUser(q sqlQuerier, query string, args ...interface{}) (models.User, error) {
+	var user models.User
+	err := getDoc(q, &user, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	return user, nil
+}
+
+// CountAdmins returns the number of accounts with the admin role.
+func (s *SQLite) CountAdmins() (int64, error) {
+	var count int64
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ?`, models.RoleAdmin).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count admins: %w", err)
+	}
+	return count, nil
+}
+
+// CreateUser inserts a new account with a generated ID. Accounts without a role are viewers.
+func (s *SQLite) CreateUser(user models.User) (models.User, error) {
+	now := time.Now().UTC()
+	user.ID = primitive.NewObjectID().Hex()
+	user.Username = strings.TrimSpace(user.Username)
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Version = 1
+	if user.Role == "" {
+		user.Role = models.RoleViewer
+	}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username_key = ?)`, usernameKey(user.Username)).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+		data, err := bson.Marshal(user)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO users (id, username_key, role, version, doc) VALUES (?, ?, ?, ?, ?)`,
+			user.ID, usernameKey(user.Username), user.Role, user.Version, data)
+		return err
+	})
+	if errors.Is(err, ErrUsernameTaken) {
+		return models.User{}, ErrUsernameTaken
+	}
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+	return user, nil
+}
+
+// writeUser overwrites a stored account if it still has the given version.
+func writeUser(q sqlQuerier, user models.User, version int) (bool, error) {
+	data, err := bson.Marshal(user)
+	if err != nil {
+		return false, err
+	}
+	result, err := q.Exec(`UPDATE users SET role = ?, version = ?, doc = ? WHERE id = ? AND version = ?`,
+		user.Role, user.Version, data, user.ID, version)
+	if err != nil {
+		return false, err
+	}
+	return updated(result)
+}
+
+// UpdateUserAccess replaces the role and device overrides of an account. The version must match the
+// stored one, otherwise the current account is returned with ErrOutdatedUserVersion.
+func (s *SQLite) UpdateUserAccess(user models.User) (models.User, error) {
+	stored, err := s.GetUser(user.ID)
+	if err != nil {
+		return models.User{}, err
+	}
+	if stored.Version == user.Version {
+		stored.Role = user.Role
+		stored.UpstreamUserIDs = user.UpstreamUserIDs
+		stored.DeviceIDs = user.DeviceIDs
+		stored.HiddenDeviceIDs = user.HiddenDeviceIDs
+		stored.UpdatedAt = storedTime(time.Now())
+		stored.Version++
+		ok, err := writeUser(s.DB, stored, user.Version)
+		if err != nil {
+			return models.User{}, fmt.Errorf("failed to update user: %w", err)
+		}
+		if ok {
+			return s.GetUser(user.ID)
+		}
+	}
+
+	// The version did not match, or the account changed since it was read
+	existing, err := s.GetUser(user.ID)
+	if err != nil {
+		return models.User{}, err
+	}
+	return existing, ErrOutdatedUserVersion
+}
+
+// SetUserRole changes the role of an account without checking or changing its version.
+func (s *SQLite) SetUserRole(id, role string) error {
+	return s.updateUser(id, func(user *models.User) { user.Role = role })
+}
+
+// SetUserPassword replaces the password hash of an account.
+func (s *SQLite) SetUserPassword(id, passwordHash string) error {
+	return s.updateUser(id, func(user *models.User) { user.PasswordHash = passwordHash })
+}
+
+// RecordLogin stores the time of a successful login.
+func (s *SQLite) RecordLogin(id string, at time.Time) error {
+	at = storedTime(at)
+	return s.updateUser(id, func(user *models.User) { user.LastLoginAt = &at })
+}
+
+func (s *SQLite) updateUser(id string, update func(user *models.User)) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		user, err := getUser(tx, `SELECT doc FROM users WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		update(&user)
+		user.UpdatedAt = storedTime(time.Now())
+		if _, err := writeUser(tx, user, user.Version); err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+		return nil
+	})
+}
+
+// CreateSession stores a new login session with a generated ID.
+func (s *SQLite) CreateSession(session models.Session) (models.Session, error) {
+	session.ID = primitive.NewObjectID().Hex()
+	session.CreatedAt = time.Now().UTC()
+	data, err := bson.Marshal(session)
+	if err != nil {
+		return models.Session{}, fmt.Errorf("failed to create session: %w", err)
+	}
+	if _, err := s.DB.Exec(`INSERT INTO sessions (id, user_id, doc) VALUES (?, ?, ?)`, session.ID, session.UserID, data); err != nil {
+		return models.Session{}, fmt.Errorf("failed to create session: %w", err)
+	}
+	return session, nil
+}
+
+// GetSession returns a session by ID. Expired sessions are returned like with MongoDB, where they
+// are only removed eventually.
+func (s *SQLite) GetSession(id string) (models.Session, error) {
+	var session models.Session
+	err := getDoc(s.DB, &session, `SELECT doc FROM sessions WHERE id = ?`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return models.Session{}, fmt.Errorf("failed to get session: %w", err)
+	}
+	return session, nil
+}
+
+// RevokeSession ends a session. It returns ErrSessionNotFound if there is no such session or it
+// was revoked already, so of two concurrent calls only one ends the session.
+func (s *SQLite) RevokeSession(id string) error {
+	revoked, err := s.revokeSessions(`SELECT doc FROM sessions WHERE id = ?`, id)
+	if err == nil && revoked == 0 {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// RevokeUserSessions ends every session of a user except keepID, which may be empty.
+func (s *SQLite) RevokeUserSessions(userID, keepID string) error {
+	_, err := s.revokeSessions(`SELECT doc FROM sessions WHERE user_id = ? AND id != ?`, userID, keepID)
+	return err
+}
+
+// revokeSessions sets revoked_at on the selected sessions that are not revoked yet and returns
+// how many it revoked.
+func (s *SQLite) revokeSessions(query string, args ...interface{}) (int, error) {
+	now := storedTime(time.Now())
+	var sessions []models.Session
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := forEachDoc(tx, func(doc bson.Raw) error {
+			var session models.Session
+			if err := bson.Unmarshal(doc, &session); err != nil {
+				return err
+			}
+			if session.RevokedAt == nil {
+				sessions = append(sessions, session)
+			}
+			return nil
+		}, query, args...)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			session.RevokedAt = &now
+			data, err := bson.Marshal(session)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE sessions SET doc = ? WHERE id = ?`, data, session.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return len(sessions), nil
+}
+
+// GetDeviceGroups returns every device group, ordered by name.
+func (s *SQLite) GetDeviceGroups() ([]models.DeviceGroup, error) {
+	groups := []models.DeviceGroup{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var group models.DeviceGroup
+		if err := bson.Unmarshal(doc, &group); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+		return nil
+	}, `SELECT doc FROM device_groups ORDER BY name, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode device groups: %w", err)
+	}
+	return groups, nil
+}
+
+// GetDeviceGroup returns a device group by ID.
+func (s *SQLite) GetDeviceGroup(id string) (models.DeviceGroup, error) {
+	return getDeviceGroup(s.DB, id)
+}
+
+func getDeviceGroup(q sqlQuerier, id string) (models.DeviceGroup, error) {
+	var group models.DeviceGroup
+	err := getDoc(q, &group, `SELECT doc FROM device_groups WHERE id = ?`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.DeviceGroup{}, ErrGroupNotFound
+	}
+	if err != nil {
+		return models.DeviceGroup{}, fmt.Errorf("failed to get device group: %w", err)
+	}
+	return group, nil
+}
+
+// writeDeviceGroup overwrites a stored group if it still has the given version.
+func writeDeviceGroup(q sqlQuerier, group models.DeviceGroup, version int) (bool, error) {
+	data, err := bson.Marshal(group)
+	if err != nil {
+		return false, err
+	}
+	result, err := q.Exec(`UPDATE device_groups SET name = ?, parent_id = ?, version = ?, doc = ? WHERE id = ? AND version = ?`,
+		group.Name, group.ParentID, group.Version, data, group.ID, version)
+	if err != nil {
+		return false, err
+	}
+	return updated(result)
+}
+
+// CreateDeviceGroup inserts a new device group with a generated ID.
+func (s *SQLite) CreateDeviceGroup(group models.DeviceGroup) (models.DeviceGroup, error) {
+	now := time.Now().UTC()
+	group.ID = primitive.NewObjectID().Hex()
+	group.Version = 1
+	group.CreatedAt = now
+	group.UpdatedAt = now
+	if group.DeviceIDs == nil {
+		group.DeviceIDs = []string{}
+	}
+	data, err := bson.Marshal(group)
+	if err != nil {
+		return models.DeviceGroup{}, fmt.Errorf("failed to create device group: %w", err)
+	}
+	_, err = s.DB.Exec(`INSERT INTO device_groups (id, name, parent_id, version, doc) VALUES (?, ?, ?, ?, ?)`,
+		group.ID, group.Name, group.ParentID, group.Version, data)
+	if err != nil {
+		return models.DeviceGroup{}, fmt.Errorf("failed to create device group: %w", err)
+	}
+	return group, nil
+}
+
+// UpdateDeviceGroup replaces a device group if its stored version still matches group.Version.
+// On a version mismatch the stored group is returned with ErrOutdatedGroupVersion.
+func (s *SQLite) UpdateDeviceGroup(group models.DeviceGroup) (models.DeviceGroup, error) {
+	existing, err := s.GetDeviceGroup(group.ID)
+	if err != nil {
+		return models.DeviceGroup{}, err
+	}
+	if existing.Version == group.Version {
+		version := group.Version
+		group.CreatedAt = existing.CreatedAt
+		group.UpdatedAt = time.Now().UTC()
+		group.Version++
+		if group.DeviceIDs == nil {
+			group.DeviceIDs = []string{}
+		}
+		ok, err := writeDeviceGroup(s.DB, group, version)
+		if err != nil {
+			return models.DeviceGroup{}, fmt.Errorf("failed to update device group: %w", err)
+		}
+		if ok {
+			return group, nil
+		}
+	}
+
+	if existing, err = s.GetDeviceGroup(group.ID); err != nil {
+		return models.DeviceGroup{}, err
+	}
+	return existing, ErrOutdatedGroupVersion
+}
+
+// AddDevicesToGroup adds devices to a group, ignoring the ones already in it.
+func (s *SQLite) AddDevicesToGroup(id string, deviceIDs []string) (models.DeviceGroup, error) {
+	return s.changeGroupDevices(id, func(members []string) []string {
+		for _, deviceID := range deviceIDs {
+			if !containsString(members, deviceID) {
+				members = append(members, deviceID)
+			}
+		}
+		return members
+	})
+}
+
+// RemoveDeviceFromGroup removes a device from a group. Removing a device that is not in it is not an error.
+func (s *SQLite) RemoveDeviceFromGroup(id, deviceID string) (models.DeviceGroup, error) {
+	return s.changeGroupDevices(id, func(members []string) []string {
+		kept := []string{}
+		for _, member := range members {
+			if member != deviceID {
+				kept = append(kept, member)
+			}
+		}
+		return kept
+	})
+}
+
+// changeGroupDevices applies a membership change to a group and bumps its version.
+func (s *SQLite) changeGroupDevices(id string, change func(members []string) []string) (models.DeviceGroup, error) {
+	var group models.DeviceGroup
+	err := s.inTx(func(tx *sql.Tx) error {
+		var err error
+		if group, err = getDeviceGroup(tx, id); err != nil {
+			return err
+		}
+		version := group.Version
+		group.DeviceIDs = change(append([]string{}, group.DeviceIDs...))
+		group.UpdatedAt = storedTime(time.Now())
+		group.Version++
+		if _, err := writeDeviceGroup(tx, group, version); err != nil {
+			return fmt.Errorf("failed to update group devices: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.DeviceGroup{}, err
+	}
+	return group, nil
+}
+
+// DeleteDeviceGroup deletes a device group. Groups with subgroups cannot be deleted.
+func (s *SQLite) DeleteDeviceGroup(id string) error {
+	var children int64
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM device_groups WHERE parent_id = ?`, id).Scan(&children); err != nil {
+		return fmt.Errorf("failed to count subgroups: %w", err)
+	}
+	if children > 0 {
+		return ErrGroupHasChildren
+	}
+	return deleteByID(s.DB, "device_groups", id, ErrGroupNotFound)
+}
+
+// deleteByID deletes the row with the given id from a table, or returns notFound.
+func deleteByID(q sqlQuerier, table, id string, notFound error) error {
+	result, err := q.Exec(`DELETE FROM `+table+` WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete from %s: %w", table, err)
+	}
+	ok, err := updated(result)
+	if err != nil {
+		return fmt.Errorf("failed to delete from %s: %w", table, err)
+	}
+	if !ok {
+		return notFound
+	}
+	return nil
+}
+
+// GetGeofences returns every geofence, ordered by name.
+func (s *SQLite) GetGeofences() ([]models.Geofence, error) {
+	geofences := []models.Geofence{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var geofence models.Geofence
+		if err := bson.Unmarshal(doc, &geofence); err != nil {
+			return err
+		}
+		geofences = append(geofences, geofence)
+		return nil
+	}, `SELECT doc FROM geofences ORDER BY name, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode geofences: %w", err)
+	}
+	return geofences, nil
+}
+
+// GetGeofence returns a geofence by ID.
+func (s *SQLite) GetGeofence(id string) (models.Geofence, error) {
+	var geofence models.Geofence
+	err := getDoc(s.DB, &geofence, `SELECT doc FROM geofences WHERE id = ?`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Geofence{}, ErrGeofenceNotFound
+	}
+	if err != nil {
+		return models.Geofence{}, fmt.Errorf("failed to get geofence: %w", err)
+	}
+	return geofence, nil
+}
+
+// CreateGeofence inserts a new geofence with a generated ID.
+func (s *SQLite) CreateGeofence(geofence models.Geofence) (models.Geofence, error) {
+	now := time.Now().UTC()
+	geofence.ID = primitive.NewObjectID().Hex()
+	geofence.Version = 1
+	geofence.CreatedAt = now
+	geofence.UpdatedAt = now
+	data, err := bson.Marshal(geofence)
+	if err != nil {
+		return models.Geofence{}, fmt.Errorf("failed to create geofence: %w", err)
+	}
+	_, err = s.DB.Exec(`INSERT INTO geofences (id, name, version, doc) VALUES (?, ?, ?, ?)`, geofence.ID, geofence.Name, geofence.Version, data)
+	if err != nil {
+		return models.Geofence{}, fmt.Errorf("failed to create geofence: %w", err)
+	}
+	return geofence, nil
+}
+
+// UpdateGeofence replaces a geofence if its stored version still matches geofence.Version.
+// On a version mismatch the stored geofence is returned with ErrOutdatedGeofenceVersion.
+func (s *SQLite) UpdateGeofence(geofence models.Geofence) (models.Geofence, error) {
+	existing, err := s.GetGeofence(geofence.ID)
+	if err != nil {
+		return models.Geofence{}, err
+	}
+	if existing.Version == geofence.Version {
+		version := geofence.Version
+		geofence.CreatedAt = existing.CreatedAt
+		geofence.UpdatedAt = time.Now().UTC()
+		geofence.Version++
+		data, err := bson.Marshal(geofence)
+		if err != nil {
+			return models.Geofence{}, fmt.Errorf("failed to update geofence: %w", err)
+		}
+		result, err := s.DB.Exec(`UPDATE geofences SET name = ?, version = ?, doc = ? WHERE id = ? AND version = ?`,
+			geofence.Name, geofence.Version, data, geofence.ID, version)
+		if err != nil {
+			return models.Geofence{}, fmt.Errorf("failed to update geofence: %w", err)
+		}
+		if ok, err := updated(result); ok || err != nil {
+			return geofence, err
+		}
+	}
+
+	if existing, err = s.GetGeofence(geofence.ID); err != nil {
+		return models.Geofence{}, err
+	}
+	return existing, ErrOutdatedGeofenceVersion
+}
+
+// DeleteGeofence deletes a geofence. Its events are kept.
+func (s *SQLite) DeleteGeofence(id string) error {
+	return deleteByID(s.DB, "geofences", id, ErrGeofenceNotFound)
+}
+
+// SaveGeofenceEvent inserts or replaces a geofence event.
+func (s *SQLite) SaveGeofenceEvent(event models.GeofenceEvent) error {
+	data, err := bson.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to save geofence event: %w", err)
+	}
+	_, err = s.DB.Exec(`INSERT OR REPLACE INTO geofence_events (id, device_id, geofence_id, time, doc) VALUES (?, ?, ?, ?, ?)`,
+		event.ID, event.DeviceID, event.GeofenceID, unixMillis(event.Time), data)
+	if err != nil {
+		return fmt.Errorf("failed to save geofence event: %w", err)
+	}
+	return nil
+}
+
+// GetGeofenceEvents returns the geofence events with from <= time <= to, oldest first, optionally
+// limited to one device and/or one geofence.
+func (s *SQLite) GetGeofenceEvents(deviceID, geofenceID string, from, to time.Time) ([]models.GeofenceEvent, error) {
+	query := `SELECT doc FROM geofence_events WHERE time BETWEEN ? AND ?`
+	args := []interface{}{unixMillis(from), unixMillis(to)}
+	if deviceID != "" {
+		query += ` AND device_id = ?`
+		args = append(args, deviceID)
+	}
+	if geofenceID != "" {
+		query += ` AND geofence_id = ?`
+		args = append(args, geofenceID)
+	}
+	events, err := s.findGeofenceEvents(query+` ORDER BY time, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get geofence events: %w", err)
+	}
+	return events, nil
+}
+
+// GetLatestGeofenceEvents returns the newest event of a device for each geofence, keyed by geofence ID.
+func (s *SQLite) GetLatestGeofenceEvents(deviceID string) (map[string]models.GeofenceEvent, error) {
+	events, err := s.findGeofenceEvents(`SELECT doc FROM geofence_events WHERE device_id = ? ORDER BY time`, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest geofence events: %w", err)
+	}
+	latest := make(map[string]models.GeofenceEvent)
+	for _, event := range events {
+		latest[event.GeofenceID] = event
+	}
+	return latest, nil
+}
+
+func (s *SQLite) findGeofenceEvents(query string, args ...interface{}) ([]models.GeofenceEvent, error) {
+	events := []models.GeofenceEvent{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var event models.GeofenceEvent
+		if err := bson.Unmarshal(doc, &event); err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	}, query, args...)
+	return events, err
+}
+
+// GetAlertRules returns every alert rule, ordered by name.
+func (s *SQLite) GetAlertRules() ([]models.AlertRule, error) {
+	rules := []models.AlertRule{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var rule models.AlertRule
+		if err := bson.Unmarshal(doc, &rule); err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+		return nil
+	}, `SELECT doc FROM alert_rules ORDER BY name, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode alert rules: %w", err)
+	}
+	return rules, nil
+}
+
+// GetAlertRule returns an alert rule by ID.
+func (s *SQLite) GetAlertRule(id string) (models.AlertRule, error) {
+	var rule models.AlertRule
+	err := getDoc(s.DB, &rule, `SELECT doc FROM alert_rules WHERE id = ?`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.AlertRule{}, ErrAlertRuleNotFound
+	}
+	if err != nil {
+		return models.AlertRule{}, fmt.Errorf("failed to get alert rule: %w", err)
+	}
+	return rule, nil
+}
+
+// CreateAlertRule inserts a new alert rule with a generated ID.
+func (s *SQLite) CreateAlertRule(rule models.AlertRule) (models.AlertRule, error) {
+	now := time.Now().UTC()
+	rule.ID = primitive.NewObjectID().Hex()
+	rule.Version = 1
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+	data, err := bson.Marshal(rule)
+	if err != nil {
+		return models.AlertRule{}, fmt.Errorf("failed to create alert rule: %w", err)
+	}
+	_, err = s.DB.Exec(`INSERT INTO alert_rules (id, name, version, doc) VALUES (?, ?, ?, ?)`, rule.ID, rule.Name, rule.Version, data)
+	if err != nil {
+		return models.AlertRule{}, fmt.Errorf("failed to create alert rule: %w", err)
+	}
+	return rule, nil
+}
+
+// UpdateAlertRule replaces an alert rule if its stored version still matches rule.Version.
+// On a version mismatch the stored rule is returned with ErrOutdatedAlertRuleVersion.
+func (s *SQLite) UpdateAlertRule(rule models.AlertRule) (models.AlertRule, error) {
+	existing, err := s.GetAlertRule(rule.ID)
+	if err != nil {
+		return models.AlertRule{}, err
+	}
+	if existing.Version == rule.Version {
+		version := rule.Version
+		rule.CreatedAt = existing.CreatedAt
+		rule.UpdatedAt = time.Now().UTC()
+		rule.Version++
+		data, err := bson.Marshal(rule)
+		if err != nil {
+			return models.AlertRule{}, fmt.Errorf("failed to update alert rule: %w", err)
+		}
+		result, err := s.DB.Exec(`UPDATE alert_rules SET name = ?, version = ?, doc = ? WHERE id = ? AND version = ?`,
+			rule.Name, rule.Version, data, rule.ID, version)
+		if err != nil {
+			return models.AlertRule{}, fmt.Errorf("failed to update alert rule: %w", err)
+		}
+		if ok, err := updated(result); ok || err != nil {
+			return rule, err
+		}
+	}
+
+	if existing, err = s.GetAlertRule(rule.ID); err != nil {
+		return models.AlertRule{}, err
+	}
+	return existing, ErrOutdatedAlertRuleVersion
+}
+
+// DeleteAlertRule deletes an alert rule. Its alerts are kept.
+func (s *SQLite) DeleteAlertRule(id string) error {
+	return deleteByID(s.DB, "alert_rules", id, ErrAlertRuleNotFound)
+}
+
+// GetLatestAlert returns the most recently triggered alert of a rule for a device, or nil if there is none.
+func (s *SQLite) GetLatestAlert(ruleID, deviceID string) (*models.Alert, error) {
+	var alert models.Alert
+	err := getDoc(s.DB, &alert, `SELECT doc FROM alerts WHERE rule_id = ? AND device_id = ?
+		ORDER BY last_triggered_at DESC LIMIT 1`, ruleID, deviceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest alert: %w", err)
+	}
+	return &alert, nil
+}
+
+func getAlert(q sqlQuerier, id string) (models.Alert, error) {
+	var alert models.Alert
+	err := getDoc(q, &alert, `SELECT doc FROM alerts WHERE id = ?`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Alert{}, ErrAlertNotFound
+	}
+	if err != nil {
+		return models.Alert{}, fmt.Errorf("failed to get alert: %w", err)
+	}
+	return alert, nil
+}
+
+// writeAlert inserts or replaces an alert.
+func writeAlert(q sqlQuerier, alert models.Alert) error {
+	data, err := bson.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`INSERT OR REPLACE INTO alerts (id, rule_id, device_id, status, last_triggered_at, doc) VALUES (?, ?, ?, ?, ?, ?)`,
+		alert.ID, alert.RuleID, alert.DeviceID, alert.Status, unixMillis(alert.LastTriggeredAt), data)
+	return err
+}
+
+// CreateAlert inserts a new alert with a generated ID.
+func (s *SQLite) CreateAlert(alert models.Alert) (models.Alert, error) {
+	alert.ID = primitive.NewObjectID().Hex()
+	if err := writeAlert(s.DB, alert); err != nil {
+		return models.Alert{}, fmt.Errorf("failed to create alert: %w", err)
+	}
+	return alert, nil
+}
+
+// RecordAlertTrigger counts another trigger of an unresolved alert.
+func (s *SQLite) RecordAlertTrigger(id string, at time.Time, message string) (models.Alert, error) {
+	return s.changeAlert(id, func(alert *models.Alert) error {
+		alert.Count++
+		alert.LastTriggeredAt = storedTime(at)
+		alert.Message = message
+		return nil
+	})
+}
+
+// GetAlert returns an alert by ID.
+func (s *SQLite) GetAlert(id string) (models.Alert, error) {
+	return getAlert(s.DB, id)
+}
+
+// GetAlerts returns the alerts matching the filter, most recently triggered first.
+func (s *SQLite) GetAlerts(filter AlertFilter) ([]models.Alert, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Status != "" {
+		conditions = append(conditions, `status = ?`)
+		args = append(args, filter.Status)
+	}
+	if filter.DeviceID != "" {
+		conditions = append(conditions, `device_id = ?`)
+		args = append(args, filter.DeviceID)
+	}
+	if filter.DeviceIDs != nil {
+		if len(filter.DeviceIDs) == 0 {
+			return []models.Alert{}, nil
+		}
+		conditions = append(conditions, `device_id IN (?`+strings.Repeat(`, ?`, len(filter.DeviceIDs)-1)+`)`)
+		for _, deviceID := range filter.DeviceIDs {
+			args = append(args, deviceID)
+		}
+	}
+	if filter.RuleID != "" {
+		conditions = append(conditions, `rule_id = ?`)
+		args = append(args, filter.RuleID)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, `last_triggered_at >= ?`)
+		args = append(args, unixMillis(filter.From))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, `last_triggered_at <= ?`)
+		args = append(args, unixMillis(filter.To))
+	}
+
+	query := `SELECT doc FROM alerts`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+	query += ` ORDER BY last_triggered_at DESC, id DESC LIMIT ?`
+	args = append(args, limit)
+
+	alerts := []models.Alert{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var alert models.Alert
+		if err := bson.Unmarshal(doc, &alert); err != nil {
+			return err
+		}
+		alerts = append(alerts, alert)
+		return nil
+	}, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alerts: %w", err)
+	}
+	return alerts, nil
+}
+
+// AcknowledgeAlert marks an open alert as acknowledged.
+func (s *SQLite) AcknowledgeAlert(id, by, note string) (models.Alert, error) {
+	now := storedTime(time.Now())
+	return s.changeAlertStatus(id, []string{models.AlertOpen}, func(alert *models.Alert) {
+		alert.Status = models.AlertAcknowledged
+		alert.AcknowledgedAt = &now
+		alert.AcknowledgedBy = by
+		if note != "" {
+			alert.Note = note
+		}
+	})
+}
+
+// ResolveAlert marks an open or acknowledged alert as resolved.
+func (s *SQLite) ResolveAlert(id, by, note string) (models.Alert, error) {
+	now := storedTime(time.Now())
+	return s.changeAlertStatus(id, []string{models.AlertOpen, models.AlertAcknowledged}, func(alert *models.Alert) {
+		alert.Status = models.AlertResolved
+		alert.ResolvedAt = &now
+		alert.ResolvedBy = by
+		if note != "" {
+			alert.Note = note
+		}
+	})
+}
+
+// changeAlertStatus applies change to an alert whose status is one of from. If the alert exists in
+// another status, it is returned unchanged with ErrAlertStatus.
+func (s *SQLite) changeAlertStatus(id string, from []string, change func(alert *models.Alert)) (models.Alert, error) {
+	return s.changeAlert(id, func(alert *models.Alert) error {
+		if !containsString(from, alert.Status) {
+			return ErrAlertStatus
+		}
+		change(alert)
+		return nil
+	})
+}
+
+// changeAlert applies change to an alert in a transaction and returns the result. When change
+// fails, the stored alert is returned with its error.
+func (s *SQLite) changeAlert(id string, change func(alert *models.Alert) error) (models.Alert, error) {
+	var alert models.Alert
+	var changeErr error
+	err := s.inTx(func(tx *sql.Tx) error {
+		var err error
+		if alert, err = getAlert(tx, id); err != nil {
+			return err
+		}
+		current := alert
+		if changeErr = change(&alert); changeErr != nil {
+			alert = current
+			return nil
+		}
+		if err := writeAlert(tx, alert); err != nil {
+			return fmt.Errorf("failed to update alert: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.Alert{}, err
+	}
+	return alert, changeErr
+}
+
+// SaveTrip inserts or replaces a trip.
+func (s *SQLite) SaveTrip(trip models.Trip) error {
+	data, err := bson.Marshal(trip)
+	if err != nil {
+		return fmt.Errorf("failed to save trip: %w", err)
+	}
+	_, err = s.DB.Exec(`INSERT OR REPLACE INTO trips (id, device_id, start_time, end_time, doc) VALUES (?, ?, ?, ?, ?)`,
+		trip.ID, trip.DeviceID, unixMillis(trip.StartTime), unixMillis(trip.EndTime), data)
+	if err != nil {
+		return fmt.Errorf("failed to save trip: %w", err)
+	}
+	return nil
+}
+
+// SaveStop inserts or replaces a stop.
+func (s *SQLite) SaveStop(stop models.Stop) error {
+	data, err := bson.Marshal(stop)
+	if err != nil {
+		return fmt.Errorf("failed to save stop: %w", err)
+	}
+	_, err = s.DB.Exec(`INSERT OR REPLACE INTO stops (id, device_id, start_time, end_time, doc) VALUES (?, ?, ?, ?, ?)`,
+		stop.ID, stop.DeviceID, unixMillis(stop.StartTime), unixMillis(stop.EndTime), data)
+	if err != nil {
+		return fmt.Errorf("failed to save stop: %w", err)
+	}
+	return nil
+}
+
+// GetTrips returns the trips of a device overlapping [from, to], oldest first.
+func (s *SQLite) GetTrips(deviceID string, from, to time.Time) ([]models.Trip, error) {
+	trips := []models.Trip{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var trip models.Trip
+		if err := bson.Unmarshal(doc, &trip); err != nil {
+			return err
+		}
+		trips = append(trips, trip)
+		return nil
+	}, `SELECT doc FROM trips WHERE device_id = ? AND start_time <= ? AND end_time >= ? ORDER BY start_time`,
+		deviceID, unixMillis(to), unixMillis(from))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trips: %w", err)
+	}
+	return trips, nil
+}
+
+// GetStops returns the stops of a device overlapping [from, to], oldest first.
+func (s *SQLite) GetStops(deviceID string, from, to time.Time) ([]models.Stop, error) {
+	stops := []models.Stop{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var stop models.Stop
+		if err := bson.Unmarshal(doc, &stop); err != nil {
+			return err
+		}
+		stops = append(stops, stop)
+		return nil
+	}, `SELECT doc FROM stops WHERE device_id = ? AND start_time <= ? AND end_time >= ? ORDER BY start_time`,
+		deviceID, unixMillis(to), unixMillis(from))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stops: %w", err)
+	}
+	return stops, nil
+}
+
+// SaveAvailabilityEvent appends an online/offline transition to the availability log.
+func (s *SQLite) SaveAvailabilityEvent(event models.AvailabilityEvent) error {
+	data, err := bson.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to save availability event: %w", err)
+	}
+	_, err = s.DB.Exec(`INSERT INTO availability_events (device_id, time, detected_at, doc) VALUES (?, ?, ?, ?)`,
+		event.DeviceID, unixMillis(event.Time), unixMillis(event.DetectedAt), data)
+	if err != nil {
+		return fmt.Errorf("failed to save availability event: %w", err)
+	}
+	return nil
+}
+
+// GetLatestAvailabilityEvent returns the newest transition of a device at or before t, or nil if there is none.
+func (s *SQLite) GetLatestAvailabilityEvent(deviceID string, t time.Time) (*models.AvailabilityEvent, error) {
+	var event models.AvailabilityEvent
+	err := getDoc(s.DB, &event, `SELECT doc FROM availability_events WHERE device_id = ? AND time <= ?
+		ORDER BY time DESC, detected_at DESC, id LIMIT 1`, deviceID, unixMillis(t))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest availability event: %w", err)
+	}
+	return &event, nil
+}
+
+// GetAvailabilityEvents returns the transitions of a device with from <= time <= to, oldest first.
+func (s *SQLite) GetAvailabilityEvents(deviceID string, from, to time.Time) ([]models.AvailabilityEvent, error) {
+	availability := []models.AvailabilityEvent{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var event models.AvailabilityEvent
+		if err := bson.Unmarshal(doc, &event); err != nil {
+			return err
+		}
+		availability = append(availability, event)
+		return nil
+	}, `SELECT doc FROM availability_events WHERE device_id = ? AND time BETWEEN ? AND ? ORDER BY time, detected_at, id`,
+		deviceID, unixMillis(from), unixMillis(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get availability events: %w", err)
+	}
+	return availability, nil
+}
+
+// SaveNotificationDelivery inserts or replaces a delivery log entry.
+func (s *SQLite) SaveNotificationDelivery(delivery models.NotificationDelivery) error {
+	data, err := bson.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to save notification delivery: %w", err)
+	}
+	_, err = s.DB.Exec(`INSERT OR REPLACE INTO notification_deliveries (id, channel, alert_id, status, created_at, doc) VALUES (?, ?, ?, ?, ?, ?)`,
+		delivery.ID, delivery.Channel, delivery.AlertID, delivery.Status, unixMillis(delivery.CreatedAt), data)
+	if err != nil {
+		return fmt.Errorf("failed to save notification delivery: %w", err)
+	}
+	return nil
+}
+
+// GetNotificationDeliveries returns delivery log entries, newest first, optionally filtered by
+// channel, alert and status. A limit of 0 returns every entry.
+func (s *SQLite) GetNotificationDeliveries(channel, alertID, status string, limit int64) ([]models.NotificationDelivery, error) {
+	query := `SELECT doc FROM notification_deliveries WHERE (? = '' OR channel = ?) AND (? = '' OR alert_id = ?) AND (? = '' OR status = ?)
+		ORDER BY created_at DESC, id LIMIT ?`
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+	deliveries, err := s.findDeliveries(query, channel, channel, alertID, alertID, status, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notification deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// GetUnfinishedNotificationDeliveries returns the deliveries that are still pending or waiting
+// for a retry, oldest first.
+func (s *SQLite) GetUnfinishedNotificationDeliveries() ([]models.NotificationDelivery, error) {
+	deliveries, err := s.findDeliveries(`SELECT doc FROM notification_deliveries WHERE status IN (?, ?) ORDER BY created_at, id`,
+		models.DeliveryPending, models.DeliveryRetrying)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unfinished notification deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (s *SQLite) findDeliveries(query string, args ...interface{}) ([]models.NotificationDelivery, error) {
+	deliveries := []models.NotificationDelivery{}
+	err := forEachDoc(s.DB, func(doc bson.Raw) error {
+		var delivery models.NotificationDelivery
+		if err := bson.Unmarshal(doc, &delivery); err != nil {
+			return err
+		}
+		deliveries = append(deliveries, delivery)
+		return nil
+	}, query, args...)
+	return deliveries, err
+}
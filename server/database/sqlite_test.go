@@ -0,0 +1,41 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"OneStepGPSLeo/models"
+)
+
+func TestSQLiteBackfillsDevicePositions(t *testing.T) {
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewSQLite: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	device := models.Device{DeviceID: "device", LatestDevicePoint: &models.DevicePoint{Lat: 34.05, Lng: -118.24}}
+	if err := db.InsertDevice(device); err != nil {
+		t.Fatalf("InsertDevice: %v", err)
+	}
+
+	// Go back to a database stored before the position columns
+	version := len(sqliteMigrations)
+	if _, err := db.DB.Exec(`DROP INDEX devices_lat_lng;
+		ALTER TABLE devices DROP COLUMN lat;
+		ALTER TABLE devices DROP COLUMN lng;
+		DELETE FROM schema_migrations WHERE version = ?`, version); err != nil {
+		t.Fatalf("failed to undo migration %d: %v", version, err)
+	}
+
+	applied, err := db.Migrate()
+	if err != nil || len(applied) != 1 || applied[0].Version != version {
+		t.Fatalf("Migrate = %+v, %v, want migration %d", applied, err, version)
+	}
+	page, err := db.FindDevices(DeviceQuery{BBox: &BoundingBox{MinLat: 34, MinLng: -119, MaxLat: 35, MaxLng: -118}})
+	if err != nil || page.Total != 1 {
+		t.Errorf("found %d devices in the box after the backfill, %v, want 1", page.Total, err)
+	}
+}
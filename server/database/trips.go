@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SaveTrip inserts or replaces a trip. Trip IDs are derived from the device and start time,
+// so reprocessing the same points does not create duplicates.
+func (db *MongoDB) SaveTrip(trip models.Trip) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.TripCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": trip.ID}, trip, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save trip: %w", err)
+	}
+	return nil
+}
+
+// SaveStop inserts or replaces a stop.
+func (db *MongoDB) SaveStop(stop models.Stop) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.StopCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": stop.ID}, stop, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save stop: %w", err)
+	}
+	return nil
+}
+
+// GetTrips returns the trips of a device overlapping [from, to], oldest first.
+func (db *MongoDB) GetTrips(deviceID string, from, to time.Time) ([]models.Trip, error) {
+	trips := []models.Trip{}
+	err := db.findOverlapping(db.TripCollectionName, deviceID, from, to, &trips)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trips: %w", err)
+	}
+	return trips, nil
+}
+
+// GetStops returns the stops of a device overlapping [from, to], oldest first.
+func (db *MongoDB) GetStops(deviceID string, from, to time.Time) ([]models.Stop, error) {
+	stops := []models.Stop{}
+	err := db.findOverlapping(db.StopCollectionName, deviceID, from, to, &stops)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stops: %w", err)
+	}
+	return stops, nil
+}
+
+// findOverlapping decodes the documents of a device whose start_time/end_time interval overlaps [from, to].
+func (db *MongoDB) findOverlapping(collectionName, deviceID string, from, to time.Time, results interface{}) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(collectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"device_id":  deviceID,
+		"start_time": bson.M{"$lte": to},
+		"end_time":   bson.M{"$gte": from},
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "start_time", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	return cursor.All(ctx, results)
+}
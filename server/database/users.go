@@ -0,0 +1,292 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"OneStepGPSLeo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrUserNotFound        = errors.New("user not found")
+	ErrUsernameTaken       = errors.New("username is already taken")
+	ErrOutdatedUserVersion = errors.New("outdated user version")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// usernameKey is the case-insensitive form of a username the unique index is built on.
+func usernameKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// CountUsers returns the number of accounts.
+func (db *MongoDB) CountUsers() (int64, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AccountCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count, nil
+}
+
+// GetUsers returns every account, ordered by username.
+func (db *MongoDB) GetUsers() ([]models.User, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AccountCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "username_key", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return users, nil
+}
+
+// GetUser returns an account by ID.
+func (db *MongoDB) GetUser(id string) (models.User, error) {
+	return db.findUser(bson.M{"_id": id})
+}
+
+// GetUserByUsername returns an account by username, ignoring case.
+func (db *MongoDB) GetUserByUsername(username string) (models.User, error) {
+	return db.findUser(bson.M{"username_key": usernameKey(username)})
+}
+
+func (db *MongoDB) findUser(filter bson.M) (models.User, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AccountCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := collection.FindOne(ctx, filter).Decode(&user); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.User{}, ErrUserNotFound
+		}
+		return models.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	return user, nil
+}
+
+// CountAdmins returns the number of accounts with the admin role.
+func (db *MongoDB) CountAdmins() (int64, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AccountCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{"role": models.RoleAdmin})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count admins: %w", err)
+	}
+	return count, nil
+}
+
+// CreateUser inserts a new account with a generated ID. The password must already be hashed.
+// Accounts without a role are viewers.
+func (db *MongoDB) CreateUser(user models.User) (models.User, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AccountCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	user.ID = primitive.NewObjectID().Hex()
+	user.Username = strings.TrimSpace(user.Username)
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Version = 1
+	if user.Role == "" {
+		user.Role = models.RoleViewer
+	}
+
+	doc, err := bson.Marshal(user)
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to encode user: %w", err)
+	}
+	var fields bson.M
+	if err := bson.Unmarshal(doc, &fields); err != nil {
+		return models.User{}, fmt.Errorf("failed to encode user: %w", err)
+	}
+	fields["username_key"] = usernameKey(user.Username)
+
+	if _, err := collection.InsertOne(ctx, fields); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return models.User{}, ErrUsernameTaken
+		}
+		return models.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+	return user, nil
+}
+
+// UpdateUserAccess replaces the role and device overrides of an account. The version must match the
+// stored one, otherwise the current account is returned with ErrOutdatedUserVersion.
+func (db *MongoDB) UpdateUserAccess(user models.User) (models.User, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AccountCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": user.ID, "version": user.Version}
+	update := bson.M{
+		"$set": bson.M{
+			"role":              user.Role,
+			"upstream_user_ids": user.UpstreamUserIDs,
+			"device_ids":        user.DeviceIDs,
+			"hidden_device_ids": user.HiddenDeviceIDs,
+			"updated_at":        time.Now().UTC(),
+		},
+		"$inc": bson.M{"version": 1},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.User
+	if err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return models.User{}, fmt.Errorf("failed to update user: %w", err)
+		}
+		existing, err := db.GetUser(user.ID)
+		if err != nil {
+			return models.User{}, err
+		}
+		return existing, ErrOutdatedUserVersion
+	}
+	return updated, nil
+}
+
+// SetUserRole changes the role of an account without checking or changing its version.
+func (db *MongoDB) SetUserRole(id, role string) error {
+	return db.updateUser(id, bson.M{"role": role})
+}
+
+// SetUserPassword replaces the password hash of an account.
+func (db *MongoDB) SetUserPassword(id, passwordHash string) error {
+	return db.updateUser(id, bson.M{"password_hash": passwordHash})
+}
+
+// RecordLogin stores the time of a successful login.
+func (db *MongoDB) RecordLogin(id string, at time.Time) error {
+	return db.updateUser(id, bson.M{"last_login_at": at})
+}
+
+func (db *MongoDB) updateUser(id string, fields bson.M) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.AccountCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fields["updated_at"] = time.Now().UTC()
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// CreateSession stores a new login session with a generated ID.
+func (db *MongoDB) CreateSession(session models.Session) (models.Session, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.SessionCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	session.ID = primitive.NewObjectID().Hex()
+	session.CreatedAt = time.Now().UTC()
+	if _, err := collection.InsertOne(ctx, session); err != nil {
+		return models.Session{}, fmt.Errorf("failed to create session: %w", err)
+	}
+	return session, nil
+}
+
+// GetSession returns a session by ID. Expired sessions may still be returned until MongoDB removes them.
+func (db *MongoDB) GetSession(id string) (models.Session, error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.SessionCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var session models.Session
+	if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&session); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.Session{}, ErrSessionNotFound
+		}
+		return models.Session{}, fmt.Errorf("failed to get session: %w", err)
+	}
+	return session, nil
+}
+
+// RevokeSession ends a session. It returns ErrSessionNotFound if there is no such session or it
+// was revoked already, so of two concurrent calls only one ends the session.
+func (db *MongoDB) RevokeSession(id string) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.SessionCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}})
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeUserSessions ends every session of a user except keepID, which may be empty.
+func (db *MongoDB) RevokeUserSessions(userID, keepID string) error {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.SessionCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "_id": bson.M{"$ne": keepID}, "revoked_at": bson.M{"$exists": false}}
+	if _, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}}); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
+
+// GetDeviceOwners returns the upstream user_id_list of every device, keyed by device_id.
+// ObjectIDs maps the MongoDB _id (hex) of each device to its device_id.
+func (db *MongoDB) GetDeviceOwners() (owners map[string][]string, objectIDs map[string]string, err error) {
+	collection := db.Client.Database(db.DatabaseName).Collection(db.DeviceCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	projection := bson.M{"_id": 1, "device_id": 1, "user_id_list": 1}
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find device owners: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var devices []struct {
+		ID         primitive.ObjectID `bson:"_id"`
+		DeviceID   string             `bson:"device_id"`
+		UserIDList []string           `bson:"user_id_list"`
+	}
+	if err := cursor.All(ctx, &devices); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode device owners: %w", err)
+	}
+
+	owners = make(map[string][]string, len(devices))
+	objectIDs = make(map[string]string, len(devices))
+	for _, device := range devices {
+		owners[device.DeviceID] = device.UserIDList
+		objectIDs[device.ID.Hex()] = device.DeviceID
+	}
+	return owners, objectIDs, nil
+}
@@ -0,0 +1,174 @@
+/*
+Package events provides the in-process event hub that feeds the device stream.
+
+Ingestion, settings and icon handlers publish events to the Hub. Subscribers get
+every event published after they subscribed, and a reconnecting subscriber can
+pass the last event ID it saw to receive exactly the events it missed, as long
+as they are still in the hub's replay buffer.
+*/
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/clock"
+)
+
+// Event types published to the hub.
+const (
+	TypeDevice   = "device"   // A device was inserted or updated by ingestion
+	TypeSettings = "settings" // Device settings were saved
+	TypeIcon     = "icon"     // A device icon was uploaded, changed or removed
+	TypeStatus   = "status"   // A device went online or offline
+	TypeGeofence = "geofence" // A device entered, left or dwelled in a geofence
+	TypeAlert    = "alert"    // An alert was raised or resolved
+)
+
+// subscriberBuffer is the number of events a subscriber may lag behind before it is dropped.
+const subscriberBuffer = 256
+
+// Event is a single change pushed to subscribers.
+type Event struct {
+	ID       string      `json:"id"`
+	Type     string      `json:"type"`
+	DeviceID string      `json:"device_id,omitempty"`
+	Time     string      `json:"time"`
+	Data     interface{} `json:"data"`
+
+	seq uint64
+}
+
+// Hub fans published events out to subscribers and keeps the most recent ones for resume.
+type Hub struct {
+	mutex       sync.Mutex
+	clock       clock.Clock
+	epoch       string // Distinguishes event IDs of different server runs
+	nextSeq     uint64
+	buffer      []Event
+	bufferSize  int
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives events on C. C is closed when the subscription is cancelled
+// or when the subscriber falls too far behind; it should then reconnect with its last event ID.
+type Subscription struct {
+	C   chan Event
+	hub *Hub
+}
+
+// NewHub creates a hub that keeps the last bufferSize events for resume. clk dates the events.
+func NewHub(bufferSize int, clk clock.Clock) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = 1000
+	}
+	return &Hub{
+		clock:       clk,
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36), // Wall clock, a replayed session is still another run
+		nextSeq:     1,
+		bufferSize:  bufferSize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends an event to all subscribers.
+func (h *Hub) Publish(eventType, deviceID string, data interface{}) Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	event := Event{
+		ID:       fmt.Sprintf("%s-%d", h.epoch, h.nextSeq),
+		Type:     eventType,
+		DeviceID: deviceID,
+		Time:     h.clock.Now().Format(time.RFC3339Nano),
+		Data:     data,
+		seq:      h.nextSeq,
+	}
+	h.nextSeq++
+
+	h.buffer = append(h.buffer, event)
+	if len(h.buffer) > h.bufferSize {
+		h.buffer = h.buffer[len(h.buffer)-h.bufferSize:]
+	}
+
+	for sub := range h.subscribers {
+		select {
+		case sub.C <- event:
+		default:
+			// The subscriber is not keeping up, drop it so it resumes from the buffer instead of blocking ingestion
+			delete(h.subscribers, sub)
+			close(sub.C)
+		}
+	}
+
+	return event
+}
+
+// Subscribe registers a subscriber. When lastEventID is not empty, the events published after it
+// are returned as missed. resumed is false when those events are no longer available (unknown ID,
+// server restart or evicted from the buffer); the subscriber should then reload its full state.
+func (h *Hub) Subscribe(lastEventID string) (sub *Subscription, missed []Event, resumed bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sub = &Subscription{C: make(chan Event, subscriberBuffer), hub: h}
+	h.subscribers[sub] = struct{}{}
+
+	if lastEventID == "" {
+		return sub, nil, true
+	}
+
+	seq, ok := h.parseID(lastEventID)
+	if !ok || seq >= h.nextSeq {
+		return sub, nil, false
+	}
+	if seq == h.nextSeq-1 {
+		return sub, nil, true // Nothing was missed
+	}
+	if len(h.buffer) == 0 || h.buffer[0].seq > seq+1 {
+		return sub, nil, false // Part of what was missed has been evicted
+	}
+
+	for _, event := range h.buffer {
+		if event.seq > seq {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed, true
+}
+
+// Cancel unregisters the subscription and closes its channel.
+func (s *Subscription) Cancel() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	if _, ok := s.hub.subscribers[s]; ok {
+		delete(s.hub.subscribers, s)
+		close(s.C)
+	}
+}
+
+// LastEventID returns the ID of the most recently published event, or "" if there is none.
+func (h *Hub) LastEventID() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.buffer) == 0 {
+		return ""
+	}
+	return h.buffer[len(h.buffer)-1].ID
+}
+
+// parseID extracts the sequence number of an event ID issued by this hub.
+func (h *Hub) parseID(id string) (uint64, bool) {
+	epoch, seqStr, found := strings.Cut(id, "-")
+	if !found || epoch != h.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
@@ -0,0 +1,163 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+)
+
+// publish publishes count device events and returns them.
+func publish(h *Hub, count int) []Event {
+	var published []Event
+	for i := 0; i < count; i++ {
+		published = append(published, h.Publish(TypeDevice, fmt.Sprintf("device-%d", i), i))
+	}
+	return published
+}
+
+// received drains the events waiting on a subscription.
+func received(sub *Subscription) []Event {
+	var events []Event
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func ids(events []Event) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func TestSubscribeReceivesNewEvents(t *testing.T) {
+	h := NewHub(10, clock.System)
+	publish(h, 2)
+	sub, missed, resumed := h.Subscribe("")
+	defer sub.Cancel()
+	if len(missed) != 0 || !resumed {
+		t.Errorf("new subscriber missed %d events, resumed %v, want none and true", len(missed), resumed)
+	}
+
+	published := publish(h, 3)
+	if got := ids(received(sub)); fmt.Sprint(got) != fmt.Sprint(ids(published)) {
+		t.Errorf("received %v, want %v", got, ids(published))
+	}
+	if h.LastEventID() != published[2].ID {
+		t.Errorf("LastEventID = %s, want %s", h.LastEventID(), published[2].ID)
+	}
+}
+
+func TestEventsAreDatedByTheClock(t *testing.T) {
+	start := time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+	virtual := clock.NewVirtual(start)
+	h := NewHub(10, virtual)
+
+	first := h.Publish(TypeDevice, "device", nil)
+	virtual.Advance(5 * time.Second)
+	second := h.Publish(TypeDevice, "device", nil)
+	if first.Time != "2024-11-13T06:00:00Z" || second.Time != "2024-11-13T06:00:05Z" {
+		t.Errorf("event times = %s, %s, want the virtual clock", first.Time, second.Time)
+	}
+}
+
+func TestSubscribeResumesAfterLastEventID(t *testing.T) {
+	h := NewHub(10, clock.System)
+	published := publish(h, 5)
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		missed      []Event
+		resumed     bool
+	}{
+		{"missed events", published[1].ID, published[2:], true},
+		{"nothing missed", published[4].ID, nil, true},
+		{"unknown epoch", "otherrun-3", nil, false},
+		{"malformed", "garbage", nil, false},
+		{"from the future", fmt.Sprintf("%s-%d", h.epoch, 9), nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sub, missed, resumed := h.Subscribe(test.lastEventID)
+			defer sub.Cancel()
+			if resumed != test.resumed {
+				t.Errorf("resumed = %v, want %v", resumed, test.resumed)
+			}
+			if fmt.Sprint(ids(missed)) != fmt.Sprint(ids(test.missed)) {
+				t.Errorf("missed %v, want %v", ids(missed), ids(test.missed))
+			}
+		})
+	}
+}
+
+func TestSubscribeResetsAfterEviction(t *testing.T) {
+	h := NewHub(3, clock.System)
+	published := publish(h, 5) // The buffer keeps the last 3
+
+	sub, missed, resumed := h.Subscribe(published[0].ID)
+	defer sub.Cancel()
+	if resumed || len(missed) != 0 {
+		t.Errorf("resuming after an evicted event: resumed %v with %d events, want a reset", resumed, len(missed))
+	}
+
+	// The oldest kept event directly follows published[1], nothing is lost
+	sub2, missed, resumed := h.Subscribe(published[1].ID)
+	defer sub2.Cancel()
+	if !resumed || fmt.Sprint(ids(missed)) != fmt.Sprint(ids(published[2:])) {
+		t.Errorf("resuming at the buffer edge: resumed %v with %v, want %v", resumed, ids(missed), ids(published[2:]))
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	h := NewHub(1000, clock.System)
+	slow, _, _ := h.Subscribe("")
+	fast, _, _ := h.Subscribe("")
+	defer fast.Cancel()
+
+	var fastReceived []Event
+	for i := 0; i < subscriberBuffer+10; i++ {
+		h.Publish(TypeDevice, "device", i)
+		fastReceived = append(fastReceived, received(fast)...)
+	}
+
+	kept := received(slow)
+	if len(kept) != subscriberBuffer {
+		t.Errorf("slow subscriber received %d events, want the %d that fit its buffer", len(kept), subscriberBuffer)
+	}
+	if _, ok := <-slow.C; ok {
+		t.Errorf("slow subscriber was not closed")
+	}
+	if len(fastReceived) != subscriberBuffer+10 {
+		t.Errorf("fast subscriber received %d events, want all %d", len(fastReceived), subscriberBuffer+10)
+	}
+
+	// Reconnecting with the last event it got, it receives exactly the rest
+	sub, missed, resumed := h.Subscribe(kept[len(kept)-1].ID)
+	defer sub.Cancel()
+	if !resumed || len(missed) != 10 || missed[0].Data != subscriberBuffer {
+		t.Errorf("resumed %v with %d missed events, want the last 10", resumed, len(missed))
+	}
+}
+
+func TestCancel(t *testing.T) {
+	h := NewHub(10, clock.System)
+	sub, _, _ := h.Subscribe("")
+	sub.Cancel()
+	sub.Cancel() // Cancelling twice is harmless
+	if _, ok := <-sub.C; ok {
+		t.Errorf("cancelled subscription is still open")
+	}
+	h.Publish(TypeDevice, "device", nil) // Must not send on the closed channel
+}
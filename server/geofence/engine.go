@@ -0,0 +1,194 @@
+package geofence
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/groups"
+	"OneStepGPSLeo/models"
+)
+
+// Store loads geofences and persists geofence events.
+type Store interface {
+	GetGeofences() ([]models.Geofence, error)
+	SaveGeofenceEvent(event models.GeofenceEvent) error
+	GetLatestGeofenceEvents(deviceID string) (map[string]models.GeofenceEvent, error)
+}
+
+// presence is a device being inside a geofence.
+type presence struct {
+	since   time.Time
+	dwelled bool // Dwell event already recorded for this visit
+}
+
+// deviceState is the geofence state of one device.
+type deviceState struct {
+	groupIDs []string
+	inside   map[string]*presence // Keyed by geofence ID
+	lastTime time.Time
+	restored bool
+}
+
+// Engine keeps the geofences in memory and tracks which of them each device is in.
+type Engine struct {
+	Store  Store
+	Hub    *events.Hub
+	Groups *groups.Directory // Server-side groups, next to the upstream ones
+
+	mutex     sync.Mutex
+	geofences []models.Geofence
+	loaded    bool
+	states    map[string]*deviceState
+}
+
+// NewEngine creates a geofence engine. Geofences are loaded on the first point.
+func NewEngine(store Store, hub *events.Hub, directory *groups.Directory) *Engine {
+	return &Engine{Store: store, Hub: hub, Groups: directory, states: make(map[string]*deviceState)}
+}
+
+// Reload reads the geofences from the store again. It must be called after geofences change.
+func (e *Engine) Reload() error {
+	geofences, err := e.Store.GetGeofences()
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	e.geofences = geofences
+	e.loaded = true
+	e.mutex.Unlock()
+	return nil
+}
+
+// ObserveDevice keeps the upstream group membership (device_groups_id_list) of a device.
+func (e *Engine) ObserveDevice(deviceID string, device *models.Device, settings models.DeviceSettings) {
+	groupIDs := device.DeviceGroupsIDList
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.state(deviceID).groupIDs = groupIDs
+}
+
+// ProcessPoint checks a new point of a device against its geofences. Points older than
+// the last processed point of the device are ignored.
+func (e *Engine) ProcessPoint(point models.DevicePointRecord, settings models.DeviceSettings) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.loaded {
+		geofences, err := e.Store.GetGeofences()
+		if err != nil {
+			log.Printf("Failed to load geofences: %v", err)
+			return
+		}
+		e.geofences = geofences
+		e.loaded = true
+	}
+
+	state := e.state(point.DeviceID)
+	if !point.DtTracker.After(state.lastTime) {
+		return
+	}
+	state.lastTime = point.DtTracker
+	e.restore(point.DeviceID, state)
+
+	groupIDs := append(e.Groups.GroupsOf(point.DeviceID), state.groupIDs...)
+	active := make(map[string]bool, len(e.geofences))
+	for _, geofence := range e.geofences {
+		if !AppliesTo(geofence, point.DeviceID, groupIDs) {
+			continue
+		}
+		active[geofence.ID] = true
+
+		visit, wasInside := state.inside[geofence.ID]
+		isInside := Contains(geofence, point.Lat, point.Lng)
+		switch {
+		case isInside && !wasInside:
+			state.inside[geofence.ID] = &presence{since: point.DtTracker}
+			e.record(geofence, point, models.GeofenceEnter, 0)
+		case isInside && wasInside:
+			inside := point.DtTracker.Sub(visit.since).Seconds()
+			if geofence.DwellSeconds > 0 && !visit.dwelled && inside >= geofence.DwellSeconds {
+				visit.dwelled = true
+				e.record(geofence, point, models.GeofenceDwell, inside)
+			}
+		case !isInside && wasInside:
+			delete(state.inside, geofence.ID)
+			e.record(geofence, point, models.GeofenceExit, point.DtTracker.Sub(visit.since).Seconds())
+		}
+	}
+
+	// Forget geofences that were deleted or unassigned from the device
+	for geofenceID := range state.inside {
+		if !active[geofenceID] {
+			delete(state.inside, geofenceID)
+		}
+	}
+}
+
+// Inside returns the IDs of the geofences a device is currently in.
+func (e *Engine) Inside(deviceID string) []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	ids := []string{}
+	if state, ok := e.states[deviceID]; ok {
+		for geofenceID := range state.inside {
+			ids = append(ids, geofenceID)
+		}
+	}
+	return ids
+}
+
+func (e *Engine) state(deviceID string) *deviceState {
+	state, ok := e.states[deviceID]
+	if !ok {
+		state = &deviceState{inside: make(map[string]*presence)}
+		e.states[deviceID] = state
+	}
+	return state
+}
+
+// restore loads which geofences the device was in from its latest events, so a restart
+// does not record a new enter event for geofences the device never left.
+func (e *Engine) restore(deviceID string, state *deviceState) {
+	if state.restored {
+		return
+	}
+	latest, err := e.Store.GetLatestGeofenceEvents(deviceID)
+	if err != nil {
+		log.Printf("Failed to restore geofence state of device %s: %v", deviceID, err)
+		return
+	}
+	state.restored = true
+	for geofenceID, event := range latest {
+		if event.Type == models.GeofenceExit {
+			continue
+		}
+		since := event.Time.Add(-time.Duration(event.InsideSeconds * float64(time.Second)))
+		state.inside[geofenceID] = &presence{since: since, dwelled: event.Type == models.GeofenceDwell}
+	}
+}
+
+func (e *Engine) record(geofence models.Geofence, point models.DevicePointRecord, eventType string, insideSeconds float64) {
+	event := models.GeofenceEvent{
+		ID:            fmt.Sprintf("%s-%s-%s-%d", point.DeviceID, geofence.ID, eventType, point.DtTracker.Unix()),
+		GeofenceID:    geofence.ID,
+		GeofenceName:  geofence.Name,
+		DeviceID:      point.DeviceID,
+		Type:          eventType,
+		Time:          point.DtTracker,
+		Location:      models.Location{Lat: point.Lat, Lng: point.Lng},
+		DevicePointID: point.DevicePointID,
+		InsideSeconds: insideSeconds,
+	}
+	if err := e.Store.SaveGeofenceEvent(event); err != nil {
+		log.Printf("Failed to save geofence event for device %s: %v", point.DeviceID, err)
+	}
+	if e.Hub != nil {
+		e.Hub.Publish(events.TypeGeofence, point.DeviceID, event)
+	}
+	log.Printf("Geofence %s: %s event for device %s at %s", geofence.Name, eventType, point.DeviceID, point.DtTracker.Format(time.RFC3339))
+}
@@ -0,0 +1,192 @@
+package geofence
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/groups"
+	"OneStepGPSLeo/models"
+)
+
+var start = time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+
+// inDepot and outside are positions relative to the depot geofence.
+var (
+	inDepot = models.Location{Lat: 34.05, Lng: -118.24}
+	outside = models.Location{Lat: 34.06, Lng: -118.24}
+)
+
+func pointAt(second int, location models.Location) models.DevicePointRecord {
+	return models.DevicePointRecord{
+		DeviceID:      "device",
+		DevicePointID: fmt.Sprintf("point-%d", second),
+		DtTracker:     start.Add(time.Duration(second) * time.Second),
+		Lat:           location.Lat,
+		Lng:           location.Lng,
+	}
+}
+
+// memoryStore keeps the geofences, device groups and the events in the order they were saved.
+type memoryStore struct {
+	geofences []models.Geofence
+	groups    []models.DeviceGroup
+	events    []models.GeofenceEvent
+}
+
+func (s *memoryStore) GetDeviceGroups() ([]models.DeviceGroup, error) {
+	return s.groups, nil
+}
+
+func (s *memoryStore) GetGeofences() ([]models.Geofence, error) {
+	return s.geofences, nil
+}
+
+func (s *memoryStore) SaveGeofenceEvent(event models.GeofenceEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memoryStore) GetLatestGeofenceEvents(deviceID string) (map[string]models.GeofenceEvent, error) {
+	latest := make(map[string]models.GeofenceEvent)
+	for _, event := range s.events {
+		if event.DeviceID == deviceID {
+			latest[event.GeofenceID] = event
+		}
+	}
+	return latest, nil
+}
+
+// newTestEngine stores the geofences in a memory store and returns an engine on it.
+func newTestEngine(geofences ...models.Geofence) (*Engine, *memoryStore) {
+	store := &memoryStore{}
+	for i, geofence := range geofences {
+		geofence.ID = fmt.Sprintf("geofence-%d", i)
+		store.geofences = append(store.geofences, geofence)
+	}
+	return NewEngine(store, nil, groups.NewDirectory(store)), store
+}
+
+// eventSummary lists the recorded events as "type@second/inside_seconds".
+func eventSummary(store *memoryStore) string {
+	var summary []string
+	for _, event := range store.events {
+		summary = append(summary, fmt.Sprintf("%s@%v/%v", event.Type, event.Time.Sub(start).Seconds(), event.InsideSeconds))
+	}
+	return fmt.Sprint(summary)
+}
+
+func TestEnterDwellExit(t *testing.T) {
+	dwelling := depot
+	dwelling.DwellSeconds = 300
+	engine, db := newTestEngine(dwelling)
+
+	for _, point := range []models.DevicePointRecord{
+		pointAt(0, outside),
+		pointAt(60, inDepot),
+		pointAt(240, inDepot),
+		pointAt(360, inDepot), // 300 s inside
+		pointAt(600, inDepot), // No second dwell in the same visit
+		pointAt(300, outside), // Older than the last point, ignored
+		pointAt(660, outside),
+		pointAt(720, inDepot),
+	} {
+		engine.ProcessPoint(point, models.DeviceSettings{})
+	}
+
+	if got, want := eventSummary(db), "[enter@60/0 dwell@360/300 exit@660/600 enter@720/0]"; got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+	if inside := engine.Inside("device"); len(inside) != 1 {
+		t.Errorf("inside %v, want the depot", inside)
+	}
+}
+
+func TestPolygonHole(t *testing.T) {
+	engine, db := newTestEngine(yard)
+	for _, point := range []models.DevicePointRecord{
+		pointAt(0, models.Location{Lat: 34.042, Lng: -118.248}), // In the yard
+		pointAt(60, models.Location{Lat: 34.05, Lng: -118.24}),  // In the hole
+		pointAt(120, models.Location{Lat: 34.058, Lng: -118.232}),
+	} {
+		engine.ProcessPoint(point, models.DeviceSettings{})
+	}
+	if got, want := eventSummary(db), "[enter@0/0 exit@60/60 enter@120/0]"; got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+}
+
+func TestGeofenceAssignment(t *testing.T) {
+	other := depot
+	other.Name = "Other device"
+	other.DeviceIDs = []string{"other"}
+	byDevice := depot
+	byDevice.Name = "By device"
+	byDevice.DeviceIDs = []string{"device"}
+	byGroup := depot
+	byGroup.Name = "By group"
+	byGroup.GroupIDs = []string{"depot-vans"}
+	byUpstreamGroup := depot
+	byUpstreamGroup.Name = "By upstream group"
+	byUpstreamGroup.GroupIDs = []string{"upstream"}
+	engine, db := newTestEngine(other, byDevice, byGroup, byUpstreamGroup)
+	db.groups = []models.DeviceGroup{{ID: "depot-vans", Name: "Depot vans", DeviceIDs: []string{"device"}}}
+
+	engine.ObserveDevice("device", &models.Device{DeviceGroupsIDList: []string{"upstream"}}, models.DeviceSettings{})
+	engine.ProcessPoint(pointAt(0, inDepot), models.DeviceSettings{})
+
+	names := map[string]bool{}
+	for _, event := range db.events {
+		names[event.GeofenceName] = true
+	}
+	if len(db.events) != 3 || !names["By device"] || !names["By group"] || !names["By upstream group"] {
+		t.Errorf("entered %v, want the geofences of the device and its groups only", names)
+	}
+}
+
+func TestStateIsRestoredFromEvents(t *testing.T) {
+	dwelling := depot
+	dwelling.DwellSeconds = 300
+
+	t.Run("inside", func(t *testing.T) {
+		engine, db := newTestEngine(dwelling)
+		engine.ProcessPoint(pointAt(0, inDepot), models.DeviceSettings{})
+
+		// After a restart the visit continues: no second enter, dwell and exit count from the enter
+		restarted := NewEngine(db, nil, groups.NewDirectory(db))
+		for _, point := range []models.DevicePointRecord{pointAt(120, inDepot), pointAt(300, inDepot), pointAt(420, outside)} {
+			restarted.ProcessPoint(point, models.DeviceSettings{})
+		}
+		if got, want := eventSummary(db), "[enter@0/0 dwell@300/300 exit@420/420]"; got != want {
+			t.Errorf("events = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("dwelled", func(t *testing.T) {
+		engine, db := newTestEngine(dwelling)
+		for _, point := range []models.DevicePointRecord{pointAt(0, inDepot), pointAt(300, inDepot)} {
+			engine.ProcessPoint(point, models.DeviceSettings{})
+		}
+
+		restarted := NewEngine(db, nil, groups.NewDirectory(db))
+		for _, point := range []models.DevicePointRecord{pointAt(600, inDepot), pointAt(660, outside)} {
+			restarted.ProcessPoint(point, models.DeviceSettings{})
+		}
+		if got, want := eventSummary(db), "[enter@0/0 dwell@300/300 exit@660/660]"; got != want {
+			t.Errorf("events = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("left", func(t *testing.T) {
+		engine, db := newTestEngine(dwelling)
+		for _, point := range []models.DevicePointRecord{pointAt(0, inDepot), pointAt(60, outside)} {
+			engine.ProcessPoint(point, models.DeviceSettings{})
+		}
+
+		restarted := NewEngine(db, nil, groups.NewDirectory(db))
+		restarted.ProcessPoint(pointAt(120, inDepot), models.DeviceSettings{})
+		if got, want := eventSummary(db), "[enter@0/0 exit@60/60 enter@120/0]"; got != want {
+			t.Errorf("events = %s, want %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+/*
+Package geofence evaluates device points against circular and polygonal geofences.
+
+For every accurate point the Engine checks each geofence that applies to the device and
+records an event when the device enters a geofence, leaves it, or has stayed inside for
+the geofence's DwellSeconds. Events are saved and published to the event hub.
+*/
+package geofence
+
+import (
+	"fmt"
+	"math"
+
+	"OneStepGPSLeo/common"
+	"OneStepGPSLeo/models"
+)
+
+// Validate checks that a geofence has a name and a well-formed shape.
+func Validate(geofence models.Geofence) error {
+	if geofence.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if geofence.DwellSeconds < 0 {
+		return fmt.Errorf("dwell_seconds must not be negative")
+	}
+
+	switch geofence.Type {
+	case models.GeofenceCircle:
+		if geofence.Center == nil {
+			return fmt.Errorf("circle geofences need a center")
+		}
+		if !validCoordinate(geofence.Center.Lat, geofence.Center.Lng) {
+			return fmt.Errorf("center is out of range")
+		}
+		if geofence.RadiusMeters <= 0 {
+			return fmt.Errorf("radius_meters must be positive")
+		}
+	case models.GeofencePolygon:
+		polygon := geofence.Polygon
+		if polygon == nil || polygon.Type != "Polygon" {
+			return fmt.Errorf("polygon geofences need a GeoJSON Polygon")
+		}
+		if len(polygon.Coordinates) == 0 {
+			return fmt.Errorf("polygon has no rings")
+		}
+		for i, ring := range polygon.Coordinates {
+			if err := validateRing(ring); err != nil {
+				return fmt.Errorf("ring %d: %w", i, err)
+			}
+		}
+	default:
+		return fmt.Errorf("type must be %q or %q", models.GeofenceCircle, models.GeofencePolygon)
+	}
+	return nil
+}
+
+// validateRing checks a GeoJSON linear ring: at least four [lng, lat] positions, closed.
+func validateRing(ring [][]float64) error {
+	if len(ring) < 4 {
+		return fmt.Errorf("a ring needs at least 4 positions")
+	}
+	for _, position := range ring {
+		if len(position) < 2 {
+			return fmt.Errorf("positions must be [lng, lat]")
+		}
+		if !validCoordinate(position[1], position[0]) {
+			return fmt.Errorf("position [%v, %v] is out of range", position[0], position[1])
+		}
+	}
+	first, last := ring[0], ring[len(ring)-1]
+	if first[0] != last[0] || first[1] != last[1] {
+		return fmt.Errorf("the first and last positions must be equal")
+	}
+	return nil
+}
+
+func validCoordinate(lat, lng float64) bool {
+	return !math.IsNaN(lat) && !math.IsNaN(lng) && lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// Contains reports whether a coordinate is inside a geofence. Points inside a polygon hole are outside.
+func Contains(geofence models.Geofence, lat, lng float64) bool {
+	switch geofence.Type {
+	case models.GeofenceCircle:
+		if geofence.Center == nil {
+			return false
+		}
+		return common.DistanceMeters(geofence.Center.Lat, geofence.Center.Lng, lat, lng) <= geofence.RadiusMeters
+	case models.GeofencePolygon:
+		if geofence.Polygon == nil || len(geofence.Polygon.Coordinates) == 0 {
+			return false
+		}
+		if !common.PointInRing(lat, lng, geofence.Polygon.Coordinates[0]) {
+			return false
+		}
+		for _, hole := range geofence.Polygon.Coordinates[1:] {
+			if common.PointInRing(lat, lng, hole) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// AppliesTo reports whether a geofence is assigned to a device directly or through one of its groups.
+// Geofences without any assignment apply to every device.
+func AppliesTo(geofence models.Geofence, deviceID string, groupIDs []string) bool {
+	return common.InScope(geofence.DeviceIDs, geofence.GroupIDs, deviceID, groupIDs)
+}
@@ -0,0 +1,99 @@
+package geofence
+
+import (
+	"testing"
+
+	"OneStepGPSLeo/models"
+)
+
+// depot is a 100 m circle in downtown Los Angeles.
+var depot = models.Geofence{
+	Name:         "Depot",
+	Type:         models.GeofenceCircle,
+	Center:       &models.Location{Lat: 34.05, Lng: -118.24},
+	RadiusMeters: 100,
+}
+
+// yard is a square of about 1.8 by 2.2 km with a square hole in the middle.
+var yard = models.Geofence{
+	Name: "Yard",
+	Type: models.GeofencePolygon,
+	Polygon: &models.GeoJSONPolygon{Type: "Polygon", Coordinates: [][][]float64{
+		{{-118.25, 34.04}, {-118.23, 34.04}, {-118.23, 34.06}, {-118.25, 34.06}, {-118.25, 34.04}},
+		{{-118.245, 34.045}, {-118.235, 34.045}, {-118.235, 34.055}, {-118.245, 34.055}, {-118.245, 34.045}},
+	}},
+}
+
+func TestContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		geofence models.Geofence
+		lat, lng float64
+		inside   bool
+	}{
+		{"circle center", depot, 34.05, -118.24, true},
+		{"circle 55 m from the center", depot, 34.0505, -118.24, true},
+		{"circle 111 m from the center", depot, 34.051, -118.24, false},
+		{"circle without a center", models.Geofence{Type: models.GeofenceCircle, RadiusMeters: 100}, 34.05, -118.24, false},
+		{"polygon outside the hole", yard, 34.042, -118.248, true},
+		{"polygon in the hole", yard, 34.05, -118.24, false},
+		{"polygon outside", yard, 34.07, -118.24, false},
+		{"polygon east of it", yard, 34.05, -118.22, false},
+		{"polygon without rings", models.Geofence{Type: models.GeofencePolygon, Polygon: &models.GeoJSONPolygon{Type: "Polygon"}}, 34.05, -118.24, false},
+		{"unknown type", models.Geofence{Type: "hexagon"}, 34.05, -118.24, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if inside := Contains(test.geofence, test.lat, test.lng); inside != test.inside {
+				t.Errorf("Contains(%v, %v) = %v, want %v", test.lat, test.lng, inside, test.inside)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	openRing := yard
+	openRing.Polygon = &models.GeoJSONPolygon{Type: "Polygon", Coordinates: [][][]float64{
+		{{-118.25, 34.04}, {-118.23, 34.04}, {-118.23, 34.06}, {-118.25, 34.06}},
+	}}
+	unclosed := yard
+	unclosed.Polygon = &models.GeoJSONPolygon{Type: "Polygon", Coordinates: [][][]float64{
+		{{-118.25, 34.04}, {-118.23, 34.04}, {-118.23, 34.06}, {-118.25, 34.06}, {-118.25, 34.05}},
+	}}
+	swapped := yard
+	swapped.Polygon = &models.GeoJSONPolygon{Type: "Polygon", Coordinates: [][][]float64{
+		{{34.04, -118.25}, {34.04, -118.23}, {34.06, -118.23}, {34.06, -118.25}, {34.04, -118.25}},
+	}}
+	noRadius := depot
+	noRadius.RadiusMeters = 0
+	farCenter := depot
+	farCenter.Center = &models.Location{Lat: 95, Lng: 0}
+	negativeDwell := depot
+	negativeDwell.DwellSeconds = -1
+	unnamed := depot
+	unnamed.Name = ""
+
+	tests := []struct {
+		name     string
+		geofence models.Geofence
+		valid    bool
+	}{
+		{"circle", depot, true},
+		{"polygon with a hole", yard, true},
+		{"ring with 4 positions", openRing, false},
+		{"ring not closed", unclosed, false},
+		{"lat and lng swapped", swapped, false},
+		{"circle without radius", noRadius, false},
+		{"center out of range", farCenter, false},
+		{"negative dwell", negativeDwell, false},
+		{"without name", unnamed, false},
+		{"unknown type", models.Geofence{Name: "Hexagon", Type: "hexagon"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Validate(test.geofence); (err == nil) != test.valid {
+				t.Errorf("Validate = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Package groups resolves the membership of server-side device groups.
+
+Groups can be nested: a device in a group is also a member of every ancestor of the group,
+so a geofence or alert rule targeting a parent group covers the devices of its subgroups.
+The Directory keeps every group in memory and is consulted by the engines on every point.
+*/
+package groups
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"OneStepGPSLeo/models"
+)
+
+// Store loads the device groups.
+type Store interface {
+	GetDeviceGroups() ([]models.DeviceGroup, error)
+}
+
+// Validate checks that a group has a name and that its parent exists and is not the group itself
+// or one of its subgroups. All are the stored groups, including the previous version of the group.
+func Validate(group models.DeviceGroup, all []models.DeviceGroup) error {
+	if group.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if group.ParentID == "" {
+		return nil
+	}
+
+	parents := make(map[string]string, len(all))
+	for _, existing := range all {
+		parents[existing.ID] = existing.ParentID
+	}
+	if _, ok := parents[group.ParentID]; !ok {
+		return fmt.Errorf("parent group %s not found", group.ParentID)
+	}
+	// Walk up from the new parent, meeting the group on the way means it would become its own ancestor
+	for id, steps := group.ParentID, 0; id != "" && steps <= len(all); id, steps = parents[id], steps+1 {
+		if id == group.ID {
+			return fmt.Errorf("a group cannot be nested inside itself or one of its subgroups")
+		}
+	}
+	return nil
+}
+
+// ValidateSettingsPatch rejects settings that do not exist or cannot be changed for a whole group.
+func ValidateSettingsPatch(patch map[string]json.RawMessage) error {
+	data, err := json.Marshal(models.DeviceSettings{})
+	if err != nil {
+		return err
+	}
+	var known map[string]json.RawMessage
+	if err := json.Unmarshal(data, &known); err != nil {
+		return err
+	}
+	for key := range patch {
+		switch key {
+		case "device_id", "version", "updated_at", "iconUrl":
+			return fmt.Errorf("%s cannot be set for a group", key)
+		}
+		if _, ok := known[key]; !ok {
+			return fmt.Errorf("unknown setting %s", key)
+		}
+	}
+	return nil
+}
+
+// ApplySettingsPatch merges a validated settings patch into the current settings of a device.
+// Settings missing from the patch keep their current value.
+func ApplySettingsPatch(current models.DeviceSettings, patch map[string]json.RawMessage) (models.DeviceSettings, error) {
+	data, err := json.Marshal(current)
+	if err != nil {
+		return models.DeviceSettings{}, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return models.DeviceSettings{}, err
+	}
+	for key, value := range patch {
+		fields[key] = value
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return models.DeviceSettings{}, err
+	}
+	var settings models.DeviceSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return models.DeviceSettings{}, fmt.Errorf("invalid settings: %w", err)
+	}
+	return settings, nil
+}
+
+// Directory keeps the device groups in memory. Groups are loaded on first use.
+type Directory struct {
+	Store Store
+
+	mutex    sync.RWMutex
+	groups   map[string]models.DeviceGroup
+	children map[string][]string // Subgroup IDs by parent ID
+	memberOf map[string][]string // Direct group IDs by device ID
+	loaded   bool
+}
+
+// NewDirectory creates a group directory.
+func NewDirectory(store Store) *Directory {
+	return &Directory{Store: store}
+}
+
+// Reload reads the groups from the store again. It must be called after groups change.
+func (d *Directory) Reload() error {
+	groups, err := d.Store.GetDeviceGroups()
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.index(groups)
+	return nil
+}
+
+// index rebuilds the lookup maps. Must be called with the write lock held.
+func (d *Directory) index(groups []models.DeviceGroup) {
+	d.groups = make(map[string]models.DeviceGroup, len(groups))
+	d.children = make(map[string][]string)
+	d.memberOf = make(map[string][]string)
+	for _, group := range groups {
+		d.groups[group.ID] = group
+		if group.ParentID != "" {
+			d.children[group.ParentID] = append(d.children[group.ParentID], group.ID)
+		}
+		for _, deviceID := range group.DeviceIDs {
+			d.memberOf[deviceID] = append(d.memberOf[deviceID], group.ID)
+		}
+	}
+	d.loaded = true
+}
+
+// ensureLoaded loads the groups if that has not happened yet. Failures are logged and retried on the next call.
+func (d *Directory) ensureLoaded() {
+	d.mutex.RLock()
+	loaded := d.loaded
+	d.mutex.RUnlock()
+	if loaded {
+		return
+	}
+	if err := d.Reload(); err != nil {
+		log.Printf("Failed to load device groups: %v", err)
+	}
+}
+
+// Exists reports whether a group exists.
+func (d *Directory) Exists(groupID string) bool {
+	d.ensureLoaded()
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	_, ok := d.groups[groupID]
+	return ok
+}
+
+// GroupsOf returns the IDs of the groups a device is in, directly or through a subgroup.
+func (d *Directory) GroupsOf(deviceID string) []string {
+	d.ensureLoaded()
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var groupIDs []string
+	seen := make(map[string]bool)
+	for _, id := range d.memberOf[deviceID] {
+		for ; id != "" && !seen[id]; id = d.groups[id].ParentID {
+			seen[id] = true
+			groupIDs = append(groupIDs, id)
+		}
+	}
+	return groupIDs
+}
+
+// DeviceIDs returns the devices of a group and of all its subgroups, sorted.
+func (d *Directory) DeviceIDs(groupID string) []string {
+	d.ensureLoaded()
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	deviceIDs := []string{}
+	seenDevices := make(map[string]bool)
+	seenGroups := make(map[string]bool)
+	pending := []string{groupID}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seenGroups[id] {
+			continue
+		}
+		seenGroups[id] = true
+		for _, deviceID := range d.groups[id].DeviceIDs {
+			if !seenDevices[deviceID] {
+				seenDevices[deviceID] = true
+				deviceIDs = append(deviceIDs, deviceID)
+			}
+		}
+		pending = append(pending, d.children[id]...)
+	}
+	sort.Strings(deviceIDs)
+	return deviceIDs
+}
@@ -0,0 +1,196 @@
+package groups
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/models"
+)
+
+// newTestDirectory stores a fleet with a region, two depots below it and a yard below the first
+// depot and an empty spare group, and returns the directory with the group IDs by name.
+func newTestDirectory(t *testing.T) (*Directory, *database.Memory, map[string]string) {
+	t.Helper()
+	db := database.NewMemory()
+	ids := make(map[string]string)
+	create := func(name, parent string, deviceIDs ...string) {
+		group, err := db.CreateDeviceGroup(models.DeviceGroup{Name: name, ParentID: ids[parent], DeviceIDs: deviceIDs})
+		if err != nil {
+			t.Fatalf("CreateDeviceGroup %s: %v", name, err)
+		}
+		ids[name] = group.ID
+	}
+	create("region", "", "dispatch")
+	create("north", "region", "truck-1", "truck-2")
+	create("south", "region", "truck-3", "truck-1")
+	create("yard", "north", "forklift")
+	create("spare", "")
+	return NewDirectory(db), db, ids
+}
+
+func TestDeviceIDsIncludeSubgroups(t *testing.T) {
+	directory, _, ids := newTestDirectory(t)
+
+	tests := []struct {
+		group string
+		want  string
+	}{
+		{"region", "[dispatch forklift truck-1 truck-2 truck-3]"},
+		{"north", "[forklift truck-1 truck-2]"},
+		{"south", "[truck-1 truck-3]"},
+		{"yard", "[forklift]"},
+		{"spare", "[]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(directory.DeviceIDs(ids[test.group])); got != test.want {
+			t.Errorf("DeviceIDs(%s) = %s, want %s", test.group, got, test.want)
+		}
+	}
+	if got := directory.DeviceIDs("missing"); len(got) != 0 {
+		t.Errorf("DeviceIDs of a missing group = %v, want none", got)
+	}
+}
+
+func TestGroupsOfIncludeAncestors(t *testing.T) {
+	directory, _, ids := newTestDirectory(t)
+
+	names := make(map[string]string, len(ids))
+	for name, id := range ids {
+		names[id] = name
+	}
+	tests := []struct {
+		deviceID string
+		want     []string
+	}{
+		{"forklift", []string{"north", "region", "yard"}},
+		{"truck-1", []string{"north", "region", "south"}},
+		{"dispatch", []string{"region"}},
+		{"unknown", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, id := range directory.GroupsOf(test.deviceID) {
+			got = append(got, names[id])
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("GroupsOf(%s) = %v, want %v", test.deviceID, got, test.want)
+		}
+	}
+}
+
+func TestReloadPicksUpChanges(t *testing.T) {
+	directory, db, ids := newTestDirectory(t)
+	if directory.Exists("missing") || !directory.Exists(ids["spare"]) {
+		t.Fatalf("Exists does not match the stored groups")
+	}
+
+	// Move the yard below the spare group
+	yard, err := db.GetDeviceGroup(ids["yard"])
+	if err != nil {
+		t.Fatalf("GetDeviceGroup: %v", err)
+	}
+	yard.ParentID = ids["spare"]
+	if _, err := db.UpdateDeviceGroup(yard); err != nil {
+		t.Fatalf("UpdateDeviceGroup: %v", err)
+	}
+	if got := fmt.Sprint(directory.DeviceIDs(ids["spare"])); got != "[]" {
+		t.Errorf("DeviceIDs before Reload = %s, want the loaded groups", got)
+	}
+	if err := directory.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := fmt.Sprint(directory.DeviceIDs(ids["spare"])); got != "[forklift]" {
+		t.Errorf("DeviceIDs(spare) = %s, want [forklift]", got)
+	}
+	if got := fmt.Sprint(directory.DeviceIDs(ids["north"])); got != "[truck-1 truck-2]" {
+		t.Errorf("DeviceIDs(north) = %s, want [truck-1 truck-2]", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	_, db, ids := newTestDirectory(t)
+	all, err := db.GetDeviceGroups()
+	if err != nil {
+		t.Fatalf("GetDeviceGroups: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		group models.DeviceGroup
+		err   string // Empty when the group is valid
+	}{
+		{"new top-level group", models.DeviceGroup{Name: "east"}, ""},
+		{"new subgroup", models.DeviceGroup{Name: "east", ParentID: ids["region"]}, ""},
+		{"move to another parent", models.DeviceGroup{ID: ids["yard"], Name: "yard", ParentID: ids["south"]}, ""},
+		{"missing name", models.DeviceGroup{ParentID: ids["region"]}, "name is required"},
+		{"missing parent", models.DeviceGroup{Name: "east", ParentID: "missing"}, "not found"},
+		{"own parent", models.DeviceGroup{ID: ids["north"], Name: "north", ParentID: ids["north"]}, "nested inside itself"},
+		{"below its child", models.DeviceGroup{ID: ids["region"], Name: "region", ParentID: ids["north"]}, "nested inside itself"},
+		{"below its grandchild", models.DeviceGroup{ID: ids["region"], Name: "region", ParentID: ids["yard"]}, "nested inside itself"},
+	}
+	for _, test := range tests {
+		err := Validate(test.group, all)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: Validate = %v, want valid", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: Validate = %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestValidateSettingsPatch(t *testing.T) {
+	tests := []struct {
+		patch string
+		err   string
+	}{
+		{`{"max_hdop": 5}`, ""},
+		{`{"offline_timeout": {"value": 2, "unit": "h"}, "history_retention_days": 30}`, ""},
+		{`{"device_id": "truck-1"}`, "device_id cannot be set for a group"},
+		{`{"version": 3}`, "version cannot be set for a group"},
+		{`{"updated_at": "2024-11-13T06:00:00Z"}`, "updated_at cannot be set for a group"},
+		{`{"iconUrl": "truck.png"}`, "iconUrl cannot be set for a group"},
+		{`{"max_hdop": 5, "colour": "red"}`, "unknown setting colour"},
+	}
+	for _, test := range tests {
+		var patch map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(test.patch), &patch); err != nil {
+			t.Fatalf("invalid patch %s: %v", test.patch, err)
+		}
+		err := ValidateSettingsPatch(patch)
+		if (err == nil) != (test.err == "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("ValidateSettingsPatch(%s) = %v, want %q", test.patch, err, test.err)
+		}
+	}
+}
+
+func TestApplySettingsPatch(t *testing.T) {
+	current := database.DefaultDeviceSettings("truck-1", time.Now())
+	current.Version = 4
+	current.MaxHdop = 2
+
+	patch := map[string]json.RawMessage{
+		"max_hdop":        json.RawMessage(`5`),
+		"offline_timeout": json.RawMessage(`{"value": 2, "unit": "h", "display": "2 h"}`),
+	}
+	settings, err := ApplySettingsPatch(current, patch)
+	if err != nil {
+		t.Fatalf("ApplySettingsPatch: %v", err)
+	}
+	if settings.MaxHdop != 5 || settings.OfflineTimeout != (models.Speed{Value: 2, Unit: "h", Display: "2 h"}) {
+		t.Errorf("patched settings = hdop %v, offline timeout %+v, want the patch", settings.MaxHdop, settings.OfflineTimeout)
+	}
+	if settings.DeviceID != "truck-1" || settings.Version != 4 || settings.BeginMovingSpeed != current.BeginMovingSpeed {
+		t.Errorf("patched settings = %+v, want the other settings kept", settings)
+	}
+
+	if _, err := ApplySettingsPatch(current, map[string]json.RawMessage{"max_hdop": json.RawMessage(`"high"`)}); err == nil {
+		t.Errorf("ApplySettingsPatch with a string hdop succeeded, want an error")
+	}
+}
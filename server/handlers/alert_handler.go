@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"OneStepGPSLeo/alerts"
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AlertHandlers manages alert rules and the alerts they raise.
+type AlertHandlers struct {
+	DB     database.Repository
+	Engine *alerts.Engine
+	Hub    *events.Hub
+	Scopes *auth.Scopes
+}
+
+// NewAlertHandlers creates a new instance of AlertHandlers.
+func NewAlertHandlers(db database.Repository, engine *alerts.Engine, hub *events.Hub, scopes *auth.Scopes) *AlertHandlers {
+	return &AlertHandlers{DB: db, Engine: engine, Hub: hub, Scopes: scopes}
+}
+
+// alertStatusRequest is the optional body of the acknowledge and resolve endpoints.
+type alertStatusRequest struct {
+	Note string `json:"note"`
+}
+
+// GetAlertRulesHandler returns every alert rule.
+func (h *AlertHandlers) GetAlertRulesHandler(c *gin.Context) {
+	rules, err := h.DB.GetAlertRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// GetAlertRuleHandler returns a single alert rule.
+func (h *AlertHandlers) GetAlertRuleHandler(c *gin.Context) {
+	rule, err := h.DB.GetAlertRule(c.Param("id"))
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// CreateAlertRuleHandler creates an alert rule from the request body.
+func (h *AlertHandlers) CreateAlertRuleHandler(c *gin.Context) {
+	var rule models.AlertRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := alerts.Validate(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := h.DB.CreateAlertRule(rule)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.reload()
+	c.JSON(http.StatusCreated, created)
+}
+
+// UpdateAlertRuleHandler replaces an alert rule. The body must carry the version it was read with,
+// a stale version returns 409 with the current rule.
+func (h *AlertHandlers) UpdateAlertRuleHandler(c *gin.Context) {
+	var rule models.AlertRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	rule.ID = c.Param("id")
+	if err := alerts.Validate(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated, err := h.DB.UpdateAlertRule(rule)
+	if err != nil {
+		if errors.Is(err, database.ErrOutdatedAlertRuleVersion) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "currentRule": updated})
+			return
+		}
+		h.writeError(c, err)
+		return
+	}
+	h.reload()
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteAlertRuleHandler deletes an alert rule. Its alerts are kept.
+func (h *AlertHandlers) DeleteAlertRuleHandler(c *gin.Context) {
+	if err := h.DB.DeleteAlertRule(c.Param("id")); err != nil {
+		h.writeError(c, err)
+		return
+	}
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted"})
+}
+
+// GetAlertsHandler returns alerts of the devices visible to the user, most recent first. Supports
+// status, device_id, rule_id, from/to (RFC3339, on the last trigger time) and limit (default 100).
+func (h *AlertHandlers) GetAlertsHandler(c *gin.Context) {
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	filter := database.AlertFilter{
+		Status:    c.Query("status"),
+		DeviceID:  c.Query("device_id"),
+		DeviceIDs: scope.DeviceIDs(),
+		RuleID:    c.Query("rule_id"),
+		Limit:     100,
+	}
+	for name, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if str := c.Query(name); str != "" {
+			parsed, err := time.Parse(time.RFC3339, str)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " timestamp format, use RFC3339"})
+				return
+			}
+			*target = parsed
+		}
+	}
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		filter.Limit = limit
+	}
+
+	alertList, err := h.DB.GetAlerts(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": alertList})
+}
+
+// GetAlertHandler returns a single alert.
+func (h *AlertHandlers) GetAlertHandler(c *gin.Context) {
+	alert, err := h.visibleAlert(c, c.Param("id"))
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, alert)
+}
+
+// visibleAlert loads an alert, reporting alerts of devices outside the user's scope as not found.
+func (h *AlertHandlers) visibleAlert(c *gin.Context, id string) (models.Alert, error) {
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		return models.Alert{}, err
+	}
+	alert, err := h.DB.GetAlert(id)
+	if err != nil {
+		return models.Alert{}, err
+	}
+	if !scope.Contains(alert.DeviceID) {
+		return models.Alert{}, database.ErrAlertNotFound
+	}
+	return alert, nil
+}
+
+// AcknowledgeAlertHandler acknowledges an open alert.
+func (h *AlertHandlers) AcknowledgeAlertHandler(c *gin.Context) {
+	var req alertStatusRequest
+	c.ShouldBindJSON(&req) // The body is optional
+	claims, _ := auth.CurrentUser(c)
+	h.writeStatusChange(c, func(id string) (models.Alert, error) {
+		return h.DB.AcknowledgeAlert(id, claims.Username, req.Note)
+	})
+}
+
+// ResolveAlertHandler resolves an open or acknowledged alert.
+func (h *AlertHandlers) ResolveAlertHandler(c *gin.Context) {
+	var req alertStatusRequest
+	c.ShouldBindJSON(&req) // The body is optional
+	claims, _ := auth.CurrentUser(c)
+	h.writeStatusChange(c, func(id string) (models.Alert, error) {
+		return h.DB.ResolveAlert(id, claims.Username, req.Note)
+	})
+}
+
+func (h *AlertHandlers) writeStatusChange(c *gin.Context, change func(id string) (models.Alert, error)) {
+	if _, err := h.visibleAlert(c, c.Param("id")); err != nil {
+		h.writeError(c, err)
+		return
+	}
+	alert, err := change(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, database.ErrAlertStatus) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "currentAlert": alert})
+			return
+		}
+		h.writeError(c, err)
+		return
+	}
+	h.Hub.Publish(events.TypeAlert, alert.DeviceID, alert)
+	c.JSON(http.StatusOK, alert)
+}
+
+// reload makes the engine pick up a rule change.
+func (h *AlertHandlers) reload() {
+	if err := h.Engine.Reload(); err != nil {
+		log.Printf("Failed to reload alert rules: %v", err)
+	}
+}
+
+func (h *AlertHandlers) writeError(c *gin.Context, err error) {
+	if errors.Is(err, database.ErrAlertRuleNotFound) || errors.Is(err, database.ErrAlertNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuthHandlers signs users in and out and refreshes their tokens.
+type AuthHandlers struct {
+	DB     database.Repository
+	Tokens *auth.Tokens
+}
+
+// NewAuthHandlers creates a new instance of AuthHandlers.
+func NewAuthHandlers(db database.Repository, tokens *auth.Tokens) *AuthHandlers {
+	return &AuthHandlers{DB: db, Tokens: tokens}
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type passwordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// LoginHandler checks a username and password and starts a session.
+func (h *AuthHandlers) LoginHandler(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+
+	user, err := h.DB.GetUserByUsername(req.Username)
+	if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var valid bool
+	if err != nil {
+		valid = auth.RejectPassword(req.Password)
+	} else {
+		valid = auth.CheckPassword(user.PasswordHash, req.Password)
+	}
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := h.DB.RecordLogin(user.ID, now); err != nil {
+		log.Printf("Failed to record login of user %s: %v", user.Username, err)
+	}
+	user.LastLoginAt = &now
+	h.startSession(c, user)
+}
+
+// RefreshHandler exchanges a refresh token for new tokens. The old session is revoked, so every
+// refresh token can only be used once.
+func (h *AuthHandlers) RefreshHandler(c *gin.Context) {
+	var req refreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+		return
+	}
+
+	claims, err := h.Tokens.Parse(req.RefreshToken, auth.TypeRefresh)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	session, err := h.DB.GetSession(claims.SessionID)
+	if err != nil {
+		if errors.Is(err, database.ErrSessionNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has ended"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if session.RevokedAt != nil || session.UserID != claims.Subject || time.Now().After(session.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has ended"})
+		return
+	}
+	user, err := h.DB.GetUser(claims.Subject)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User no longer exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.DB.RevokeSession(session.ID); err != nil {
+		if errors.Is(err, database.ErrSessionNotFound) {
+			// A concurrent refresh with the same token revoked the session first
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has ended"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.startSession(c, user)
+}
+
+// LogoutHandler ends the session of the access token. Its refresh token stops working immediately,
+// the access token itself stays valid until it expires.
+func (h *AuthHandlers) LogoutHandler(c *gin.Context) {
+	claims, _ := auth.CurrentUser(c)
+	if err := h.DB.RevokeSession(claims.SessionID); err != nil && !errors.Is(err, database.ErrSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// MeHandler returns the authenticated user.
+func (h *AuthHandlers) MeHandler(c *gin.Context) {
+	claims, _ := auth.CurrentUser(c)
+	user, err := h.DB.GetUser(claims.Subject)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// ChangePasswordHandler changes the password of the authenticated user and ends their other sessions.
+func (h *AuthHandlers) ChangePasswordHandler(c *gin.Context) {
+	claims, _ := auth.CurrentUser(c)
+	var req passwordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	user, err := h.DB.GetUser(claims.Subject)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.CheckPassword(user.PasswordHash, req.CurrentPassword) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	hash, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.SetUserPassword(user.ID, hash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.RevokeUserSessions(user.ID, claims.SessionID); err != nil {
+		log.Printf("Failed to end sessions of user %s: %v", user.Username, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed"})
+}
+
+// startSession creates a session for the user and responds with its tokens.
+func (h *AuthHandlers) startSession(c *gin.Context, user models.User) {
+	session, err := h.DB.CreateSession(models.Session{
+		UserID:    user.ID,
+		UserAgent: c.Request.UserAgent(),
+		ExpiresAt: time.Now().UTC().Add(h.Tokens.RefreshTTL),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	tokens, err := h.Tokens.Issue(user, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/models"
+)
+
+// newAuthRouter serves the login and refresh endpoints for a single operator.
+func newAuthRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db := database.NewMemory()
+	hash, err := auth.HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if _, err := db.CreateUser(models.User{Username: "dispatch", PasswordHash: hash, Role: models.RoleOperator}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	tokens, err := auth.NewTokens("secret", 15*time.Minute, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+
+	h := NewAuthHandlers(db, tokens)
+	router := gin.New()
+	router.POST("/api/auth/login", h.LoginHandler)
+	router.POST("/api/auth/refresh", h.RefreshHandler)
+	return router
+}
+
+// post sends a JSON body and returns the recorded response.
+func post(router *gin.Engine, path string, body any) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// login returns the refresh token of a new session.
+func login(t *testing.T, router *gin.Engine) string {
+	t.Helper()
+	w := post(router, "/api/auth/login", loginRequest{Username: "dispatch", Password: "correct horse"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login = %d %s", w.Code, w.Body.String())
+	}
+	var pair auth.TokenPair
+	if err := json.Unmarshal(w.Body.Bytes(), &pair); err != nil {
+		t.Fatalf("failed to decode tokens: %v", err)
+	}
+	return pair.RefreshToken
+}
+
+func TestRefreshTokenIsSingleUse(t *testing.T) {
+	router := newAuthRouter(t)
+	refreshToken := login(t, router)
+
+	if w := post(router, "/api/auth/refresh", refreshRequest{RefreshToken: refreshToken}); w.Code != http.StatusOK {
+		t.Fatalf("first refresh = %d %s, want 200", w.Code, w.Body.String())
+	}
+	if w := post(router, "/api/auth/refresh", refreshRequest{RefreshToken: refreshToken}); w.Code != http.StatusUnauthorized {
+		t.Errorf("second refresh = %d %s, want 401", w.Code, w.Body.String())
+	}
+}
+
+func TestConcurrentRefreshesStartOneSession(t *testing.T) {
+	router := newAuthRouter(t)
+	refreshToken := login(t, router)
+
+	const attempts = 8
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- post(router, "/api/auth/refresh", refreshRequest{RefreshToken: refreshToken}).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	succeeded := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusUnauthorized:
+		default:
+			t.Errorf("refresh = %d, want 200 or 401", code)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d of %d concurrent refreshes succeeded, want 1", succeeded, attempts)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"OneStepGPSLeo/availability"
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AvailabilityHandlers serves the online/offline log and uptime of devices.
+type AvailabilityHandlers struct {
+	DB      database.Repository
+	Monitor *availability.Monitor
+	Clock   clock.Clock // Time the default ranges and the uptime of today end at
+}
+
+// NewAvailabilityHandlers creates a new instance of AvailabilityHandlers.
+func NewAvailabilityHandlers(db database.Repository, monitor *availability.Monitor, clk clock.Clock) *AvailabilityHandlers {
+	return &AvailabilityHandlers{DB: db, Monitor: monitor, Clock: clk}
+}
+
+// GetAvailabilityHandler returns the current status of a device and its transitions in the
+// from/to range (RFC3339, defaults to the last 7 days).
+func (h *AvailabilityHandlers) GetAvailabilityHandler(c *gin.Context) {
+	deviceID := c.Param("id")
+	from, to, err := parseTimeRange(c, h.Clock.Now(), 7*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transitions, err := h.DB.GetAvailabilityEvents(deviceID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"device_id": deviceID, "from": from.Format(time.RFC3339), "to": to.Format(time.RFC3339), "transitions": transitions}
+	if online, since, lastSeen, ok := h.Monitor.Status(deviceID); ok {
+		response["online"] = online
+		response["since"] = since.Format(time.RFC3339)
+		response["last_seen"] = lastSeen.Format(time.RFC3339)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetUptimeHandler returns the online and offline time of a device per UTC day in the
+// from/to range (RFC3339, defaults to the last 7 days).
+func (h *AvailabilityHandlers) GetUptimeHandler(c *gin.Context) {
+	deviceID := c.Param("id")
+	now := h.Clock.Now()
+	from, to, err := parseTimeRange(c, now, 7*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	initial, err := h.DB.GetLatestAvailabilityEvent(deviceID, from)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	transitions, err := h.DB.GetAvailabilityEvents(deviceID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	days := availability.DailyUptime(initial, transitions, from, to, now)
+	c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "from": from.Format(time.RFC3339), "to": to.Format(time.RFC3339), "days": days})
+}
@@ -1,49 +1,142 @@
 package handlers
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"OneStepGPSLeo/api"
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/clock"
 	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/groups"
 	"OneStepGPSLeo/models"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type DeviceHandlers struct {
-	DB              *database.MongoDB
-	Config          models.Config
-	UpdateMutex     sync.RWMutex         // Add mutex field
-	LastUpdateTimes map[string]time.Time // Add map field
-	LastChecked     time.Time            // Add lastChecked field
+	DB       database.Repository
+	Config   models.Config
+	Ingestor *api.Ingestor // Shared with the background poller so refreshes see the same update times
+	Scopes   *auth.Scopes
+	Groups   *groups.Directory
+	Clock    clock.Clock // Time the default history range ends at
 }
 
-func NewDeviceHandlers(cfg models.Config, db *database.MongoDB) *DeviceHandlers {
+func NewDeviceHandlers(cfg models.Config, db database.Repository, ingestor *api.Ingestor, scopes *auth.Scopes, directory *groups.Directory, clk clock.Clock) *DeviceHandlers {
 	return &DeviceHandlers{
-		Config:          cfg,
-		DB:              db,
-		UpdateMutex:     sync.RWMutex{},
-		LastUpdateTimes: make(map[string]time.Time),
-		LastChecked:     time.Now(),
+		Config:   cfg,
+		DB:       db,
+		Ingestor: ingestor,
+		Scopes:   scopes,
+		Groups:   directory,
+		Clock:    clk,
 	}
 }
 
+// GetDevices returns the devices visible to the authenticated user. Query parameters:
+//   - limit (at most 1000, default every device) and cursor (next_cursor of the previous page)
+//   - online (true or false), active_state and make (comma-separated values), search (part of display_name)
+//   - group: devices of a server-side group and its subgroups, or of the upstream group with that ID
+//   - sort: one of database.DeviceSortFields, prefixed with - for descending (default display_name)
+//   - fields: comma-separated fields to return, _id and device_id are always included
 func (h *DeviceHandlers) GetDevices(c *gin.Context) {
-	devices, err := h.DB.GetDevices()
+	scope, err := h.Scopes.ForRequest(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"result_list": devices})
+	query, err := h.deviceQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	query.DeviceIDs = scope.DeviceIDs()
+
+	page, err := h.DB.FindDevices(query)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"result_list": page.Devices, "total": page.Total}
+	if page.NextCursor != "" {
+		response["next_cursor"] = page.NextCursor
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// deviceQuery reads the list parameters of GetDevices.
+func (h *DeviceHandlers) deviceQuery(c *gin.Context) (database.DeviceQuery, error) {
+	query := database.DeviceQuery{
+		ActiveStates: splitList(c.Query("active_state")),
+		Makes:        splitList(c.Query("make")),
+		Search:       strings.TrimSpace(c.Query("search")),
+		Fields:       splitList(c.Query("fields")),
+		Cursor:       c.Query("cursor"),
+	}
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit < 1 || limit > database.MaxDevicePageSize {
+			return query, fmt.Errorf("invalid limit, use 1 to %d", database.MaxDevicePageSize)
+		}
+		query.Limit = limit
+	}
+	if onlineStr := c.Query("online"); onlineStr != "" {
+		online, err := strconv.ParseBool(onlineStr)
+		if err != nil {
+			return query, fmt.Errorf("invalid online, use true or false")
+		}
+		query.Online = &online
+	}
+	if sort := c.Query("sort"); sort != "" {
+		query.Descending = strings.HasPrefix(sort, "-")
+		query.Sort = strings.TrimPrefix(sort, "-")
+		if !contains(database.DeviceSortFields, query.Sort) {
+			return query, fmt.Errorf("invalid sort, use one of %s", strings.Join(database.DeviceSortFields, ", "))
+		}
+	}
+	for _, field := range query.Fields {
+		if !database.ValidDeviceField(field) {
+			return query, fmt.Errorf("invalid field %q", field)
+		}
+	}
+	if groupID := c.Query("group"); groupID != "" {
+		query.GroupID = groupID
+		query.GroupDeviceIDs = h.Groups.DeviceIDs(groupID)
+	}
+	return query, nil
+}
+
+// splitList splits a comma-separated query parameter, dropping empty values.
+func splitList(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *DeviceHandlers) UpdateDeviceHandler(c *gin.Context) {
@@ -71,7 +164,7 @@ func (h *DeviceHandlers) UpdateDeviceHandler(c *gin.Context) {
 	}
 
 	if err := h.DB.UpdateDevice(deviceID, updatedDevice, version); err != nil { // Pass version to UpdateDevice
-		if err.Error() == "device not found" || err.Error() == "Outdated device version" {
+		if errors.Is(err, database.ErrOutdatedDeviceVersion) {
 			c.JSON(http.StatusConflict, gin.H{"error": err.Error()}) // Return 409 Conflict and specific message
 			return
 		} else {
@@ -98,9 +191,7 @@ func (h *DeviceHandlers) CheckForUpdates(c *gin.Context) {
 		return
 	}
 
-	h.UpdateMutex.RLock()
-	serverLastUpdate, deviceExists := h.LastUpdateTimes[deviceID]
-	h.UpdateMutex.RUnlock()
+	serverLastUpdate, deviceExists := h.Ingestor.LastUpdate(deviceID)
 
 	if !deviceExists {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
@@ -115,7 +206,7 @@ func (h *DeviceHandlers) CheckForUpdates(c *gin.Context) {
 		// Efficiently fetch the updated device data, including _id
 		updatedDevice, err := h.fetchUpdatedDevice(deviceID)
 		if err != nil {
-			if err == mongo.ErrNoDocuments { // Handle device not found during fetch
+			if errors.Is(err, database.ErrDeviceNotFound) { // Handle device not found during fetch
 
 				c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 			} else {
@@ -141,37 +232,16 @@ func (h *DeviceHandlers) CheckForUpdates(c *gin.Context) {
 	c.JSON(http.StatusOK, responseData)
 }
 
-// Helper function to fetch a single updated device efficiently
+// fetchUpdatedDevice returns the DeviceDeltaFields of a device, or database.ErrDeviceNotFound.
 func (h *DeviceHandlers) fetchUpdatedDevice(deviceID string) (map[string]interface{}, error) {
-
-	objID, err := primitive.ObjectIDFromHex(deviceID) // Convert to ObjectID
-
+	page, err := h.DB.FindDevices(database.DeviceQuery{DeviceIDs: []string{deviceID}, Fields: api.DeviceDeltaFields})
 	if err != nil {
-		return nil, fmt.Errorf("invalid device ID: %w", err) //Wrap the error
+		return nil, err
 	}
-
-	collection := h.DB.Client.Database(h.Config.DatabaseName).Collection(h.Config.DeviceCollectionName)
-
-	// Project only necessary fields as you did in earlier fetch functions. Add more fields if needed.
-	projection := bson.D{
-		{"online", 1},
-		{"latest_device_point", 1},
-		{"latest_accurate_device_point", 1},
-		{"updated_at", 1},
-		{"device_id", 1},
-		{"active_state", 1},
-		{"_id", 1},
+	if len(page.Devices) == 0 {
+		return nil, database.ErrDeviceNotFound
 	}
-
-	var updatedDevice map[string]interface{} //Correctly use updatedDevice here
-
-	err = collection.FindOne(context.TODO(), bson.M{"_id": objID}, options.FindOne().SetProjection(projection)).Decode(&updatedDevice) //Use correct filter, options
-
-	if err != nil {
-		return nil, err //Return the error from database query, for specific error handling
-	}
-
-	return updatedDevice, nil
+	return page.Devices[0], nil
 }
 
 // RefreshDatabaseHandler clears the device and user preferences collections and then re-fetches device data from the external API.
@@ -182,7 +252,7 @@ func (h *DeviceHandlers) RefreshDatabaseHandler(c *gin.Context) {
 	}
 
 	//Refetch devices from API.
-	api.FetchAndStoreDevices(h.DB, h.Config, &h.UpdateMutex, h.LastUpdateTimes, &h.LastChecked)
+	h.Ingestor.FetchAndStoreDevices()
 
 	c.JSON(http.StatusOK, gin.H{"message": "Database refreshed successfully"})
 }
@@ -205,10 +275,17 @@ func (h *DeviceHandlers) SaveDeviceSettingsHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// The scope was checked against the path, the body cannot name another device
+	if settings.DeviceID != "" && settings.DeviceID != c.Param("id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id does not match the path"})
+		return
+	}
+	settings.DeviceID = c.Param("id")
 
 	updatedSettings, err := h.DB.SaveDeviceSettings(settings) // Updated to match changes
 	if err != nil {
-		if err.Error() == "Outdated device settings version" {
+		if errors.Is(err, database.ErrOutdatedSettingsVersion) {
+			// currentPrefs, like the preferences conflict, is the key clients already read
 			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "currentPrefs": updatedSettings})
 			return
 		}
@@ -217,6 +294,81 @@ func (h *DeviceHandlers) SaveDeviceSettingsHandler(c *gin.Context) {
 		return
 
 	}
+	h.Ingestor.Hub.Publish(events.TypeSettings, updatedSettings.DeviceID, updatedSettings)
 
 	c.JSON(http.StatusOK, updatedSettings) //Return updated settings
 }
+
+// GetDeviceHistoryHandler returns the recorded track of a device between the from and to query
+// parameters (RFC3339). Defaults to the last 24 hours.
+func (h *DeviceHandlers) GetDeviceHistoryHandler(c *gin.Context) {
+	deviceID := c.Param("id")
+
+	from, to, err := parseTimeRange(c, h.Clock.Now(), 24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var limit int64
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err = strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+	}
+
+	// accuracy=accurate (default), inaccurate to debug noisy units, or all
+	var accurate *bool
+	switch c.DefaultQuery("accuracy", "accurate") {
+	case "accurate":
+		accurate = &[]bool{true}[0]
+	case "inaccurate":
+		accurate = &[]bool{false}[0]
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid accuracy, use accurate, inaccurate or all"})
+		return
+	}
+
+	points, err := h.DB.GetDeviceHistory(deviceID, from, to, limit, accurate)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"device_id": deviceID,
+		"from":      from.Format(time.RFC3339),
+		"to":        to.Format(time.RFC3339),
+		"points":    points,
+	})
+}
+
+// parseTimeRange reads the from/to query parameters (RFC3339). Missing values default to
+// the window of the given length ending now.
+func parseTimeRange(c *gin.Context, now time.Time, defaultWindow time.Duration) (time.Time, time.Time, error) {
+	to := now
+	if toStr := c.Query("to"); toStr != "" {
+		parsed, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to timestamp format, use RFC3339")
+		}
+		to = parsed
+	}
+
+	from := to.Add(-defaultWindow)
+	if fromStr := c.Query("from"); fromStr != "" {
+		parsed, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from timestamp format, use RFC3339")
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
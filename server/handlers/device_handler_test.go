@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"OneStepGPSLeo/api"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/mockserver"
+	"OneStepGPSLeo/models"
+	"OneStepGPSLeo/sources"
+)
+
+func TestHistoryDefaultsToTheSessionClock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	session, err := mockserver.NewSession(mockserver.NewDatastore(), models.Config{MockSeed: 42, MockDataFile: "../result.json"}, 0.5, 2)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	server := httptest.NewServer(mockserver.NewRouter(session.Datastore, mockserver.NewSink()))
+	defer server.Close()
+
+	config := models.Config{APIURL: server.URL + "/api/v1/devices", DataSources: []string{"api"}, UpdateInterval: 60}
+	deviceSources, err := sources.FromConfig(config, session.Clock)
+	if err != nil {
+		t.Fatalf("FromConfig: %v", err)
+	}
+	db := database.NewMemory()
+	db.Clock = session.Clock
+	ingestor := api.NewIngestor(config, db, deviceSources, events.NewHub(100, session.Clock), session.Clock)
+	for i := 0; i < 20; i++ {
+		session.Advance(time.Minute)
+		ingestor.FetchAndStoreDevices()
+	}
+
+	h := NewDeviceHandlers(config, db, ingestor, nil, nil, session.Clock)
+	router := gin.New()
+	router.GET("/api/devices/:id/history", h.GetDeviceHistoryHandler)
+
+	// The session runs in November 2024, a range ending at the system time would miss every point
+	to := session.Clock.Now()
+	from := to.Add(-24 * time.Hour)
+	found := 0
+	for _, device := range session.Datastore.GetDevices() {
+		deviceID := device["device_id"].(string)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/devices/"+deviceID+"/history?accuracy=all", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("history of %s answered %d: %s", deviceID, w.Code, w.Body.String())
+		}
+		var response struct {
+			From   string                     `json:"from"`
+			To     string                     `json:"to"`
+			Points []models.DevicePointRecord `json:"points"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("failed to decode the history of %s: %v", deviceID, err)
+		}
+		if response.From != from.Format(time.RFC3339) || response.To != to.Format(time.RFC3339) {
+			t.Errorf("history of %s ranges from %s to %s, want the last 24 hours of the session up to %s", deviceID, response.From, response.To, to.Format(time.RFC3339))
+		}
+		for _, point := range response.Points {
+			if point.DtTracker.Before(from) || point.DtTracker.After(to) {
+				t.Errorf("history of %s has a point at %s outside the default range", deviceID, point.DtTracker)
+			}
+		}
+		found += len(response.Points)
+	}
+	if found == 0 {
+		t.Errorf("no points in the default history range of any device after 20 polls")
+	}
+
+	// Default settings are dated by the session clock as well
+	settings, err := db.GetDeviceSettings("new-device")
+	if err != nil || settings.UpdatedAt != to.Format(time.RFC3339) {
+		t.Errorf("default settings updated at %s, %v, want %s", settings.UpdatedAt, err, to.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/geofence"
+	"OneStepGPSLeo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GeofenceHandlers manages geofences and serves their events.
+type GeofenceHandlers struct {
+	DB     database.Repository
+	Engine *geofence.Engine
+	Scopes *auth.Scopes
+	Clock  clock.Clock // Time the default event ranges end at
+}
+
+// NewGeofenceHandlers creates a new instance of GeofenceHandlers.
+func NewGeofenceHandlers(db database.Repository, engine *geofence.Engine, scopes *auth.Scopes, clk clock.Clock) *GeofenceHandlers {
+	return &GeofenceHandlers{DB: db, Engine: engine, Scopes: scopes, Clock: clk}
+}
+
+// GetGeofencesHandler returns every geofence.
+func (h *GeofenceHandlers) GetGeofencesHandler(c *gin.Context) {
+	geofences, err := h.DB.GetGeofences()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"geofences": geofences})
+}
+
+// GetGeofenceHandler returns a single geofence.
+func (h *GeofenceHandlers) GetGeofenceHandler(c *gin.Context) {
+	geofence, err := h.DB.GetGeofence(c.Param("id"))
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, geofence)
+}
+
+// CreateGeofenceHandler creates a geofence from the request body.
+func (h *GeofenceHandlers) CreateGeofenceHandler(c *gin.Context) {
+	var fence models.Geofence
+	if err := c.ShouldBindJSON(&fence); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := geofence.Validate(fence); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := h.DB.CreateGeofence(fence)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.reload()
+	c.JSON(http.StatusCreated, created)
+}
+
+// UpdateGeofenceHandler replaces a geofence. The body must carry the version it was read with,
+// a stale version returns 409 with the current geofence.
+func (h *GeofenceHandlers) UpdateGeofenceHandler(c *gin.Context) {
+	var fence models.Geofence
+	if err := c.ShouldBindJSON(&fence); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	fence.ID = c.Param("id")
+	if err := geofence.Validate(fence); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated, err := h.DB.UpdateGeofence(fence)
+	if err != nil {
+		if errors.Is(err, database.ErrOutdatedGeofenceVersion) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "currentGeofence": updated})
+			return
+		}
+		h.writeError(c, err)
+		return
+	}
+	h.reload()
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteGeofenceHandler deletes a geofence. Its events are kept.
+func (h *GeofenceHandlers) DeleteGeofenceHandler(c *gin.Context) {
+	if err := h.DB.DeleteGeofence(c.Param("id")); err != nil {
+		h.writeError(c, err)
+		return
+	}
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"message": "Geofence deleted"})
+}
+
+// GetGeofenceEventsHandler returns the events of a geofence in the from/to range (RFC3339, defaults
+// to the last 7 days), optionally limited to one device with device_id.
+func (h *GeofenceHandlers) GetGeofenceEventsHandler(c *gin.Context) {
+	geofenceID := c.Param("id")
+	from, to, err := parseTimeRange(c, h.Clock.Now(), 7*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	geofenceEvents, err := h.DB.GetGeofenceEvents(c.Query("device_id"), geofenceID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	visible := geofenceEvents[:0]
+	for _, event := range geofenceEvents {
+		if scope.Contains(event.DeviceID) {
+			visible = append(visible, event)
+		}
+	}
+	geofenceEvents = visible
+	c.JSON(http.StatusOK, gin.H{"geofence_id": geofenceID, "from": from.Format(time.RFC3339), "to": to.Format(time.RFC3339), "events": geofenceEvents})
+}
+
+// GetDeviceGeofenceEventsHandler returns the geofence events of a device in the from/to range
+// (RFC3339, defaults to the last 7 days) and the geofences it is currently in.
+func (h *GeofenceHandlers) GetDeviceGeofenceEventsHandler(c *gin.Context) {
+	deviceID := c.Param("id")
+	from, to, err := parseTimeRange(c, h.Clock.Now(), 7*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	geofenceEvents, err := h.DB.GetGeofenceEvents(deviceID, "", from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"device_id": deviceID,
+		"from":      from.Format(time.RFC3339),
+		"to":        to.Format(time.RFC3339),
+		"inside":    h.Engine.Inside(deviceID),
+		"events":    geofenceEvents,
+	})
+}
+
+// reload makes the engine pick up a geofence change.
+func (h *GeofenceHandlers) reload() {
+	if err := h.Engine.Reload(); err != nil {
+		log.Printf("Failed to reload geofences: %v", err)
+	}
+}
+
+func (h *GeofenceHandlers) writeError(c *gin.Context, err error) {
+	if errors.Is(err, database.ErrGeofenceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
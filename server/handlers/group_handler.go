@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/availability"
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/groups"
+	"OneStepGPSLeo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GroupHandlers manages device groups and runs settings changes and reports on whole groups.
+type GroupHandlers struct {
+	DB        database.Repository
+	Directory *groups.Directory
+	Hub       *events.Hub
+	Scopes    *auth.Scopes
+	Clock     clock.Clock // Time the default report range and the uptime of today end at
+}
+
+// NewGroupHandlers creates a new instance of GroupHandlers.
+func NewGroupHandlers(db database.Repository, directory *groups.Directory, hub *events.Hub, scopes *auth.Scopes, clk clock.Clock) *GroupHandlers {
+	return &GroupHandlers{DB: db, Directory: directory, Hub: hub, Scopes: scopes, Clock: clk}
+}
+
+type groupDevicesRequest struct {
+	DeviceIDs []string `json:"device_ids"`
+}
+
+// settingsFailure is a device a group settings change could not be applied to.
+type settingsFailure struct {
+	DeviceID string `json:"device_id"`
+	Error    string `json:"error"`
+}
+
+// GetGroupsHandler returns every device group. Devices outside the user's scope are left out of device_ids.
+func (h *GroupHandlers) GetGroupsHandler(c *gin.Context) {
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	deviceGroups, err := h.DB.GetDeviceGroups()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range deviceGroups {
+		deviceGroups[i].DeviceIDs = visibleDeviceIDs(scope, deviceGroups[i].DeviceIDs)
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": deviceGroups})
+}
+
+// GetGroupHandler returns a single device group.
+func (h *GroupHandlers) GetGroupHandler(c *gin.Context) {
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	group, err := h.DB.GetDeviceGroup(c.Param("id"))
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	group.DeviceIDs = visibleDeviceIDs(scope, group.DeviceIDs)
+	c.JSON(http.StatusOK, group)
+}
+
+// CreateGroupHandler creates a device group from the request body.
+func (h *GroupHandlers) CreateGroupHandler(c *gin.Context) {
+	var group models.DeviceGroup
+	if err := c.ShouldBindJSON(&group); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := h.validate(c, group, nil); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := h.DB.CreateDeviceGroup(group)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.reload()
+	c.JSON(http.StatusCreated, created)
+}
+
+// UpdateGroupHandler replaces a device group. The body must carry the version it was read with,
+// a stale version returns 409 with the current group. Devices outside the user's scope keep their membership.
+func (h *GroupHandlers) UpdateGroupHandler(c *gin.Context) {
+	var group models.DeviceGroup
+	if err := c.ShouldBindJSON(&group); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	group.ID = c.Param("id")
+
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	existing, err := h.DB.GetDeviceGroup(group.ID)
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	if err := h.validate(c, group, &scope); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, deviceID := range existing.DeviceIDs {
+		if !scope.Contains(deviceID) {
+			group.DeviceIDs = append(group.DeviceIDs, deviceID)
+		}
+	}
+
+	updated, err := h.DB.UpdateDeviceGroup(group)
+	if err != nil {
+		if errors.Is(err, database.ErrOutdatedGroupVersion) {
+			updated.DeviceIDs = visibleDeviceIDs(scope, updated.DeviceIDs)
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "currentGroup": updated})
+			return
+		}
+		h.writeError(c, err)
+		return
+	}
+	h.reload()
+	updated.DeviceIDs = visibleDeviceIDs(scope, updated.DeviceIDs)
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteGroupHandler deletes a device group. Groups with subgroups return 409, groups with devices
+// outside the user's scope return 403 as deleting them would change the membership of those devices.
+func (h *GroupHandlers) DeleteGroupHandler(c *gin.Context) {
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	group, err := h.DB.GetDeviceGroup(c.Param("id"))
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	for _, deviceID := range group.DeviceIDs {
+		if !scope.Contains(deviceID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Device group has devices outside your scope"})
+			return
+		}
+	}
+
+	if err := h.DB.DeleteDeviceGroup(group.ID); err != nil {
+		h.writeError(c, err)
+		return
+	}
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"message": "Device group deleted"})
+}
+
+// AddGroupDevicesHandler adds the devices in the body to a group without needing its version.
+func (h *GroupHandlers) AddGroupDevicesHandler(c *gin.Context) {
+	var req groupDevicesRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.DeviceIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_ids is required"})
+		return
+	}
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	unknown, err := h.unknownDevice(scope, req.DeviceIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if unknown != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Device %s not found", unknown)})
+		return
+	}
+
+	group, err := h.DB.AddDevicesToGroup(c.Param("id"), req.DeviceIDs)
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	h.reload()
+	group.DeviceIDs = visibleDeviceIDs(scope, group.DeviceIDs)
+	c.JSON(http.StatusOK, group)
+}
+
+// RemoveGroupDeviceHandler removes a device from a group without needing its version.
+func (h *GroupHandlers) RemoveGroupDeviceHandler(c *gin.Context) {
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	deviceID := c.Param("deviceId")
+	if !scope.Contains(deviceID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	group, err := h.DB.RemoveDeviceFromGroup(c.Param("id"), deviceID)
+	if err != nil {
+		h.writeError(c, err)
+		return
+	}
+	h.reload()
+	group.DeviceIDs = visibleDeviceIDs(scope, group.DeviceIDs)
+	c.JSON(http.StatusOK, group)
+}
+
+// SaveGroupSettingsHandler applies the settings in the body to every device of a group and its
+// subgroups that the user can see. The body holds only the settings to change, e.g.
+// {"offline_timeout": {...}, "max_hdop": 5}, the other settings of each device are kept.
+func (h *GroupHandlers) SaveGroupSettingsHandler(c *gin.Context) {
+	var patch map[string]json.RawMessage
+	if err := c.ShouldBindJSON(&patch); err != nil || len(patch) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := groups.ValidateSettingsPatch(patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	deviceIDs, ok := h.groupDevices(c)
+	if !ok {
+		return
+	}
+
+	updated := []models.DeviceSettings{}
+	failed := []settingsFailure{}
+	for _, deviceID := range deviceIDs {
+		settings, err := h.applySettings(deviceID, patch)
+		if err != nil {
+			failed = append(failed, settingsFailure{DeviceID: deviceID, Error: err.Error()})
+			continue
+		}
+		h.Hub.Publish(events.TypeSettings, settings.DeviceID, settings)
+		updated = append(updated, settings)
+	}
+	c.JSON(http.StatusOK, gin.H{"group_id": c.Param("id"), "updated": updated, "failed": failed})
+}
+
+// GetGroupReportHandler sums up the trips, stops and uptime of every device of a group and its
+// subgroups that the user can see, in the from/to range (RFC3339, defaults to the last 7 days).
+// Trips and stops overlapping the range are counted in full.
+func (h *GroupHandlers) GetGroupReportHandler(c *gin.Context) {
+	now := h.Clock.Now()
+	from, to, err := parseTimeRange(c, now, 7*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	deviceIDs, ok := h.groupDevices(c)
+	if !ok {
+		return
+	}
+
+	reports := make([]models.DeviceReport, 0, len(deviceIDs))
+	var totals models.DeviceReport
+	for _, deviceID := range deviceIDs {
+		report, err := h.deviceReport(deviceID, from, to, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		reports = append(reports, report)
+
+		totals.Trips += report.Trips
+		totals.DistanceMeters += report.DistanceMeters
+		totals.DriveSeconds += report.DriveSeconds
+		totals.Stops += report.Stops
+		totals.StopSeconds += report.StopSeconds
+		totals.OnlineSeconds += report.OnlineSeconds
+		totals.OfflineSeconds += report.OfflineSeconds
+	}
+	totals.UptimePercent = uptimePercent(totals.OnlineSeconds, totals.OfflineSeconds)
+
+	c.JSON(http.StatusOK, gin.H{
+		"group_id": c.Param("id"),
+		"from":     from.Format(time.RFC3339),
+		"to":       to.Format(time.RFC3339),
+		"devices":  reports,
+		"totals":   totals,
+	})
+}
+
+// groupDevices returns the visible devices of the group in the id parameter and its subgroups.
+// It responds with an error and returns false if the group does not exist.
+func (h *GroupHandlers) groupDevices(c *gin.Context) ([]string, bool) {
+	groupID := c.Param("id")
+	if !h.Directory.Exists(groupID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": database.ErrGroupNotFound.Error()})
+		return nil, false
+	}
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return visibleDeviceIDs(scope, h.Directory.DeviceIDs(groupID)), true
+}
+
+// applySettings merges a settings patch into the current settings of a device and saves them.
+func (h *GroupHandlers) applySettings(deviceID string, patch map[string]json.RawMessage) (models.DeviceSettings, error) {
+	current, err := h.DB.GetDeviceSettings(deviceID)
+	if err != nil {
+		return models.DeviceSettings{}, err
+	}
+	settings, err := groups.ApplySettingsPatch(current, patch)
+	if err != nil {
+		return models.DeviceSettings{}, err
+	}
+	return h.DB.SaveDeviceSettings(settings)
+}
+
+// deviceReport sums up the trips, stops and uptime of one device.
+func (h *GroupHandlers) deviceReport(deviceID string, from, to, now time.Time) (models.DeviceReport, error) {
+	report := models.DeviceReport{DeviceID: deviceID}
+
+	trips, err := h.DB.GetTrips(deviceID, from, to)
+	if err != nil {
+		return report, err
+	}
+	for _, trip := range trips {
+		report.Trips++
+		report.DistanceMeters += trip.DistanceMeters
+		report.DriveSeconds += trip.DurationSeconds
+	}
+	stops, err := h.DB.GetStops(deviceID, from, to)
+	if err != nil {
+		return report, err
+	}
+	for _, stop := range stops {
+		report.Stops++
+		report.StopSeconds += stop.DurationSeconds
+	}
+
+	initial, err := h.DB.GetLatestAvailabilityEvent(deviceID, from)
+	if err != nil {
+		return report, err
+	}
+	transitions, err := h.DB.GetAvailabilityEvents(deviceID, from, to)
+	if err != nil {
+		return report, err
+	}
+	for _, day := range availability.DailyUptime(initial, transitions, from, to, now) {
+		report.OnlineSeconds += day.OnlineSeconds
+		report.OfflineSeconds += day.OfflineSeconds
+	}
+	report.UptimePercent = uptimePercent(report.OnlineSeconds, report.OfflineSeconds)
+	return report, nil
+}
+
+// validate checks a group against the stored groups and that its devices are stored and visible to the user.
+// A nil scope loads the scope of the request.
+func (h *GroupHandlers) validate(c *gin.Context, group models.DeviceGroup, scope *auth.Scope) error {
+	if scope == nil {
+		requestScope, err := h.Scopes.ForRequest(c)
+		if err != nil {
+			return err
+		}
+		scope = &requestScope
+	}
+	unknown, err := h.unknownDevice(*scope, group.DeviceIDs)
+	if err != nil {
+		return err
+	}
+	if unknown != "" {
+		return fmt.Errorf("device %s not found", unknown)
+	}
+	all, err := h.DB.GetDeviceGroups()
+	if err != nil {
+		return err
+	}
+	return groups.Validate(group, all)
+}
+
+// unknownDevice returns the first of deviceIDs that is not the device_id of a stored device visible
+// to the user, or "" if they all are. MongoDB _ids are not accepted as group members.
+func (h *GroupHandlers) unknownDevice(scope auth.Scope, deviceIDs []string) (string, error) {
+	for _, deviceID := range deviceIDs {
+		if !scope.Contains(deviceID) {
+			return deviceID, nil
+		}
+		exists, err := h.DB.DeviceExists(deviceID)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return deviceID, nil
+		}
+	}
+	return "", nil
+}
+
+// reload makes the directory pick up a group change.
+func (h *GroupHandlers) reload() {
+	if err := h.Directory.Reload(); err != nil {
+		log.Printf("Failed to reload device groups: %v", err)
+	}
+}
+
+func (h *GroupHandlers) writeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrGroupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, database.ErrGroupHasChildren):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// visibleDeviceIDs returns the device IDs in the scope, keeping their order.
+func visibleDeviceIDs(scope auth.Scope, deviceIDs []string) []string {
+	if scope.All() {
+		return deviceIDs
+	}
+	visible := []string{}
+	for _, deviceID := range deviceIDs {
+		if scope.Contains(deviceID) {
+			visible = append(visible, deviceID)
+		}
+	}
+	return visible
+}
+
+func uptimePercent(online, offline float64) float64 {
+	if total := online + offline; total > 0 {
+		return online / total * 100
+	}
+	return 0
+}
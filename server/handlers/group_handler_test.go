@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/groups"
+	"OneStepGPSLeo/models"
+)
+
+// groupTest serves the group endpoints of a memory backend with the devices truck-1 and truck-2.
+type groupTest struct {
+	db     *database.Memory
+	router *gin.Engine
+	tokens *auth.Tokens
+}
+
+func newGroupTest(t *testing.T) *groupTest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db := database.NewMemory()
+	for _, deviceID := range []string{"truck-1", "truck-2"} {
+		if err := db.InsertDevice(models.Device{DeviceID: deviceID}); err != nil {
+			t.Fatalf("InsertDevice: %v", err)
+		}
+	}
+	tokens, err := auth.NewTokens("secret", 15*time.Minute, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+	directory := groups.NewDirectory(db)
+	if err := directory.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	h := NewGroupHandlers(db, directory, events.NewHub(10, clock.System), auth.NewScopes(db), clock.System)
+	router := gin.New()
+	groupRoutes := router.Group("/api/groups", auth.Middleware(tokens))
+	groupRoutes.DELETE("/:id", h.DeleteGroupHandler)
+	groupRoutes.POST("/:id/devices", h.AddGroupDevicesHandler)
+	return &groupTest{db: db, router: router, tokens: tokens}
+}
+
+// user creates a user and returns its access token.
+func (g *groupTest) user(t *testing.T, user models.User) string {
+	t.Helper()
+	user, err := g.db.CreateUser(user)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	pair, err := g.tokens.Issue(user, "session-"+user.Username)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	return pair.AccessToken
+}
+
+func (g *groupTest) group(t *testing.T, deviceIDs ...string) models.DeviceGroup {
+	t.Helper()
+	group, err := g.db.CreateDeviceGroup(models.DeviceGroup{Name: "Fleet", DeviceIDs: deviceIDs})
+	if err != nil {
+		t.Fatalf("CreateDeviceGroup: %v", err)
+	}
+	return group
+}
+
+// send makes a request as the user of the access token.
+func (g *groupTest) send(method, path, accessToken string, body any) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	g.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestDeleteGroupWithDevicesOutsideTheScope(t *testing.T) {
+	g := newGroupTest(t)
+	operator := g.user(t, models.User{Username: "dispatch", Role: models.RoleOperator, DeviceIDs: []string{"truck-1"}})
+	admin := g.user(t, models.User{Username: "admin", Role: models.RoleAdmin})
+
+	shared := g.group(t, "truck-1", "truck-2")
+	if w := g.send(http.MethodDelete, "/api/groups/"+shared.ID, operator, nil); w.Code != http.StatusForbidden {
+		t.Errorf("operator deleting a group with truck-2 = %d %s, want 403", w.Code, w.Body.String())
+	}
+	if _, err := g.db.GetDeviceGroup(shared.ID); err != nil {
+		t.Errorf("group is gone after the refused delete: %v", err)
+	}
+
+	own := g.group(t, "truck-1")
+	if w := g.send(http.MethodDelete, "/api/groups/"+own.ID, operator, nil); w.Code != http.StatusOK {
+		t.Errorf("operator deleting a group of their devices = %d %s, want 200", w.Code, w.Body.String())
+	}
+	if w := g.send(http.MethodDelete, "/api/groups/"+shared.ID, admin, nil); w.Code != http.StatusOK {
+		t.Errorf("admin deleting the group = %d %s, want 200", w.Code, w.Body.String())
+	}
+	if w := g.send(http.MethodDelete, "/api/groups/"+shared.ID, admin, nil); w.Code != http.StatusNotFound {
+		t.Errorf("deleting the group again = %d %s, want 404", w.Code, w.Body.String())
+	}
+}
+
+func TestAddGroupDevicesRequiresStoredDevices(t *testing.T) {
+	g := newGroupTest(t)
+	admin := g.user(t, models.User{Username: "admin", Role: models.RoleAdmin})
+	group := g.group(t, "truck-1")
+	_, objectIDs, err := g.db.GetDeviceOwners()
+	if err != nil {
+		t.Fatalf("GetDeviceOwners: %v", err)
+	}
+	unknown := []string{"ghost"}
+	for objectID := range objectIDs {
+		unknown = append(unknown, objectID) // The admin scope contains _ids, they are still no device_ids
+	}
+
+	for _, deviceID := range unknown {
+		w := g.send(http.MethodPost, "/api/groups/"+group.ID+"/devices", admin, groupDevicesRequest{DeviceIDs: []string{"truck-2", deviceID}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("adding %s = %d %s, want 400", deviceID, w.Code, w.Body.String())
+		}
+	}
+	if stored, _ := g.db.GetDeviceGroup(group.ID); len(stored.DeviceIDs) != 1 {
+		t.Errorf("group has devices %v after the refused additions, want only truck-1", stored.DeviceIDs)
+	}
+
+	if w := g.send(http.MethodPost, "/api/groups/"+group.ID+"/devices", admin, groupDevicesRequest{DeviceIDs: []string{"truck-2"}}); w.Code != http.StatusOK {
+		t.Errorf("adding truck-2 = %d %s, want 200", w.Code, w.Body.String())
+	}
+}
@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"context"
 	"fmt"
 	"image"
 	"io"
@@ -10,23 +9,23 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
 
 	"OneStepGPSLeo/database" // Correct import path
-	"OneStepGPSLeo/models"   // Correct import path
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/models" // Correct import path
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type IconHandlers struct {
-	DB     *database.MongoDB
+	DB     database.Repository
 	Config models.Config
+	Hub    *events.Hub
 }
 
-func NewIconHandlers(cfg models.Config, db *database.MongoDB) *IconHandlers {
-	return &IconHandlers{Config: cfg, DB: db}
+func NewIconHandlers(cfg models.Config, db database.Repository, hub *events.Hub) *IconHandlers {
+	return &IconHandlers{Config: cfg, DB: db, Hub: hub}
 }
 
 // HandleIconUpload handles both uploading and removing device icons.
@@ -39,11 +38,7 @@ func (h *IconHandlers) HandleIconUpload(c *gin.Context) {
 		return
 	}
 
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	if err := h.validateDevice(ctx, deviceIDStr); err != nil {
+	if err := h.validateDevice(deviceIDStr); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
 	}
@@ -59,6 +54,7 @@ func (h *IconHandlers) HandleIconUpload(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove icon"})
 			return
 		}
+		h.publishIcon(deviceIDStr, "")
 		c.JSON(http.StatusOK, gin.H{"message": "Icon removed successfully"})
 		return
 	}
@@ -69,6 +65,7 @@ func (h *IconHandlers) HandleIconUpload(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set default icon"})
 			return
 		}
+		h.publishIcon(deviceIDStr, defaultIcon)
 		c.JSON(http.StatusOK, gin.H{"iconUrl": defaultIcon, "message": "Default icon set successfully"})
 		return
 	}
@@ -79,6 +76,7 @@ func (h *IconHandlers) HandleIconUpload(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process icon upload"})
 		return
 	}
+	h.publishIcon(deviceIDStr, updatedSettings.IconURL)
 
 	c.JSON(http.StatusOK, gin.H{
 		"iconUrl": updatedSettings.IconURL,
@@ -87,9 +85,20 @@ func (h *IconHandlers) HandleIconUpload(c *gin.Context) {
 	})
 }
 
-func (h *IconHandlers) validateDevice(ctx context.Context, deviceID string) error {
-	collection := h.DB.Client.Database(h.DB.DatabaseName).Collection(h.DB.DeviceCollectionName)
-	return collection.FindOne(ctx, bson.M{"device_id": deviceID}).Err()
+// publishIcon notifies stream subscribers that the icon of a device changed.
+func (h *IconHandlers) publishIcon(deviceID, iconURL string) {
+	h.Hub.Publish(events.TypeIcon, deviceID, gin.H{"device_id": deviceID, "iconUrl": iconURL})
+}
+
+func (h *IconHandlers) validateDevice(deviceID string) error {
+	exists, err := h.DB.DeviceExists(deviceID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return database.ErrDeviceNotFound
+	}
+	return nil
 }
 
 func (h *IconHandlers) handleIconRemoval(settings models.DeviceSettings, iconDir string) error {
@@ -231,13 +240,5 @@ func (h *IconHandlers) saveIconFile(file multipart.File, filename string) error
 }
 
 func (h *IconHandlers) UpdateDeviceIconURL(deviceID primitive.ObjectID, iconURL string) error {
-	filter := bson.M{"_id": deviceID}
-	update := bson.M{"$set": bson.M{"iconUrl": iconURL}} // Make sure field name matches your database
-
-	// Use the database client from h.DB
-	collection := h.DB.Client.Database(h.DB.DatabaseName).Collection(h.DB.DeviceCollectionName)
-	_, err := collection.UpdateOne(context.TODO(), filter, update)
-
-	return err // Directly return the error from UpdateOne for simpler error handling
-
+	return h.DB.UpdateDeviceIconURL(deviceID, iconURL)
 }
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/notify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NotificationHandlers reports the notification channels and their delivery log.
+type NotificationHandlers struct {
+	DB         database.Repository
+	Dispatcher *notify.Dispatcher
+}
+
+// NewNotificationHandlers creates a new instance of NotificationHandlers.
+func NewNotificationHandlers(db database.Repository, dispatcher *notify.Dispatcher) *NotificationHandlers {
+	return &NotificationHandlers{DB: db, Dispatcher: dispatcher}
+}
+
+// GetChannelsHandler returns every configured channel with its queue and delivery counts.
+func (h *NotificationHandlers) GetChannelsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"channels": h.Dispatcher.Statuses()})
+}
+
+// TestChannelHandler queues a test alert on a channel.
+func (h *NotificationHandlers) TestChannelHandler(c *gin.Context) {
+	delivery, err := h.Dispatcher.Test(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+// GetDeliveriesHandler returns the delivery log, newest first. Supports channel, alert_id,
+// status and limit (default 100).
+func (h *NotificationHandlers) GetDeliveriesHandler(c *gin.Context) {
+	limit := int64(100)
+	if limitStr := c.Query("limit"); limitStr != "" {
+		parsed, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = parsed
+	}
+
+	deliveries, err := h.DB.GetNotificationDeliveries(c.Query("channel"), c.Query("alert_id"), c.Query("status"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
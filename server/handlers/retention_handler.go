@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+
+	"OneStepGPSLeo/retention"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetentionHandlers exposes the history retention worker to admins.
+type RetentionHandlers struct {
+	Worker *retention.Worker
+}
+
+// NewRetentionHandlers creates a new instance of RetentionHandlers.
+func NewRetentionHandlers(worker *retention.Worker) *RetentionHandlers {
+	return &RetentionHandlers{Worker: worker}
+}
+
+// GetRetentionReportHandler returns a dry-run report of the points the next retention pass will purge.
+func (h *RetentionHandlers) GetRetentionReportHandler(c *gin.Context) {
+	report, err := h.Worker.Plan()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// RunRetentionHandler runs a retention pass immediately and returns what was deleted.
+func (h *RetentionHandlers) RunRetentionHandler(c *gin.Context) {
+	report, err := h.Worker.Purge()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+
+	"OneStepGPSLeo/api"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SourceHandlers exposes the state of the ingestion sources.
+type SourceHandlers struct {
+	Ingestor *api.Ingestor
+}
+
+// NewSourceHandlers creates a new instance of SourceHandlers.
+func NewSourceHandlers(ingestor *api.Ingestor) *SourceHandlers {
+	return &SourceHandlers{Ingestor: ingestor}
+}
+
+// GetSourcesHandler returns the health, last successful fetch and error count of each source.
+func (h *SourceHandlers) GetSourcesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"sources": h.Ingestor.SourceStatuses()})
+}
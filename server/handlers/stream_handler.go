@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+// heartbeatInterval keeps idle connections from being closed by proxies.
+const heartbeatInterval = 15 * time.Second
+
+// StreamHandlers serves the server-sent events stream fed by the event hub.
+type StreamHandlers struct {
+	Hub    *events.Hub
+	Scopes *auth.Scopes
+}
+
+// NewStreamHandlers creates a new instance of StreamHandlers.
+func NewStreamHandlers(hub *events.Hub, scopes *auth.Scopes) *StreamHandlers {
+	return &StreamHandlers{Hub: hub, Scopes: scopes}
+}
+
+// StreamHandler pushes device, settings and icon events as they happen.
+// A client reconnecting with the Last-Event-ID header (or lastEventId query parameter) first receives
+// the events it missed. When they are no longer available a "reset" event tells it to reload everything.
+// Only events of devices visible to the user are sent; the scope is fixed when the stream opens.
+func (h *StreamHandlers) StreamHandler(c *gin.Context) {
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	sub, missed, resumed := h.Hub.Subscribe(lastEventID)
+	defer sub.Cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Disable proxy buffering (nginx)
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	switch {
+	case !resumed:
+		log.Printf("Stream client could not resume from event %q, sending reset", lastEventID)
+		writeSSE(w, h.Hub.LastEventID(), "reset", gin.H{"reason": "missed events are no longer available"})
+	case lastEventID == "":
+		writeSSE(w, h.Hub.LastEventID(), "connected", gin.H{})
+	}
+	for _, event := range missed {
+		if visibleEvent(scope, event) {
+			writeSSE(w, event.ID, event.Type, event)
+		}
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				return // Dropped for falling behind, the client reconnects with its Last-Event-ID
+			}
+			if !visibleEvent(scope, event) {
+				continue
+			}
+			writeSSE(w, event.ID, event.Type, event)
+			w.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			w.Flush()
+		}
+	}
+}
+
+// visibleEvent reports whether an event may be sent to a user with the given scope.
+func visibleEvent(scope auth.Scope, event events.Event) bool {
+	return event.DeviceID == "" || scope.Contains(event.DeviceID)
+}
+
+// writeSSE writes a single event in the text/event-stream format.
+func writeSSE(w io.Writer, id, eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", eventType, err)
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, payload)
+}
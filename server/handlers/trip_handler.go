@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/trips"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TripHandlers serves the trips and stops detected by the trip engine.
+type TripHandlers struct {
+	DB     database.Repository
+	Engine *trips.Engine
+	Clock  clock.Clock // Time the default ranges end at
+}
+
+// NewTripHandlers creates a new instance of TripHandlers.
+func NewTripHandlers(db database.Repository, engine *trips.Engine, clk clock.Clock) *TripHandlers {
+	return &TripHandlers{DB: db, Engine: engine, Clock: clk}
+}
+
+// GetTripsHandler returns the trips of a device overlapping the from/to range (RFC3339, defaults to
+// the last 7 days), including the trip in progress.
+func (h *TripHandlers) GetTripsHandler(c *gin.Context) {
+	deviceID := c.Param("id")
+	from, to, err := parseTimeRange(c, h.Clock.Now(), 7*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceTrips, err := h.DB.GetTrips(deviceID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if trip, ok := h.Engine.OpenTrip(deviceID); ok && !trip.StartTime.After(to) && !trip.EndTime.Before(from) {
+		deviceTrips = append(deviceTrips, trip)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "from": from.Format(time.RFC3339), "to": to.Format(time.RFC3339), "trips": deviceTrips})
+}
+
+// GetStopsHandler returns the stops of a device overlapping the from/to range (RFC3339, defaults to
+// the last 7 days), including the current stop.
+func (h *TripHandlers) GetStopsHandler(c *gin.Context) {
+	deviceID := c.Param("id")
+	from, to, err := parseTimeRange(c, h.Clock.Now(), 7*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stops, err := h.DB.GetStops(deviceID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if stop, ok := h.Engine.OpenStop(deviceID); ok && !stop.StartTime.After(to) && !stop.EndTime.Before(from) {
+		stops = append(stops, stop)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "from": from.Format(time.RFC3339), "to": to.Format(time.RFC3339), "stops": stops})
+}
@@ -1,8 +1,9 @@
 /*
 Package handlers provides HTTP request handlers for user-related operations.
 
-This file contains handlers for retrieving, saving, and updating user preferences.
-It interacts with the database to manage user specific settings.
+This file contains handlers for managing user accounts and for retrieving, saving, and
+updating the preferences of the authenticated user. It interacts with the database to
+manage user specific settings.
 */
 package handlers
 
@@ -12,33 +13,123 @@ import (
 	"log"
 	"net/http"
 
+	"OneStepGPSLeo/auth"
 	"OneStepGPSLeo/database"
 	"OneStepGPSLeo/models"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // UserHandlers struct to manage dependencies for user-related operations. Contains a database client and configuration for the handlers.
 type UserHandlers struct {
-	DB     *database.MongoDB
+	DB     database.Repository
 	Config models.Config
 }
 
 // NewUserHandlers creates a new instance of UserHandlers with the provided dependencies.
-func NewUserHandlers(cfg models.Config, db *database.MongoDB) *UserHandlers {
+func NewUserHandlers(cfg models.Config, db database.Repository) *UserHandlers {
 	return &UserHandlers{Config: cfg, DB: db}
 }
 
-// GetUserPreferencesHandler retrieves user preferences from the database.
+// createUserRequest is the body of CreateUserHandler.
+type createUserRequest struct {
+	Username        string   `json:"username"`
+	Password        string   `json:"password"`
+	Role            string   `json:"role"`
+	UpstreamUserIDs []string `json:"upstream_user_ids"`
+	DeviceIDs       []string `json:"device_ids"`
+	HiddenDeviceIDs []string `json:"hidden_device_ids"`
+}
+
+// GetUsersHandler returns every user account.
+func (h *UserHandlers) GetUsersHandler(c *gin.Context) {
+	users, err := h.DB.GetUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// CreateUserHandler creates a user account. The role defaults to viewer.
+func (h *UserHandlers) CreateUserHandler(c *gin.Context) {
+	var req createUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	if req.Role != "" && !auth.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be viewer, operator or admin"})
+		return
+	}
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.DB.CreateUser(models.User{
+		Username:        req.Username,
+		PasswordHash:    hash,
+		Role:            req.Role,
+		UpstreamUserIDs: req.UpstreamUserIDs,
+		DeviceIDs:       req.DeviceIDs,
+		HiddenDeviceIDs: req.HiddenDeviceIDs,
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrUsernameTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, user)
+}
+
+// UpdateUserHandler replaces the role and device overrides of an account. The body must contain the
+// version that was read; on a mismatch 409 is returned with the current account.
+func (h *UserHandlers) UpdateUserHandler(c *gin.Context) {
+	var user models.User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	user.ID = c.Param("id")
+	if !auth.ValidRole(user.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be viewer, operator or admin"})
+		return
+	}
+	if claims, _ := auth.CurrentUser(c); claims.Subject == user.ID && user.Role != models.RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot remove your own admin role"})
+		return
+	}
+
+	updated, err := h.DB.UpdateUserAccess(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrUserNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, database.ErrOutdatedUserVersion):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "currentUser": updated})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// GetUserPreferencesHandler retrieves the preferences of the authenticated user from the database.
 // It handles cases where preferences are not found by returning default values.
 func (h *UserHandlers) GetUserPreferencesHandler(c *gin.Context) {
-	userID := c.Param("userId")
+	claims, _ := auth.CurrentUser(c)
+	userID := claims.Subject
 
 	prefs, err := h.DB.GetUserPreferences(userID)
 	if err != nil {
 		// Check if it's a "not found" error to return the default
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrPreferencesNotFound) {
 			fmt.Println(err)
 			prefs = models.UserPreferences{
 				UserID:          userID,
@@ -62,10 +153,11 @@ func (h *UserHandlers) GetUserPreferencesHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, prefs)
 }
 
-// SaveUserPreferencesHandler saves or updates user preferences in the database.
+// SaveUserPreferencesHandler saves or updates the preferences of the authenticated user in the database.
 
 func (h *UserHandlers) SaveUserPreferencesHandler(c *gin.Context) {
-	userId := c.Param("userId") // Get userId from URL parameter
+	claims, _ := auth.CurrentUser(c)
+	userId := claims.Subject // Preferences always belong to the authenticated user
 
 	log.Printf("SaveUserPreferencesHandler called for userId: %s", userId)
 
@@ -75,7 +167,7 @@ func (h *UserHandlers) SaveUserPreferencesHandler(c *gin.Context) {
 
 	}
 	log.Printf("Attempting to save preferences: %+v", prefs)
-	// Set UserID from the URL parameter.
+	// Set UserID from the access token, whatever the body says.
 	prefs.UserID = userId // Ensure UserID is set correctly
 
 	// Attempt to save preferences.  Use returned updatedPrefs to update frontend store if needed.
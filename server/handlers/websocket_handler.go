@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"OneStepGPSLeo/api"
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = 45 * time.Second
+	wsMaxMessage   = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// The REST API allows every origin (cors.Default), the socket follows the same policy
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocketHandlers serves device updates to clients subscribed to a subset of the fleet.
+type WebSocketHandlers struct {
+	DB     database.Repository
+	Config models.Config
+	Hub    *events.Hub
+	Scopes *auth.Scopes
+}
+
+// NewWebSocketHandlers creates a new instance of WebSocketHandlers.
+func NewWebSocketHandlers(cfg models.Config, db database.Repository, hub *events.Hub, scopes *auth.Scopes) *WebSocketHandlers {
+	return &WebSocketHandlers{Config: cfg, DB: db, Hub: hub, Scopes: scopes}
+}
+
+// wsClientMessage is sent by the client to change its subscription.
+//
+//	{"type": "subscribe", "device_ids": ["..."], "bbox": {"min_lat": 0, "min_lng": 0, "max_lat": 1, "max_lng": 1}}
+//	{"type": "unsubscribe"}
+type wsClientMessage struct {
+	Type string `json:"type"`
+	api.DeviceFilter
+}
+
+// wsServerMessage is sent to the client. Type is one of subscribed, snapshot, device, leave, settings, icon or error.
+type wsServerMessage struct {
+	Type     string                   `json:"type"`
+	EventID  string                   `json:"event_id,omitempty"`
+	DeviceID string                   `json:"device_id,omitempty"`
+	Filter   *api.DeviceFilter        `json:"filter,omitempty"`
+	Devices  []map[string]interface{} `json:"devices,omitempty"`
+	Data     interface{}              `json:"data,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// wsClient is the per connection subscription state, only touched by the connection's write loop.
+type wsClient struct {
+	scope      auth.Scope // Devices the user may see, fixed when the connection opens
+	filter     api.DeviceFilter
+	subscribed bool
+	inView     map[string]bool // Devices the client currently has, used to send "leave" for bbox subscriptions
+}
+
+// WebSocketHandler upgrades the connection and streams updates for the subscribed devices only.
+// Nothing is sent until the client subscribes; a subscribe with no device_ids and no bbox selects every
+// device visible to the user.
+func (h *WebSocketHandlers) WebSocketHandler(c *gin.Context) {
+	scope, err := h.Scopes.ForRequest(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	sub, _, _ := h.Hub.Subscribe("")
+	defer sub.Cancel()
+
+	requests := make(chan wsClientMessage)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go h.readLoop(conn, requests, done, quit)
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	client := &wsClient{scope: scope, inView: make(map[string]bool)}
+	for {
+		select {
+		case <-done:
+			return
+		case msg := <-requests:
+			if err := h.handleClientMessage(conn, client, msg); err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				h.write(conn, wsServerMessage{Type: "error", Error: "client is too slow, reconnect and subscribe again"})
+				return
+			}
+			if err := h.forwardEvent(conn, client, event); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop decodes client messages until the connection is closed.
+func (h *WebSocketHandlers) readLoop(conn *websocket.Conn, requests chan<- wsClientMessage, done chan<- struct{}, quit <-chan struct{}) {
+	defer close(done)
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var msg wsClientMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket read error: %v", err)
+			}
+			return
+		}
+		select {
+		case requests <- msg:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (h *WebSocketHandlers) handleClientMessage(conn *websocket.Conn, client *wsClient, msg wsClientMessage) error {
+	switch msg.Type {
+	case "subscribe":
+		if msg.BBox != nil {
+			if err := msg.BBox.Validate(); err != nil {
+				return h.write(conn, wsServerMessage{Type: "error", Error: err.Error()})
+			}
+		}
+
+		devices, err := api.FetchDeviceDeltas(h.DB, msg.DeviceFilter, client.scope)
+		if err != nil {
+			log.Printf("Failed to load devices for subscription: %v", err)
+			return h.write(conn, wsServerMessage{Type: "error", Error: "Failed to load devices"})
+		}
+
+		client.filter = msg.DeviceFilter
+		client.subscribed = true
+		client.inView = make(map[string]bool, len(devices))
+		for _, device := range devices {
+			if deviceID, ok := device["device_id"].(string); ok {
+				client.inView[deviceID] = true
+			}
+		}
+
+		if err := h.write(conn, wsServerMessage{Type: "subscribed", Filter: &client.filter}); err != nil {
+			return err
+		}
+		return h.write(conn, wsServerMessage{Type: "snapshot", Devices: devices})
+	case "unsubscribe":
+		client.filter = api.DeviceFilter{}
+		client.subscribed = false
+		client.inView = make(map[string]bool)
+		return h.write(conn, wsServerMessage{Type: "subscribed"})
+	default:
+		return h.write(conn, wsServerMessage{Type: "error", Error: "unknown message type " + msg.Type})
+	}
+}
+
+// forwardEvent sends a hub event to the client if it concerns one of its devices.
+func (h *WebSocketHandlers) forwardEvent(conn *websocket.Conn, client *wsClient, event events.Event) error {
+	if !client.subscribed || !visibleEvent(client.scope, event) {
+		return nil
+	}
+
+	switch event.Type {
+	case events.TypeDevice:
+		delta, ok := event.Data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if client.filter.Matches(delta) {
+			client.inView[event.DeviceID] = true
+			return h.write(conn, wsServerMessage{Type: event.Type, EventID: event.ID, DeviceID: event.DeviceID, Data: delta})
+		}
+		if client.inView[event.DeviceID] {
+			// The device moved out of the bounding box, send its final position so the client can drop it
+			delete(client.inView, event.DeviceID)
+			return h.write(conn, wsServerMessage{Type: "leave", EventID: event.ID, DeviceID: event.DeviceID, Data: delta})
+		}
+	default:
+		if client.filter.IsEmpty() || client.inView[event.DeviceID] || client.filter.MatchesID(event.DeviceID) {
+			return h.write(conn, wsServerMessage{Type: event.Type, EventID: event.ID, DeviceID: event.DeviceID, Data: event.Data})
+		}
+	}
+	return nil
+}
+
+func (h *WebSocketHandlers) write(conn *websocket.Conn, msg wsServerMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := conn.WriteJSON(msg); err != nil {
+		log.Printf("WebSocket write error: %v", err)
+		return err
+	}
+	return nil
+}
@@ -5,15 +5,27 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
-	"sync"
+	"text/tabwriter"
 	"time"
 
+	"OneStepGPSLeo/alerts"
 	"OneStepGPSLeo/api"
+	"OneStepGPSLeo/auth"
+	"OneStepGPSLeo/availability"
+	"OneStepGPSLeo/clock"
 	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/geofence"
+	"OneStepGPSLeo/groups"
 	"OneStepGPSLeo/handlers"
-	mockserver "OneStepGPSLeo/mockServer"
+	"OneStepGPSLeo/mockserver"
 	"OneStepGPSLeo/models"
+	"OneStepGPSLeo/notify"
+	"OneStepGPSLeo/retention"
+	"OneStepGPSLeo/sources"
+	"OneStepGPSLeo/trips"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -29,20 +41,72 @@ func main() {
 	mockMode := flag.Bool("mock", false, "Run in mock mode")
 	mutateChance := flag.Float64("mutateChance", 0.3, "Chance of mutation (0.0 - 1.0)") // Mutation chance flag
 	mutateDeviceCount := flag.Int("mutateDevice", 2, "Number of devices to mutate")     // Number of mutations flag
+	storage := flag.String("storage", "", "Storage backend, mongodb, sqlite or memory (overrides the storage setting)")
+	scenario := flag.String("scenario", "", "Mock scenario file with device routes (overrides the mock_scenario_file setting)")
+	replay := flag.String("replay", "", "Recorded track to replay in mock mode, .gpx, .csv or .jsonl (overrides the mock_replay_file setting)")
+	replaySpeed := flag.Float64("replaySpeed", 0, "Replay clock relative to real time, e.g. 10 (overrides the mock_replay_speed setting)")
+	fleetSize := flag.Int("fleet", 0, "Number of synthetic mock devices to generate (overrides the mock_fleet_size setting)")
+	fleetSeed := flag.Int64("fleetSeed", 0, "Seed of the synthetic mock fleet (overrides the mock_fleet_seed setting)")
+	seed := flag.Int64("seed", 0, "Seed of a deterministic mock session on a virtual clock (overrides the mock_seed setting)")
 	flag.Parse()
+	if *storage != "" {
+		config.Storage = *storage
+	}
+	if *scenario != "" {
+		config.MockScenarioFile = *scenario
+	}
+	if *replay != "" {
+		config.MockReplayFile = *replay
+	}
+	if *replaySpeed > 0 {
+		config.MockReplaySpeed = *replaySpeed
+	}
+	if *fleetSize > 0 {
+		config.MockFleetSize = *fleetSize
+	}
+	if *fleetSeed != 0 {
+		config.MockFleetSeed = *fleetSeed
+	}
+	if *seed != 0 {
+		config.MockSeed = *seed
+	}
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(config, flag.Args()[1:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
 	fmt.Println("Mock mode:", *mockMode)
 	fmt.Println("Mutation chance:", *mutateChance)
 	fmt.Println("Number of mutations:", *mutateDeviceCount)
 
+	appClock := clock.System
+	var mockSession *mockserver.Session
 	if *mockMode {
 		// Get mock server port from config, default to 8081 if not set
 		mockServerPort := config.MockServerPort
 		if mockServerPort == "" {
 			mockServerPort = "8081"
 		}
-		go mockserver.StartMockServer(config, mockServerPort, 5*time.Second, *mutateChance, *mutateDeviceCount)
-		config.APIURL = "http://localhost:8081/api/v1/devices"
+		datastore := mockserver.NewDatastore()
+		mockserver.RegisterSource(datastore) // Allows selecting the in-process "mock" source
+		sink := mockserver.NewSink()         // Records notifications sent to the mock server
+		mockSession, err = mockserver.NewSession(datastore, config, *mutateChance, *mutateDeviceCount)
+		if err != nil {
+			log.Fatalf("Failed to start the mock session: %v", err)
+		}
+		if mockSession.Deterministic() {
+			// The mock devices only move when the poller advances the virtual clock
+			appClock = mockSession.Clock
+			fmt.Printf("Deterministic mock session with seed %d, starting at %s\n", config.MockSeed, appClock.Now().Format(time.RFC3339))
+		} else {
+			go mockSession.Run(5 * time.Second)
+		}
+		go mockserver.StartMockServer(datastore, sink, mockServerPort)
+		// Unless sources were chosen explicitly, the "api" source polls the mock server over HTTP
+		config.APIURL = fmt.Sprintf("http://localhost:%s/api/v1/devices", mockServerPort)
 		config.APIKey = ""
+		go mockserver.StartSMTPServer(sink, config.MockSMTPPort)
 
 		fmt.Println("Waiting for mock server to start...") // Indicate waiting
 		time.Sleep(2 * time.Second)                        // Give the mock server time to start
@@ -50,23 +114,86 @@ func main() {
 		fmt.Println("Mock server started, continuing...") // Indicate continuation
 	}
 
-	db, err := database.NewMongoDB(config)
+	if len(config.DataSources) == 0 {
+		config.DataSources = []string{"api"}
+		if config.APIURL == "" {
+			config.DataSources = []string{sources.TypeFile}
+		}
+	}
+
+	db, err := database.Open(config, appClock)
+	if err != nil {
+		log.Fatalf("Failed to initialize the %s storage: %v", config.Storage, err)
+	}
+
+	if err := ensureAdminUser(db, config); err != nil {
+		log.Fatalf("Failed to create the admin user: %v", err)
+	}
+	if config.JWTSecret == "" {
+		log.Printf("jwt_secret is not set, tokens will not survive a restart")
+	}
+	tokens, err := auth.NewTokens(config.JWTSecret, time.Duration(config.AccessTokenTTL)*time.Minute, time.Duration(config.RefreshTokenTTL)*time.Hour)
 	if err != nil {
-		log.Fatalf("Failed to initialize MongoDB: %v", err)
+		log.Fatalf("Failed to configure authentication: %v", err)
 	}
 
-	deviceHandlers := handlers.NewDeviceHandlers(config, db)
+	deviceSources, err := sources.FromConfig(config, appClock)
+	if err != nil {
+		log.Fatalf("Failed to configure data sources: %v", err)
+	}
+	hub := events.NewHub(config.EventBufferSize, appClock)
+	ingestor := api.NewIngestor(config, db, deviceSources, hub, appClock)
+	tripEngine := trips.NewEngine(db)
+	ingestor.AddProcessor(tripEngine)
+	availabilityMonitor := availability.NewMonitor(db, hub, api.DeviceDelta, time.Duration(config.OfflineCheckInterval)*time.Second, appClock)
+	ingestor.AddObserver(availabilityMonitor)
+	groupDirectory := groups.NewDirectory(db)
+	geofenceEngine := geofence.NewEngine(db, hub, groupDirectory)
+	ingestor.AddObserver(geofenceEngine)
+	ingestor.AddProcessor(geofenceEngine)
+	alertEngine := alerts.NewEngine(db, hub, groupDirectory)
+	ingestor.AddObserver(alertEngine)
+	ingestor.AddProcessor(alertEngine)
+	dispatcher, err := notify.NewDispatcher(db, hub, config.NotificationChannels)
+	if err != nil {
+		log.Fatalf("Failed to configure notification channels: %v", err)
+	}
+
+	scopes := auth.NewScopes(db)
+	authHandlers := handlers.NewAuthHandlers(db, tokens)
+	deviceHandlers := handlers.NewDeviceHandlers(config, db, ingestor, scopes, groupDirectory, appClock)
 	userHandlers := handlers.NewUserHandlers(config, db)
-	iconHandlers := handlers.NewIconHandlers(config, db)
+	iconHandlers := handlers.NewIconHandlers(config, db, hub)
+	streamHandlers := handlers.NewStreamHandlers(hub, scopes)
+	webSocketHandlers := handlers.NewWebSocketHandlers(config, db, hub, scopes)
+	tripHandlers := handlers.NewTripHandlers(db, tripEngine, appClock)
+	sourceHandlers := handlers.NewSourceHandlers(ingestor)
+	availabilityHandlers := handlers.NewAvailabilityHandlers(db, availabilityMonitor, appClock)
+	geofenceHandlers := handlers.NewGeofenceHandlers(db, geofenceEngine, scopes, appClock)
+	alertHandlers := handlers.NewAlertHandlers(db, alertEngine, hub, scopes)
+	notificationHandlers := handlers.NewNotificationHandlers(db, dispatcher)
+	groupHandlers := handlers.NewGroupHandlers(db, groupDirectory, hub, scopes, appClock)
 
-	lastUpdateTimes := make(map[string]time.Time)
-	var updateMutex sync.RWMutex
-	lastChecked := time.Now()
+	retentionWorker := retention.NewWorker(db, time.Duration(config.RetentionInterval)*time.Minute, appClock)
+	retentionHandlers := handlers.NewRetentionHandlers(retentionWorker)
+	go retentionWorker.Run()
+	if mockSession == nil || !mockSession.Deterministic() {
+		go availabilityMonitor.Run() // A deterministic session checks after every poll instead
+	}
+	go alertEngine.Run()
+	go dispatcher.Run()
 
 	go func() {
 		for {
-			fmt.Println("Fetching device data from external api")
-			api.FetchAndStoreDevices(db, config, &updateMutex, lastUpdateTimes, &lastChecked) // Call from api package
+			if mockSession != nil && mockSession.Deterministic() {
+				// Every poll is one step of the virtual clock, so a seed replays the same session
+				mockSession.Advance(time.Duration(config.UpdateInterval) * time.Second)
+			}
+			fmt.Println("Fetching device data from sources", config.DataSources)
+			ingestor.FetchAndStoreDevices()
+			if mockSession != nil && mockSession.Deterministic() {
+				availabilityMonitor.Check(appClock.Now())
+			}
 
 			time.Sleep(time.Duration(config.UpdateInterval) * time.Second) // Correct duration
 		}
@@ -75,34 +202,146 @@ func main() {
 	router := gin.Default()
 	router.Use(cors.Default())
 
-	apiRoutes := router.Group("/api")
+	// Signing in is the only thing possible without an access token
+	router.POST("/api/auth/login", authHandlers.LoginHandler)
+	router.POST("/api/auth/refresh", authHandlers.RefreshHandler)
+
+	// Viewers may read, operator and admin routes are marked, device routes check the user's scope
+	operator := auth.RequireRole(models.RoleOperator)
+	admin := auth.RequireRole(models.RoleAdmin)
+	device := scopes.RequireDevice()
+
+	apiRoutes := router.Group("/api", auth.Middleware(tokens))
 	{
+		authRoutes := apiRoutes.Group("/auth")
+		{
+			authRoutes.POST("/logout", authHandlers.LogoutHandler)
+			authRoutes.GET("/me", authHandlers.MeHandler)
+			authRoutes.POST("/password", authHandlers.ChangePasswordHandler)
+		}
 		deviceRoutes := apiRoutes.Group("/devices")
 		{
 			deviceRoutes.GET("", deviceHandlers.GetDevices)
-			deviceRoutes.PUT("/:id", deviceHandlers.UpdateDeviceHandler)
+			deviceRoutes.PUT("/:id", operator, device, deviceHandlers.UpdateDeviceHandler)
+			deviceRoutes.GET("/stream", streamHandlers.StreamHandler)
+			deviceRoutes.GET("/ws", webSocketHandlers.WebSocketHandler)
 			deviceRoutes.GET("/check-updates", func(c *gin.Context) {
-				api.CheckForUpdates(c, db, config, &lastChecked, lastUpdateTimes)
+				scope, err := scopes.ForRequest(c)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				api.CheckForUpdates(c, db, config, ingestor.LastCheck(), scope)
 			})
-			deviceRoutes.GET("/:id/settings", deviceHandlers.GetDeviceSettingsHandler)
-			deviceRoutes.PUT("/:id/settings", deviceHandlers.SaveDeviceSettingsHandler)
-			deviceRoutes.DELETE("/refresh", deviceHandlers.RefreshDatabaseHandler)
+			deviceRoutes.GET("/:id/settings", device, deviceHandlers.GetDeviceSettingsHandler)
+			deviceRoutes.GET("/:id/history", device, deviceHandlers.GetDeviceHistoryHandler)
+			deviceRoutes.GET("/:id/trips", device, tripHandlers.GetTripsHandler)
+			deviceRoutes.GET("/:id/stops", device, tripHandlers.GetStopsHandler)
+			deviceRoutes.GET("/:id/availability", device, availabilityHandlers.GetAvailabilityHandler)
+			deviceRoutes.GET("/:id/uptime", device, availabilityHandlers.GetUptimeHandler)
+			deviceRoutes.GET("/:id/geofence-events", device, geofenceHandlers.GetDeviceGeofenceEventsHandler)
+			deviceRoutes.PUT("/:id/settings", operator, device, deviceHandlers.SaveDeviceSettingsHandler)
+			deviceRoutes.DELETE("/refresh", admin, deviceHandlers.RefreshDatabaseHandler)
+			deviceRoutes.POST("/:id/icon", operator, device, iconHandlers.HandleIconUpload)
+			deviceRoutes.GET("/:id/icon", device, iconHandlers.GetIconHandler)
+		}
+		apiRoutes.GET("/sources", sourceHandlers.GetSourcesHandler)
+		geofenceRoutes := apiRoutes.Group("/geofences")
+		{
+			geofenceRoutes.GET("", geofenceHandlers.GetGeofencesHandler)
+			geofenceRoutes.POST("", operator, geofenceHandlers.CreateGeofenceHandler)
+			geofenceRoutes.GET("/:id", geofenceHandlers.GetGeofenceHandler)
+			geofenceRoutes.PUT("/:id", operator, geofenceHandlers.UpdateGeofenceHandler)
+			geofenceRoutes.DELETE("/:id", operator, geofenceHandlers.DeleteGeofenceHandler)
+			geofenceRoutes.GET("/:id/events", geofenceHandlers.GetGeofenceEventsHandler)
+		}
+		groupRoutes := apiRoutes.Group("/groups")
+		{
+			groupRoutes.GET("", groupHandlers.GetGroupsHandler)
+			groupRoutes.POST("", operator, groupHandlers.CreateGroupHandler)
+			groupRoutes.GET("/:id", groupHandlers.GetGroupHandler)
+			groupRoutes.PUT("/:id", operator, groupHandlers.UpdateGroupHandler)
+			groupRoutes.DELETE("/:id", operator, groupHandlers.DeleteGroupHandler)
+			groupRoutes.POST("/:id/devices", operator, groupHandlers.AddGroupDevicesHandler)
+			groupRoutes.DELETE("/:id/devices/:deviceId", operator, groupHandlers.RemoveGroupDeviceHandler)
+			groupRoutes.PUT("/:id/settings", operator, groupHandlers.SaveGroupSettingsHandler)
+			groupRoutes.GET("/:id/report", groupHandlers.GetGroupReportHandler)
+		}
+		alertRoutes := apiRoutes.Group("/alerts")
+		{
+			alertRoutes.GET("", alertHandlers.GetAlertsHandler)
+			alertRoutes.GET("/rules", alertHandlers.GetAlertRulesHandler)
+			alertRoutes.POST("/rules", operator, alertHandlers.CreateAlertRuleHandler)
+			alertRoutes.GET("/rules/:id", alertHandlers.GetAlertRuleHandler)
+			alertRoutes.PUT("/rules/:id", operator, alertHandlers.UpdateAlertRuleHandler)
+			alertRoutes.DELETE("/rules/:id", operator, alertHandlers.DeleteAlertRuleHandler)
+			alertRoutes.GET("/:id", alertHandlers.GetAlertHandler)
+			alertRoutes.POST("/:id/acknowledge", operator, alertHandlers.AcknowledgeAlertHandler)
+			alertRoutes.POST("/:id/resolve", operator, alertHandlers.ResolveAlertHandler)
+		}
+		notificationRoutes := apiRoutes.Group("/notifications", admin)
+		{
+			notificationRoutes.GET("/channels", notificationHandlers.GetChannelsHandler)
+			notificationRoutes.POST("/channels/:name/test", notificationHandlers.TestChannelHandler)
+			notificationRoutes.GET("/deliveries", notificationHandlers.GetDeliveriesHandler)
+		}
+		adminRoutes := apiRoutes.Group("/admin", admin)
+		{
+			adminRoutes.GET("/retention", retentionHandlers.GetRetentionReportHandler)
+			adminRoutes.POST("/retention", retentionHandlers.RunRetentionHandler)
 		}
 		userRoutes := apiRoutes.Group("/users")
 		{
-			userRoutes.GET("/:userId/preferences", userHandlers.GetUserPreferencesHandler)
-			userRoutes.POST("/:userId/preferences", userHandlers.SaveUserPreferencesHandler)
+			userRoutes.GET("", admin, userHandlers.GetUsersHandler)
+			userRoutes.POST("", admin, userHandlers.CreateUserHandler)
+			userRoutes.PUT("/:id", admin, userHandlers.UpdateUserHandler)
+			userRoutes.GET("/me/preferences", userHandlers.GetUserPreferencesHandler)
+			userRoutes.POST("/me/preferences", userHandlers.SaveUserPreferencesHandler)
 		}
 	}
 
-	router.POST("/api/devices/:id/icon", iconHandlers.HandleIconUpload)
-	router.GET("/api/devices/:id/icon", iconHandlers.GetIconHandler)
 	router.Static("/icons", "./icons")
 
 	router.Run(":" + config.ServerPort)
 
 }
 
+// ensureAdminUser makes sure there is an admin. When there are no accounts yet the admin_username
+// account is created, without an admin_password a random one is generated and logged once. When there
+// are accounts but no admin, the admin_username account is promoted.
+func ensureAdminUser(db database.Repository, config models.Config) error {
+	admins, err := db.CountAdmins()
+	if err != nil || admins > 0 {
+		return err
+	}
+	count, err := db.CountUsers()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		user, err := db.GetUserByUsername(config.AdminUsername)
+		if err != nil {
+			return fmt.Errorf("there is no admin and no %q account to promote: %w", config.AdminUsername, err)
+		}
+		log.Printf("Giving user %q the admin role", user.Username)
+		return db.SetUserRole(user.ID, models.RoleAdmin)
+	}
+
+	password := config.AdminPassword
+	if password == "" {
+		if password, err = auth.RandomPassword(); err != nil {
+			return err
+		}
+		log.Printf("Created user %q with password %q, change it after signing in", config.AdminUsername, password)
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.CreateUser(models.User{Username: config.AdminUsername, PasswordHash: hash, Role: models.RoleAdmin})
+	return err
+}
+
 func loadConfig(filename string) (models.Config, error) {
 	var config models.Config
 	file, err := os.Open(filename)
@@ -121,12 +360,147 @@ func loadConfig(filename string) (models.Config, error) {
 	if config.UpdateInterval == 0 {
 		config.UpdateInterval = 60
 	}
+	if config.Storage == "" {
+		config.Storage = database.StorageMongoDB
+	}
+	if config.SQLitePath == "" {
+		config.SQLitePath = "onestepgps.db"
+	}
+	if config.EventBufferSize == 0 {
+		config.EventBufferSize = 1000
+	}
+	if config.RetentionInterval == 0 {
+		config.RetentionInterval = 60
+	}
+	if config.HistoryCollectionName == "" {
+		config.HistoryCollectionName = "device_history"
+	}
+	if config.TripCollectionName == "" {
+		config.TripCollectionName = "device_trips"
+	}
+	if config.StopCollectionName == "" {
+		config.StopCollectionName = "device_stops"
+	}
+	if config.AvailabilityCollectionName == "" {
+		config.AvailabilityCollectionName = "device_availability"
+	}
+	if config.GeofenceCollectionName == "" {
+		config.GeofenceCollectionName = "geofences"
+	}
+	if config.GeofenceEventCollectionName == "" {
+		config.GeofenceEventCollectionName = "geofence_events"
+	}
+	if config.AlertRuleCollectionName == "" {
+		config.AlertRuleCollectionName = "alert_rules"
+	}
+	if config.AlertCollectionName == "" {
+		config.AlertCollectionName = "alerts"
+	}
+	if config.NotificationLogCollectionName == "" {
+		config.NotificationLogCollectionName = "notification_log"
+	}
+	if config.AccountCollectionName == "" {
+		config.AccountCollectionName = "accounts"
+	}
+	if config.SessionCollectionName == "" {
+		config.SessionCollectionName = "sessions"
+	}
+	if config.GroupCollectionName == "" {
+		config.GroupCollectionName = "device_groups"
+	}
+	if config.MigrationCollectionName == "" {
+		config.MigrationCollectionName = "schema_migrations"
+	}
+	if config.AccessTokenTTL == 0 {
+		config.AccessTokenTTL = 15
+	}
+	if config.RefreshTokenTTL == 0 {
+		config.RefreshTokenTTL = 24 * 30
+	}
+	if config.AdminUsername == "" {
+		config.AdminUsername = "admin"
+	}
+	if config.MockSMTPPort == "" {
+		config.MockSMTPPort = "2525"
+	}
+	if config.OfflineCheckInterval == 0 {
+		config.OfflineCheckInterval = 60
+	}
 	if config.MockServerPort == "" {
 		config.MockServerPort = "8081"
 	}
+	if config.MockReplaySpeed <= 0 {
+		config.MockReplaySpeed = 1
+	}
 	if config.ServerPort == "" {
 		config.ServerPort = "8080"
 	}
+	if len(config.DataSources) == 0 && config.DataSource != "" {
+		config.DataSources = []string{config.DataSource}
+	}
+	if config.DataFile == "" {
+		config.DataFile = "result.json"
+	}
+	if config.APITimeoutSeconds == 0 {
+		config.APITimeoutSeconds = 10
+	}
+	if config.APIMaxRetries == nil {
+		retries := 3 // Set to 0 to disable retries
+		config.APIMaxRetries = &retries
+	}
+	if config.APIRetryBackoffMillis == 0 {
+		config.APIRetryBackoffMillis = 500
+	}
 
 	return config, nil
 }
+
+// runMigrate is the migrate command. "migrate" applies the pending schema migrations and lists them
+// all, "migrate status" only lists them.
+func runMigrate(config models.Config, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if command != "up" && command != "status" {
+		return fmt.Errorf("unknown migrate command %q, use up or status", command)
+	}
+
+	db, err := database.Connect(config, clock.System)
+	if err != nil {
+		return fmt.Errorf("failed to initialize the %s storage: %w", config.Storage, err)
+	}
+	migrator, ok := db.(database.Migrator)
+	if !ok {
+		fmt.Printf("The %s storage has no schema migrations\n", config.Storage)
+		return nil
+	}
+
+	if command == "up" {
+		applied, err := migrator.Migrate()
+		for _, status := range applied {
+			fmt.Printf("Applied migration %d: %s\n", status.Version, status.Description)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("No pending migrations")
+		}
+	}
+
+	statuses, err := migrator.Migrations()
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, status := range statuses {
+		applied := "pending"
+		if status.AppliedAt != nil {
+			applied = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\n", status.Version, applied, status.Description)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,170 @@
+package mockserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Faults are the upstream failures injected into /api/v1/devices, set with /mock/control.
+// The zero value serves the devices unchanged.
+type Faults struct {
+	LatencyMillis     int    `json:"latency_ms"`          // Delay before every response
+	Status            int    `json:"status"`              // Answer with this status instead of the devices, e.g. 503 or 429
+	RetryAfterSeconds int    `json:"retry_after_seconds"` // Retry-After header sent with Status
+	Body              string `json:"body"`                // "truncated" cuts the JSON in half, "malformed" makes it invalid
+	DuplicateDevices  int    `json:"duplicate_devices"`   // Number of devices listed twice
+	MissingDeviceID   int    `json:"missing_device_id"`   // Number of devices sent without device_id
+	ClockSkewSeconds  int    `json:"clock_skew_seconds"`  // Added to every updated_at, negative for a clock running behind
+	Requests          int    `json:"requests"`            // Number of requests the faults apply to, 0 until they are cleared
+}
+
+// Body faults.
+const (
+	BodyTruncated = "truncated"
+	BodyMalformed = "malformed"
+)
+
+// FaultInjector holds the faults of the mock device API.
+type FaultInjector struct {
+	mutex  sync.Mutex
+	faults Faults
+}
+
+// NewFaultInjector creates a FaultInjector without faults.
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{}
+}
+
+// Set replaces the faults.
+func (f *FaultInjector) Set(faults Faults) error {
+	if faults.Status != 0 && (faults.Status < 400 || faults.Status > 599) {
+		return fmt.Errorf("status must be a 4xx or 5xx status")
+	}
+	if faults.Body != "" && faults.Body != BodyTruncated && faults.Body != BodyMalformed {
+		return fmt.Errorf("body must be %q or %q", BodyTruncated, BodyMalformed)
+	}
+	if faults.LatencyMillis < 0 || faults.RetryAfterSeconds < 0 || faults.DuplicateDevices < 0 || faults.MissingDeviceID < 0 || faults.Requests < 0 {
+		return fmt.Errorf("latency_ms, retry_after_seconds, duplicate_devices, missing_device_id and requests cannot be negative")
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = faults
+	return nil
+}
+
+// Get returns the current faults.
+func (f *FaultInjector) Get() Faults {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.faults
+}
+
+// next returns the faults for a request, counting it against Requests.
+func (f *FaultInjector) next() Faults {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	faults := f.faults
+	if f.faults.Requests > 0 {
+		f.faults.Requests--
+		if f.faults.Requests == 0 {
+			f.faults = Faults{} // The last faulty request, serve the devices unchanged again
+		}
+	}
+	return faults
+}
+
+// serveDevices answers a device API request with devices, applying the faults.
+func (f *FaultInjector) serveDevices(c *gin.Context, devices []map[string]interface{}) {
+	faults := f.next()
+	if faults != (Faults{}) {
+		log.Printf("Injecting faults into the device response: %+v", faults)
+	}
+
+	if faults.LatencyMillis > 0 {
+		select {
+		case <-time.After(time.Duration(faults.LatencyMillis) * time.Millisecond):
+		case <-c.Request.Context().Done():
+			return // The client gave up
+		}
+	}
+
+	if faults.Status != 0 {
+		if faults.RetryAfterSeconds > 0 {
+			c.Header("Retry-After", strconv.Itoa(faults.RetryAfterSeconds))
+		}
+		c.JSON(faults.Status, gin.H{"error": http.StatusText(faults.Status)})
+		return
+	}
+
+	// The devices are copies, so they can be changed freely. The skew goes first, duplicates share the map.
+	if faults.ClockSkewSeconds != 0 {
+		skew := time.Duration(faults.ClockSkewSeconds) * time.Second
+		for _, device := range devices {
+			if updatedAt, ok := device["updated_at"].(string); ok {
+				if t, err := time.Parse(time.RFC3339, updatedAt); err == nil {
+					device["updated_at"] = t.Add(skew).Format(time.RFC3339)
+				}
+			}
+		}
+	}
+
+	for i := 0; i < faults.DuplicateDevices && i < len(devices); i++ {
+		devices = append(devices, devices[i])
+	}
+	for i := 0; i < faults.MissingDeviceID && i < len(devices); i++ {
+		device := copyMap(devices[i])
+		delete(device, "device_id")
+		devices[i] = device
+	}
+
+	body, err := json.Marshal(MockAPIResponse{ResultList: devices})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch faults.Body {
+	case BodyTruncated:
+		// Like a connection dropped halfway through the response
+		body = body[:len(body)/2]
+	case BodyMalformed:
+		// A trailing comma, invalid JSON that hand-written serializers produce
+		body = append(bytes.TrimSuffix(body, []byte("]}")), []byte(",]}")...)
+	}
+	c.Data(http.StatusOK, "application/json", body)
+}
+
+// registerControlRoutes serves the fault controls on the mock server:
+//   - GET /mock/control returns the current faults.
+//   - PUT /mock/control replaces them with the Faults in the body.
+//   - DELETE /mock/control clears them.
+func registerControlRoutes(router *gin.Engine, faults *FaultInjector) {
+	router.GET("/mock/control", func(c *gin.Context) {
+		c.JSON(http.StatusOK, faults.Get())
+	})
+
+	router.PUT("/mock/control", func(c *gin.Context) {
+		var update Faults
+		if err := c.ShouldBindJSON(&update); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := faults.Set(update); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, faults.Get())
+	})
+
+	router.DELETE("/mock/control", func(c *gin.Context) {
+		faults.Set(Faults{})
+		c.JSON(http.StatusOK, gin.H{"message": "Faults cleared"})
+	})
+}
@@ -0,0 +1,126 @@
+package mockserver
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// DefaultFleetRegion is the Los Angeles area, where the devices of result.json are.
+var DefaultFleetRegion = [4]float64{-118.7, 33.7, -117.6, 34.4}
+
+// FleetOptions configures GenerateFleet.
+type FleetOptions struct {
+	Size   int
+	Seed   int64      // The same seed generates the same fleet
+	Region [4]float64 // Bounding box of the positions, [west, south, east, north] like a GeoJSON bbox
+}
+
+const deviceIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-_"
+
+var (
+	fleetVehicleKinds = []string{"Truck", "Van", "Pickup", "Trailer", "Sedan", "Box Truck", "Flatbed", "Service Van"}
+	fleetDriverNames  = []string{"Alejandro", "Maria", "James", "Linh", "Fatima", "Oliver", "Priya", "Mateo", "Grace", "Hiroshi", "Amara", "Noah", "Sofia", "Daniel", "Aisha", "Lucas"}
+)
+
+// GenerateFleet synthesizes options.Size devices for load testing. Every device is a copy of one
+// of the templates, so makes, models and the point layout stay realistic, with its own device_id,
+// display_name, hardware ids, settings and a position within the region. Everything but the
+// timestamps, which are relative to now, depends only on the options and the templates.
+func GenerateFleet(templates []map[string]interface{}, options FleetOptions, now time.Time) ([]map[string]interface{}, error) {
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("no template devices to generate the fleet from")
+	}
+	if options.Size <= 0 {
+		return nil, fmt.Errorf("fleet size must be positive")
+	}
+	west, south, east, north := options.Region[0], options.Region[1], options.Region[2], options.Region[3]
+	if west >= east || south >= north || south < -90 || north > 90 || west < -180 || east > 180 {
+		return nil, fmt.Errorf("invalid fleet region %v, use [west, south, east, north]", options.Region)
+	}
+
+	rng := rand.New(rand.NewSource(options.Seed))
+	seen := make(map[string]bool, options.Size)
+	fleet := make([]map[string]interface{}, 0, options.Size)
+	for i := 0; i < options.Size; i++ {
+		device := copyMap(templates[rng.Intn(len(templates))])
+
+		deviceID := randomDeviceID(rng)
+		for seen[deviceID] {
+			deviceID = randomDeviceID(rng)
+		}
+		seen[deviceID] = true
+		device["device_id"] = deviceID
+		device["display_name"] = fmt.Sprintf("%s %04d %s", fleetVehicleKinds[rng.Intn(len(fleetVehicleKinds))], i+1, fleetDriverNames[rng.Intn(len(fleetDriverNames))])
+		if factoryID, ok := device["factory_id"].(string); ok {
+			device["factory_id"] = randomLike(rng, factoryID)
+		}
+		if secondaryID, ok := device["secondary_id"].(string); ok && secondaryID != "" {
+			device["secondary_id"] = randomLike(rng, secondaryID)
+		}
+		createdAt := now.Add(-time.Duration(rng.Int63n(int64(5 * 365 * 24 * time.Hour))))
+		device["created_at"] = createdAt.UTC().Format(time.RFC3339)
+		device["online"] = rng.Float64() < 0.9
+		if settings, ok := device["settings"].(map[string]interface{}); ok {
+			device["settings"] = fleetSettings(rng, settings)
+		}
+
+		state := routeState{
+			Lat:      south + rng.Float64()*(north-south),
+			Lng:      west + rng.Float64()*(east-west),
+			Heading:  float64(rng.Intn(360)),
+			Online:   true,
+			Ignition: rng.Float64() < 0.4,
+		}
+		if state.Ignition {
+			state.SpeedKmh = float64(rng.Intn(110))
+		}
+		reportedAt := now.Add(-time.Duration(rng.Int63n(int64(time.Hour))))
+		online := device["online"]
+		device = reportDevice(device, state, reportedAt)
+		device["online"] = online // reportDevice marks every reporting device online
+		fleet = append(fleet, device)
+	}
+	return fleet, nil
+}
+
+// randomDeviceID returns an id in the upstream format, e.g. 6jAOdk2wPiTjH-81f07-0k.
+func randomDeviceID(rng *rand.Rand) string {
+	var id strings.Builder
+	id.WriteByte('6')
+	for i := 0; i < 12; i++ {
+		id.WriteByte(deviceIDAlphabet[rng.Intn(len(deviceIDAlphabet))])
+	}
+	id.WriteString("-81f07-")
+	for i := 0; i < 2; i++ {
+		id.WriteByte(deviceIDAlphabet[rng.Intn(len(deviceIDAlphabet))])
+	}
+	return id.String()
+}
+
+// randomLike replaces the digits of s with random digits and its lowercase hex letters with
+// random hex letters, keeping the layout of hardware serial numbers like 2RVP422301833.
+func randomLike(rng *rand.Rand, s string) string {
+	const hexLetters = "abcdef"
+	replaced := []byte(s)
+	for i, c := range replaced {
+		switch {
+		case c >= '0' && c <= '9':
+			replaced[i] = byte('0' + rng.Intn(10))
+		case c >= 'a' && c <= 'f':
+			replaced[i] = hexLetters[rng.Intn(len(hexLetters))]
+		}
+	}
+	return string(replaced)
+}
+
+// fleetSettings returns a copy of the template settings with varied GPS quality thresholds.
+func fleetSettings(rng *rand.Rand, template map[string]interface{}) map[string]interface{} {
+	settings := copyMap(template)
+	settings["min_num_satellites"] = []int{0, 4, 6, 8}[rng.Intn(4)]
+	settings["max_hdop"] = []float64{2.5, 3.5, 5}[rng.Intn(3)]
+	mph := 2 + rng.Intn(4)
+	settings["begin_moving_speed"] = map[string]interface{}{"value": mph, "unit": "mph", "display": fmt.Sprintf("%d mph", mph)}
+	return settings
+}
@@ -0,0 +1,114 @@
+package mockserver
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/common"
+)
+
+// fleetTemplates returns the devices of result.json.
+func fleetTemplates(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	templates, err := common.ReadDevicesFromJSON(testDataFile)
+	if err != nil {
+		t.Fatalf("failed to read result.json: %v", err)
+	}
+	return templates
+}
+
+func generateFleetJSON(t *testing.T, templates []map[string]interface{}, options FleetOptions) string {
+	t.Helper()
+	fleet, err := GenerateFleet(templates, options, recorded)
+	if err != nil {
+		t.Fatalf("GenerateFleet: %v", err)
+	}
+	data, err := json.Marshal(fleet)
+	if err != nil {
+		t.Fatalf("failed to marshal the fleet: %v", err)
+	}
+	return string(data)
+}
+
+func TestGenerateFleetIsSeeded(t *testing.T) {
+	templates := fleetTemplates(t)
+	before, _ := json.Marshal(templates)
+	options := FleetOptions{Size: 200, Seed: 42, Region: DefaultFleetRegion}
+
+	first := generateFleetJSON(t, templates, options)
+	if second := generateFleetJSON(t, templates, options); second != first {
+		t.Errorf("two fleets with seed 42 differ")
+	}
+	options.Seed = 43
+	if other := generateFleetJSON(t, templates, options); other == first {
+		t.Errorf("fleets with seeds 42 and 43 are the same")
+	}
+	if after, _ := json.Marshal(templates); string(after) != string(before) {
+		t.Errorf("generating fleets changed the templates")
+	}
+}
+
+func TestGenerateFleetDevices(t *testing.T) {
+	regions := map[string][4]float64{
+		"default": DefaultFleetRegion,
+		"small":   {-118.25, 34.04, -118.24, 34.05},
+		"sydney":  {150.9, -34.1, 151.3, -33.7},
+	}
+	for name, region := range regions {
+		t.Run(name, func(t *testing.T) {
+			fleet, err := GenerateFleet(fleetTemplates(t), FleetOptions{Size: 500, Seed: 7, Region: region}, recorded)
+			if err != nil {
+				t.Fatalf("GenerateFleet: %v", err)
+			}
+			if len(fleet) != 500 {
+				t.Fatalf("generated %d devices, want 500", len(fleet))
+			}
+
+			west, south, east, north := region[0], region[1], region[2], region[3]
+			seen := make(map[string]bool, len(fleet))
+			for _, device := range fleet {
+				deviceID, _ := device["device_id"].(string)
+				if deviceID == "" || seen[deviceID] {
+					t.Errorf("device_id %q is empty or not unique", deviceID)
+				}
+				seen[deviceID] = true
+
+				for _, key := range []string{"latest_device_point", "latest_accurate_device_point"} {
+					point, ok := device[key].(map[string]interface{})
+					if !ok {
+						t.Fatalf("device %s has no %s", deviceID, key)
+					}
+					lat, _ := point["lat"].(float64)
+					lng, _ := point["lng"].(float64)
+					if lat < south || lat > north || lng < west || lng > east {
+						t.Errorf("device %s %s at %v, %v is outside %v", deviceID, key, lat, lng, region)
+					}
+					if reportedAt, err := time.Parse(time.RFC3339, point["dt_tracker"].(string)); err != nil || reportedAt.After(recorded) {
+						t.Errorf("device %s reported at %v, %v, want before %s", deviceID, point["dt_tracker"], err, recorded)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateFleetOptions(t *testing.T) {
+	templates := fleetTemplates(t)
+	tests := []struct {
+		name      string
+		templates []map[string]interface{}
+		options   FleetOptions
+	}{
+		{"no templates", nil, FleetOptions{Size: 10, Region: DefaultFleetRegion}},
+		{"no devices", templates, FleetOptions{Region: DefaultFleetRegion}},
+		{"west of east swapped", templates, FleetOptions{Size: 10, Region: [4]float64{-117.6, 33.7, -118.7, 34.4}}},
+		{"latitude out of range", templates, FleetOptions{Size: 10, Region: [4]float64{0, -95, 10, 10}}},
+		{"zero region", templates, FleetOptions{Size: 10}},
+	}
+	for _, test := range tests {
+		if _, err := GenerateFleet(test.templates, test.options, recorded); err == nil {
+			t.Errorf("%s: GenerateFleet succeeded, want an error", test.name)
+		}
+	}
+}
@@ -67,33 +67,40 @@ func (ds *Datastore) GetDevices() []map[string]interface{} {
 	return devicesCopy
 }
 
-func StartMockServer(config models.Config, port string, updateInterval time.Duration, mutateChance float64, mutateDeviceCount int) {
-	datastore := NewDatastore()
+// StartMockServer serves the mock server routes, see NewRouter, on port.
+func StartMockServer(datastore *Datastore, sink *Sink, port string) {
+	router := NewRouter(datastore, sink)
 
-	err := initializeMockDevicesFromLocal(datastore)
-	if err != nil {
-		log.Fatalf("Failed to initialize mock devices: %v", err)
+	log.Printf("Mock server started on :%s\n", port)
+
+	if err := router.Run(":" + port); err != nil { // Correct error handling for router.Run
+		log.Fatalf("Failed to start mock server: %v", err)
 	}
+}
 
-	// Rest of the function remains the same
-	go updateMockDevices(datastore, updateInterval, mutateChance, mutateDeviceCount)
+// NewRouter serves the datastore at /api/v1/devices, together with the notification sink.
+// Upstream failures are injected into /api/v1/devices with /mock/control.
+func NewRouter(datastore *Datastore, sink *Sink) *gin.Engine {
+	faults := NewFaultInjector() // Set with /mock/control
 
 	router := gin.Default() // Create a Gin router
 
 	router.GET("/api/v1/devices", func(c *gin.Context) {
 		c.Header("Content-Type", "application/json")
 		devices := datastore.GetDevices()
-		resp := MockAPIResponse{
-			ResultList: devices,
+		// Like the real API, only include the latest points when latest_point=true is requested
+		if c.Query("latest_point") != "true" {
+			for _, device := range devices {
+				delete(device, "latest_device_point")
+				delete(device, "latest_accurate_device_point")
+			}
 		}
-		c.JSON(http.StatusOK, resp)
+		faults.serveDevices(c, devices)
 	})
 
-	log.Printf("Mock server started on :%s\n", port)
-
-	if err := router.Run(":" + port); err != nil { // Correct error handling for router.Run
-		log.Fatalf("Failed to start mock server: %v", err)
-	}
+	registerSinkRoutes(router, sink)
+	registerControlRoutes(router, faults)
+	return router
 }
 
 // initializeMockDevicesFromAPI initializes the mock devices from the API.
@@ -135,8 +142,8 @@ func initializeMockDevicesFromAPI(datastore *Datastore, config models.Config) er
 
 }
 
-func initializeMockDevicesFromLocal(datastore *Datastore) error {
-	devices, err := common.ReadDevicesFromJSON("result.json")
+func initializeMockDevicesFromLocal(datastore *Datastore, path string) error {
+	devices, err := common.ReadDevicesFromJSON(path)
 	if err != nil {
 		return err
 	}
@@ -149,35 +156,55 @@ func initializeMockDevicesFromLocal(datastore *Datastore) error {
 	return nil
 }
 
-// updateMockDevices
-func updateMockDevices(datastore *Datastore, updateInterval time.Duration, mutateChance float64, mutateDeviceCount int) {
-	for {
-		time.Sleep(updateInterval)
+// initializeMockFleet replaces the devices from result.json with a synthetic fleet generated from them.
+func initializeMockFleet(datastore *Datastore, config models.Config, now time.Time) error {
+	options := FleetOptions{Size: config.MockFleetSize, Seed: config.MockFleetSeed, Region: DefaultFleetRegion}
+	if len(config.MockFleetRegion) > 0 {
+		if len(config.MockFleetRegion) != 4 {
+			return fmt.Errorf("mock_fleet_region needs 4 values, [west, south, east, north]")
+		}
+		copy(options.Region[:], config.MockFleetRegion)
+	}
+	fleet, err := GenerateFleet(datastore.GetDevices(), options, now)
+	if err != nil {
+		return err
+	}
 
-		devices := datastore.GetDevices() //Get copy
-		randomNumber := rand.Float64()
+	datastore.Mutex.Lock()
+	datastore.Devices = fleet
+	datastore.Mutex.Unlock()
+	log.Printf("Generated %d mock devices with seed %d.\n", len(fleet), options.Seed)
+	return nil
+}
 
-		//fmt.Printf("Random number: %f\n", randomNumber)
-		//fmt.Printf("Mutating %.2f chance\n", mutateChance) // Print with 2 decimal places
+// randomMutations moves random devices to random positions, the default simulation.
+type randomMutations struct {
+	datastore *Datastore
+	rng       *rand.Rand
+	chance    float64 // Chance of a mutation per step
+	count     int     // Devices mutated at once
+}
 
-		// Apply mutations with a certain chance
-		if randomNumber < mutateChance {
-			mutateDevices(&devices, mutateDeviceCount) // Pass devices as a pointer
-			fmt.Println("Mock devices mutated")
+func (m *randomMutations) Step(now time.Time) {
+	devices := m.datastore.GetDevices() //Get copy
+	randomNumber := m.rng.Float64()
 
-			//Update the device in datastore
-			datastore.Mutex.Lock()
+	// Apply mutations with a certain chance
+	if randomNumber < m.chance {
+		mutateDevices(&devices, m.count, m.rng, now) // Pass devices as a pointer
+		fmt.Println("Mock devices mutated")
 
-			datastore.Devices = devices //Update the devices
+		//Update the device in datastore
+		m.datastore.Mutex.Lock()
 
-			datastore.Mutex.Unlock()
+		m.datastore.Devices = devices //Update the devices
 
-		}
+		m.datastore.Mutex.Unlock()
 
 	}
 }
 
-func mutateDevices(devices *[]map[string]interface{}, mutateCount int) {
+func mutateDevices(devices *[]map[string]interface{}, mutateCount int, rng *rand.Rand, now time.Time) {
 	if len(*devices) == 0 {
 		return // Nothing to mutate
 	}
@@ -185,7 +212,7 @@ func mutateDevices(devices *[]map[string]interface{}, mutateCount int) {
 	count := min(mutateCount, len(*devices))
 
 	for i := 0; i < count; i++ {
-		index := rand.Intn(len(*devices))
+		index := rng.Intn(len(*devices))
 		device := (*devices)[index]
 
 		deviceID, ok := device["device_id"].(string) // Get device_id
@@ -196,7 +223,7 @@ func mutateDevices(devices *[]map[string]interface{}, mutateCount int) {
 
 		// Mutate online status
 		if _, ok := device["online"]; ok {
-			device["online"] = rand.Intn(2) == 0
+			device["online"] = rng.Intn(2) == 0
 
 		}
 
@@ -211,7 +238,7 @@ func mutateDevices(devices *[]map[string]interface{}, mutateCount int) {
 			if _, ok := latestDevicePoint["lat"]; ok {
 
 				if lat, ok := latestDevicePoint["lat"].(float64); ok {
-					latestDevicePoint["lat"] = mutateLat(lat)
+					latestDevicePoint["lat"] = mutateLat(lat, rng)
 
 				} else {
 					log.Printf("Latitude is not float64 for device %v", device)
@@ -224,7 +251,7 @@ func mutateDevices(devices *[]map[string]interface{}, mutateCount int) {
 
 				if lng, ok := latestDevicePoint["lng"].(float64); ok {
 
-					latestDevicePoint["lng"] = mutateLng(lng)
+					latestDevicePoint["lng"] = mutateLng(lng, rng)
 
 				} else {
 					log.Printf("Longitude is not float64 for device %v", device)
@@ -233,10 +260,16 @@ func mutateDevices(devices *[]map[string]interface{}, mutateCount int) {
 
 			}
 
+			// Every mutation is a new point, like a real tracker report
+			reportedAt := now.UTC()
+			latestDevicePoint["device_point_id"] = fmt.Sprintf("mock-%s-%d", deviceID, reportedAt.UnixNano())
+			latestDevicePoint["dt_tracker"] = reportedAt.Format(time.RFC3339)
+			latestDevicePoint["dt_server"] = reportedAt.Format(time.RFC3339Nano)
+
 			// Correctly mutate nested speed value and display:
 			if devicePointDetail, ok := latestDevicePoint["device_point_detail"].(map[string]interface{}); ok {
 				if speed, ok := devicePointDetail["speed"].(map[string]interface{}); ok {
-					speed["value"] = rand.Intn(51)
+					speed["value"] = rng.Intn(51)
 					speed["display"] = fmt.Sprintf("%d km/h", speed["value"])
 				} else {
 
@@ -249,7 +282,7 @@ func mutateDevices(devices *[]map[string]interface{}, mutateCount int) {
 		}
 
 		if _, ok := device["updated_at"]; ok {
-			device["updated_at"] = time.Now().Format(time.RFC3339) // Update timestamp
+			device["updated_at"] = now.Format(time.RFC3339) // Update timestamp
 		}
 		color.Green("Mutated device: %s\n", deviceID)
 		(*devices)[index] = device
@@ -258,9 +291,9 @@ func mutateDevices(devices *[]map[string]interface{}, mutateCount int) {
 }
 
 // Helper functions to mutate latitude, longitude. Add or subtract a random number between 0.01 degree to 0.05 degree
-func mutateLat(lat float64) float64 {
-	change := (rand.Float64() * 0.19) + 0.01 // Random change between 0.01 and 0.20
-	if rand.Intn(2) == 0 {
+func mutateLat(lat float64, rng *rand.Rand) float64 {
+	change := (rng.Float64() * 0.19) + 0.01 // Random change between 0.01 and 0.20
+	if rng.Intn(2) == 0 {
 		lat += change
 	} else {
 		lat -= change
@@ -268,10 +301,10 @@ func mutateLat(lat float64) float64 {
 	return lat
 }
 
-func mutateLng(lng float64) float64 {
+func mutateLng(lng float64, rng *rand.Rand) float64 {
 
-	change := (rand.Float64() * 0.19) + 0.01 // Random change between 0.01 and 0.20
-	if rand.Intn(2) == 0 {
+	change := (rng.Float64() * 0.19) + 0.01 // Random change between 0.01 and 0.20
+	if rng.Intn(2) == 0 {
 		lng += change
 	} else {
 		lng -= change
@@ -0,0 +1,388 @@
+package mockserver
+
+import (
+	"OneStepGPSLeo/common"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrackPoint is a recorded position of a device. Speed, heading and ignition are optional in
+// the recordings, missing speeds and headings are derived from the previous point of the device
+// and the ignition is assumed on while the device moves.
+type TrackPoint struct {
+	DeviceID string
+	Time     time.Time
+	Lat, Lng float64
+	SpeedKmh *float64
+	Heading  *float64
+	Ignition *bool
+	Point    map[string]interface{} // The full recorded device point, JSON lines only
+}
+
+// LoadTrack reads a recorded history, the format is chosen by the file extension:
+//   - .gpx: every track is a device, named by the track name, GPX 1.0 speed (m/s) and course are used.
+//   - .csv: a header row naming the columns device_id, dt_tracker (or time), lat, lng and optionally
+//     speed (km/h), angle (or heading) and acc (or ignition).
+//   - .jsonl or .ndjson: one device point per line, either a history entry with the full point in
+//     "point" or a latest_device_point with a device_id.
+//
+// The points are returned in time order.
+func LoadTrack(path string) ([]TrackPoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open track: %w", err)
+	}
+	defer file.Close()
+
+	var points []TrackPoint
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".gpx":
+		points, err = readGPX(file)
+	case ".csv":
+		points, err = readTrackCSV(file)
+	case ".jsonl", ".ndjson":
+		points, err = readTrackJSONLines(file)
+	default:
+		return nil, fmt.Errorf("unsupported track format %q, use .gpx, .csv, .jsonl or .ndjson", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read track %s: %w", path, err)
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("track %s has no points", path)
+	}
+
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	fillTrack(points)
+	return points, nil
+}
+
+// fillTrack derives the missing speeds, headings and ignition states from consecutive points.
+func fillTrack(points []TrackPoint) {
+	previous := make(map[string]*TrackPoint)
+	for i := range points {
+		point := &points[i]
+		if last, ok := previous[point.DeviceID]; ok {
+			if point.SpeedKmh == nil {
+				speed := 0.0
+				if hours := point.Time.Sub(last.Time).Hours(); hours > 0 {
+					speed = common.DistanceMeters(last.Lat, last.Lng, point.Lat, point.Lng) / 1000 / hours
+				}
+				point.SpeedKmh = &speed
+			}
+			if point.Heading == nil {
+				heading := *last.Heading // Keep facing the same way while stopped
+				if point.Lat != last.Lat || point.Lng != last.Lng {
+					heading = common.BearingDegrees(last.Lat, last.Lng, point.Lat, point.Lng)
+				}
+				point.Heading = &heading
+			}
+		} else {
+			zero := 0.0
+			if point.SpeedKmh == nil {
+				point.SpeedKmh = &zero
+			}
+			if point.Heading == nil {
+				point.Heading = &zero
+			}
+		}
+		if point.Ignition == nil {
+			moving := *point.SpeedKmh > 0
+			point.Ignition = &moving
+		}
+		previous[point.DeviceID] = point
+	}
+}
+
+func readGPX(r io.Reader) ([]TrackPoint, error) {
+	var gpx struct {
+		Tracks []struct {
+			Name     string `xml:"name"`
+			Segments []struct {
+				Points []struct {
+					Lat    float64  `xml:"lat,attr"`
+					Lon    float64  `xml:"lon,attr"`
+					Time   string   `xml:"time"`
+					Speed  *float64 `xml:"speed"` // m/s
+					Course *float64 `xml:"course"`
+				} `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+	}
+	if err := xml.NewDecoder(r).Decode(&gpx); err != nil {
+		return nil, err
+	}
+
+	var points []TrackPoint
+	for i, track := range gpx.Tracks {
+		deviceID := strings.TrimSpace(track.Name)
+		if deviceID == "" {
+			deviceID = fmt.Sprintf("track-%d", i+1)
+		}
+		for _, segment := range track.Segments {
+			for _, trkpt := range segment.Points {
+				t, err := time.Parse(time.RFC3339, strings.TrimSpace(trkpt.Time))
+				if err != nil {
+					return nil, fmt.Errorf("track %s has a point with an invalid time %q", deviceID, trkpt.Time)
+				}
+				point := TrackPoint{DeviceID: deviceID, Time: t, Lat: trkpt.Lat, Lng: trkpt.Lon, Heading: trkpt.Course}
+				if trkpt.Speed != nil {
+					speed := *trkpt.Speed * 3.6
+					point.SpeedKmh = &speed
+				}
+				points = append(points, point)
+			}
+		}
+	}
+	return points, nil
+}
+
+func readTrackCSV(r io.Reader) ([]TrackPoint, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header row: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	column := func(names ...string) int {
+		for _, name := range names {
+			if i, ok := columns[name]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	deviceCol, timeCol := column("device_id"), column("dt_tracker", "time")
+	latCol, lngCol := column("lat", "latitude"), column("lng", "lon", "longitude")
+	speedCol, headingCol, ignitionCol := column("speed"), column("angle", "heading"), column("acc", "ignition")
+	if deviceCol < 0 || timeCol < 0 || latCol < 0 || lngCol < 0 {
+		return nil, fmt.Errorf("the header row needs device_id, dt_tracker, lat and lng columns")
+	}
+
+	var points []TrackPoint
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return points, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		point := TrackPoint{DeviceID: record[deviceCol]}
+		if point.Time, err = time.Parse(time.RFC3339, record[timeCol]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid dt_tracker %q", line, record[timeCol])
+		}
+		if point.Lat, err = strconv.ParseFloat(record[latCol], 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid lat %q", line, record[latCol])
+		}
+		if point.Lng, err = strconv.ParseFloat(record[lngCol], 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid lng %q", line, record[lngCol])
+		}
+		if speedCol >= 0 && record[speedCol] != "" {
+			speed, err := strconv.ParseFloat(record[speedCol], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid speed %q", line, record[speedCol])
+			}
+			point.SpeedKmh = &speed
+		}
+		if headingCol >= 0 && record[headingCol] != "" {
+			heading, err := strconv.ParseFloat(record[headingCol], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid heading %q", line, record[headingCol])
+			}
+			point.Heading = &heading
+		}
+		if ignitionCol >= 0 && record[ignitionCol] != "" {
+			ignition, err := strconv.ParseBool(record[ignitionCol])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid ignition %q", line, record[ignitionCol])
+			}
+			point.Ignition = &ignition
+		}
+		points = append(points, point)
+	}
+}
+
+func readTrackJSONLines(r io.Reader) ([]TrackPoint, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024) // Full device points are a few KB each
+
+	var points []TrackPoint
+	for line := 1; scanner.Scan(); line++ {
+		data := strings.TrimSpace(scanner.Text())
+		if data == "" {
+			continue
+		}
+		// The extracted fields of a history entry match those of a device point
+		var record struct {
+			DeviceID  string                 `json:"device_id"`
+			DtTracker string                 `json:"dt_tracker"`
+			Lat       *float64               `json:"lat"`
+			Lng       *float64               `json:"lng"`
+			Angle     *float64               `json:"angle"`
+			Speed     *float64               `json:"speed"`
+			Point     map[string]interface{} `json:"point"`
+		}
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if record.Point == nil {
+			if err := json.Unmarshal([]byte(data), &record.Point); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			delete(record.Point, "device_id")
+		}
+		if record.DeviceID == "" || record.Lat == nil || record.Lng == nil {
+			return nil, fmt.Errorf("line %d: device_id, lat and lng are required", line)
+		}
+		t, err := time.Parse(time.RFC3339, record.DtTracker)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid dt_tracker %q", line, record.DtTracker)
+		}
+		points = append(points, TrackPoint{
+			DeviceID: record.DeviceID,
+			Time:     t,
+			Lat:      *record.Lat,
+			Lng:      *record.Lng,
+			SpeedKmh: record.Speed,
+			Heading:  record.Angle,
+			Ignition: pointIgnition(record.Point),
+			Point:    record.Point,
+		})
+	}
+	return points, scanner.Err()
+}
+
+// pointIgnition reads the ignition of a recorded device point, nil if it is not reported.
+func pointIgnition(point map[string]interface{}) *bool {
+	if detail, ok := point["device_point_detail"].(map[string]interface{}); ok {
+		if acc, ok := detail["acc"].(bool); ok {
+			return &acc
+		}
+	}
+	if params, ok := point["params"].(map[string]interface{}); ok {
+		if acc, ok := params["acc"].(string); ok && (acc == "0" || acc == "1") {
+			on := acc == "1"
+			return &on
+		}
+	}
+	return nil
+}
+
+// replayRun reports the recorded points as the clock of the recording advances, speed times
+// faster than the session clock. The recording starts at the first step. Devices report at
+// most one point per step, the latest one that is due, and stay at their last point once the
+// recording ends.
+type replayRun struct {
+	datastore *Datastore
+	points    []TrackPoint
+	speed     float64
+	start     time.Time
+	next      int // First point that is not reported yet
+}
+
+func newReplayRun(datastore *Datastore, points []TrackPoint, speed float64) *replayRun {
+	addReplayDevices(datastore, points)
+	return &replayRun{datastore: datastore, points: points, speed: speed}
+}
+
+func (r *replayRun) Step(now time.Time) {
+	if r.next >= len(r.points) {
+		return
+	}
+	if r.start.IsZero() {
+		r.start = now
+	}
+	elapsed := time.Duration(float64(now.Sub(r.start)) * r.speed)
+	r.next = applyReplay(r.datastore, r.points, r.next, r.points[0].Time.Add(elapsed))
+	if r.next >= len(r.points) {
+		log.Printf("Replay finished at %s.\n", r.points[len(r.points)-1].Time.Format(time.RFC3339))
+	}
+}
+
+// applyReplay reports the points from next up to the recording time now, and returns the index
+// of the first point that is not due yet.
+func applyReplay(datastore *Datastore, points []TrackPoint, next int, now time.Time) int {
+	due := make(map[string]TrackPoint)
+	for ; next < len(points) && !points[next].Time.After(now); next++ {
+		due[points[next].DeviceID] = points[next]
+	}
+	if len(due) == 0 {
+		return next
+	}
+
+	datastore.Mutex.Lock()
+	defer datastore.Mutex.Unlock()
+	for i, device := range datastore.Devices {
+		deviceID, _ := device["device_id"].(string)
+		point, ok := due[deviceID]
+		if !ok {
+			continue
+		}
+		if point.Point != nil {
+			device = copyMap(device)
+			device["latest_device_point"] = point.Point
+		}
+		state := routeState{
+			Lat:      point.Lat,
+			Lng:      point.Lng,
+			Heading:  math.Mod(*point.Heading, 360),
+			SpeedKmh: *point.SpeedKmh,
+			Ignition: *point.Ignition,
+			Online:   true,
+		}
+		device = reportDevice(device, state, point.Time)
+		if point.Point != nil {
+			// Keep the recorded identity so the points match the bug report
+			for _, key := range []string{"device_point_id", "dt_server"} {
+				if value, ok := point.Point[key]; ok {
+					device["latest_device_point"].(map[string]interface{})[key] = value
+				}
+			}
+		}
+		datastore.Devices[i] = device
+	}
+	return next
+}
+
+// addReplayDevices adds the recorded devices that are not mock devices, as copies of the first
+// mock device.
+func addReplayDevices(datastore *Datastore, points []TrackPoint) {
+	datastore.Mutex.Lock()
+	defer datastore.Mutex.Unlock()
+
+	known := make(map[interface{}]bool, len(datastore.Devices))
+	for _, device := range datastore.Devices {
+		known[device["device_id"]] = true
+	}
+	for _, point := range points {
+		if known[point.DeviceID] {
+			continue
+		}
+		known[point.DeviceID] = true
+		device := map[string]interface{}{}
+		if len(datastore.Devices) > 0 {
+			device = copyMap(datastore.Devices[0])
+		}
+		device["device_id"] = point.DeviceID
+		device["display_name"] = point.DeviceID
+		datastore.Devices = append(datastore.Devices, device)
+		log.Printf("Added replay device %s.\n", point.DeviceID)
+	}
+}
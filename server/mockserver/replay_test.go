@@ -0,0 +1,302 @@
+package mockserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var recorded = time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+
+func float(v float64) *float64 { return &v }
+func boolean(v bool) *bool     { return &v }
+
+// describe formats a track point with its optional fields, nil ones as -.
+func describe(p TrackPoint) string {
+	optional := func(v interface{}) string {
+		switch v := v.(type) {
+		case *float64:
+			if v != nil {
+				return fmt.Sprintf("%.4g", *v)
+			}
+		case *bool:
+			if v != nil {
+				return fmt.Sprint(*v)
+			}
+		}
+		return "-"
+	}
+	return fmt.Sprintf("%s %s %.4f,%.4f speed %s heading %s ignition %s", p.DeviceID, p.Time.Format("15:04:05"), p.Lat, p.Lng,
+		optional(p.SpeedKmh), optional(p.Heading), optional(p.Ignition))
+}
+
+func describeAll(points []TrackPoint) string {
+	lines := make([]string, 0, len(points))
+	for _, point := range points {
+		lines = append(lines, describe(point))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestReadTrackCSV(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string // The points or the error
+	}{
+		{
+			name: "required columns only",
+			input: "device_id,dt_tracker,lat,lng\n" +
+				"truck,2024-11-13T06:00:00Z,34.05,-118.24\n",
+			want: "truck 06:00:00 34.0500,-118.2400 speed - heading - ignition -",
+		},
+		{
+			name: "all columns",
+			input: "device_id,dt_tracker,lat,lng,speed,angle,acc\n" +
+				"truck,2024-11-13T06:00:00Z,34.05,-118.24,42.5,90,1\n" +
+				"truck,2024-11-13T06:01:00Z,34.06,-118.24,,,\n",
+			want: "truck 06:00:00 34.0500,-118.2400 speed 42.5 heading 90 ignition true\n" +
+				"truck 06:01:00 34.0600,-118.2400 speed - heading - ignition -",
+		},
+		{
+			name: "aliases in another order",
+			input: " Time, Longitude, Latitude, DEVICE_ID, heading, ignition\n" +
+				"2024-11-13T06:00:00Z, -118.24, 34.05, truck, 180, false\n",
+			want: "truck 06:00:00 34.0500,-118.2400 speed - heading 180 ignition false",
+		},
+		{
+			name:  "lon alias",
+			input: "device_id,time,lat,lon\ntruck,2024-11-13T06:00:00Z,34.05,-118.24\n",
+			want:  "truck 06:00:00 34.0500,-118.2400 speed - heading - ignition -",
+		},
+		{
+			name:  "missing required column",
+			input: "device_id,dt_tracker,lat\ntruck,2024-11-13T06:00:00Z,34.05\n",
+			want:  "the header row needs device_id, dt_tracker, lat and lng columns",
+		},
+		{
+			name: "invalid time",
+			input: "device_id,dt_tracker,lat,lng\n" +
+				"truck,2024-11-13T06:00:00Z,34.05,-118.24\n" +
+				"truck,13/11/2024 06:01,34.05,-118.24\n",
+			want: `line 3: invalid dt_tracker "13/11/2024 06:01"`,
+		},
+		{
+			name: "invalid coordinate",
+			input: "device_id,dt_tracker,lat,lng\n" +
+				"truck,2024-11-13T06:00:00Z,34.05,-118.24\n" +
+				"truck,2024-11-13T06:01:00Z,34.05,-118.24\n" +
+				"truck,2024-11-13T06:02:00Z,34.05,west\n",
+			want: `line 4: invalid lng "west"`,
+		},
+		{
+			name:  "invalid ignition",
+			input: "device_id,dt_tracker,lat,lng,acc\ntruck,2024-11-13T06:00:00Z,34.05,-118.24,on\n",
+			want:  `line 2: invalid ignition "on"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			points, err := readTrackCSV(strings.NewReader(test.input))
+			got := describeAll(points)
+			if err != nil {
+				got = err.Error()
+			}
+			if got != test.want {
+				t.Errorf("readTrackCSV =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadGPX(t *testing.T) {
+	const input = `<?xml version="1.0"?>
+<gpx version="1.0">
+  <trk><name> truck </name><trkseg>
+    <trkpt lat="34.05" lon="-118.24"><time>2024-11-13T06:00:00Z</time><speed>10</speed><course>45</course></trkpt>
+    <trkpt lat="34.06" lon="-118.23"><time>2024-11-13T06:01:00Z</time></trkpt>
+  </trkseg></trk>
+  <trk><trkseg>
+    <trkpt lat="33.9" lon="-118.4"><time>2024-11-13T06:00:30Z</time></trkpt>
+  </trkseg></trk>
+</gpx>`
+	points, err := readGPX(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("readGPX: %v", err)
+	}
+	want := "truck 06:00:00 34.0500,-118.2400 speed 36 heading 45 ignition -\n" +
+		"truck 06:01:00 34.0600,-118.2300 speed - heading - ignition -\n" +
+		"track-2 06:00:30 33.9000,-118.4000 speed - heading - ignition -"
+	if got := describeAll(points); got != want {
+		t.Errorf("readGPX =\n%s\nwant\n%s", got, want)
+	}
+
+	invalid := `<gpx><trk><name>truck</name><trkseg><trkpt lat="34" lon="-118"><time>yesterday</time></trkpt></trkseg></trk></gpx>`
+	if _, err := readGPX(strings.NewReader(invalid)); err == nil || !strings.Contains(err.Error(), `invalid time "yesterday"`) {
+		t.Errorf("readGPX with an invalid time: err = %v", err)
+	}
+}
+
+func TestReadTrackJSONLines(t *testing.T) {
+	const input = `{"device_id": "truck", "dt_tracker": "2024-11-13T06:00:00Z", "lat": 34.05, "lng": -118.24, "angle": 90, "speed": 30, "point": {"device_point_id": "p1", "device_point_detail": {"acc": true}}}
+
+{"device_id": "van", "device_point_id": "p2", "dt_tracker": "2024-11-13T06:01:00Z", "lat": 33.9, "lng": -118.4, "params": {"acc": "0"}}
+{"device_id": "van", "dt_tracker": "2024-11-13T06:02:00Z", "lat": 33.9, "lng": -118.4}
+`
+	points, err := readTrackJSONLines(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("readTrackJSONLines: %v", err)
+	}
+	want := "truck 06:00:00 34.0500,-118.2400 speed 30 heading 90 ignition true\n" +
+		"van 06:01:00 33.9000,-118.4000 speed - heading - ignition false\n" +
+		"van 06:02:00 33.9000,-118.4000 speed - heading - ignition -"
+	if got := describeAll(points); got != want {
+		t.Errorf("readTrackJSONLines =\n%s\nwant\n%s", got, want)
+	}
+	if points[0].Point["device_point_id"] != "p1" || points[1].Point["device_point_id"] != "p2" {
+		t.Errorf("recorded points = %v and %v, want p1 and p2", points[0].Point, points[1].Point)
+	}
+	if _, ok := points[1].Point["device_id"]; ok {
+		t.Errorf("device_id is kept in the recorded device point")
+	}
+
+	errors := []struct {
+		input string
+		want  string
+	}{
+		{"{\"device_id\": \"truck\", \"dt_tracker\": \"2024-11-13T06:00:00Z\", \"lat\": 34, \"lng\": -118}\n\n{\"device_id\": \"truck\", \"lat\": 34}\n", "line 3: device_id, lat and lng are required"},
+		{"{\"device_id\": \"truck\", \"dt_tracker\": \"06:00\", \"lat\": 34, \"lng\": -118}\n", `line 1: invalid dt_tracker "06:00"`},
+		{"{\"device_id\": \"truck\", \"dt_tracker\": \"2024-11-13T06:00:00Z\", \"lat\": 34, \"lng\": -118}\nnot json\n", "line 2: "},
+	}
+	for _, test := range errors {
+		if _, err := readTrackJSONLines(strings.NewReader(test.input)); err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("readTrackJSONLines(%q): err = %v, want %q", test.input, err, test.want)
+		}
+	}
+}
+
+func TestFillTrack(t *testing.T) {
+	// 0.01 degrees of latitude are 1.11 km, covered in a minute at 66.7 km/h
+	points := []TrackPoint{
+		{DeviceID: "truck", Time: recorded, Lat: 34.00, Lng: -118},
+		{DeviceID: "van", Time: recorded, Lat: 33.9, Lng: -118.4, SpeedKmh: float(20), Heading: float(270), Ignition: boolean(false)},
+		{DeviceID: "truck", Time: recorded.Add(time.Minute), Lat: 34.01, Lng: -118},
+		{DeviceID: "truck", Time: recorded.Add(2 * time.Minute), Lat: 34.01, Lng: -118},
+		{DeviceID: "truck", Time: recorded.Add(3 * time.Minute), Lat: 34.01, Lng: -117.99, Ignition: boolean(false)},
+		{DeviceID: "truck", Time: recorded.Add(3 * time.Minute), Lat: 34.01, Lng: -117.99},
+	}
+	fillTrack(points)
+
+	want := "truck 06:00:00 34.0000,-118.0000 speed 0 heading 0 ignition false\n" +
+		"van 06:00:00 33.9000,-118.4000 speed 20 heading 270 ignition false\n" +
+		"truck 06:01:00 34.0100,-118.0000 speed 66.72 heading 0 ignition true\n" +
+		"truck 06:02:00 34.0100,-118.0000 speed 0 heading 0 ignition false\n" +
+		"truck 06:03:00 34.0100,-117.9900 speed 55.3 heading 90 ignition false\n" +
+		"truck 06:03:00 34.0100,-117.9900 speed 0 heading 90 ignition false"
+	if got := describeAll(points); got != want {
+		t.Errorf("fillTrack =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// replayPoints are two devices recorded every minute, filled in like LoadTrack does.
+func replayPoints() []TrackPoint {
+	points := []TrackPoint{
+		{DeviceID: "truck", Time: recorded, Lat: 34.00, Lng: -118},
+		{DeviceID: "truck", Time: recorded.Add(time.Minute), Lat: 34.01, Lng: -118},
+		{DeviceID: "van", Time: recorded.Add(90 * time.Second), Lat: 33.9, Lng: -118.4, Heading: float(450)},
+		{DeviceID: "truck", Time: recorded.Add(2 * time.Minute), Lat: 34.02, Lng: -118},
+	}
+	fillTrack(points)
+	return points
+}
+
+// position returns the reported position of a device.
+func position(t *testing.T, datastore *Datastore, deviceID string) string {
+	t.Helper()
+	for _, device := range datastore.GetDevices() {
+		if device["device_id"] != deviceID {
+			continue
+		}
+		point, ok := device["latest_device_point"].(map[string]interface{})
+		if !ok {
+			return "none"
+		}
+		return fmt.Sprintf("%.2f,%.2f at %s", point["lat"], point["lng"], point["dt_tracker"])
+	}
+	t.Fatalf("device %s not in the datastore", deviceID)
+	return ""
+}
+
+func TestApplyReplay(t *testing.T) {
+	datastore := NewDatastore()
+	datastore.AddDevice(map[string]interface{}{"device_id": "truck"})
+	datastore.AddDevice(map[string]interface{}{"device_id": "van"})
+	points := replayPoints()
+
+	next := applyReplay(datastore, points, 0, recorded.Add(-time.Second))
+	if next != 0 || position(t, datastore, "truck") != "none" {
+		t.Fatalf("before the recording reported %d points", next)
+	}
+
+	// Only the latest due point of each device is reported
+	next = applyReplay(datastore, points, next, recorded.Add(100*time.Second))
+	if next != 3 {
+		t.Errorf("next = %d after 100s, want 3", next)
+	}
+	if got := position(t, datastore, "truck"); got != "34.01,-118.00 at 2024-11-13T06:01:00Z" {
+		t.Errorf("truck reported %s, want its point of 06:01", got)
+	}
+	if got := position(t, datastore, "van"); got != "33.90,-118.40 at 2024-11-13T06:01:30Z" {
+		t.Errorf("van reported %s, want its point of 06:01:30", got)
+	}
+	for _, device := range datastore.GetDevices() {
+		if device["device_id"] == "van" {
+			if angle := device["latest_device_point"].(map[string]interface{})["angle"]; angle != 90.0 {
+				t.Errorf("van reported angle %v, want 450 wrapped to 90", angle)
+			}
+		}
+	}
+
+	if next = applyReplay(datastore, points, next, recorded.Add(time.Hour)); next != len(points) {
+		t.Errorf("next = %d at the end, want %d", next, len(points))
+	}
+	if got := position(t, datastore, "truck"); got != "34.02,-118.00 at 2024-11-13T06:02:00Z" {
+		t.Errorf("truck reported %s, want its last point", got)
+	}
+}
+
+func TestReplayRunSpeed(t *testing.T) {
+	datastore := NewDatastore()
+	datastore.AddDevice(map[string]interface{}{"device_id": "truck"})
+	points := replayPoints()
+	run := newReplayRun(datastore, points, 10)
+	if position(t, datastore, "van") != "none" {
+		t.Fatalf("recorded device van was not added")
+	}
+
+	// At 10x every 6 seconds of the session clock are a minute of the recording
+	session := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after time.Duration
+		next  int
+		truck string
+	}{
+		{0, 1, "34.00,-118.00 at 2024-11-13T06:00:00Z"},
+		{5 * time.Second, 1, "34.00,-118.00 at 2024-11-13T06:00:00Z"},
+		{6 * time.Second, 2, "34.01,-118.00 at 2024-11-13T06:01:00Z"},
+		{9 * time.Second, 3, "34.01,-118.00 at 2024-11-13T06:01:00Z"},
+		{12 * time.Second, 4, "34.02,-118.00 at 2024-11-13T06:02:00Z"},
+		{time.Minute, 4, "34.02,-118.00 at 2024-11-13T06:02:00Z"},
+	}
+	for _, step := range steps {
+		run.Step(session.Add(step.after))
+		if run.next != step.next {
+			t.Errorf("after %s next = %d, want %d", step.after, run.next, step.next)
+		}
+		if got := position(t, datastore, "truck"); got != step.truck {
+			t.Errorf("after %s truck reported %s, want %s", step.after, got, step.truck)
+		}
+	}
+}
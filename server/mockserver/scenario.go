@@ -0,0 +1,325 @@
+package mockserver
+
+import (
+	"OneStepGPSLeo/common"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario scripts the movement of mock devices. It is read from a YAML or JSON file, durations
+// are strings like "90s" or "5m". Devices that are not in the scenario keep their position.
+//
+//	devices:
+//	  - device_id: 6jAOdk2wPiTjH-81f07-0k
+//	    speed_kmh: 60
+//	    loop: true
+//	    route:
+//	      - {lat: 34.2987, lng: -118.4265, stop: 2m}
+//	      - {lat: 34.2801, lng: -118.4402, speed_kmh: 40}
+//	      - {lat: 34.2644, lng: -118.4107, stop: 5m, ignition: true}
+//	    offline:
+//	      - {at: 4m, for: 90s}
+type Scenario struct {
+	Devices []ScenarioDevice `yaml:"devices"`
+}
+
+// ScenarioDevice is the route of one device. The route starts when the mock server starts.
+type ScenarioDevice struct {
+	DeviceID string       `yaml:"device_id"` // Must be one of the mock devices
+	SpeedKmh float64      `yaml:"speed_kmh"` // Speed of legs without their own, 50 if not set
+	Loop     bool         `yaml:"loop"`      // Drive back to the first waypoint and start over, otherwise park at the last one
+	Route    []Waypoint   `yaml:"route"`
+	Offline  []OfflineGap `yaml:"offline"` // Times the device does not report, repeated on every loop
+}
+
+// Waypoint is a point of a route. The device stops there for Stop, then drives to the next waypoint.
+type Waypoint struct {
+	Lat      float64       `yaml:"lat"`
+	Lng      float64       `yaml:"lng"`
+	SpeedKmh float64       `yaml:"speed_kmh"` // Speed of the leg to the next waypoint
+	Stop     time.Duration `yaml:"stop"`
+	Ignition bool          `yaml:"ignition"` // Keep the ignition on during the stop, e.g. idling at a delivery
+}
+
+// OfflineGap is a time the device is offline, relative to the start of the route.
+type OfflineGap struct {
+	At  time.Duration `yaml:"at"`
+	For time.Duration `yaml:"for"`
+}
+
+const defaultScenarioSpeedKmh = 50
+
+// LoadScenario reads and validates a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+	// JSON is valid YAML, so one decoder reads both
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var scenario Scenario
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool, len(scenario.Devices))
+	for i, device := range scenario.Devices {
+		if device.DeviceID == "" {
+			return nil, fmt.Errorf("scenario device %d has no device_id", i)
+		}
+		if seen[device.DeviceID] {
+			return nil, fmt.Errorf("scenario device %s is listed more than once", device.DeviceID)
+		}
+		seen[device.DeviceID] = true
+		if len(device.Route) == 0 {
+			return nil, fmt.Errorf("scenario device %s has no route", device.DeviceID)
+		}
+		if device.SpeedKmh < 0 {
+			return nil, fmt.Errorf("scenario device %s has a negative speed_kmh", device.DeviceID)
+		}
+		for j, waypoint := range device.Route {
+			switch {
+			case waypoint.Lat < -90 || waypoint.Lat > 90 || waypoint.Lng < -180 || waypoint.Lng > 180:
+				return nil, fmt.Errorf("scenario device %s waypoint %d is out of range (%v, %v)", device.DeviceID, j, waypoint.Lat, waypoint.Lng)
+			case waypoint.SpeedKmh < 0:
+				return nil, fmt.Errorf("scenario device %s waypoint %d has a negative speed_kmh", device.DeviceID, j)
+			case waypoint.Stop < 0:
+				return nil, fmt.Errorf("scenario device %s waypoint %d has a negative stop", device.DeviceID, j)
+			}
+		}
+		for _, gap := range device.Offline {
+			if gap.At < 0 || gap.For <= 0 {
+				return nil, fmt.Errorf("scenario device %s has an offline gap with a negative at or a for that is not positive", device.DeviceID)
+			}
+		}
+	}
+	return &scenario, nil
+}
+
+// routeState is where a device is at some time along its route.
+type routeState struct {
+	Lat, Lng float64
+	Heading  float64 // Degrees clockwise from north
+	SpeedKmh float64
+	Ignition bool
+	Online   bool
+}
+
+// routeSegment is a stop or a leg between two waypoints, From equals To for a stop.
+type routeSegment struct {
+	Start, Duration time.Duration
+	From, To        Waypoint
+	SpeedKmh        float64
+	Heading         float64
+	Ignition        bool
+}
+
+// route is a scenario device compiled to consecutive segments.
+type route struct {
+	Device   ScenarioDevice
+	Segments []routeSegment
+	Length   time.Duration // Time of one pass through the route
+}
+
+func newRoute(device ScenarioDevice) *route {
+	r := &route{Device: device}
+	waypoints := device.Route
+	heading := 0.0
+	if len(waypoints) > 1 {
+		heading = common.BearingDegrees(waypoints[0].Lat, waypoints[0].Lng, waypoints[1].Lat, waypoints[1].Lng) // Parked at the start facing the first leg
+	}
+	for i, waypoint := range waypoints {
+		if waypoint.Stop > 0 {
+			r.add(routeSegment{Duration: waypoint.Stop, From: waypoint, To: waypoint, Heading: heading, Ignition: waypoint.Ignition})
+		}
+
+		var next Waypoint
+		switch {
+		case i+1 < len(waypoints):
+			next = waypoints[i+1]
+		case device.Loop:
+			next = waypoints[0]
+		default:
+			continue
+		}
+		speed := waypoint.SpeedKmh
+		if speed == 0 {
+			speed = device.SpeedKmh
+		}
+		if speed == 0 {
+			speed = defaultScenarioSpeedKmh
+		}
+		distance := common.DistanceMeters(waypoint.Lat, waypoint.Lng, next.Lat, next.Lng)
+		if distance == 0 {
+			continue
+		}
+		heading = common.BearingDegrees(waypoint.Lat, waypoint.Lng, next.Lat, next.Lng)
+		duration := time.Duration(distance / 1000 / speed * float64(time.Hour))
+		r.add(routeSegment{Duration: duration, From: waypoint, To: next, SpeedKmh: speed, Heading: heading, Ignition: true})
+	}
+	return r
+}
+
+func (r *route) add(segment routeSegment) {
+	segment.Start = r.Length
+	r.Segments = append(r.Segments, segment)
+	r.Length += segment.Duration
+}
+
+// At returns the state of the device elapsed after the start of the route.
+func (r *route) At(elapsed time.Duration) routeState {
+	last := r.Device.Route[len(r.Device.Route)-1]
+	if r.Length == 0 {
+		return routeState{Lat: last.Lat, Lng: last.Lng, Online: r.online(elapsed)}
+	}
+	if r.Device.Loop {
+		elapsed %= r.Length
+	} else if elapsed >= r.Length {
+		// Parked at the end of the route with the ignition off
+		final := r.Segments[len(r.Segments)-1]
+		return routeState{Lat: last.Lat, Lng: last.Lng, Heading: final.Heading, Online: r.online(elapsed)}
+	}
+
+	for _, segment := range r.Segments {
+		if elapsed >= segment.Start+segment.Duration {
+			continue
+		}
+		// Linear interpolation is close enough to the great circle over the length of a road leg
+		fraction := float64(elapsed-segment.Start) / float64(segment.Duration)
+		return routeState{
+			Lat:      segment.From.Lat + (segment.To.Lat-segment.From.Lat)*fraction,
+			Lng:      segment.From.Lng + (segment.To.Lng-segment.From.Lng)*fraction,
+			Heading:  segment.Heading,
+			SpeedKmh: segment.SpeedKmh,
+			Ignition: segment.Ignition,
+			Online:   r.online(elapsed),
+		}
+	}
+	return routeState{Lat: last.Lat, Lng: last.Lng, Online: r.online(elapsed)}
+}
+
+// online reports whether elapsed falls outside the offline gaps of the device.
+func (r *route) online(elapsed time.Duration) bool {
+	for _, gap := range r.Device.Offline {
+		if elapsed >= gap.At && elapsed < gap.At+gap.For {
+			return false
+		}
+	}
+	return true
+}
+
+// scenarioRun moves the scripted devices along their routes, in place of the random mutations.
+// The routes start at the first step.
+type scenarioRun struct {
+	datastore *Datastore
+	routes    []*route
+	start     time.Time
+}
+
+// newScenarioRun compiles the routes of a scenario. Every scenario device must be a mock device.
+func newScenarioRun(datastore *Datastore, scenario *Scenario) (*scenarioRun, error) {
+	known := make(map[interface{}]bool)
+	for _, device := range datastore.GetDevices() {
+		known[device["device_id"]] = true
+	}
+	routes := make([]*route, 0, len(scenario.Devices))
+	for _, device := range scenario.Devices {
+		if !known[device.DeviceID] {
+			return nil, fmt.Errorf("scenario device %s is not a mock device", device.DeviceID)
+		}
+		routes = append(routes, newRoute(device))
+	}
+	return &scenarioRun{datastore: datastore, routes: routes}, nil
+}
+
+func (s *scenarioRun) Step(now time.Time) {
+	if s.start.IsZero() {
+		s.start = now
+	}
+	applyScenario(s.datastore, s.routes, s.start, now)
+}
+
+// applyScenario reports the position of every scripted device at now.
+func applyScenario(datastore *Datastore, routes []*route, start, now time.Time) {
+	datastore.Mutex.Lock()
+	defer datastore.Mutex.Unlock()
+
+	for _, r := range routes {
+		for i, device := range datastore.Devices {
+			if device["device_id"] == r.Device.DeviceID {
+				datastore.Devices[i] = reportDevice(device, r.At(now.Sub(start)), now)
+				break
+			}
+		}
+	}
+}
+
+// reportDevice returns a copy of device reporting state at time at. The nested maps are copied
+// as well, because readers of the datastore share them.
+func reportDevice(device map[string]interface{}, state routeState, at time.Time) map[string]interface{} {
+	deviceID, _ := device["device_id"].(string)
+	updated := copyMap(device)
+	wasOnline, _ := device["online"].(bool)
+	if !state.Online {
+		// An offline tracker sends no points, only the status changes
+		if wasOnline {
+			updated["online"] = false
+			updated["updated_at"] = at.UTC().Format(time.RFC3339)
+		}
+		return updated
+	}
+	updated["online"] = true
+	updated["updated_at"] = at.UTC().Format(time.RFC3339)
+
+	point, _ := device["latest_device_point"].(map[string]interface{})
+	point = copyMap(point)
+	point["device_point_id"] = fmt.Sprintf("mock-%s-%d", deviceID, at.UnixNano())
+	point["dt_tracker"] = at.UTC().Format(time.RFC3339)
+	point["dt_server"] = at.UTC().Format(time.RFC3339Nano)
+	point["lat"] = state.Lat
+	point["lng"] = state.Lng
+	point["angle"] = math.Round(state.Heading)
+	point["speed"] = math.Round(state.SpeedKmh)
+
+	params, _ := point["params"].(map[string]interface{})
+	params = copyMap(params)
+	params["acc"] = "0"
+	if state.Ignition {
+		params["acc"] = "1"
+	}
+	point["params"] = params
+
+	detail, _ := point["device_point_detail"].(map[string]interface{})
+	detail = copyMap(detail)
+	detail["gps_time"] = point["dt_tracker"]
+	detail["transmit_time"] = point["dt_tracker"]
+	detail["lat_lng"] = map[string]interface{}{"lat": state.Lat, "lng": state.Lng}
+	detail["heading"] = point["angle"]
+	detail["acc"] = state.Ignition
+	detail["speed"] = map[string]interface{}{
+		"value":   point["speed"],
+		"unit":    "km/h",
+		"display": fmt.Sprintf("%.0f km/h", point["speed"]),
+	}
+	point["device_point_detail"] = detail
+
+	updated["latest_device_point"] = point
+	// Scripted and replayed fixes are treated as good ones
+	updated["latest_accurate_device_point"] = point
+	return updated
+}
+
+// copyMap returns a shallow copy of m, or an empty map if m is nil.
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,116 @@
+package mockserver
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+// testRoute parks a minute at the depot, drives 1.1 km north to a drop-off at 36 km/h (until
+// 2m51s), idles there for two minutes and drives on east. It is offline from 2m30s for a minute.
+func testRoute(loop bool) *route {
+	return newRoute(ScenarioDevice{
+		DeviceID: "truck",
+		SpeedKmh: 36,
+		Loop:     loop,
+		Route: []Waypoint{
+			{Lat: 34.0, Lng: -118.0, Stop: time.Minute},
+			{Lat: 34.01, Lng: -118.0, Stop: 2 * time.Minute, Ignition: true},
+			{Lat: 34.01, Lng: -117.99},
+		},
+		Offline: []OfflineGap{{At: 2*time.Minute + 30*time.Second, For: time.Minute}},
+	})
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestRouteAt(t *testing.T) {
+	oneWay := testRoute(false)
+	if len(oneWay.Segments) != 4 {
+		t.Fatalf("route has %d segments, want a stop, a leg, a stop and a leg", len(oneWay.Segments))
+	}
+	north := oneWay.Segments[1]
+	east := oneWay.Segments[3]
+	if north.Start != time.Minute || oneWay.Length != east.Start+east.Duration {
+		t.Fatalf("segments %+v do not follow each other", oneWay.Segments)
+	}
+
+	tests := []struct {
+		name     string
+		route    *route
+		elapsed  time.Duration
+		lat, lng float64
+		heading  float64
+		speed    float64
+		ignition bool
+		online   bool
+	}{
+		{"parked at the start", oneWay, 30 * time.Second, 34.0, -118.0, north.Heading, 0, false, true},
+		{"halfway up the first leg", oneWay, north.Start + north.Duration/2, 34.005, -118.0, north.Heading, 36, true, true},
+		{"idling at the drop-off while offline", oneWay, north.Start + north.Duration + 30*time.Second, 34.01, -118.0, north.Heading, 0, true, false},
+		{"back online at the end of the gap", oneWay, 3*time.Minute + 30*time.Second, 34.01, -118.0, north.Heading, 0, true, true},
+		{"parked at the end", oneWay, oneWay.Length + time.Hour, 34.01, -117.99, east.Heading, 0, false, true},
+		{"looped back to the start", testRoute(true), testRoute(true).Length + 30*time.Second, 34.0, -118.0, north.Heading, 0, false, true},
+		{"offline again on the next loop", testRoute(true), testRoute(true).Length + 3*time.Minute + 15*time.Second, 34.01, -118.0, north.Heading, 0, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := test.route.At(test.elapsed)
+			if state.Online != test.online {
+				t.Errorf("online = %v, want %v", state.Online, test.online)
+			}
+			if !near(state.Lat, test.lat) || !near(state.Lng, test.lng) {
+				t.Errorf("position = %v, %v, want %v, %v", state.Lat, state.Lng, test.lat, test.lng)
+			}
+			if !near(state.Heading, test.heading) || !near(state.SpeedKmh, test.speed) || state.Ignition != test.ignition {
+				t.Errorf("heading %v, speed %v, ignition %v, want %v, %v, %v", state.Heading, state.SpeedKmh, state.Ignition, test.heading, test.speed, test.ignition)
+			}
+		})
+	}
+}
+
+func TestLoopingRouteDrivesBackToTheStart(t *testing.T) {
+	loop := testRoute(true)
+	oneWay := testRoute(false)
+	back := loop.Segments[len(loop.Segments)-1]
+	if back.To != loop.Device.Route[0] || loop.Length <= oneWay.Length {
+		t.Fatalf("looping route ends with %+v, want a leg back to the first waypoint", back)
+	}
+	state := loop.At(back.Start + back.Duration/2)
+	if !near(state.Lat, 34.005) || !near(state.Lng, -117.995) || !state.Ignition {
+		t.Errorf("halfway back = %+v, want driving at 34.005, -117.995", state)
+	}
+}
+
+func TestScenarioRejectsUnknownDevices(t *testing.T) {
+	datastore := NewDatastore()
+	datastore.AddDevice(map[string]interface{}{"device_id": "truck"})
+
+	if _, err := newScenarioRun(datastore, &Scenario{Devices: []ScenarioDevice{testRoute(false).Device}}); err != nil {
+		t.Errorf("scenario of a mock device: %v", err)
+	}
+	unknown := testRoute(false).Device
+	unknown.DeviceID = "trailer"
+	_, err := newScenarioRun(datastore, &Scenario{Devices: []ScenarioDevice{testRoute(false).Device, unknown}})
+	if err == nil || !strings.Contains(err.Error(), "trailer") {
+		t.Errorf("scenario with an unknown device: err = %v, want it named", err)
+	}
+
+	// The session does not start with such a scenario
+	path := filepath.Join(t.TempDir(), "scenario.yaml")
+	scenario := "devices:\n  - device_id: trailer\n    route:\n      - {lat: 34.0, lng: -118.0}\n"
+	if err := os.WriteFile(path, []byte(scenario), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSession(NewDatastore(), models.Config{MockDataFile: testDataFile, MockScenarioFile: path}, 0.5, 2); err == nil {
+		t.Errorf("NewSession with an unknown scenario device succeeded")
+	}
+}
@@ -0,0 +1,115 @@
+package mockserver
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+)
+
+// DefaultMockStart is where the virtual clock of a deterministic session starts, shortly after
+// the latest points of result.json.
+var DefaultMockStart = time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+
+// Simulation moves the mock devices. Step is called once per update with the session time.
+type Simulation interface {
+	Step(now time.Time)
+}
+
+// Session is a mock run: the devices, the simulation moving them and the clock and random
+// source it uses. With mock_seed set the session is deterministic, it runs on a virtual clock
+// that only moves with Advance, so the same seed and the same calls replay the same session.
+type Session struct {
+	Datastore  *Datastore
+	Simulation Simulation
+	Clock      clock.Clock
+	Rand       *rand.Rand
+
+	virtual *clock.Virtual // Set in deterministic sessions
+}
+
+// NewSession fills the datastore from mock_data_file (result.json if not set), or with a synthetic
+// fleet generated from it, and sets up the simulation: the recorded tracks or the mock scenario if
+// one is configured, otherwise random mutations of mutateChance per step on mutateDeviceCount devices.
+func NewSession(datastore *Datastore, config models.Config, mutateChance float64, mutateDeviceCount int) (*Session, error) {
+	session := &Session{Datastore: datastore, Clock: clock.System}
+	if config.MockSeed != 0 {
+		start := DefaultMockStart
+		if config.MockStartTime != "" {
+			var err error
+			if start, err = time.Parse(time.RFC3339, config.MockStartTime); err != nil {
+				return nil, fmt.Errorf("invalid mock_start_time %q, use RFC3339", config.MockStartTime)
+			}
+		}
+		session.virtual = clock.NewVirtual(start)
+		session.Clock = session.virtual
+		session.Rand = rand.New(rand.NewSource(config.MockSeed))
+	} else {
+		session.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	dataFile := config.MockDataFile
+	if dataFile == "" {
+		dataFile = "result.json"
+	}
+	if err := initializeMockDevicesFromLocal(datastore, dataFile); err != nil {
+		return nil, fmt.Errorf("failed to initialize mock devices: %w", err)
+	}
+	if config.MockFleetSize > 0 {
+		if err := initializeMockFleet(datastore, config, session.Clock.Now()); err != nil {
+			return nil, fmt.Errorf("failed to generate the mock fleet: %w", err)
+		}
+	}
+
+	switch {
+	case config.MockScenarioFile != "" && config.MockReplayFile != "":
+		return nil, fmt.Errorf("use either a mock scenario or a mock replay, not both")
+	case config.MockReplayFile != "":
+		// Recorded tracks replace the random mutations
+		points, err := LoadTrack(config.MockReplayFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load mock replay: %w", err)
+		}
+		log.Printf("Replaying %d points from %s at %gx.\n", len(points), config.MockReplayFile, config.MockReplaySpeed)
+		session.Simulation = newReplayRun(datastore, points, config.MockReplaySpeed)
+	case config.MockScenarioFile != "":
+		// Scripted routes replace the random mutations
+		scenario, err := LoadScenario(config.MockScenarioFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load mock scenario: %w", err)
+		}
+		run, err := newScenarioRun(datastore, scenario)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start mock scenario: %w", err)
+		}
+		log.Printf("Running mock scenario %s with %d devices.\n", config.MockScenarioFile, len(scenario.Devices))
+		session.Simulation = run
+	default:
+		session.Simulation = &randomMutations{datastore: datastore, rng: session.Rand, chance: mutateChance, count: mutateDeviceCount}
+	}
+	return session, nil
+}
+
+// Deterministic reports whether the session runs on a virtual clock.
+func (s *Session) Deterministic() bool {
+	return s.virtual != nil
+}
+
+// Run steps the simulation every interval of real time. It never returns, deterministic
+// sessions are stepped with Advance instead.
+func (s *Session) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.Simulation.Step(s.Clock.Now())
+		<-ticker.C
+	}
+}
+
+// Advance moves the virtual clock of a deterministic session forward by d and steps the simulation.
+func (s *Session) Advance(d time.Duration) {
+	s.Simulation.Step(s.virtual.Advance(d))
+}
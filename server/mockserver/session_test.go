@@ -0,0 +1,107 @@
+package mockserver
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+// testDataFile holds the devices the test sessions start with.
+const testDataFile = "../result.json"
+
+// sessionSnapshots advances a new session steps times by a minute and returns the datastore
+// contents and the updated_at of every device after each step.
+func sessionSnapshots(t *testing.T, config models.Config, steps int) ([]string, [][]string) {
+	t.Helper()
+	config.MockDataFile = testDataFile
+	session, err := NewSession(NewDatastore(), config, 0.5, 2)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if !session.Deterministic() {
+		t.Fatalf("session with mock_seed %d is not deterministic", config.MockSeed)
+	}
+
+	var snapshots []string
+	var updatedAts [][]string
+	for i := 0; i < steps; i++ {
+		session.Advance(time.Minute)
+		devices := session.Datastore.GetDevices()
+		data, err := json.Marshal(devices)
+		if err != nil {
+			t.Fatalf("failed to marshal the devices: %v", err)
+		}
+		snapshots = append(snapshots, string(data))
+		var stepUpdatedAts []string
+		for _, device := range devices {
+			updatedAt, _ := device["updated_at"].(string)
+			stepUpdatedAts = append(stepUpdatedAts, updatedAt)
+		}
+		updatedAts = append(updatedAts, stepUpdatedAts)
+	}
+	return snapshots, updatedAts
+}
+
+func TestSessionReplaysWithTheSameSeed(t *testing.T) {
+	const steps = 30
+
+	for name, config := range map[string]models.Config{
+		"mutations": {MockSeed: 42},
+		"fleet":     {MockSeed: 42, MockFleetSize: 50, MockFleetSeed: 7},
+		"scenario":  {MockSeed: 42, MockScenarioFile: "../scenarios/example.yaml"},
+		"replay":    {MockSeed: 42, MockReplayFile: "../scenarios/example-track.csv", MockReplaySpeed: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			first, firstUpdatedAts := sessionSnapshots(t, config, steps)
+			second, secondUpdatedAts := sessionSnapshots(t, config, steps)
+
+			for i := range first {
+				if first[i] != second[i] {
+					t.Fatalf("the datastores differ after step %d", i+1)
+				}
+				for j := range firstUpdatedAts[i] {
+					if firstUpdatedAts[i][j] != secondUpdatedAts[i][j] {
+						t.Fatalf("device %d has updated_at %s and %s after step %d", j, firstUpdatedAts[i][j], secondUpdatedAts[i][j], i+1)
+					}
+				}
+			}
+			if first[0] == first[steps-1] {
+				t.Errorf("the devices did not change in %d steps", steps)
+			}
+		})
+	}
+}
+
+func TestSessionUsesTheVirtualClock(t *testing.T) {
+	start := "2025-03-01T12:00:00Z"
+	_, updatedAts := sessionSnapshots(t, models.Config{MockSeed: 42, MockStartTime: start}, 30)
+
+	begin, _ := time.Parse(time.RFC3339, start)
+	end := begin.Add(30 * time.Minute)
+	mutated := 0
+	for _, stepUpdatedAts := range updatedAts {
+		for _, updatedAt := range stepUpdatedAts {
+			at, err := time.Parse(time.RFC3339, updatedAt)
+			if err != nil || at.Before(begin) {
+				continue // Not mutated yet, still the updated_at of result.json
+			}
+			mutated++
+			if at.After(end) || !at.Equal(at.Truncate(time.Minute)) {
+				t.Errorf("updated_at %s is not a step of the virtual clock", updatedAt)
+			}
+		}
+	}
+	if mutated == 0 {
+		t.Errorf("no device was mutated in 30 steps")
+	}
+}
+
+func TestSessionSeedsDiffer(t *testing.T) {
+	first, _ := sessionSnapshots(t, models.Config{MockSeed: 1}, 30)
+	second, _ := sessionSnapshots(t, models.Config{MockSeed: 2}, 30)
+	if first[len(first)-1] == second[len(second)-1] {
+		t.Errorf("seeds 1 and 2 produced the same session")
+	}
+}
@@ -0,0 +1,116 @@
+package mockserver
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sinkCapacity is the number of requests and emails the sink keeps.
+const sinkCapacity = 200
+
+// SinkRequest is an HTTP request received by the sink.
+type SinkRequest struct {
+	Time    time.Time           `json:"time"`
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   string              `json:"query,omitempty"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+// SinkEmail is an email received by the SMTP stand-in.
+type SinkEmail struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   []string  `json:"to"`
+	Data string    `json:"data"`
+}
+
+// Sink records notifications sent to the mock server, so webhook, HTTP and SMTP channels can be
+// tried without external services.
+type Sink struct {
+	mutex    sync.Mutex
+	requests []SinkRequest
+	emails   []SinkEmail
+}
+
+// NewSink creates an empty sink.
+func NewSink() *Sink {
+	return &Sink{}
+}
+
+// AddRequest records an HTTP request, dropping the oldest one when full.
+func (s *Sink) AddRequest(req SinkRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, req)
+	if len(s.requests) > sinkCapacity {
+		s.requests = s.requests[len(s.requests)-sinkCapacity:]
+	}
+}
+
+// AddEmail records an email, dropping the oldest one when full.
+func (s *Sink) AddEmail(email SinkEmail) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.emails = append(s.emails, email)
+	if len(s.emails) > sinkCapacity {
+		s.emails = s.emails[len(s.emails)-sinkCapacity:]
+	}
+}
+
+// Requests returns the recorded HTTP requests, oldest first.
+func (s *Sink) Requests() []SinkRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]SinkRequest(nil), s.requests...)
+}
+
+// Emails returns the recorded emails, oldest first.
+func (s *Sink) Emails() []SinkEmail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]SinkEmail(nil), s.emails...)
+}
+
+// registerSinkRoutes serves the sink on the mock server:
+//   - ANY /sink/http/*path records the request. ?status=500 answers with that status to exercise retries.
+//   - GET /sink lists the recorded requests and emails, DELETE /sink clears them.
+func registerSinkRoutes(router *gin.Engine, sink *Sink) {
+	router.Any("/sink/http/*path", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		sink.AddRequest(SinkRequest{
+			Time:    time.Now(),
+			Method:  c.Request.Method,
+			Path:    c.Param("path"),
+			Query:   c.Request.URL.RawQuery,
+			Headers: c.Request.Header,
+			Body:    string(body),
+		})
+
+		status := http.StatusOK
+		if s, err := strconv.Atoi(c.Query("status")); err == nil && s >= 100 && s <= 599 {
+			status = s
+		}
+		c.JSON(status, gin.H{"received": true})
+	})
+
+	router.GET("/sink", func(c *gin.Context) {
+		sink.mutex.Lock()
+		defer sink.mutex.Unlock()
+		c.JSON(http.StatusOK, gin.H{"requests": sink.requests, "emails": sink.emails})
+	})
+
+	router.DELETE("/sink", func(c *gin.Context) {
+		sink.mutex.Lock()
+		sink.requests = nil
+		sink.emails = nil
+		sink.mutex.Unlock()
+		c.JSON(http.StatusOK, gin.H{"message": "Sink cleared"})
+	})
+}
@@ -0,0 +1,111 @@
+package mockserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// StartSMTPServer runs a minimal SMTP stand-in that accepts every message and records it in
+// the sink. It has no TLS or AUTH, so channels pointed at it must not set a username.
+func StartSMTPServer(sink *Sink, port string) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Printf("Failed to start mock SMTP server: %v", err)
+		return
+	}
+	log.Printf("Mock SMTP server started on :%s\n", port)
+	ServeSMTP(listener, sink)
+}
+
+// ServeSMTP runs the SMTP stand-in on listener until it is closed.
+func ServeSMTP(listener net.Listener, sink *Sink) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Mock SMTP accept error: %v", err)
+			continue
+		}
+		go handleSMTPConn(conn, sink)
+	}
+}
+
+func handleSMTPConn(conn net.Conn, sink *Sink) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	reply("220 localhost mock SMTP ready")
+	var email SinkEmail
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			email = SinkEmail{From: smtpAddress(line)}
+			reply("250 OK")
+		case "RCPT":
+			email.To = append(email.To, smtpAddress(line))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" || dataLine == ".\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, ".")) // Undo dot-stuffing
+			}
+			email.Time = time.Now()
+			email.Data = data.String()
+			sink.AddEmail(email)
+			log.Printf("Mock SMTP received email from %s to %v", email.From, email.To)
+			reply("250 OK")
+		case "RSET":
+			email = SinkEmail{}
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// smtpAddress extracts the address from "MAIL FROM:<a@b>" or "RCPT TO:<a@b>".
+func smtpAddress(line string) string {
+	start := strings.Index(line, "<")
+	end := strings.LastIndex(line, ">")
+	if start >= 0 && end > start {
+		return line[start+1 : end]
+	}
+	if i := strings.Index(line, ":"); i >= 0 {
+		return strings.TrimSpace(line[i+1:])
+	}
+	return ""
+}
@@ -0,0 +1,38 @@
+package mockserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+	"OneStepGPSLeo/sources"
+)
+
+// Source exposes the mock Datastore as an in-process DeviceSource, skipping the HTTP layer.
+type Source struct {
+	*sources.Health
+	datastore *Datastore
+}
+
+// RegisterSource makes the "mock" source type read from the given datastore.
+func RegisterSource(datastore *Datastore) {
+	sources.Register(sources.TypeMock, func(cfg models.SourceConfig, clk clock.Clock) (sources.DeviceSource, error) {
+		return &Source{Health: sources.NewHealth(cfg.Name, sources.TypeMock, clk), datastore: datastore}, nil
+	})
+}
+
+func (s *Source) FetchDevices(ctx context.Context) ([]models.Device, error) {
+	// The datastore keeps the raw JSON shape, which is what the HTTP endpoint serves
+	var resultList []json.RawMessage
+	for _, device := range s.datastore.GetDevices() {
+		raw, err := json.Marshal(device)
+		if err != nil {
+			log.Printf("Skipping mock device %v: %v", device["device_id"], err)
+			continue
+		}
+		resultList = append(resultList, raw)
+	}
+	return s.Track(sources.DecodeDevices(s.Name(), resultList), nil)
+}
@@ -0,0 +1,205 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Device is a device in the upstream result_list shape, as stored in the devices collection.
+// Fields the server does not use are kept in Extra, so they survive the round trip from the
+// upstream API to MongoDB and the REST API unchanged.
+type Device struct {
+	ID                        *primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	DeviceID                  string              `bson:"device_id" json:"device_id"`
+	DisplayName               string              `bson:"display_name" json:"display_name"`
+	ActiveState               string              `bson:"active_state" json:"active_state"`
+	Online                    bool                `bson:"online" json:"online"`
+	Make                      string              `bson:"make" json:"make"`
+	Model                     string              `bson:"model" json:"model"`
+	FactoryID                 string              `bson:"factory_id" json:"factory_id"`
+	SecondaryID               string              `bson:"secondary_id" json:"secondary_id"`
+	BccID                     string              `bson:"bcc_id" json:"bcc_id"`
+	ConnType                  string              `bson:"conn_type" json:"conn_type"`
+	DataNode                  string              `bson:"data_node" json:"data_node"`
+	CreatedAt                 *string             `bson:"created_at" json:"created_at"`
+	UpdatedAt                 string              `bson:"updated_at" json:"updated_at"` // RFC3339, compared as a string by check-updates
+	ActivatedAt               *string             `bson:"activated_at" json:"activated_at"`
+	DeliveredAt               *string             `bson:"delivered_at" json:"delivered_at"`
+	UserIDList                []string            `bson:"user_id_list" json:"user_id_list"`
+	DeviceGroupsIDList        []string            `bson:"device_groups_id_list" json:"device_groups_id_list"`
+	LatestDevicePoint         *DevicePoint        `bson:"latest_device_point,omitempty" json:"latest_device_point,omitempty"`
+	LatestAccurateDevicePoint *DevicePoint        `bson:"latest_accurate_device_point,omitempty" json:"latest_accurate_device_point,omitempty"`
+	LatestPointQuality        *PointQuality       `bson:"latest_point_quality,omitempty" json:"latest_point_quality,omitempty"` // Set by the server during ingestion
+	Settings                  *DeviceSettings     `bson:"settings,omitempty" json:"settings,omitempty"`                         // Upstream settings, moved to the settings collection before storing
+	Version                   int                 `bson:"version,omitempty" json:"version,omitempty"`
+
+	Extra map[string]interface{} `bson:"-" json:"-"` // Fields not listed above, e.g. conn_data and device_ui_settings
+}
+
+// DevicePoint is a reported position of a device (latest_device_point and latest_accurate_device_point).
+type DevicePoint struct {
+	DevicePointID       string                 `bson:"device_point_id" json:"device_point_id"`
+	DtTracker           string                 `bson:"dt_tracker" json:"dt_tracker"` // RFC3339, time of the fix on the device
+	DtServer            string                 `bson:"dt_server" json:"dt_server"`   // RFC3339, time the upstream received it
+	Lat                 float64                `bson:"lat" json:"lat"`
+	Lng                 float64                `bson:"lng" json:"lng"`
+	Altitude            *float64               `bson:"altitude" json:"altitude"`
+	Angle               float64                `bson:"angle" json:"angle"`
+	Speed               float64                `bson:"speed" json:"speed"` // km/h
+	Sequence            string                 `bson:"sequence" json:"sequence"`
+	DeviceStateStale    bool                   `bson:"device_state_stale" json:"device_state_stale"`
+	Params              map[string]interface{} `bson:"params" json:"params"` // Raw tracker values, mostly numeric strings
+	DeviceState         map[string]interface{} `bson:"device_state" json:"device_state"`
+	DevicePointExternal map[string]interface{} `bson:"device_point_external" json:"device_point_external"`
+	DevicePointDetail   *DevicePointDetail     `bson:"device_point_detail" json:"device_point_detail"`
+
+	Extra map[string]interface{} `bson:"-" json:"-"`
+}
+
+// DevicePointDetail is the decoded tracker data of a point. Most fields are optional, depending on the tracker.
+type DevicePointDetail struct {
+	FactoryID         string       `bson:"factory_id" json:"factory_id"`
+	GpsTime           string       `bson:"gps_time" json:"gps_time"`
+	TransmitTime      string       `bson:"transmit_time" json:"transmit_time"`
+	RemoteAddr        string       `bson:"remote_addr" json:"remote_addr"`
+	LatLng            *LatLng      `bson:"lat_lng" json:"lat_lng"`
+	Altitude          *Measurement `bson:"altitude" json:"altitude"`
+	Speed             *Measurement `bson:"speed" json:"speed"`
+	TripDistance      *Measurement `bson:"trip_distance" json:"trip_distance"`
+	Heading           *float64     `bson:"heading" json:"heading"`
+	NumSatellites     *float64     `bson:"num_satellites" json:"num_satellites"`
+	Hdop              *float64     `bson:"hdop" json:"hdop"`
+	Rssi              *float64     `bson:"rssi" json:"rssi"`
+	Acc               *bool        `bson:"acc" json:"acc"` // Ignition
+	ExternalVolt      *float64     `bson:"external_volt" json:"external_volt"`
+	BackupBatteryVolt *float64     `bson:"backup_battery_volt" json:"backup_battery_volt"`
+	FuelPercent       *float64     `bson:"fuel_percent" json:"fuel_percent"`
+
+	Extra map[string]interface{} `bson:"-" json:"-"`
+}
+
+// LatLng is a coordinate pair inside a point detail.
+type LatLng struct {
+	Lat float64 `bson:"lat" json:"lat"`
+	Lng float64 `bson:"lng" json:"lng"`
+}
+
+// Measurement is an upstream value with its unit and display text. The upstream sends {} when
+// the tracker does not report it, so every field is optional.
+type Measurement struct {
+	Value   *float64 `bson:"value,omitempty" json:"value,omitempty"`
+	Unit    string   `bson:"unit,omitempty" json:"unit,omitempty"`
+	Display string   `bson:"display,omitempty" json:"display,omitempty"`
+}
+
+// PointQuality is the outcome of the GPS quality checks for a point, see the quality package.
+type PointQuality struct {
+	Accurate      bool     `bson:"accurate" json:"accurate"`
+	RejectReasons []string `bson:"reject_reasons,omitempty" json:"reject_reasons,omitempty"`
+	NumSatellites *float64 `bson:"num_satellites,omitempty" json:"num_satellites,omitempty"`
+	Hdop          *float64 `bson:"hdop,omitempty" json:"hdop,omitempty"`
+}
+
+// The marshal methods convert to local types without methods to reuse the default encoding,
+// then add or collect the overflow fields.
+
+func (d Device) MarshalJSON() ([]byte, error) {
+	type device Device
+	return marshalJSONWithExtra(device(d), d.Extra)
+}
+
+func (d *Device) UnmarshalJSON(data []byte) error {
+	type device Device
+	var decoded device
+	extra, err := unmarshalJSONWithExtra(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*d = Device(decoded)
+	d.Extra = extra
+	return nil
+}
+
+func (d Device) MarshalBSON() ([]byte, error) {
+	type device Device
+	return marshalBSONWithExtra(device(d), d.Extra)
+}
+
+func (d *Device) UnmarshalBSON(data []byte) error {
+	type device Device
+	var decoded device
+	extra, err := unmarshalBSONWithExtra(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*d = Device(decoded)
+	d.Extra = extra
+	return nil
+}
+
+func (p DevicePoint) MarshalJSON() ([]byte, error) {
+	type point DevicePoint
+	return marshalJSONWithExtra(point(p), p.Extra)
+}
+
+func (p *DevicePoint) UnmarshalJSON(data []byte) error {
+	type point DevicePoint
+	var decoded point
+	extra, err := unmarshalJSONWithExtra(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*p = DevicePoint(decoded)
+	p.Extra = extra
+	return nil
+}
+
+func (p DevicePoint) MarshalBSON() ([]byte, error) {
+	type point DevicePoint
+	return marshalBSONWithExtra(point(p), p.Extra)
+}
+
+func (p *DevicePoint) UnmarshalBSON(data []byte) error {
+	type point DevicePoint
+	var decoded point
+	extra, err := unmarshalBSONWithExtra(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*p = DevicePoint(decoded)
+	p.Extra = extra
+	return nil
+}
+
+func (d DevicePointDetail) MarshalJSON() ([]byte, error) {
+	type detail DevicePointDetail
+	return marshalJSONWithExtra(detail(d), d.Extra)
+}
+
+func (d *DevicePointDetail) UnmarshalJSON(data []byte) error {
+	type detail DevicePointDetail
+	var decoded detail
+	extra, err := unmarshalJSONWithExtra(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*d = DevicePointDetail(decoded)
+	d.Extra = extra
+	return nil
+}
+
+func (d DevicePointDetail) MarshalBSON() ([]byte, error) {
+	type detail DevicePointDetail
+	return marshalBSONWithExtra(detail(d), d.Extra)
+}
+
+func (d *DevicePointDetail) UnmarshalBSON(data []byte) error {
+	type detail DevicePointDetail
+	var decoded detail
+	extra, err := unmarshalBSONWithExtra(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*d = DevicePointDetail(decoded)
+	d.Extra = extra
+	return nil
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// readResultList returns the raw devices of result.json.
+func readResultList(t *testing.T) []json.RawMessage {
+	t.Helper()
+	data, err := os.ReadFile("../result.json")
+	if err != nil {
+		t.Fatalf("failed to read result.json: %v", err)
+	}
+	var result struct {
+		ResultList []json.RawMessage `json:"result_list"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil || len(result.ResultList) == 0 {
+		t.Fatalf("failed to decode result.json: %v", err)
+	}
+	return result.ResultList
+}
+
+// generic decodes JSON without a schema. The upstream settings are left out: they are typed and
+// moved to the settings collection before a device is stored, so they are not kept as sent.
+func generic(t *testing.T, data []byte) map[string]interface{} {
+	t.Helper()
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("failed to decode %s: %v", data, err)
+	}
+	delete(fields, "settings")
+	return fields
+}
+
+func TestDeviceRoundTrip(t *testing.T) {
+	for _, raw := range readResultList(t) {
+		var device Device
+		if err := json.Unmarshal(raw, &device); err != nil {
+			t.Fatalf("UnmarshalJSON: %v", err)
+		}
+		want := generic(t, raw)
+
+		data, err := json.Marshal(device)
+		if err != nil {
+			t.Fatalf("MarshalJSON: %v", err)
+		}
+		if got := generic(t, data); !reflect.DeepEqual(got, want) {
+			t.Errorf("device %s changed in the JSON round trip:\n got %s\nwant %s", device.DeviceID, data, raw)
+		}
+
+		doc, err := bson.Marshal(device)
+		if err != nil {
+			t.Fatalf("MarshalBSON: %v", err)
+		}
+		var stored Device
+		if err := bson.Unmarshal(doc, &stored); err != nil {
+			t.Fatalf("UnmarshalBSON: %v", err)
+		}
+		if data, err = json.Marshal(stored); err != nil {
+			t.Fatalf("MarshalJSON after BSON: %v", err)
+		}
+		if got := generic(t, data); !reflect.DeepEqual(got, want) {
+			t.Errorf("device %s changed in the BSON round trip:\n got %s\nwant %s", device.DeviceID, data, raw)
+		}
+	}
+}
+
+func TestKnownFieldsAreNotExtra(t *testing.T) {
+	deviceFields := knownFields(reflect.TypeOf(Device{}), "json")
+	pointFields := knownFields(reflect.TypeOf(DevicePoint{}), "json")
+	detailFields := knownFields(reflect.TypeOf(DevicePointDetail{}), "json")
+	check := func(name string, extra map[string]interface{}, known map[string]bool) {
+		for key := range extra {
+			if known[key] {
+				t.Errorf("%s: declared field %s is also in Extra", name, key)
+			}
+		}
+	}
+
+	for _, raw := range readResultList(t) {
+		var device Device
+		if err := json.Unmarshal(raw, &device); err != nil {
+			t.Fatalf("UnmarshalJSON: %v", err)
+		}
+		if len(device.Extra) == 0 {
+			t.Errorf("device %s: no unknown fields kept, want at least conn_data", device.DeviceID)
+		}
+		check(device.DeviceID, device.Extra, deviceFields)
+		for _, p := range []*DevicePoint{device.LatestDevicePoint, device.LatestAccurateDevicePoint} {
+			if p == nil {
+				continue
+			}
+			check(device.DeviceID+" point", p.Extra, pointFields)
+			if p.DevicePointDetail != nil {
+				check(device.DeviceID+" point detail", p.DevicePointDetail.Extra, detailFields)
+			}
+		}
+	}
+}
+
+func TestExtraFields(t *testing.T) {
+	const input = `{
+		"device_id": "truck-1",
+		"imei": 356307042441013123,
+		"conn_data": {"sim_id": 89014103211118510720, "carrier": "att"},
+		"latest_device_point": {
+			"lat": 34.05,
+			"lng": -118.24,
+			"satellite_fix": "3d",
+			"device_point_detail": {"hdop": 0.9, "hevent_list": [{"code": 12}]}
+		}
+	}`
+
+	var device Device
+	if err := json.Unmarshal([]byte(input), &device); err != nil {
+		t.Fatalf("UnmarshalJSON: %v", err)
+	}
+	if device.DeviceID != "truck-1" || device.LatestDevicePoint == nil || device.LatestDevicePoint.Lat != 34.05 {
+		t.Fatalf("declared fields = %+v, want them decoded", device)
+	}
+	if _, ok := device.Extra["device_id"]; ok {
+		t.Errorf("device_id is in Extra")
+	}
+	if got := device.LatestDevicePoint.Extra["satellite_fix"]; got != "3d" {
+		t.Errorf("unknown point field = %v, want 3d", got)
+	}
+	if got := device.LatestDevicePoint.DevicePointDetail.Extra["hevent_list"]; got == nil {
+		t.Errorf("unknown point detail field was dropped")
+	}
+
+	// A declared name in Extra does not override the field or appear twice
+	device.Extra["device_id"] = "other"
+	data, err := json.Marshal(device)
+	if err != nil {
+		t.Fatalf("MarshalJSON: %v", err)
+	}
+	if strings.Count(string(data), `"device_id"`) != 1 || !strings.Contains(string(data), `"device_id":"truck-1"`) {
+		t.Errorf("device_id in Extra changed the output: %s", data)
+	}
+
+	// Large integers are kept exactly, in JSON and through BSON where they fit an int64
+	for _, digits := range []string{`"imei":356307042441013123`, `"sim_id":89014103211118510720`} {
+		if !strings.Contains(string(data), digits) {
+			t.Errorf("JSON output %s does not contain %s", data, digits)
+		}
+	}
+	doc, err := bson.Marshal(device)
+	if err != nil {
+		t.Fatalf("MarshalBSON: %v", err)
+	}
+	var stored Device
+	if err := bson.Unmarshal(doc, &stored); err != nil {
+		t.Fatalf("UnmarshalBSON: %v", err)
+	}
+	if data, err = json.Marshal(stored); err != nil {
+		t.Fatalf("MarshalJSON after BSON: %v", err)
+	}
+	if !strings.Contains(string(data), `"imei":356307042441013123`) {
+		t.Errorf("JSON output after BSON %s does not contain the exact imei", data)
+	}
+	if !strings.Contains(string(data), `"satellite_fix":"3d"`) || !strings.Contains(string(data), `"hevent_list":[{"code":12}]`) {
+		t.Errorf("JSON output after BSON %s lost the nested unknown fields", data)
+	}
+}
@@ -1,20 +1,359 @@
 package models
 
+import "time"
+
 // Config represents the configuration structure for the application
 type Config struct {
-	ServerPort             string `json:"server_port"`
-	MongoDBURL             string `json:"mongodb_url"`
-	MongoDBPort            string `json:"mongodb_port"`
-	MongoDBUsername        string `json:"mongodb_username"`
-	MongoDBPassword        string `json:"mongodb_password"`
-	DatabaseName           string `json:"database_name"`
-	DeviceCollectionName   string `json:"device_collection_name"`
-	UserCollectionName     string `json:"user_collection_name"`
-	SettingsCollectionName string `json:"device_setting_collection_name"`
-	APIKey                 string `json:"api_key"`
-	APIURL                 string `json:"api_url"`
-	UpdateInterval         int    `json:"update_interval_seconds"`
-	MockServerPort         string `json:"mock_server_port"`
+	ServerPort                    string                      `json:"server_port"`
+	Storage                       string                      `json:"storage"` // "mongodb" (default), "sqlite" or "memory"
+	SQLitePath                    string                      `json:"sqlite_path"`
+	SkipMigrations                bool                        `json:"skip_migrations"` // Leave pending schema migrations to the migrate command
+	MongoDBURL                    string                      `json:"mongodb_url"`
+	MongoDBPort                   string                      `json:"mongodb_port"`
+	MongoDBUsername               string                      `json:"mongodb_username"`
+	MongoDBPassword               string                      `json:"mongodb_password"`
+	DatabaseName                  string                      `json:"database_name"`
+	DeviceCollectionName          string                      `json:"device_collection_name"`
+	UserCollectionName            string                      `json:"user_collection_name"`
+	SettingsCollectionName        string                      `json:"device_setting_collection_name"`
+	HistoryCollectionName         string                      `json:"device_history_collection_name"`
+	TripCollectionName            string                      `json:"device_trip_collection_name"`
+	StopCollectionName            string                      `json:"device_stop_collection_name"`
+	AvailabilityCollectionName    string                      `json:"device_availability_collection_name"`
+	GeofenceCollectionName        string                      `json:"geofence_collection_name"`
+	GeofenceEventCollectionName   string                      `json:"geofence_event_collection_name"`
+	AlertRuleCollectionName       string                      `json:"alert_rule_collection_name"`
+	AlertCollectionName           string                      `json:"alert_collection_name"`
+	NotificationLogCollectionName string                      `json:"notification_log_collection_name"`
+	AccountCollectionName         string                      `json:"account_collection_name"`
+	SessionCollectionName         string                      `json:"session_collection_name"`
+	GroupCollectionName           string                      `json:"device_group_collection_name"`
+	MigrationCollectionName       string                      `json:"migration_collection_name"`
+	JWTSecret                     string                      `json:"jwt_secret"`               // Signs access and refresh tokens, random per run if empty
+	AccessTokenTTL                int                         `json:"access_token_ttl_minutes"` // Lifetime of access tokens
+	RefreshTokenTTL               int                         `json:"refresh_token_ttl_hours"`  // Lifetime of a login session
+	AdminUsername                 string                      `json:"admin_username"`           // Account created when there are none
+	AdminPassword                 string                      `json:"admin_password"`           // Generated and logged if empty
+	APIKey                        string                      `json:"api_key"`
+	APIURL                        string                      `json:"api_url"`
+	UpdateInterval                int                         `json:"update_interval_seconds"`
+	RetentionInterval             int                         `json:"retention_interval_minutes"`     // How often expired history is purged
+	OfflineCheckInterval          int                         `json:"offline_check_interval_seconds"` // How often devices are checked for going offline
+	EventBufferSize               int                         `json:"event_buffer_size"`              // Events kept for stream resume
+	MockServerPort                string                      `json:"mock_server_port"`
+	MockSMTPPort                  string                      `json:"mock_smtp_port"`           // SMTP stand-in started in mock mode
+	MockDataFile                  string                      `json:"mock_data_file"`           // Devices the mock server starts with, result.json if not set
+	MockScenarioFile              string                      `json:"mock_scenario_file"`       // Routes the mock devices follow, see mockserver.Scenario
+	MockReplayFile                string                      `json:"mock_replay_file"`         // Recorded tracks the mock devices replay, see mockserver.LoadTrack
+	MockReplaySpeed               float64                     `json:"mock_replay_speed"`        // Replay clock relative to real time, 1 if not set
+	MockFleetSize                 int                         `json:"mock_fleet_size"`          // Synthetic devices generated in place of result.json, 0 for none
+	MockFleetSeed                 int64                       `json:"mock_fleet_seed"`          // The same seed generates the same fleet
+	MockFleetRegion               []float64                   `json:"mock_fleet_region"`        // [west, south, east, north] of the fleet, Los Angeles if not set
+	MockSeed                      int64                       `json:"mock_seed"`                // Makes mock mode deterministic, with seeded mutations and a virtual clock
+	MockStartTime                 string                      `json:"mock_start_time"`          // RFC3339 start of the virtual clock, see mockserver.DefaultMockStart
+	DataSource                    string                      `json:"data_source"`              // Shorthand for a single entry in DataSources
+	DataFile                      string                      `json:"data_file"`                // Local device list used by the built-in "file" source
+	APITimeoutSeconds             int                         `json:"api_timeout_seconds"`      // Per request timeout for the upstream API
+	APIMaxRetries                 *int                        `json:"api_max_retries"`          // Retries after the first failed request, 3 if not set
+	APIRetryBackoffMillis         int                         `json:"api_retry_backoff_millis"` // Initial retry delay, doubled on every attempt
+	DataSources                   []string                    `json:"data_sources"`             // Names of the sources to poll
+	Sources                       []SourceConfig              `json:"sources"`                  // Source definitions, looked up by name
+	NotificationChannels          []NotificationChannelConfig `json:"notification_channels"`    // Where alerts are delivered
+}
+
+// SourceConfig defines a device source. Type selects the implementation, the remaining
+// fields are interpreted by that implementation.
+type SourceConfig struct {
+	Name               string            `json:"name"`
+	Type               string            `json:"type"` // "onestepgps", "file", "mock" or any registered type
+	URL                string            `json:"url"`
+	APIKey             string            `json:"api_key"`
+	File               string            `json:"file"`
+	TimeoutSeconds     int               `json:"timeout_seconds"`
+	MaxRetries         *int              `json:"max_retries"` // api_max_retries if not set, 0 disables retries
+	RetryBackoffMillis int               `json:"retry_backoff_millis"`
+	Options            map[string]string `json:"options,omitempty"` // Free form settings for third party sources
+}
+
+// DevicePointRecord is a single entry of a device's point history.
+// The extracted fields are used for querying, Point keeps the full upstream latest_device_point.
+type DevicePointRecord struct {
+	DeviceID      string       `bson:"device_id" json:"device_id"`
+	DevicePointID string       `bson:"device_point_id" json:"device_point_id"`
+	DtTracker     time.Time    `bson:"dt_tracker" json:"dt_tracker"`
+	DtServer      time.Time    `bson:"dt_server" json:"dt_server"`
+	Lat           float64      `bson:"lat" json:"lat"`
+	Lng           float64      `bson:"lng" json:"lng"`
+	Angle         float64      `bson:"angle" json:"angle"`
+	Speed         float64      `bson:"speed" json:"speed"`
+	Accurate      bool         `bson:"accurate" json:"accurate"`
+	RejectReasons []string     `bson:"reject_reasons,omitempty" json:"reject_reasons,omitempty"` // Why the point failed the quality checks
+	Point         *DevicePoint `bson:"point" json:"point"`
+}
+
+// NotificationChannelConfig defines where alerts are delivered. Type selects the implementation:
+// "webhook" (JSON POST to URL, signed with Secret), "smtp" (email through SMTPHost) or "http"
+// (Method to URL with BodyTemplate). Templates use Go text/template syntax on the alert.
+type NotificationChannelConfig struct {
+	Name               string            `json:"name"`
+	Type               string            `json:"type"`
+	URL                string            `json:"url"`
+	Method             string            `json:"method"`
+	Headers            map[string]string `json:"headers"`
+	Secret             string            `json:"secret"` // HMAC-SHA256 key for webhook signatures
+	BodyTemplate       string            `json:"body_template"`
+	SMTPHost           string            `json:"smtp_host"`
+	SMTPPort           string            `json:"smtp_port"`
+	SMTPUsername       string            `json:"smtp_username"`
+	SMTPPassword       string            `json:"smtp_password"`
+	From               string            `json:"from"`
+	To                 []string          `json:"to"`
+	SubjectTemplate    string            `json:"subject_template"`
+	Statuses           []string          `json:"statuses"`    // Alert statuses to deliver, defaults to open (newly raised)
+	AlertTypes         []string          `json:"alert_types"` // Rule types to deliver, empty for all
+	RateLimitPerMinute int               `json:"rate_limit_per_minute"`
+	MaxAttempts        int               `json:"max_attempts"`
+	RetryBackoffMillis int               `json:"retry_backoff_millis"`
+	TimeoutSeconds     int               `json:"timeout_seconds"`
+}
+
+// Notification delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryRetrying  = "retrying"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// NotificationDelivery is the delivery log entry of one alert on one channel.
+type NotificationDelivery struct {
+	ID          string     `bson:"_id" json:"id"`
+	Channel     string     `bson:"channel" json:"channel"`
+	ChannelType string     `bson:"channel_type" json:"channel_type"`
+	AlertID     string     `bson:"alert_id" json:"alert_id"`
+	AlertStatus string     `bson:"alert_status" json:"alert_status"`
+	DeviceID    string     `bson:"device_id" json:"device_id"`
+	Status      string     `bson:"status" json:"status"`
+	Attempts    int        `bson:"attempts" json:"attempts"`
+	LastError   string     `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt   time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time  `bson:"updated_at" json:"updated_at"`
+	NextAttempt *time.Time `bson:"next_attempt,omitempty" json:"next_attempt,omitempty"`
+	DeliveredAt *time.Time `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
+
+// Location is a latitude/longitude pair.
+type Location struct {
+	Lat float64 `bson:"lat" json:"lat"`
+	Lng float64 `bson:"lng" json:"lng"`
+}
+
+// Trip is a continuous drive of a device, detected from its points using the device settings.
+// Speeds are in km/h and distances in meters.
+type Trip struct {
+	ID              string    `bson:"_id" json:"id"`
+	DeviceID        string    `bson:"device_id" json:"device_id"`
+	StartTime       time.Time `bson:"start_time" json:"start_time"`
+	EndTime         time.Time `bson:"end_time" json:"end_time"`
+	StartLocation   Location  `bson:"start_location" json:"start_location"`
+	EndLocation     Location  `bson:"end_location" json:"end_location"`
+	DistanceMeters  float64   `bson:"distance_meters" json:"distance_meters"`
+	MaxSpeedKmh     float64   `bson:"max_speed_kmh" json:"max_speed_kmh"`
+	AvgSpeedKmh     float64   `bson:"avg_speed_kmh" json:"avg_speed_kmh"`
+	DurationSeconds float64   `bson:"duration_seconds" json:"duration_seconds"`
+	PointCount      int       `bson:"point_count" json:"point_count"`
+	InProgress      bool      `bson:"-" json:"in_progress,omitempty"`
+}
+
+// Stop is a period during which a device stayed parked between two trips.
+type Stop struct {
+	ID              string    `bson:"_id" json:"id"`
+	DeviceID        string    `bson:"device_id" json:"device_id"`
+	StartTime       time.Time `bson:"start_time" json:"start_time"`
+	EndTime         time.Time `bson:"end_time" json:"end_time"`
+	Location        Location  `bson:"location" json:"location"`
+	DurationSeconds float64   `bson:"duration_seconds" json:"duration_seconds"`
+	InProgress      bool      `bson:"-" json:"in_progress,omitempty"`
+}
+
+// AvailabilityEvent records a device going online or offline. Time is when the transition
+// happened (the last point for online, last point + OfflineTimeout for offline), DetectedAt
+// when the server noticed it.
+type AvailabilityEvent struct {
+	DeviceID   string    `bson:"device_id" json:"device_id"`
+	Online     bool      `bson:"online" json:"online"`
+	Time       time.Time `bson:"time" json:"time"`
+	DetectedAt time.Time `bson:"detected_at" json:"detected_at"`
+	LastSeen   time.Time `bson:"last_seen" json:"last_seen"`
+}
+
+// DailyUptime is the availability of a device during one UTC day. Unknown covers the time
+// before the first recorded transition and after now.
+type DailyUptime struct {
+	Date           string  `json:"date"`
+	OnlineSeconds  float64 `json:"online_seconds"`
+	OfflineSeconds float64 `json:"offline_seconds"`
+	UnknownSeconds float64 `json:"unknown_seconds"`
+	UptimePercent  float64 `json:"uptime_percent"` // Online share of the known time
+}
+
+// Geofence types.
+const (
+	GeofenceCircle  = "circle"
+	GeofencePolygon = "polygon"
+)
+
+// Geofence is a circular or polygonal zone. It applies to the devices in DeviceIDs and to the
+// devices of the groups in GroupIDs, or to every device when both are empty.
+type Geofence struct {
+	ID           string          `bson:"_id" json:"id"`
+	Name         string          `bson:"name" json:"name"`
+	Description  string          `bson:"description,omitempty" json:"description,omitempty"`
+	Type         string          `bson:"type" json:"type"`
+	Center       *Location       `bson:"center,omitempty" json:"center,omitempty"`               // Circle center
+	RadiusMeters float64         `bson:"radius_meters,omitempty" json:"radius_meters,omitempty"` // Circle radius
+	Polygon      *GeoJSONPolygon `bson:"polygon,omitempty" json:"polygon,omitempty"`
+	DeviceIDs    []string        `bson:"device_ids" json:"device_ids"`
+	GroupIDs     []string        `bson:"group_ids" json:"group_ids"`
+	DwellSeconds float64         `bson:"dwell_seconds" json:"dwell_seconds"` // Time inside before a dwell event, 0 disables dwell
+	Version      int             `bson:"version" json:"version"`
+	CreatedAt    time.Time       `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time       `bson:"updated_at" json:"updated_at"`
+}
+
+// GeoJSONPolygon is a GeoJSON Polygon geometry. Positions are [lng, lat], the first ring is the
+// outer boundary and the others are holes.
+type GeoJSONPolygon struct {
+	Type        string        `bson:"type" json:"type"`
+	Coordinates [][][]float64 `bson:"coordinates" json:"coordinates"`
+}
+
+// Geofence event types.
+const (
+	GeofenceEnter = "enter"
+	GeofenceExit  = "exit"
+	GeofenceDwell = "dwell"
+)
+
+// GeofenceEvent records a device entering, leaving or dwelling in a geofence.
+type GeofenceEvent struct {
+	ID            string    `bson:"_id" json:"id"`
+	GeofenceID    string    `bson:"geofence_id" json:"geofence_id"`
+	GeofenceName  string    `bson:"geofence_name" json:"geofence_name"`
+	DeviceID      string    `bson:"device_id" json:"device_id"`
+	Type          string    `bson:"type" json:"type"`
+	Time          time.Time `bson:"time" json:"time"`
+	Location      Location  `bson:"location" json:"location"`
+	DevicePointID string    `bson:"device_point_id" json:"device_point_id"`
+	InsideSeconds float64   `bson:"inside_seconds" json:"inside_seconds"` // Time since entering, for exit and dwell
+}
+
+// AlertRule raises alerts for the devices in DeviceIDs and the groups in GroupIDs, or for every
+// device when both are empty. Type selects the condition, Options are interpreted by it.
+type AlertRule struct {
+	ID              string            `bson:"_id" json:"id"`
+	Name            string            `bson:"name" json:"name"`
+	Type            string            `bson:"type" json:"type"` // "speeding", "geofence", "offline", "low_battery", "ignition_hours" or any registered type
+	Options         map[string]string `bson:"options" json:"options"`
+	DeviceIDs       []string          `bson:"device_ids" json:"device_ids"`
+	GroupIDs        []string          `bson:"group_ids" json:"group_ids"`
+	CooldownSeconds float64           `bson:"cooldown_seconds" json:"cooldown_seconds"` // Minimum time between two alerts of the rule for one device
+	Enabled         bool              `bson:"enabled" json:"enabled"`
+	Version         int               `bson:"version" json:"version"`
+	CreatedAt       time.Time         `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time         `bson:"updated_at" json:"updated_at"`
+}
+
+// Alert states.
+const (
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// Alert is raised when a rule fires for a device. While it is not resolved, further triggers of
+// the same rule for the same device increase Count instead of raising new alerts.
+type Alert struct {
+	ID              string     `bson:"_id" json:"id"`
+	RuleID          string     `bson:"rule_id" json:"rule_id"`
+	RuleName        string     `bson:"rule_name" json:"rule_name"`
+	Type            string     `bson:"type" json:"type"`
+	DeviceID        string     `bson:"device_id" json:"device_id"`
+	Message         string     `bson:"message" json:"message"`
+	Status          string     `bson:"status" json:"status"`
+	Count           int        `bson:"count" json:"count"`
+	TriggeredAt     time.Time  `bson:"triggered_at" json:"triggered_at"`
+	LastTriggeredAt time.Time  `bson:"last_triggered_at" json:"last_triggered_at"`
+	Location        *Location  `bson:"location,omitempty" json:"location,omitempty"`
+	DevicePointID   string     `bson:"device_point_id,omitempty" json:"device_point_id,omitempty"`
+	AcknowledgedAt  *time.Time `bson:"acknowledged_at,omitempty" json:"acknowledged_at,omitempty"`
+	AcknowledgedBy  string     `bson:"acknowledged_by,omitempty" json:"acknowledged_by,omitempty"`
+	ResolvedAt      *time.Time `bson:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+	ResolvedBy      string     `bson:"resolved_by,omitempty" json:"resolved_by,omitempty"`
+	Note            string     `bson:"note,omitempty" json:"note,omitempty"`
+}
+
+// DeviceGroup is a named set of devices. Groups can be nested with ParentID, a device in a group is
+// also in every ancestor of the group. Geofences and alert rules target groups by ID through GroupIDs,
+// next to the upstream groups in device_groups_id_list.
+type DeviceGroup struct {
+	ID          string    `bson:"_id" json:"id"`
+	Name        string    `bson:"name" json:"name"`
+	Description string    `bson:"description,omitempty" json:"description,omitempty"`
+	ParentID    string    `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	DeviceIDs   []string  `bson:"device_ids" json:"device_ids"`
+	Version     int       `bson:"version" json:"version"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// DeviceReport sums up the trips, stops and uptime of a device over a time range.
+type DeviceReport struct {
+	DeviceID       string  `json:"device_id,omitempty"`
+	Trips          int     `json:"trips"`
+	DistanceMeters float64 `json:"distance_meters"`
+	DriveSeconds   float64 `json:"drive_seconds"`
+	Stops          int     `json:"stops"`
+	StopSeconds    float64 `json:"stop_seconds"`
+	OnlineSeconds  float64 `json:"online_seconds"`
+	OfflineSeconds float64 `json:"offline_seconds"`
+	UptimePercent  float64 `json:"uptime_percent"` // Online share of the known time
+}
+
+// User roles. Viewers can read, operators can also change devices, settings, icons, geofences and
+// alert rules, admins can do everything including managing users.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// User is an account that can sign in to the API. The ID is also the key of the user's preferences.
+//
+// Admins see every device. Other users see the devices whose upstream user_id_list contains one of
+// their UpstreamUserIDs, plus DeviceIDs, minus HiddenDeviceIDs.
+type User struct {
+	ID              string     `bson:"_id" json:"id"`
+	Username        string     `bson:"username" json:"username"`
+	PasswordHash    string     `bson:"password_hash" json:"-"`
+	Role            string     `bson:"role" json:"role"`
+	UpstreamUserIDs []string   `bson:"upstream_user_ids" json:"upstream_user_ids"`
+	DeviceIDs       []string   `bson:"device_ids" json:"device_ids"`
+	HiddenDeviceIDs []string   `bson:"hidden_device_ids" json:"hidden_device_ids"`
+	Version         int        `bson:"version" json:"version"`
+	CreatedAt       time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time  `bson:"updated_at" json:"updated_at"`
+	LastLoginAt     *time.Time `bson:"last_login_at,omitempty" json:"last_login_at,omitempty"`
+}
+
+// Session is a login. Refresh tokens are bound to a session and stop working once it is revoked or expired.
+type Session struct {
+	ID        string     `bson:"_id" json:"id"`
+	UserID    string     `bson:"user_id" json:"user_id"`
+	UserAgent string     `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at" json:"expires_at"`
+	RevokedAt *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
 }
 
 type UserPreferences struct {
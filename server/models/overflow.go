@@ -0,0 +1,168 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// knownFieldsCache holds the declared field names per struct type and tag ("json" or "bson").
+var knownFieldsCache sync.Map
+
+type knownFieldsKey struct {
+	t   reflect.Type
+	tag string
+}
+
+// knownFields returns the names a struct's fields are encoded under with the given tag.
+func knownFields(t reflect.Type, tag string) map[string]bool {
+	key := knownFieldsKey{t, tag}
+	if cached, ok := knownFieldsCache.Load(key); ok {
+		return cached.(map[string]bool)
+	}
+	fields := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get(tag), ",")[0]
+		switch {
+		case name == "-" || !field.IsExported():
+			continue
+		case name == "":
+			name = field.Name
+			if tag == "bson" {
+				name = strings.ToLower(name)
+			}
+		}
+		fields[name] = true
+	}
+	knownFieldsCache.Store(key, fields)
+	return fields
+}
+
+// marshalJSONWithExtra encodes value (a struct without its own MarshalJSON) and appends the
+// extra fields that do not collide with a declared one.
+func marshalJSONWithExtra(value interface{}, extra map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	known := knownFields(reflect.TypeOf(value), "json")
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-1])
+	empty := len(data) == 2
+	for _, key := range sortedKeys(extra) {
+		if known[key] {
+			continue
+		}
+		name, _ := json.Marshal(key)
+		field, err := json.Marshal(extra[key])
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			buf.WriteByte(',')
+		}
+		empty = false
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(field)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// unmarshalJSONWithExtra decodes data into target (a pointer to a struct without its own
+// UnmarshalJSON) and returns the fields that are not declared by the struct.
+func unmarshalJSONWithExtra(data []byte, target interface{}) (map[string]interface{}, error) {
+	if err := json.Unmarshal(data, target); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	known := knownFields(reflect.TypeOf(target).Elem(), "json")
+	var extra map[string]interface{}
+	for key, raw := range fields {
+		if known[key] {
+			continue
+		}
+		// Numbers are kept as json.Number so large IDs are not rounded through float64
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		if extra == nil {
+			extra = make(map[string]interface{})
+		}
+		extra[key] = value
+	}
+	return extra, nil
+}
+
+// marshalBSONWithExtra is the BSON counterpart of marshalJSONWithExtra.
+func marshalBSONWithExtra(value interface{}, extra map[string]interface{}) ([]byte, error) {
+	data, err := bson.Marshal(value)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	known := knownFields(reflect.TypeOf(value), "bson")
+	for _, key := range sortedKeys(extra) {
+		if !known[key] {
+			doc = append(doc, bson.E{Key: key, Value: extra[key]})
+		}
+	}
+	return bson.Marshal(doc)
+}
+
+// unmarshalBSONWithExtra is the BSON counterpart of unmarshalJSONWithExtra.
+func unmarshalBSONWithExtra(data []byte, target interface{}) (map[string]interface{}, error) {
+	if err := bson.Unmarshal(data, target); err != nil {
+		return nil, err
+	}
+	elements, err := bson.Raw(data).Elements()
+	if err != nil {
+		return nil, err
+	}
+	known := knownFields(reflect.TypeOf(target).Elem(), "bson")
+	var extra map[string]interface{}
+	for _, element := range elements {
+		if known[element.Key()] {
+			continue
+		}
+		// Wrapped in a map so nested documents decode to maps instead of bson.D
+		var value map[string]interface{}
+		wrapped, err := bson.Marshal(bson.D{{Key: "v", Value: element.Value()}})
+		if err != nil {
+			return nil, err
+		}
+		if err := bson.Unmarshal(wrapped, &value); err != nil {
+			return nil, err
+		}
+		if extra == nil {
+			extra = make(map[string]interface{})
+		}
+		extra[element.Key()] = value["v"]
+	}
+	return extra, nil
+}
+
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
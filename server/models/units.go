@@ -0,0 +1,47 @@
+package models
+
+import "strings"
+
+// The upstream settings reuse the value/unit/display shape (Speed) for speeds, durations
+// and distances. These helpers normalize them so the values can be compared with points.
+
+// KilometersPerHour converts a speed setting to km/h. Unknown units are assumed to be km/h.
+func (s Speed) KilometersPerHour() float64 {
+	switch strings.ToLower(s.Unit) {
+	case "mph":
+		return s.Value * 1.609344
+	case "m/s", "mps":
+		return s.Value * 3.6
+	case "kn", "knots", "kt":
+		return s.Value * 1.852
+	}
+	return s.Value
+}
+
+// Seconds converts a duration setting to seconds. Unknown units are assumed to be seconds.
+func (s Speed) Seconds() float64 {
+	switch strings.ToLower(s.Unit) {
+	case "ms":
+		return s.Value / 1000
+	case "m", "min", "minutes":
+		return s.Value * 60
+	case "h", "hours":
+		return s.Value * 3600
+	case "d", "days":
+		return s.Value * 86400
+	}
+	return s.Value
+}
+
+// Meters converts a distance setting to meters. Unknown units are assumed to be meters.
+func (s Speed) Meters() float64 {
+	switch strings.ToLower(s.Unit) {
+	case "km":
+		return s.Value * 1000
+	case "mi":
+		return s.Value * 1609.344
+	case "ft":
+		return s.Value * 0.3048
+	}
+	return s.Value
+}
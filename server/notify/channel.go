@@ -0,0 +1,123 @@
+/*
+Package notify delivers alerts to external channels.
+
+The Dispatcher reads alert events from the event hub and queues a delivery for every
+configured channel that accepts the alert. Each channel has its own worker with a rate
+limit (rate_limit_per_minute) and retries failed deliveries with exponential backoff up to
+max_attempts. Every delivery is recorded in the delivery log, unfinished deliveries are
+queued again when the server restarts. When the dispatcher falls behind the hub further than
+its buffer reaches, the open alerts it missed are loaded from the store and queued again.
+
+Built-in channel types are "webhook", "smtp" and "http". Further types can be added with Register.
+*/
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+// Built-in channel types.
+const (
+	TypeWebhook = "webhook"
+	TypeSMTP    = "smtp"
+	TypeHTTP    = "http"
+)
+
+// Channel sends an alert to one destination.
+type Channel interface {
+	Name() string
+	Type() string
+	Send(ctx context.Context, alert models.Alert) error
+}
+
+// Factory creates a channel from its configuration.
+type Factory func(cfg models.NotificationChannelConfig) (Channel, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Factory{
+		TypeWebhook: newWebhook,
+		TypeSMTP:    newSMTP,
+		TypeHTTP:    newHTTP,
+	}
+)
+
+// Register makes a channel type available to the notification_channels configuration.
+// Registering an existing type replaces it.
+func Register(channelType string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[channelType] = factory
+}
+
+// New creates the channel for a configuration.
+func New(cfg models.NotificationChannelConfig) (Channel, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("notification channel without a name")
+	}
+	registryMutex.RLock()
+	factory, ok := registry[cfg.Type]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("notification channel %s: unknown type %q", cfg.Name, cfg.Type)
+	}
+	channel, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("notification channel %s: %w", cfg.Name, err)
+	}
+	return channel, nil
+}
+
+// templateData is what channel templates are executed on.
+type templateData struct {
+	models.Alert
+	SentAt string
+}
+
+// templateFuncs are available in channel templates. json quotes a value for JSON bodies.
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// parseTemplate parses a channel template, using fallback when the configuration has none.
+func parseTemplate(name, text, fallback string) (*template.Template, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// render executes a template on an alert.
+func render(tmpl *template.Template, alert models.Alert) (string, error) {
+	var buf bytes.Buffer
+	data := templateData{Alert: alert, SentAt: time.Now().UTC().Format(time.RFC3339)}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// statusError is returned for non-2xx HTTP responses.
+type statusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Body)
+}
@@ -0,0 +1,485 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/models"
+)
+
+// queueSize is the number of deliveries a channel may have waiting before new ones fail.
+const queueSize = 1000
+
+// maxRetryDelay caps the exponential backoff between attempts.
+const maxRetryDelay = 10 * time.Minute
+
+// Store persists the delivery log and loads alerts for deliveries resumed after a restart or
+// after the dispatcher fell behind the event hub.
+type Store interface {
+	SaveNotificationDelivery(delivery models.NotificationDelivery) error
+	GetUnfinishedNotificationDeliveries() ([]models.NotificationDelivery, error)
+	GetAlert(id string) (models.Alert, error)
+	GetAlerts(filter database.AlertFilter) ([]models.Alert, error)
+}
+
+// ChannelStatus reports the state of a channel.
+type ChannelStatus struct {
+	Name               string `json:"name"`
+	Type               string `json:"type"`
+	Queued             int    `json:"queued"`
+	Delivered          int    `json:"delivered"`
+	Failed             int    `json:"failed"`
+	RateLimitPerMinute int    `json:"rate_limit_per_minute"`
+	MaxAttempts        int    `json:"max_attempts"`
+}
+
+// delivery is a queued alert for one channel.
+type delivery struct {
+	log   models.NotificationDelivery
+	alert models.Alert
+}
+
+// worker delivers the queue of one channel.
+type worker struct {
+	channel Channel
+	config  models.NotificationChannelConfig
+	queue   chan *delivery
+	limiter *rateLimiter
+	store   Store
+
+	mutex     sync.Mutex
+	delivered int
+	failed    int
+}
+
+// Dispatcher fans alerts out to the configured channels.
+type Dispatcher struct {
+	Hub     *events.Hub
+	Store   Store
+	workers []*worker
+}
+
+// NewDispatcher creates a dispatcher for the configured channels.
+func NewDispatcher(store Store, hub *events.Hub, configs []models.NotificationChannelConfig) (*Dispatcher, error) {
+	d := &Dispatcher{Hub: hub, Store: store}
+	names := make(map[string]bool)
+	for _, cfg := range configs {
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("duplicate notification channel %s", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		channel, err := New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg = withDefaults(cfg)
+		d.workers = append(d.workers, &worker{
+			channel: channel,
+			config:  cfg,
+			queue:   make(chan *delivery, queueSize),
+			limiter: newRateLimiter(cfg.RateLimitPerMinute),
+			store:   store,
+		})
+	}
+	return d, nil
+}
+
+// withDefaults fills in the optional channel settings.
+func withDefaults(cfg models.NotificationChannelConfig) models.NotificationChannelConfig {
+	if len(cfg.Statuses) == 0 {
+		cfg.Statuses = []string{models.AlertOpen}
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.RetryBackoffMillis <= 0 {
+		cfg.RetryBackoffMillis = 2000
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 10
+	}
+	return cfg
+}
+
+// Run starts the channel workers, queues the deliveries left unfinished by a previous run and
+// then delivers alert events from the hub. It never returns.
+func (d *Dispatcher) Run() {
+	for _, w := range d.workers {
+		go w.run()
+	}
+	d.resume()
+
+	// Alerts triggered before the start were delivered by the previous run or resumed above
+	handled := d.latestAlert()
+	lastEventID := d.Hub.LastEventID()
+	for {
+		sub := d.subscribe(lastEventID, handled)
+		for event := range sub.C {
+			d.handleEvent(event)
+			handled.add(event)
+			lastEventID = event.ID
+		}
+		log.Printf("Notification dispatcher fell behind the event hub, resubscribing")
+	}
+}
+
+// subscribe subscribes to the hub after lastEventID and handles the missed events. When the hub
+// no longer has them, the open alerts triggered since the last handled alert are queued again.
+func (d *Dispatcher) subscribe(lastEventID string, handled *watermark) *events.Subscription {
+	sub, missed, resumed := d.Hub.Subscribe(lastEventID)
+	if !resumed {
+		d.requeue(handled)
+	}
+	for _, event := range missed {
+		d.handleEvent(event)
+		handled.add(event)
+	}
+	return sub
+}
+
+// requeue queues the open alerts the watermark does not cover. Acknowledgements and resolutions
+// published while the dispatcher was behind are not sent.
+func (d *Dispatcher) requeue(handled *watermark) {
+	alerts, err := d.Store.GetAlerts(database.AlertFilter{Status: models.AlertOpen, From: handled.at})
+	if err != nil {
+		log.Printf("Notification dispatcher missed events of the hub and failed to load the open alerts: %v", err)
+		return
+	}
+	requeued := 0
+	for i := len(alerts) - 1; i >= 0; i-- { // Oldest first
+		alert := alerts[i]
+		if handled.covers(alert) {
+			continue
+		}
+		d.handleAlert(alert)
+		handled.addAlert(alert)
+		requeued++
+	}
+	log.Printf("Notification dispatcher missed events of the hub, queued %d open alerts triggered since %s again", requeued, handled.at.Format(time.RFC3339))
+}
+
+// latestAlert returns a watermark at the most recently triggered alert.
+func (d *Dispatcher) latestAlert() *watermark {
+	handled := &watermark{}
+	alerts, err := d.Store.GetAlerts(database.AlertFilter{Limit: 1})
+	if err != nil {
+		log.Printf("Failed to load the latest alert: %v", err)
+	}
+	for _, alert := range alerts {
+		handled.addAlert(alert)
+	}
+	return handled
+}
+
+// Test queues a test alert on a channel, bypassing its status and type filters.
+func (d *Dispatcher) Test(channelName string) (models.NotificationDelivery, error) {
+	for _, w := range d.workers {
+		if w.channel.Name() != channelName {
+			continue
+		}
+		now := time.Now().UTC()
+		alert := models.Alert{
+			ID:              fmt.Sprintf("test-%d", now.UnixNano()),
+			RuleName:        "Test notification",
+			Type:            "test",
+			DeviceID:        "test",
+			Message:         "This is a test notification from OneStepGPS",
+			Status:          models.AlertOpen,
+			Count:           1,
+			TriggeredAt:     now,
+			LastTriggeredAt: now,
+		}
+		return w.enqueue(alert), nil
+	}
+	return models.NotificationDelivery{}, fmt.Errorf("notification channel %s not found", channelName)
+}
+
+// Statuses reports every channel.
+func (d *Dispatcher) Statuses() []ChannelStatus {
+	statuses := make([]ChannelStatus, 0, len(d.workers))
+	for _, w := range d.workers {
+		w.mutex.Lock()
+		statuses = append(statuses, ChannelStatus{
+			Name:               w.channel.Name(),
+			Type:               w.channel.Type(),
+			Queued:             len(w.queue),
+			Delivered:          w.delivered,
+			Failed:             w.failed,
+			RateLimitPerMinute: w.config.RateLimitPerMinute,
+			MaxAttempts:        w.config.MaxAttempts,
+		})
+		w.mutex.Unlock()
+	}
+	return statuses
+}
+
+func (d *Dispatcher) handleEvent(event events.Event) {
+	if alert, ok := event.Data.(models.Alert); ok {
+		d.handleAlert(alert)
+	}
+}
+
+func (d *Dispatcher) handleAlert(alert models.Alert) {
+	for _, w := range d.workers {
+		if w.accepts(alert) {
+			w.enqueue(alert)
+		}
+	}
+}
+
+// resume queues the deliveries that were pending or waiting for a retry when the server stopped.
+func (d *Dispatcher) resume() {
+	unfinished, err := d.Store.GetUnfinishedNotificationDeliveries()
+	if err != nil {
+		log.Printf("Failed to load unfinished notification deliveries: %v", err)
+		return
+	}
+	for _, entry := range unfinished {
+		w := d.worker(entry.Channel)
+		if w == nil {
+			entry.Status = models.DeliveryFailed
+			entry.LastError = "channel no longer configured"
+			if err := d.Store.SaveNotificationDelivery(entry); err != nil {
+				log.Printf("Failed to save notification delivery %s: %v", entry.ID, err)
+			}
+			continue
+		}
+		alert, err := d.Store.GetAlert(entry.AlertID)
+		if err != nil {
+			entry.Status = models.DeliveryFailed
+			entry.LastError = err.Error()
+			if err := d.Store.SaveNotificationDelivery(entry); err != nil {
+				log.Printf("Failed to save notification delivery %s: %v", entry.ID, err)
+			}
+			continue
+		}
+		w.push(&delivery{log: entry, alert: alert})
+	}
+	if len(unfinished) > 0 {
+		log.Printf("Resumed %d unfinished notification deliveries", len(unfinished))
+	}
+}
+
+// watermark is the latest trigger time of the handled alerts, with the alerts triggered at that time.
+type watermark struct {
+	at  time.Time
+	ids map[string]bool
+}
+
+func (w *watermark) add(event events.Event) {
+	if alert, ok := event.Data.(models.Alert); ok {
+		w.addAlert(alert)
+	}
+}
+
+func (w *watermark) addAlert(alert models.Alert) {
+	switch {
+	case alert.LastTriggeredAt.After(w.at):
+		w.at = alert.LastTriggeredAt
+		w.ids = map[string]bool{alert.ID: true}
+	case alert.LastTriggeredAt.Equal(w.at):
+		if w.ids == nil {
+			w.ids = make(map[string]bool)
+		}
+		w.ids[alert.ID] = true
+	}
+}
+
+// covers reports whether the alert was triggered before the watermark or handled at it.
+func (w *watermark) covers(alert models.Alert) bool {
+	return alert.LastTriggeredAt.Before(w.at) || (alert.LastTriggeredAt.Equal(w.at) && w.ids[alert.ID])
+}
+
+func (d *Dispatcher) worker(name string) *worker {
+	for _, w := range d.workers {
+		if w.channel.Name() == name {
+			return w
+		}
+	}
+	return nil
+}
+
+// accepts reports whether the channel delivers this alert.
+func (w *worker) accepts(alert models.Alert) bool {
+	if !contains(w.config.Statuses, alert.Status) {
+		return false
+	}
+	return len(w.config.AlertTypes) == 0 || contains(w.config.AlertTypes, alert.Type)
+}
+
+// enqueue records a new delivery and queues it.
+func (w *worker) enqueue(alert models.Alert) models.NotificationDelivery {
+	now := time.Now().UTC()
+	d := &delivery{
+		alert: alert,
+		log: models.NotificationDelivery{
+			ID:          fmt.Sprintf("%s-%s-%s-%d", w.channel.Name(), alert.ID, alert.Status, now.UnixNano()),
+			Channel:     w.channel.Name(),
+			ChannelType: w.channel.Type(),
+			AlertID:     alert.ID,
+			AlertStatus: alert.Status,
+			DeviceID:    alert.DeviceID,
+			Status:      models.DeliveryPending,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		},
+	}
+	entry := d.log // The worker owns d once it is pushed
+	w.save(d)
+	w.push(d)
+	return entry
+}
+
+// push adds a delivery to the queue, failing it if the queue is full.
+func (w *worker) push(d *delivery) {
+	select {
+	case w.queue <- d:
+	default:
+		d.log.Status = models.DeliveryFailed
+		d.log.LastError = "queue full"
+		w.save(d)
+		w.count(false)
+		log.Printf("Notification queue of channel %s is full, dropping alert %s", w.channel.Name(), d.alert.ID)
+	}
+}
+
+// run delivers queued alerts one at a time within the rate limit.
+func (w *worker) run() {
+	for d := range w.queue {
+		if d.log.NextAttempt != nil {
+			if wait := time.Until(*d.log.NextAttempt); wait > 0 {
+				// Not due yet (resumed after a restart), the timer owns the delivery until it is due
+				time.AfterFunc(wait, func() {
+					d.log.NextAttempt = nil
+					w.push(d)
+				})
+				continue
+			}
+		}
+		w.limiter.wait()
+		w.attempt(d)
+	}
+}
+
+// attempt sends a delivery once and schedules a retry if it failed and attempts are left.
+func (w *worker) attempt(d *delivery) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(w.config.TimeoutSeconds)*time.Second)
+	err := w.channel.Send(ctx, d.alert)
+	cancel()
+
+	now := time.Now().UTC()
+	d.log.Attempts++
+	d.log.UpdatedAt = now
+	d.log.NextAttempt = nil
+	var retryIn time.Duration
+	switch {
+	case err == nil:
+		d.log.Status = models.DeliveryDelivered
+		d.log.LastError = ""
+		d.log.DeliveredAt = &now
+		w.count(true)
+	case d.log.Attempts >= w.config.MaxAttempts:
+		d.log.Status = models.DeliveryFailed
+		d.log.LastError = err.Error()
+		w.count(false)
+		log.Printf("Notification of alert %s on channel %s failed after %d attempts: %v", d.alert.ID, w.channel.Name(), d.log.Attempts, err)
+	default:
+		delay := w.retryDelay(d.log.Attempts)
+		next := now.Add(delay)
+		d.log.Status = models.DeliveryRetrying
+		d.log.LastError = err.Error()
+		d.log.NextAttempt = &next
+		log.Printf("Notification of alert %s on channel %s failed, retrying in %s: %v", d.alert.ID, w.channel.Name(), delay, err)
+		retryIn = delay
+	}
+	w.save(d)
+
+	// Scheduled only once the retrying state is saved, the timer owns the delivery from here
+	if retryIn > 0 {
+		time.AfterFunc(retryIn, func() {
+			d.log.NextAttempt = nil
+			w.push(d)
+		})
+	}
+}
+
+// retryDelay doubles the configured backoff for every attempt made.
+func (w *worker) retryDelay(attempts int) time.Duration {
+	delay := time.Duration(w.config.RetryBackoffMillis) * time.Millisecond
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (w *worker) save(d *delivery) {
+	if err := w.store.SaveNotificationDelivery(d.log); err != nil {
+		log.Printf("Failed to save notification delivery %s: %v", d.log.ID, err)
+	}
+}
+
+func (w *worker) count(delivered bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if delivered {
+		w.delivered++
+	} else {
+		w.failed++
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter is a token bucket allowing perMinute sends per minute with bursts of the same size.
+// A limit of 0 disables it.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64 // Tokens per second
+	last     time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{capacity: float64(perMinute), tokens: float64(perMinute), rate: float64(perMinute) / 60, last: time.Now()}
+}
+
+// wait blocks until a send is allowed.
+func (l *rateLimiter) wait() {
+	if l.capacity <= 0 {
+		return
+	}
+	for {
+		l.mutex.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.capacity {
+			l.tokens = l.capacity
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mutex.Unlock()
+			return
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mutex.Unlock()
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/models"
+)
+
+func TestDispatcherRequeuesAlertsEvictedFromTheHub(t *testing.T) {
+	url, _ := startHTTPSink(t)
+	db := database.NewMemory()
+	hub := events.NewHub(3, clock.System)
+	dispatcher, err := NewDispatcher(db, hub, []models.NotificationChannelConfig{{Name: "hook", Type: TypeWebhook, URL: url}})
+	if err != nil {
+		t.Fatalf("NewDispatcher: %v", err)
+	}
+	raise := func(at time.Time) models.Alert {
+		alert, err := db.CreateAlert(models.Alert{RuleName: "Speeding", Type: "speed", DeviceID: "truck", Status: models.AlertOpen, Count: 1, TriggeredAt: at, LastTriggeredAt: at})
+		if err != nil {
+			t.Fatalf("CreateAlert: %v", err)
+		}
+		hub.Publish(events.TypeAlert, alert.DeviceID, alert)
+		return alert
+	}
+
+	// The first alert was delivered before the dispatcher fell behind
+	start := time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+	delivered := raise(start)
+	handled := dispatcher.latestAlert()
+	lastEventID := hub.LastEventID()
+
+	// Ten more alerts while it is behind, one of them at the same time, evict its position from the hub
+	missed := []models.Alert{raise(start)}
+	for i := 1; i < 10; i++ {
+		missed = append(missed, raise(start.Add(time.Duration(i)*time.Minute)))
+	}
+	resolved := raise(start.Add(time.Hour))
+	if _, err := db.ResolveAlert(resolved.ID, "ops", ""); err != nil {
+		t.Fatalf("ResolveAlert: %v", err)
+	}
+
+	dispatcher.subscribe(lastEventID, handled).Cancel()
+
+	for _, alert := range missed {
+		deliveries, err := db.GetNotificationDeliveries("hook", alert.ID, "", 0)
+		if err != nil || len(deliveries) != 1 || deliveries[0].Status != models.DeliveryPending {
+			t.Errorf("deliveries of the missed alert at %s = %+v, %v, want one pending", alert.LastTriggeredAt, deliveries, err)
+		}
+	}
+	for _, alert := range []models.Alert{delivered, resolved} {
+		if deliveries, _ := db.GetNotificationDeliveries("hook", alert.ID, "", 0); len(deliveries) != 0 {
+			t.Errorf("alert %s was queued again: %+v", alert.ID, deliveries)
+		}
+	}
+
+	// Once caught up, the alerts are not queued a second time
+	dispatcher.subscribe(lastEventID, handled).Cancel()
+	if deliveries, _ := db.GetNotificationDeliveries("hook", "", "", 0); len(deliveries) != len(missed) {
+		t.Errorf("delivery log has %d entries after resubscribing, want %d", len(deliveries), len(missed))
+	}
+}
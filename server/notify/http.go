@@ -0,0 +1,156 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+// Webhook signature headers. The signature is "sha256=" followed by the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the channel secret.
+const (
+	SignatureHeader = "X-OneStepGPS-Signature"
+	TimestampHeader = "X-OneStepGPS-Timestamp"
+)
+
+// webhookPayload is the JSON body of webhook deliveries.
+type webhookPayload struct {
+	Event  string       `json:"event"`
+	SentAt string       `json:"sent_at"`
+	Alert  models.Alert `json:"alert"`
+}
+
+// webhook POSTs the alert as JSON, signed with the channel secret.
+type webhook struct {
+	name    string
+	url     string
+	secret  string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newWebhook(cfg models.NotificationChannelConfig) (Channel, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	return &webhook{name: cfg.Name, url: cfg.URL, secret: cfg.Secret, headers: cfg.Headers, client: &http.Client{}}, nil
+}
+
+func (w *webhook) Name() string { return w.name }
+func (w *webhook) Type() string { return TypeWebhook }
+
+func (w *webhook) Send(ctx context.Context, alert models.Alert) error {
+	now := time.Now().UTC()
+	body, err := json.Marshal(webhookPayload{Event: "alert." + alert.Status, SentAt: now.Format(time.RFC3339), Alert: alert})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	for key, value := range w.headers {
+		headers[key] = value
+	}
+	if w.secret != "" {
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		headers[TimestampHeader] = timestamp
+		headers[SignatureHeader] = Sign(w.secret, timestamp, body)
+	}
+	return doRequest(ctx, w.client, http.MethodPost, w.url, headers, body)
+}
+
+// Sign computes the webhook signature of a body sent at timestamp (Unix seconds).
+// Receivers recompute it with their copy of the secret and compare in constant time.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// templatedHTTP sends a request with a templated body, for services with their own payload format.
+type templatedHTTP struct {
+	name    string
+	method  string
+	url     *template.Template
+	body    *template.Template
+	headers map[string]string
+	client  *http.Client
+}
+
+const defaultHTTPBody = `{"text": {{json (printf "%s: %s (device %s, %s)" .RuleName .Message .DeviceID .Status)}}}`
+
+func newHTTP(cfg models.NotificationChannelConfig) (Channel, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	urlTemplate, err := parseTemplate("url", cfg.URL, "")
+	if err != nil {
+		return nil, err
+	}
+	bodyTemplate, err := parseTemplate("body_template", cfg.BodyTemplate, defaultHTTPBody)
+	if err != nil {
+		return nil, err
+	}
+	method := strings.ToUpper(cfg.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	return &templatedHTTP{name: cfg.Name, method: method, url: urlTemplate, body: bodyTemplate, headers: cfg.Headers, client: &http.Client{}}, nil
+}
+
+func (t *templatedHTTP) Name() string { return t.name }
+func (t *templatedHTTP) Type() string { return TypeHTTP }
+
+func (t *templatedHTTP) Send(ctx context.Context, alert models.Alert) error {
+	url, err := render(t.url, alert)
+	if err != nil {
+		return err
+	}
+	body, err := render(t.body, alert)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	for key, value := range t.headers {
+		headers[key] = value
+	}
+	return doRequest(ctx, t.client, t.method, url, headers, []byte(body))
+}
+
+// doRequest sends a request and treats any non-2xx response as a failure.
+func doRequest(ctx context.Context, client *http.Client, method, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(snippet))}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,245 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/events"
+	"OneStepGPSLeo/mockserver"
+	"OneStepGPSLeo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testAlert = models.Alert{
+	ID:          "alert-1",
+	RuleName:    "Speeding",
+	Type:        "speed",
+	DeviceID:    "6jAOdk2wPiTjH-81f07-0k",
+	Message:     "Speed 120 km/h above 100 km/h",
+	Status:      models.AlertOpen,
+	TriggeredAt: time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC),
+}
+
+// memoryStore keeps the delivery log of a dispatcher test.
+type memoryStore struct {
+	mutex      sync.Mutex
+	deliveries map[string]models.NotificationDelivery
+}
+
+func (s *memoryStore) SaveNotificationDelivery(delivery models.NotificationDelivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (s *memoryStore) GetUnfinishedNotificationDeliveries() ([]models.NotificationDelivery, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) GetAlert(id string) (models.Alert, error) {
+	return testAlert, nil
+}
+
+func (s *memoryStore) GetAlerts(filter database.AlertFilter) ([]models.Alert, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) list() []models.NotificationDelivery {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var deliveries []models.NotificationDelivery
+	for _, delivery := range s.deliveries {
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+// startHTTPSink serves the sink of the mock server and returns the URL of its /sink/http route.
+func startHTTPSink(t *testing.T) (string, *mockserver.Sink) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	sink := mockserver.NewSink()
+	server := httptest.NewServer(mockserver.NewRouter(mockserver.NewDatastore(), sink))
+	t.Cleanup(server.Close)
+	return server.URL + "/sink/http", sink
+}
+
+// sendTo sends the test alert through a new channel and returns the request the sink received.
+func sendTo(t *testing.T, sink *mockserver.Sink, cfg models.NotificationChannelConfig) mockserver.SinkRequest {
+	t.Helper()
+	channel, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := channel.Send(ctx, testAlert); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	requests := sink.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("sink received %d requests, want 1", len(requests))
+	}
+	return requests[0]
+}
+
+func header(req mockserver.SinkRequest, name string) string {
+	return http.Header(req.Headers).Get(name)
+}
+
+func TestWebhookSignsTheBody(t *testing.T) {
+	url, sink := startHTTPSink(t)
+	sent := time.Now()
+	req := sendTo(t, sink, models.NotificationChannelConfig{
+		Name:    "hook",
+		Type:    TypeWebhook,
+		URL:     url + "/hook",
+		Secret:  "s3cret",
+		Headers: map[string]string{"X-Team": "ops"},
+	})
+
+	if req.Method != http.MethodPost || req.Path != "/hook" {
+		t.Errorf("request = %s %s, want POST /hook", req.Method, req.Path)
+	}
+	if header(req, "X-Team") != "ops" || header(req, "Content-Type") != "application/json" {
+		t.Errorf("headers = %v, want the configured headers and JSON", req.Headers)
+	}
+
+	timestamp := header(req, TimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || unix < sent.Unix() || unix > time.Now().Unix() {
+		t.Errorf("%s = %q, want the Unix time of the send", TimestampHeader, timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + req.Body))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header(req, SignatureHeader) != want {
+		t.Errorf("%s = %q, want %q", SignatureHeader, header(req, SignatureHeader), want)
+	}
+	if Sign("other", timestamp, []byte(req.Body)) == header(req, SignatureHeader) {
+		t.Errorf("the signature does not depend on the secret")
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(req.Body), &payload); err != nil {
+		t.Fatalf("body is not a webhook payload: %v", err)
+	}
+	if payload.Event != "alert."+models.AlertOpen || payload.Alert.ID != testAlert.ID || payload.Alert.DeviceID != testAlert.DeviceID {
+		t.Errorf("payload = %+v, want the open alert", payload)
+	}
+}
+
+func TestWebhookWithoutSecretIsUnsigned(t *testing.T) {
+	url, sink := startHTTPSink(t)
+	req := sendTo(t, sink, models.NotificationChannelConfig{Name: "hook", Type: TypeWebhook, URL: url})
+	if header(req, SignatureHeader) != "" || header(req, TimestampHeader) != "" {
+		t.Errorf("unsigned webhook sent %s %q and %s %q", SignatureHeader, header(req, SignatureHeader), TimestampHeader, header(req, TimestampHeader))
+	}
+}
+
+func TestHTTPRendersTemplates(t *testing.T) {
+	t.Run("configured", func(t *testing.T) {
+		url, sink := startHTTPSink(t)
+		req := sendTo(t, sink, models.NotificationChannelConfig{
+			Name:         "chat",
+			Type:         TypeHTTP,
+			Method:       "put",
+			URL:          url + "/devices/{{.DeviceID}}",
+			BodyTemplate: `{"rule": {{json .RuleName}}, "status": "{{.Status}}", "message": {{json .Message}}}`,
+		})
+		if req.Method != http.MethodPut || req.Path != "/devices/"+testAlert.DeviceID {
+			t.Errorf("request = %s %s, want PUT to the rendered URL", req.Method, req.Path)
+		}
+		want := `{"rule": "Speeding", "status": "open", "message": "Speed 120 km/h above 100 km/h"}`
+		if req.Body != want {
+			t.Errorf("body = %s, want %s", req.Body, want)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		url, sink := startHTTPSink(t)
+		req := sendTo(t, sink, models.NotificationChannelConfig{Name: "chat", Type: TypeHTTP, URL: url})
+		if req.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", req.Method)
+		}
+		var body struct{ Text string }
+		if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+			t.Fatalf("default body is not JSON: %v", err)
+		}
+		want := "Speeding: Speed 120 km/h above 100 km/h (device 6jAOdk2wPiTjH-81f07-0k, open)"
+		if body.Text != want {
+			t.Errorf("text = %q, want %q", body.Text, want)
+		}
+	})
+}
+
+func TestHTTPRejectsBadTemplates(t *testing.T) {
+	_, err := New(models.NotificationChannelConfig{Name: "chat", Type: TypeHTTP, URL: "http://localhost", BodyTemplate: "{{.RuleName"})
+	if err == nil || !strings.Contains(err.Error(), "body_template") {
+		t.Errorf("New with a broken body_template: err = %v", err)
+	}
+}
+
+func TestDispatcherRetriesFailedDeliveries(t *testing.T) {
+	url, sink := startHTTPSink(t)
+	store := &memoryStore{deliveries: make(map[string]models.NotificationDelivery)}
+	dispatcher, err := NewDispatcher(store, events.NewHub(10, clock.System), []models.NotificationChannelConfig{{
+		Name:               "hook",
+		Type:               TypeWebhook,
+		URL:                url + "/hook?status=500",
+		MaxAttempts:        3,
+		RetryBackoffMillis: 100,
+	}})
+	if err != nil {
+		t.Fatalf("NewDispatcher: %v", err)
+	}
+	for _, w := range dispatcher.workers {
+		go w.run()
+	}
+	queued, err := dispatcher.Test("hook")
+	if err != nil {
+		t.Fatalf("Test: %v", err)
+	}
+
+	var delivery models.NotificationDelivery
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		deliveries := store.list()
+		if len(deliveries) == 1 && deliveries[0].Status == models.DeliveryFailed {
+			delivery = deliveries[0]
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery log = %+v, want a failed delivery", deliveries)
+		}
+	}
+
+	if delivery.ID != queued.ID || delivery.Attempts != 3 || !strings.Contains(delivery.LastError, "500") {
+		t.Errorf("delivery = %+v, want %s failed after 3 attempts with the status 500", delivery, queued.ID)
+	}
+	requests := sink.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("sink received %d requests, want MaxAttempts 3", len(requests))
+	}
+	// The backoff doubles: 100ms before the second attempt, 200ms before the third
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if gap := requests[i+1].Time.Sub(requests[i].Time); gap < want {
+			t.Errorf("attempt %d came %s after the one before, want at least %s", i+2, gap, want)
+		}
+	}
+	if status := dispatcher.Statuses()[0]; status.Failed != 1 || status.Delivered != 0 {
+		t.Errorf("channel status = %+v, want 1 failed", status)
+	}
+}
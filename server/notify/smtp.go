@@ -0,0 +1,123 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+const (
+	defaultSubject = `[{{.Status}}] {{.RuleName}} - {{.DeviceID}}`
+	defaultEmail   = `{{.Message}}
+
+Rule:      {{.RuleName}} ({{.Type}})
+Device:    {{.DeviceID}}
+Status:    {{.Status}}
+Triggered: {{.TriggeredAt.Format "2006-01-02 15:04:05 MST"}}{{if .Location}}
+Location:  {{.Location.Lat}}, {{.Location.Lng}}{{end}}
+`
+)
+
+// smtpChannel emails the alert. Authentication is only used when a username is set, so local
+// SMTP stand-ins without AUTH work.
+type smtpChannel struct {
+	name     string
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+	subject  *template.Template
+	body     *template.Template
+}
+
+func newSMTP(cfg models.NotificationChannelConfig) (Channel, error) {
+	if cfg.SMTPHost == "" {
+		return nil, fmt.Errorf("smtp_host is required")
+	}
+	if cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("from and to are required")
+	}
+	port := cfg.SMTPPort
+	if port == "" {
+		port = "25"
+	}
+	subject, err := parseTemplate("subject_template", cfg.SubjectTemplate, defaultSubject)
+	if err != nil {
+		return nil, err
+	}
+	body, err := parseTemplate("body_template", cfg.BodyTemplate, defaultEmail)
+	if err != nil {
+		return nil, err
+	}
+	return &smtpChannel{
+		name:     cfg.Name,
+		addr:     net.JoinHostPort(cfg.SMTPHost, port),
+		host:     cfg.SMTPHost,
+		username: cfg.SMTPUsername,
+		password: cfg.SMTPPassword,
+		from:     cfg.From,
+		to:       cfg.To,
+		subject:  subject,
+		body:     body,
+	}, nil
+}
+
+func (s *smtpChannel) Name() string { return s.name }
+func (s *smtpChannel) Type() string { return TypeSMTP }
+
+func (s *smtpChannel) Send(ctx context.Context, alert models.Alert) error {
+	subject, err := render(s.subject, alert)
+	if err != nil {
+		return err
+	}
+	body, err := render(s.body, alert)
+	if err != nil {
+		return err
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", headerValue(s.from))
+	fmt.Fprintf(&msg, "To: %s\r\n", headerValue(strings.Join(s.to, ", ")))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", headerValue(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+
+	// net/smtp has no context support, run it in the background and give up at the deadline
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, auth, s.from, s.to, []byte(msg.String()))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send email: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send email: %w", ctx.Err())
+	}
+}
+
+// headerLineBreaks replaces the line breaks in header values, which would start a new header.
+var headerLineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// headerValue makes s safe to use as a single line header value. Rule and device names end up
+// in the subject, a CR or LF in them must not inject headers.
+func headerValue(s string) string {
+	return headerLineBreaks.Replace(s)
+}
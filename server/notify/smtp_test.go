@@ -0,0 +1,108 @@
+package notify
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/mockserver"
+	"OneStepGPSLeo/models"
+)
+
+// startSMTPStandIn serves the mock SMTP server on a free local port and returns the port.
+func startSMTPStandIn(t *testing.T, sink *mockserver.Sink) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go mockserver.ServeSMTP(listener, sink)
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// sendTestAlert sends alert through an SMTP channel pointed at a fresh stand-in and returns the
+// email it received.
+func sendTestAlert(t *testing.T, alert models.Alert) mockserver.SinkEmail {
+	t.Helper()
+	sink := mockserver.NewSink()
+	channel, err := newSMTP(models.NotificationChannelConfig{
+		Name:     "email",
+		Type:     TypeSMTP,
+		SMTPHost: "127.0.0.1",
+		SMTPPort: startSMTPStandIn(t, sink),
+		From:     "alerts@example.com",
+		To:       []string{"ops@example.com", "oncall@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("newSMTP: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := channel.Send(ctx, alert); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	emails := sink.Emails()
+	if len(emails) != 1 {
+		t.Fatalf("stand-in received %d emails, want 1", len(emails))
+	}
+	return emails[0]
+}
+
+// headers returns the header lines of a raw message.
+func headers(data string) []string {
+	head, _, _ := strings.Cut(data, "\r\n\r\n")
+	return strings.Split(head, "\r\n")
+}
+
+func TestSMTPSendsToStandIn(t *testing.T) {
+	email := sendTestAlert(t, models.Alert{
+		RuleName:    "Speeding",
+		Type:        "speed",
+		DeviceID:    "6jAOdk2wPiTjH-81f07-0k",
+		Message:     "Speed 120 km/h above 100 km/h",
+		Status:      models.AlertOpen,
+		TriggeredAt: time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC),
+	})
+
+	if email.From != "alerts@example.com" {
+		t.Errorf("envelope from = %q", email.From)
+	}
+	if strings.Join(email.To, ",") != "ops@example.com,oncall@example.com" {
+		t.Errorf("envelope to = %v", email.To)
+	}
+	wantSubject := "Subject: [" + models.AlertOpen + "] Speeding - 6jAOdk2wPiTjH-81f07-0k"
+	found := false
+	for _, header := range headers(email.Data) {
+		found = found || header == wantSubject
+	}
+	if !found {
+		t.Errorf("missing %q in headers %q", wantSubject, headers(email.Data))
+	}
+	if !strings.Contains(email.Data, "Speed 120 km/h above 100 km/h") {
+		t.Errorf("body is missing the alert message: %q", email.Data)
+	}
+}
+
+func TestSMTPHeadersCannotBeInjected(t *testing.T) {
+	for _, name := range []string{
+		"Speeding\r\nBcc: victim@example.com",
+		"Speeding\rBcc: victim@example.com",
+		"Speeding\nBcc: victim@example.com",
+	} {
+		email := sendTestAlert(t, models.Alert{RuleName: name, DeviceID: "device", Status: models.AlertOpen})
+		for _, header := range headers(email.Data) {
+			if strings.HasPrefix(strings.ToLower(header), "bcc:") {
+				t.Errorf("rule name %q injected the header %q", name, header)
+			}
+			if strings.ContainsAny(header, "\r\n") {
+				t.Errorf("rule name %q left a line break in the header %q", name, header)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Package quality decides whether a GPS point is accurate enough to be used.
+
+Points are checked against the device settings MinNumSatellites, IgnoreUnsetMinNumSats
+and MaxHdop. Inaccurate points are still stored in the history, flagged with the
+reasons they were rejected, but are not passed on to trip detection or other processing.
+*/
+package quality
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"OneStepGPSLeo/models"
+)
+
+// Result is the outcome of evaluating a point. It is stored on the device as latest_point_quality.
+type Result = models.PointQuality
+
+// Evaluate checks an upstream device point against the device settings.
+func Evaluate(point *models.DevicePoint, settings models.DeviceSettings) Result {
+	result := Result{Accurate: true}
+	reject := func(format string, args ...interface{}) {
+		result.Accurate = false
+		result.RejectReasons = append(result.RejectReasons, fmt.Sprintf(format, args...))
+	}
+
+	// A point without coordinates decodes as 0,0
+	lat, lng := point.Lat, point.Lng
+	switch {
+	case lat < -90 || lat > 90 || lng < -180 || lng > 180:
+		reject("coordinates out of range (%v, %v)", lat, lng)
+	case lat == 0 && lng == 0:
+		reject("coordinates are 0,0")
+	}
+
+	detail := point.DevicePointDetail
+	if detail == nil {
+		detail = &models.DevicePointDetail{}
+	}
+
+	satellites, ok := firstNumber(detail.NumSatellites, point.Params["gpslev"])
+	if ok {
+		result.NumSatellites = &satellites
+	}
+	if settings.MinNumSatellites > 0 {
+		if !ok || satellites == 0 {
+			if !settings.IgnoreUnsetMinNumSats {
+				reject("num_satellites is not reported (min_num_satellites %d)", settings.MinNumSatellites)
+			}
+		} else if satellites < float64(settings.MinNumSatellites) {
+			reject("num_satellites %v is below min_num_satellites %d", satellites, settings.MinNumSatellites)
+		}
+	}
+
+	hdop, ok := firstNumber(detail.Hdop, point.Params["hdop"])
+	if ok {
+		result.Hdop = &hdop
+		if settings.MaxHdop > 0 && hdop > settings.MaxHdop {
+			reject("hdop %v is above max_hdop %v", hdop, settings.MaxHdop)
+		}
+	}
+
+	return result
+}
+
+// firstNumber returns the first value that can be read as a number.
+func firstNumber(values ...interface{}) (float64, bool) {
+	for _, value := range values {
+		if n, ok := number(value); ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// number reads JSON/BSON numbers and numeric strings (the upstream params are strings).
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case *float64:
+		if v == nil {
+			return 0, false
+		}
+		return *v, !math.IsNaN(*v)
+	case float64:
+		return v, !math.IsNaN(v)
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
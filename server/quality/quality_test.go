@@ -0,0 +1,99 @@
+package quality
+
+import (
+	"strings"
+	"testing"
+
+	"OneStepGPSLeo/models"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+// fix is a point in Los Angeles with the given detail and params.
+func fix(detail *models.DevicePointDetail, params map[string]interface{}) *models.DevicePoint {
+	return &models.DevicePoint{Lat: 34.05, Lng: -118.24, DevicePointDetail: detail, Params: params}
+}
+
+func TestEvaluate(t *testing.T) {
+	minSats := models.DeviceSettings{MinNumSatellites: 5}
+	ignoreUnset := models.DeviceSettings{MinNumSatellites: 5, IgnoreUnsetMinNumSats: true}
+	maxHdop := models.DeviceSettings{MaxHdop: 2.5}
+
+	tests := []struct {
+		name       string
+		point      *models.DevicePoint
+		settings   models.DeviceSettings
+		accurate   bool
+		reason     string // Part of the only reject reason
+		satellites *float64
+		hdop       *float64
+	}{
+		{"no limits", fix(nil, nil), models.DeviceSettings{}, true, "", nil, nil},
+		{"enough satellites", fix(&models.DevicePointDetail{NumSatellites: float(7)}, nil), minSats, true, "", float(7), nil},
+		{"exactly the minimum", fix(&models.DevicePointDetail{NumSatellites: float(5)}, nil), minSats, true, "", float(5), nil},
+		{"too few satellites", fix(&models.DevicePointDetail{NumSatellites: float(3)}, nil), minSats, false, "num_satellites 3 is below", float(3), nil},
+		{"satellites from params", fix(nil, map[string]interface{}{"gpslev": "4"}), minSats, false, "num_satellites 4 is below", float(4), nil},
+		{"detail before params", fix(&models.DevicePointDetail{NumSatellites: float(8)}, map[string]interface{}{"gpslev": "2"}), minSats, true, "", float(8), nil},
+		{"satellites unset", fix(nil, nil), minSats, false, "num_satellites is not reported", nil, nil},
+		{"satellites zero", fix(&models.DevicePointDetail{NumSatellites: float(0)}, nil), minSats, false, "num_satellites is not reported", float(0), nil},
+		{"satellites unset and ignored", fix(nil, nil), ignoreUnset, true, "", nil, nil},
+		{"satellites zero and ignored", fix(&models.DevicePointDetail{NumSatellites: float(0)}, nil), ignoreUnset, true, "", float(0), nil},
+		{"too few satellites while ignoring unset", fix(&models.DevicePointDetail{NumSatellites: float(3)}, nil), ignoreUnset, false, "below min_num_satellites 5", float(3), nil},
+		{"unreadable satellites", fix(nil, map[string]interface{}{"gpslev": "n/a"}), minSats, false, "not reported", nil, nil},
+		{"hdop within the limit", fix(&models.DevicePointDetail{Hdop: float(1.2)}, nil), maxHdop, true, "", nil, float(1.2)},
+		{"hdop at the limit", fix(&models.DevicePointDetail{Hdop: float(2.5)}, nil), maxHdop, true, "", nil, float(2.5)},
+		{"hdop above the limit", fix(&models.DevicePointDetail{Hdop: float(4)}, nil), maxHdop, false, "hdop 4 is above max_hdop 2.5", nil, float(4)},
+		{"hdop from params", fix(nil, map[string]interface{}{"hdop": 3.1}), maxHdop, false, "hdop 3.1 is above", nil, float(3.1)},
+		{"hdop unknown", fix(nil, nil), maxHdop, true, "", nil, nil},
+		{"hdop without a limit", fix(&models.DevicePointDetail{Hdop: float(9)}, nil), models.DeviceSettings{}, true, "", nil, float(9)},
+		{"0,0 fix", &models.DevicePoint{}, models.DeviceSettings{}, false, "coordinates are 0,0", nil, nil},
+		{"on the equator", &models.DevicePoint{Lat: 0, Lng: 32.5}, models.DeviceSettings{}, true, "", nil, nil},
+		{"latitude out of range", &models.DevicePoint{Lat: 91, Lng: 10}, models.DeviceSettings{}, false, "coordinates out of range", nil, nil},
+		{"longitude out of range", &models.DevicePoint{Lat: 10, Lng: -181}, models.DeviceSettings{}, false, "coordinates out of range", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := Evaluate(test.point, test.settings)
+			if result.Accurate != test.accurate {
+				t.Errorf("accurate = %v (%v), want %v", result.Accurate, result.RejectReasons, test.accurate)
+			}
+			if test.reason == "" && len(result.RejectReasons) != 0 {
+				t.Errorf("reject reasons %v, want none", result.RejectReasons)
+			}
+			if test.reason != "" && (len(result.RejectReasons) != 1 || !strings.Contains(result.RejectReasons[0], test.reason)) {
+				t.Errorf("reject reasons %v, want one with %q", result.RejectReasons, test.reason)
+			}
+			if !sameNumber(result.NumSatellites, test.satellites) {
+				t.Errorf("num_satellites = %v, want %v", deref(result.NumSatellites), deref(test.satellites))
+			}
+			if !sameNumber(result.Hdop, test.hdop) {
+				t.Errorf("hdop = %v, want %v", deref(result.Hdop), deref(test.hdop))
+			}
+		})
+	}
+}
+
+func TestEvaluateCollectsEveryReason(t *testing.T) {
+	point := &models.DevicePoint{DevicePointDetail: &models.DevicePointDetail{NumSatellites: float(2), Hdop: float(6)}}
+	result := Evaluate(point, models.DeviceSettings{MinNumSatellites: 4, MaxHdop: 2})
+	if result.Accurate || len(result.RejectReasons) != 3 {
+		t.Errorf("result = %+v, want rejected for 0,0, satellites and hdop", result)
+	}
+}
+
+func sameNumber(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func deref(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
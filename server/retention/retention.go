@@ -0,0 +1,160 @@
+/*
+Package retention prunes stored device points according to each device's settings.
+
+A device keeps HistoryRetentionDays of history, and points recorded before its
+InitialDevicePointDeleteCutoffTime are never kept. The worker runs periodically;
+Plan computes the same result without deleting anything so it can be reviewed first.
+*/
+package retention
+
+import (
+	"log"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+)
+
+// DevicePlan describes what retention will remove for one device.
+type DevicePlan struct {
+	DeviceID         string `json:"device_id"`
+	RetentionDays    int    `json:"history_retention_days"`
+	DeleteCutoffTime string `json:"initial_device_point_delete_cutoff_time,omitempty"`
+	Cutoff           string `json:"cutoff"` // Points with dt_tracker before this are purged
+	PointsToDelete   int64  `json:"points_to_delete"`
+	Deleted          int64  `json:"deleted"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Report is the result of a retention pass.
+type Report struct {
+	DryRun       bool         `json:"dry_run"`
+	GeneratedAt  string       `json:"generated_at"`
+	Devices      []DevicePlan `json:"devices"`
+	TotalPoints  int64        `json:"total_points"`
+	TotalDeleted int64        `json:"total_deleted"`
+}
+
+// Store is the storage the worker reads the settings from and purges the history in.
+type Store interface {
+	GetHistoryDeviceIDs() ([]string, error)
+	GetAllDeviceSettings() (map[string]models.DeviceSettings, error)
+	CountDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error)
+	DeleteDevicePointsBefore(deviceID string, cutoff time.Time) (int64, error)
+}
+
+// Worker periodically applies the retention settings to the device history.
+type Worker struct {
+	DB       Store
+	Interval time.Duration
+	Clock    clock.Clock // Time the retention cutoffs are relative to
+}
+
+// NewWorker creates a retention worker running every interval, reading the time from clk.
+func NewWorker(db Store, interval time.Duration, clk clock.Clock) *Worker {
+	return &Worker{DB: db, Interval: interval, Clock: clk}
+}
+
+// Run purges expired points forever, it is meant to be started in its own goroutine.
+func (w *Worker) Run() {
+	for {
+		report, err := w.Purge()
+		if err != nil {
+			log.Printf("Retention pass failed: %v", err)
+		} else if report.TotalDeleted > 0 {
+			log.Printf("Retention pass deleted %d device points", report.TotalDeleted)
+		}
+		time.Sleep(w.Interval)
+	}
+}
+
+// Plan reports what the next retention pass would delete without deleting anything.
+func (w *Worker) Plan() (Report, error) {
+	return w.run(true)
+}
+
+// Purge deletes the expired points of every device and reports what was deleted.
+func (w *Worker) Purge() (Report, error) {
+	return w.run(false)
+}
+
+func (w *Worker) run(dryRun bool) (Report, error) {
+	now := w.Clock.Now()
+	report := Report{DryRun: dryRun, GeneratedAt: now.Format(time.RFC3339), Devices: []DevicePlan{}}
+
+	deviceIDs, err := w.DB.GetHistoryDeviceIDs()
+	if err != nil {
+		return report, err
+	}
+	settingsMap, err := w.DB.GetAllDeviceSettings()
+	if err != nil {
+		return report, err
+	}
+
+	for _, deviceID := range deviceIDs {
+		settings, ok := settingsMap[deviceID]
+		if !ok {
+			continue // Without settings there is no retention policy to apply
+		}
+
+		cutoff, ok := Cutoff(settings, now)
+		if !ok {
+			continue
+		}
+
+		plan := DevicePlan{
+			DeviceID:         deviceID,
+			RetentionDays:    settings.HistoryRetentionDays,
+			DeleteCutoffTime: settings.InitialDevicePointDeleteCutoffTime,
+			Cutoff:           cutoff.Format(time.RFC3339),
+		}
+
+		plan.PointsToDelete, err = w.DB.CountDevicePointsBefore(deviceID, cutoff)
+		if err != nil {
+			plan.Error = err.Error()
+			report.Devices = append(report.Devices, plan)
+			continue
+		}
+		if plan.PointsToDelete == 0 {
+			continue
+		}
+
+		if !dryRun {
+			plan.Deleted, err = w.DB.DeleteDevicePointsBefore(deviceID, cutoff)
+			if err != nil {
+				plan.Error = err.Error()
+				log.Printf("Retention failed for device %s: %v", deviceID, err)
+			} else {
+				log.Printf("Retention deleted %d points before %s for device %s (retention %d days)",
+					plan.Deleted, plan.Cutoff, deviceID, settings.HistoryRetentionDays)
+			}
+		}
+
+		report.TotalPoints += plan.PointsToDelete
+		report.TotalDeleted += plan.Deleted
+		report.Devices = append(report.Devices, plan)
+	}
+
+	return report, nil
+}
+
+// Cutoff returns the time before which the points of a device are purged: the later of
+// now - HistoryRetentionDays and InitialDevicePointDeleteCutoffTime. It returns false when
+// neither setting applies.
+func Cutoff(settings models.DeviceSettings, now time.Time) (time.Time, bool) {
+	var cutoff time.Time
+	if settings.HistoryRetentionDays > 0 {
+		cutoff = now.AddDate(0, 0, -settings.HistoryRetentionDays)
+	}
+
+	if settings.InitialDevicePointDeleteCutoffTime != "" {
+		initialCutoff, err := time.Parse(time.RFC3339Nano, settings.InitialDevicePointDeleteCutoffTime)
+		if err != nil {
+			log.Printf("Ignoring invalid initial_device_point_delete_cutoff_time for device %s: %v", settings.DeviceID, err)
+		} else if initialCutoff.After(cutoff) {
+			cutoff = initialCutoff
+		}
+	}
+
+	return cutoff, !cutoff.IsZero()
+}
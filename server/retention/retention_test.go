@@ -0,0 +1,155 @@
+package retention
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/database"
+	"OneStepGPSLeo/models"
+)
+
+var start = time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+
+func TestCutoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings models.DeviceSettings
+		want     time.Time // Zero when nothing is purged
+	}{
+		{
+			name:     "retention days",
+			settings: models.DeviceSettings{HistoryRetentionDays: 30},
+			want:     start.AddDate(0, 0, -30),
+		},
+		{
+			name:     "no retention",
+			settings: models.DeviceSettings{},
+		},
+		{
+			name:     "delete cutoff without retention days",
+			settings: models.DeviceSettings{InitialDevicePointDeleteCutoffTime: "2024-11-01T00:00:00Z"},
+			want:     time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "delete cutoff before the retention",
+			settings: models.DeviceSettings{HistoryRetentionDays: 7, InitialDevicePointDeleteCutoffTime: "2024-11-01T00:00:00Z"},
+			want:     start.AddDate(0, 0, -7),
+		},
+		{
+			name:     "delete cutoff after the retention",
+			settings: models.DeviceSettings{HistoryRetentionDays: 30, InitialDevicePointDeleteCutoffTime: "2024-11-01T00:00:00Z"},
+			want:     time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "invalid delete cutoff",
+			settings: models.DeviceSettings{HistoryRetentionDays: 7, InitialDevicePointDeleteCutoffTime: "yesterday"},
+			want:     start.AddDate(0, 0, -7),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cutoff, ok := Cutoff(test.settings, start)
+			if ok != !test.want.IsZero() || !cutoff.Equal(test.want) {
+				t.Errorf("Cutoff = %s, %v, want %s", cutoff, ok, test.want)
+			}
+		})
+	}
+}
+
+// newTestStore records a point every day of the last 10 days for each device and saves the
+// settings of the devices that have some.
+func newTestStore(t *testing.T, settings map[string]models.DeviceSettings, deviceIDs ...string) *database.Memory {
+	t.Helper()
+	db := database.NewMemory()
+	for _, deviceID := range deviceIDs {
+		for day := 1; day <= 10; day++ {
+			record := models.DevicePointRecord{
+				DeviceID:      deviceID,
+				DevicePointID: fmt.Sprintf("point-%d", day),
+				DtTracker:     start.AddDate(0, 0, -day),
+			}
+			if _, err := db.AppendDevicePoint(record); err != nil {
+				t.Fatalf("AppendDevicePoint: %v", err)
+			}
+		}
+	}
+	for deviceID, deviceSettings := range settings {
+		deviceSettings.DeviceID = deviceID
+		if _, err := db.SaveDeviceSettings(deviceSettings); err != nil {
+			t.Fatalf("SaveDeviceSettings: %v", err)
+		}
+	}
+	return db
+}
+
+// remaining counts the stored points of a device.
+func remaining(t *testing.T, db *database.Memory, deviceID string) int {
+	t.Helper()
+	points, err := db.GetDeviceHistory(deviceID, start.AddDate(0, 0, -30), start, 0, nil)
+	if err != nil {
+		t.Fatalf("GetDeviceHistory: %v", err)
+	}
+	return len(points)
+}
+
+func TestRetentionPass(t *testing.T) {
+	settings := map[string]models.DeviceSettings{
+		"week":       {HistoryRetentionDays: 7},
+		"cutoff":     {HistoryRetentionDays: 7, InitialDevicePointDeleteCutoffTime: start.AddDate(0, 0, -3).Format(time.RFC3339)},
+		"no-history": {HistoryRetentionDays: 0},
+	}
+	// Points that are kept: 7 and 3 days of history, everything without a retention policy
+	want := map[string]int{"week": 7, "cutoff": 3, "no-history": 10, "no-settings": 10}
+
+	tests := []struct {
+		name   string
+		dryRun bool
+	}{
+		{name: "dry run", dryRun: true},
+		{name: "purge"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestStore(t, settings, "week", "cutoff", "no-history", "no-settings")
+			worker := NewWorker(db, time.Hour, clock.NewVirtual(start))
+
+			var report Report
+			var err error
+			if test.dryRun {
+				report, err = worker.Plan()
+			} else {
+				report, err = worker.Purge()
+			}
+			if err != nil {
+				t.Fatalf("retention pass: %v", err)
+			}
+
+			if report.DryRun != test.dryRun || report.GeneratedAt != start.Format(time.RFC3339) {
+				t.Errorf("report is dry run %v at %s, want %v at %s", report.DryRun, report.GeneratedAt, test.dryRun, start.Format(time.RFC3339))
+			}
+			if len(report.Devices) != 2 || report.TotalPoints != 3+7 {
+				t.Errorf("report plans %d points for %+v, want 3 and 7 points of 2 devices", report.TotalPoints, report.Devices)
+			}
+			wantDeleted := int64(0)
+			if !test.dryRun {
+				wantDeleted = report.TotalPoints
+			}
+			if report.TotalDeleted != wantDeleted {
+				t.Errorf("report deleted %d points, want %d", report.TotalDeleted, wantDeleted)
+			}
+
+			for deviceID, kept := range want {
+				if test.dryRun {
+					kept = 10 // A dry run deletes nothing
+				}
+				if got := remaining(t, db, deviceID); got != kept {
+					t.Errorf("device %s has %d points left, want %d", deviceID, got, kept)
+				}
+			}
+		})
+	}
+}
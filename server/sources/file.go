@@ -0,0 +1,42 @@
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+)
+
+// FileSource reads devices from a local JSON file in the API response format (e.g. result.json).
+type FileSource struct {
+	Health
+	File string
+}
+
+// NewFileSource creates a FileSource. The file is read on every fetch so edits are picked up.
+func NewFileSource(cfg models.SourceConfig, clk clock.Clock) (DeviceSource, error) {
+	if cfg.File == "" {
+		return nil, fmt.Errorf("file source %q has no file configured", cfg.Name)
+	}
+	return &FileSource{Health: newHealth(cfg.Name, TypeFile, clk), File: cfg.File}, nil
+}
+
+// FetchDevices reads the devices from the file.
+func (s *FileSource) FetchDevices(ctx context.Context) ([]models.Device, error) {
+	return s.Track(s.readDevices())
+}
+
+func (s *FileSource) readDevices() ([]models.Device, error) {
+	data, err := os.ReadFile(s.File)
+	if err != nil {
+		return nil, err
+	}
+	var response deviceListResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", s.File, err)
+	}
+	return DecodeDevices(s.Name(), response.ResultList), nil
+}
@@ -0,0 +1,201 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+)
+
+const maxRetryDelay = 30 * time.Second
+
+// OneStepGPSSource polls the OneStepGPS HTTP API (or anything serving the same shape,
+// such as the mock server), applying request timeouts, retries with exponential backoff
+// and the latest_point=true query parameter.
+type OneStepGPSSource struct {
+	Health
+	requestURL string
+	client     *http.Client
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+// NewOneStepGPSSource creates a OneStepGPSSource from the URL and API key in the config.
+func NewOneStepGPSSource(cfg models.SourceConfig, clk clock.Clock) (DeviceSource, error) {
+	requestURL, err := buildDeviceURL(cfg.URL, cfg.APIKey)
+	if err != nil {
+		return nil, fmt.Errorf("source %q: %w", cfg.Name, err)
+	}
+
+	maxRetries := 0
+	if cfg.MaxRetries != nil {
+		maxRetries = *cfg.MaxRetries
+	}
+	return &OneStepGPSSource{
+		Health:     newHealth(cfg.Name, TypeOneStepGPS, clk),
+		requestURL: requestURL,
+		client:     &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+		maxRetries: maxRetries,
+		baseDelay:  time.Duration(cfg.RetryBackoffMillis) * time.Millisecond,
+	}, nil
+}
+
+// deviceListResponse mirrors the envelope returned by the upstream device API. The devices
+// are decoded one by one by DecodeDevices.
+type deviceListResponse struct {
+	ResultList []json.RawMessage `json:"result_list"`
+}
+
+// retryableError marks errors that are worth retrying (network failures, 5xx, 429).
+// RetryAfter is set when the server told us how long to wait.
+type retryableError struct {
+	err        error
+	RetryAfter time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// FetchDevices calls the upstream API, retrying transient failures with exponential backoff.
+func (s *OneStepGPSSource) FetchDevices(ctx context.Context) ([]models.Device, error) {
+	return s.Track(s.fetchWithRetry(ctx))
+}
+
+func (s *OneStepGPSSource) fetchWithRetry(ctx context.Context) ([]models.Device, error) {
+	var lastErr error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := backoffDelay(s.baseDelay, attempt)
+			var retryErr *retryableError
+			if errors.As(lastErr, &retryErr) && retryErr.RetryAfter > delay {
+				delay = retryErr.RetryAfter
+			}
+			// Waiting past the deadline would only end in a context error
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				return nil, fmt.Errorf("device API request failed, the next attempt in %s is past the poll deadline: %w", delay, lastErr)
+			}
+			log.Printf("Retrying %s request in %s (attempt %d/%d): %v", s.Name(), delay, attempt, s.maxRetries, lastErr)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		devices, err := doDeviceRequest(ctx, s.Name(), s.client, s.requestURL)
+		if err == nil {
+			return devices, nil
+		}
+		lastErr = err
+
+		var retryErr *retryableError
+		if !errors.As(err, &retryErr) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("device API request failed after %d attempts: %w", s.maxRetries+1, lastErr)
+}
+
+// doDeviceRequest performs a single GET against the device API and decodes the result list.
+func doDeviceRequest(ctx context.Context, sourceName string, client *http.Client, requestURL string) ([]models.Device, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &retryableError{err: fmt.Errorf("error fetching from API: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &retryableError{err: fmt.Errorf("error reading response body: %w", err)}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		return nil, &retryableError{
+			err:        fmt.Errorf("device API returned status %d", resp.StatusCode),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device API returned status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var response deviceListResponse
+	body = bytes.TrimSpace(body)
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, &retryableError{err: fmt.Errorf("error parsing JSON: %w", err)}
+	}
+
+	devices := DecodeDevices(sourceName, response.ResultList)
+	for _, device := range devices {
+		if device.LatestDevicePoint == nil {
+			log.Printf("Device %s returned without latest_device_point, is latest_point=true honored?", device.DeviceID)
+		}
+	}
+
+	return devices, nil
+}
+
+// buildDeviceURL adds the api-key and latest_point=true query parameters to the configured API URL.
+// The README style URL ending with "api-key=" is supported, the key simply replaces the empty value.
+func buildDeviceURL(apiURL, apiKey string) (string, error) {
+	if apiURL == "" {
+		return "", fmt.Errorf("api_url is not configured")
+	}
+
+	parsed, err := url.Parse(apiURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid api_url %q: %w", apiURL, err)
+	}
+
+	query := parsed.Query()
+	query.Set("latest_point", "true")
+	if apiKey != "" {
+		query.Set("api-key", apiKey)
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
+
+// backoffDelay returns base * 2^(attempt-1), capped at maxRetryDelay.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return delay
+}
+
+// parseRetryAfter understands both forms of the Retry-After header (seconds or HTTP date).
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
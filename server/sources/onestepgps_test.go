@@ -0,0 +1,198 @@
+package sources
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+)
+
+var started = time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+
+const deviceList = `{"result_list": [{"device_id": "truck-1", "latest_device_point": {"lat": 34.0, "lng": -118.0}}, {"device_id": 7}, {"device_id": "truck-2"}]}`
+
+// upstream answers the device API with the given responses in turn, repeating the last one.
+type upstream struct {
+	mutex     sync.Mutex
+	responses []func(w http.ResponseWriter)
+	requests  []*http.Request
+	times     []time.Time
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	respond := u.responses[min(len(u.requests), len(u.responses)-1)]
+	u.requests = append(u.requests, r)
+	u.times = append(u.times, time.Now())
+	respond(w)
+}
+
+func (u *upstream) count() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return len(u.requests)
+}
+
+func status(code int, retryAfter string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(code)
+	}
+}
+
+func devices(w http.ResponseWriter) {
+	w.Write([]byte(deviceList))
+}
+
+// newOneStepGPS starts the upstream and creates a source for it retrying up to maxRetries times.
+func newOneStepGPS(t *testing.T, u *upstream, maxRetries int) (*OneStepGPSSource, *clock.Virtual) {
+	t.Helper()
+	server := httptest.NewServer(u)
+	t.Cleanup(server.Close)
+	clk := clock.NewVirtual(started)
+	source, err := NewOneStepGPSSource(models.SourceConfig{
+		Name:               "upstream",
+		URL:                server.URL + "/api/v1/devices?api-key=",
+		APIKey:             "key",
+		TimeoutSeconds:     5,
+		MaxRetries:         &maxRetries,
+		RetryBackoffMillis: 10,
+	}, clk)
+	if err != nil {
+		t.Fatalf("NewOneStepGPSSource: %v", err)
+	}
+	return source.(*OneStepGPSSource), clk
+}
+
+func TestOneStepGPSRetriesTransientFailures(t *testing.T) {
+	u := &upstream{responses: []func(w http.ResponseWriter){status(500, ""), status(429, "1"), devices}}
+	source, _ := newOneStepGPS(t, u, 3)
+
+	fetched, err := source.FetchDevices(context.Background())
+	if err != nil {
+		t.Fatalf("FetchDevices: %v", err)
+	}
+	if len(fetched) != 2 || fetched[0].DeviceID != "truck-1" || fetched[1].DeviceID != "truck-2" {
+		t.Errorf("fetched %+v, want truck-1 and truck-2 without the malformed device", fetched)
+	}
+	if len(u.requests) != 3 {
+		t.Fatalf("upstream received %d requests, want 3", len(u.requests))
+	}
+	query := u.requests[0].URL.Query()
+	if query.Get("latest_point") != "true" || query.Get("api-key") != "key" {
+		t.Errorf("query = %s, want latest_point=true and the API key", u.requests[0].URL.RawQuery)
+	}
+	if gap := u.times[2].Sub(u.times[1]); gap < time.Second {
+		t.Errorf("retried %s after the 429, want the Retry-After of 1s", gap)
+	}
+	if status := source.Status(); !status.Healthy || status.ErrorCount != 0 || status.DeviceCount != 2 {
+		t.Errorf("status = %+v, want healthy with 2 devices, retries are not errors", status)
+	}
+}
+
+func TestOneStepGPSGivesUp(t *testing.T) {
+	t.Run("after the retries", func(t *testing.T) {
+		u := &upstream{responses: []func(w http.ResponseWriter){status(500, "")}}
+		source, _ := newOneStepGPS(t, u, 2)
+		_, err := source.FetchDevices(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "after 3 attempts") || u.count() != 3 {
+			t.Errorf("err = %v after %d requests, want a failure after 3 attempts", err, u.count())
+		}
+	})
+
+	t.Run("on client errors", func(t *testing.T) {
+		u := &upstream{responses: []func(w http.ResponseWriter){status(404, "")}}
+		source, _ := newOneStepGPS(t, u, 2)
+		_, err := source.FetchDevices(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "404") || u.count() != 1 {
+			t.Errorf("err = %v after %d requests, want the 404 without retries", err, u.count())
+		}
+	})
+
+	t.Run("when Retry-After is past the deadline", func(t *testing.T) {
+		u := &upstream{responses: []func(w http.ResponseWriter){status(429, "60")}}
+		source, _ := newOneStepGPS(t, u, 2)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		begin := time.Now()
+		_, err := source.FetchDevices(ctx)
+		if err == nil || !strings.Contains(err.Error(), "past the poll deadline") || time.Since(begin) > time.Second {
+			t.Errorf("err = %v after %s, want an immediate failure", err, time.Since(begin))
+		}
+	})
+}
+
+func TestOneStepGPSHealth(t *testing.T) {
+	u := &upstream{responses: []func(w http.ResponseWriter){devices, status(503, ""), status(503, ""), devices}}
+	source, clk := newOneStepGPS(t, u, 0)
+
+	if _, err := source.FetchDevices(context.Background()); err != nil {
+		t.Fatalf("FetchDevices: %v", err)
+	}
+	succeeded := clk.Now().Format(time.RFC3339)
+	for i := 0; i < 2; i++ {
+		clk.Advance(time.Minute)
+		if _, err := source.FetchDevices(context.Background()); err == nil {
+			t.Fatalf("fetch %d succeeded, want the 503", i+2)
+		}
+	}
+	status := source.Status()
+	if status.Healthy || status.ErrorCount != 2 || status.ConsecutiveErrors != 2 || status.LastSuccess != succeeded ||
+		status.LastErrorAt != clk.Now().Format(time.RFC3339) || !strings.Contains(status.LastError, "503") {
+		t.Errorf("status after two failures = %+v, want unhealthy since %s", status, succeeded)
+	}
+
+	clk.Advance(time.Minute)
+	if _, err := source.FetchDevices(context.Background()); err != nil {
+		t.Fatalf("FetchDevices: %v", err)
+	}
+	status = source.Status()
+	if !status.Healthy || status.ErrorCount != 2 || status.ConsecutiveErrors != 0 || status.LastSuccess != clk.Now().Format(time.RFC3339) {
+		t.Errorf("status after recovering = %+v, want healthy keeping the error count", status)
+	}
+	if status.Name != "upstream" || status.Type != TypeOneStepGPS {
+		t.Errorf("status names %s of type %s, want upstream of type %s", status.Name, status.Type, TypeOneStepGPS)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{6, maxRetryDelay},
+		{50, maxRetryDelay},
+	}
+	for _, test := range tests {
+		if got := backoffDelay(time.Second, test.attempt); got != test.want {
+			t.Errorf("backoffDelay(1s, %d) = %s, want %s", test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("parseRetryAfter(120) = %s, want 2m", got)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%s) = %s, want about an hour", date, got)
+	}
+	for _, value := range []string{"", "0", "-5", "soon"} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %s, want 0", value, got)
+		}
+	}
+}
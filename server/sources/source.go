@@ -0,0 +1,206 @@
+/*
+Package sources defines the DeviceSource interface used to ingest device data.
+
+A source returns devices in the upstream "result_list" shape. The upsert logic in
+the api package does not care where the devices come from, so other vendors' feeds
+can be added by implementing DeviceSource and registering a Factory for its type.
+*/
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+)
+
+const (
+	// TypeOneStepGPS polls the OneStepGPS HTTP API.
+	TypeOneStepGPS = "onestepgps"
+	// TypeFile reads a local JSON file in the API response format.
+	TypeFile = "file"
+	// TypeMock reads the in-process mock server datastore.
+	TypeMock = "mock"
+)
+
+// DeviceSource is a feed of devices that can be polled by the ingestion loop.
+type DeviceSource interface {
+	Name() string
+	Type() string
+	FetchDevices(ctx context.Context) ([]models.Device, error)
+	Status() Status
+}
+
+// Factory creates a DeviceSource from its configuration. clk dates the fetch results in Status.
+type Factory func(cfg models.SourceConfig, clk clock.Clock) (DeviceSource, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Factory{
+		TypeOneStepGPS: NewOneStepGPSSource,
+		TypeFile:       NewFileSource,
+	}
+)
+
+// Register makes a source type available to the config. Registering an existing type replaces it.
+func Register(sourceType string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[sourceType] = factory
+}
+
+// New creates a source from its configuration using the registered factory for its type.
+func New(cfg models.SourceConfig, clk clock.Clock) (DeviceSource, error) {
+	registryMutex.RLock()
+	factory, ok := registry[cfg.Type]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown source type %q for source %q", cfg.Type, cfg.Name)
+	}
+	return factory(cfg, clk)
+}
+
+// FromConfig builds the sources selected by name in config.DataSources.
+func FromConfig(config models.Config, clk clock.Clock) ([]DeviceSource, error) {
+	definitions := make(map[string]models.SourceConfig, len(config.Sources))
+	for _, def := range config.Sources {
+		definitions[def.Name] = def
+	}
+
+	var result []DeviceSource
+	for _, name := range config.DataSources {
+		def, ok := definitions[name]
+		if !ok {
+			if def, ok = builtinDefinition(config, name); !ok {
+				return nil, fmt.Errorf("data source %q is not defined in sources", name)
+			}
+		}
+		source, err := New(withDefaults(def, config), clk)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, source)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no data sources selected")
+	}
+	return result, nil
+}
+
+// builtinDefinition resolves the source names that work without a "sources" entry,
+// using the top level api_url, api_key and data_file settings.
+func builtinDefinition(config models.Config, name string) (models.SourceConfig, bool) {
+	switch name {
+	case "api", TypeOneStepGPS:
+		return models.SourceConfig{Name: name, Type: TypeOneStepGPS, URL: config.APIURL, APIKey: config.APIKey}, true
+	case TypeFile:
+		return models.SourceConfig{Name: name, Type: TypeFile, File: config.DataFile}, true
+	case TypeMock:
+		return models.SourceConfig{Name: name, Type: TypeMock}, true
+	}
+	return models.SourceConfig{}, false
+}
+
+// DecodeDevices decodes the entries of a result_list. A device that does not match the typed
+// model is logged and skipped, so one malformed device does not fail the whole fetch.
+func DecodeDevices(sourceName string, resultList []json.RawMessage) []models.Device {
+	devices := make([]models.Device, 0, len(resultList))
+	for i, raw := range resultList {
+		var device models.Device
+		if err := json.Unmarshal(raw, &device); err != nil {
+			log.Printf("Skipping device %d from source %s: %v", i, sourceName, err)
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// withDefaults fills unset request settings from the top level api_* settings.
+func withDefaults(def models.SourceConfig, config models.Config) models.SourceConfig {
+	if def.TimeoutSeconds == 0 {
+		def.TimeoutSeconds = config.APITimeoutSeconds
+	}
+	if def.MaxRetries == nil {
+		def.MaxRetries = config.APIMaxRetries
+	}
+	if def.RetryBackoffMillis == 0 {
+		def.RetryBackoffMillis = config.APIRetryBackoffMillis
+	}
+	return def
+}
+
+// Status describes the health of a single source.
+type Status struct {
+	Name              string `json:"name"`
+	Type              string `json:"type"`
+	Healthy           bool   `json:"healthy"`
+	LastSuccess       string `json:"last_success,omitempty"`
+	LastError         string `json:"last_error,omitempty"`
+	LastErrorAt       string `json:"last_error_at,omitempty"`
+	ErrorCount        int    `json:"error_count"`
+	ConsecutiveErrors int    `json:"consecutive_errors"`
+	DeviceCount       int    `json:"device_count"`
+}
+
+// Health keeps track of a source's fetch results. Embed it in a DeviceSource to get Status for free.
+type Health struct {
+	mutex  sync.Mutex
+	clock  clock.Clock
+	status Status
+}
+
+func newHealth(name, sourceType string, clk clock.Clock) Health {
+	return Health{clock: clk, status: Status{Name: name, Type: sourceType}}
+}
+
+// NewHealth creates the health tracker for a source implemented outside of this package.
+func NewHealth(name, sourceType string, clk clock.Clock) *Health {
+	h := newHealth(name, sourceType, clk)
+	return &h
+}
+
+// Track records the outcome of a fetch and passes the result through.
+func (h *Health) Track(devices []models.Device, err error) ([]models.Device, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := h.clock.Now().Format(time.RFC3339)
+	if err != nil {
+		h.status.ErrorCount++
+		h.status.ConsecutiveErrors++
+		h.status.LastError = err.Error()
+		h.status.LastErrorAt = now
+		h.status.Healthy = false
+		return nil, err
+	}
+
+	h.status.ConsecutiveErrors = 0
+	h.status.LastSuccess = now
+	h.status.DeviceCount = len(devices)
+	h.status.Healthy = true
+	return devices, nil
+}
+
+// Status returns a snapshot of the source health.
+func (h *Health) Status() Status {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.status
+}
+
+// Name returns the configured source name.
+func (h *Health) Name() string {
+	return h.status.Name
+}
+
+// Type returns the source type.
+func (h *Health) Type() string {
+	return h.status.Type
+}
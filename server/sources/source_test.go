@@ -0,0 +1,114 @@
+package sources
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/clock"
+	"OneStepGPSLeo/models"
+)
+
+func TestFromConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "devices.json")
+	config := models.Config{
+		APIURL:   "http://localhost:3001/api/v1/devices",
+		DataFile: file,
+		Sources: []models.SourceConfig{
+			{Name: "east", Type: TypeOneStepGPS, URL: "http://east.example.com/devices"},
+			{Name: "west", Type: TypeOneStepGPS, URL: "http://west.example.com/devices", TimeoutSeconds: 3},
+			{Name: "unused", Type: "carrier-pigeon"},
+		},
+		DataSources:       []string{"east", "file", "west", "api"},
+		APITimeoutSeconds: 10,
+	}
+
+	selected, err := FromConfig(config, clock.System)
+	if err != nil {
+		t.Fatalf("FromConfig: %v", err)
+	}
+	want := []struct{ name, sourceType string }{{"east", TypeOneStepGPS}, {"file", TypeFile}, {"west", TypeOneStepGPS}, {"api", TypeOneStepGPS}}
+	if len(selected) != len(want) {
+		t.Fatalf("selected %d sources, want %d", len(selected), len(want))
+	}
+	for i, source := range selected {
+		if source.Name() != want[i].name || source.Type() != want[i].sourceType {
+			t.Errorf("source %d is %s of type %s, want %s of type %s", i, source.Name(), source.Type(), want[i].name, want[i].sourceType)
+		}
+	}
+	if timeout := selected[0].(*OneStepGPSSource).client.Timeout; timeout != 10*time.Second {
+		t.Errorf("east times out after %s, want api_timeout_seconds", timeout)
+	}
+	if timeout := selected[2].(*OneStepGPSSource).client.Timeout; timeout != 3*time.Second {
+		t.Errorf("west times out after %s, want its own 3s", timeout)
+	}
+	if file := selected[1].(*FileSource).File; file != config.DataFile {
+		t.Errorf("file source reads %s, want data_file", file)
+	}
+
+	tests := []struct {
+		name        string
+		dataSources []string
+		err         string
+	}{
+		{"undefined name", []string{"east", "north"}, `"north" is not defined`},
+		{"unknown type", []string{"unused"}, `unknown source type "carrier-pigeon"`},
+		{"nothing selected", nil, "no data sources selected"},
+	}
+	for _, test := range tests {
+		config.DataSources = test.dataSources
+		if _, err := FromConfig(config, clock.System); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: err = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "devices.json")
+	if err := os.WriteFile(file, []byte(deviceList), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewVirtual(started)
+	source, err := NewFileSource(models.SourceConfig{Name: "local", File: file}, clk)
+	if err != nil {
+		t.Fatalf("NewFileSource: %v", err)
+	}
+
+	fetched, err := source.FetchDevices(context.Background())
+	if err != nil || len(fetched) != 2 {
+		t.Fatalf("fetched %d devices, %v, want the 2 well formed ones", len(fetched), err)
+	}
+
+	// The file is read on every fetch
+	if err := os.WriteFile(file, []byte(`{"result_list": [{"device_id": "truck-3"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Minute)
+	if fetched, err = source.FetchDevices(context.Background()); err != nil || len(fetched) != 1 || fetched[0].DeviceID != "truck-3" {
+		t.Errorf("fetched %+v, %v after editing the file, want truck-3", fetched, err)
+	}
+	if status := source.Status(); !status.Healthy || status.DeviceCount != 1 || status.LastSuccess != clk.Now().Format(time.RFC3339) {
+		t.Errorf("status = %+v, want healthy with 1 device", status)
+	}
+
+	for _, content := range []string{"not json", ""} {
+		if content == "" {
+			os.Remove(file)
+		} else if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.FetchDevices(context.Background()); err == nil {
+			t.Errorf("fetching %q succeeded", content)
+		}
+	}
+	if status := source.Status(); status.Healthy || status.ErrorCount != 2 || status.ConsecutiveErrors != 2 {
+		t.Errorf("status = %+v, want 2 consecutive errors", status)
+	}
+
+	if _, err := NewFileSource(models.SourceConfig{Name: "local"}, clk); err == nil {
+		t.Errorf("NewFileSource without a file succeeded")
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Package trips segments the point stream of each device into trips and stops.
+
+The segmentation is driven by the device settings:
+  - BeginMovingSpeed: a stopped device starts a trip when it reaches this speed.
+  - BeginStoppedSpeed: a moving device is considered stopped at or below this speed.
+  - MaxDriftDistance: position changes within this distance of where the device
+    stopped are GPS drift; moving farther starts a trip even at low reported speed,
+    and trips shorter than this are discarded.
+  - DriveTimeout: a trip ends once the device has been stopped for this long, shorter
+    stops (traffic lights, drive-throughs) stay part of the trip.
+  - StopTimeout: a gap between two points longer than this ends the current trip at
+    the last point received instead of joining the trip across the gap.
+*/
+package trips
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"OneStepGPSLeo/common"
+	"OneStepGPSLeo/models"
+)
+
+// Store persists completed trips and stops.
+type Store interface {
+	SaveTrip(trip models.Trip) error
+	SaveStop(stop models.Stop) error
+}
+
+// deviceState is the segmentation state of one device.
+type deviceState struct {
+	lastPoint *models.DevicePointRecord
+	moving    bool
+
+	trip              *models.Trip
+	stopCandidate     *models.DevicePointRecord // First slow point of a possible stop during a trip
+	candidateDistance float64                   // Trip distance when the stop candidate was seen
+
+	stop        *models.Stop // Open stop while parked
+	pendingStop *models.Stop // Stop closed by the current trip, saved once the trip is confirmed
+}
+
+// Engine keeps the per device segmentation state and persists trips and stops as they complete.
+type Engine struct {
+	Store  Store
+	mutex  sync.Mutex
+	states map[string]*deviceState
+}
+
+// NewEngine creates a trip engine saving to the given store.
+func NewEngine(store Store) *Engine {
+	return &Engine{Store: store, states: make(map[string]*deviceState)}
+}
+
+// ProcessPoint feeds a new point of a device into the engine. Points older than the last
+// processed point of the device are ignored.
+func (e *Engine) ProcessPoint(point models.DevicePointRecord, settings models.DeviceSettings) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	state, ok := e.states[point.DeviceID]
+	if !ok {
+		state = &deviceState{}
+		e.states[point.DeviceID] = state
+	}
+	if state.lastPoint != nil && !point.DtTracker.After(state.lastPoint.DtTracker) {
+		return
+	}
+
+	e.process(state, point, settings)
+	state.lastPoint = &point
+}
+
+func (e *Engine) process(state *deviceState, point models.DevicePointRecord, settings models.DeviceSettings) {
+	driftDistance := settings.MaxDriftDistance.Meters()
+	stopTimeout := time.Duration(settings.StopTimeout.Seconds() * float64(time.Second))
+	last := state.lastPoint
+
+	if state.moving {
+		if stopTimeout > 0 && point.DtTracker.Sub(last.DtTracker) > stopTimeout {
+			// Lost contact mid trip, close it where we last saw the device
+			e.endTrip(state, *last, state.trip.DistanceMeters, driftDistance)
+			if state.stop == nil {
+				state.stop = &models.Stop{
+					ID:        fmt.Sprintf("%s-%d", last.DeviceID, last.DtTracker.Unix()),
+					DeviceID:  last.DeviceID,
+					StartTime: last.DtTracker,
+					EndTime:   last.DtTracker,
+					Location:  models.Location{Lat: last.Lat, Lng: last.Lng},
+				}
+			}
+		} else {
+			e.continueTrip(state, point, settings, driftDistance)
+			return
+		}
+	}
+
+	if e.startsMoving(state, point, settings, driftDistance) {
+		e.startTrip(state, point, stopTimeout)
+		return
+	}
+
+	if state.stop == nil {
+		state.stop = &models.Stop{
+			ID:        fmt.Sprintf("%s-%d", point.DeviceID, point.DtTracker.Unix()),
+			DeviceID:  point.DeviceID,
+			StartTime: point.DtTracker,
+			Location:  models.Location{Lat: point.Lat, Lng: point.Lng},
+		}
+	}
+	state.stop.EndTime = point.DtTracker
+}
+
+// startsMoving reports whether a stopped device is now driving.
+func (e *Engine) startsMoving(state *deviceState, point models.DevicePointRecord, settings models.DeviceSettings, driftDistance float64) bool {
+	beginMoving := settings.BeginMovingSpeed.KilometersPerHour()
+	if point.Speed > 0 && point.Speed >= beginMoving {
+		return true
+	}
+	if state.stop != nil && driftDistance > 0 {
+		return common.DistanceMeters(state.stop.Location.Lat, state.stop.Location.Lng, point.Lat, point.Lng) > driftDistance
+	}
+	return false
+}
+
+func (e *Engine) startTrip(state *deviceState, point models.DevicePointRecord, stopTimeout time.Duration) {
+	// The trip starts at the last parked point when it is recent enough, so it covers the way
+	// from there to the first moving point
+	start := point
+	if last := state.lastPoint; last != nil && (stopTimeout <= 0 || point.DtTracker.Sub(last.DtTracker) <= stopTimeout) {
+		start = *last
+	}
+
+	if state.stop != nil {
+		state.stop.EndTime = start.DtTracker
+		state.pendingStop = state.stop
+		state.stop = nil
+	}
+
+	state.moving = true
+	state.stopCandidate = nil
+	state.trip = &models.Trip{
+		ID:            fmt.Sprintf("%s-%d", point.DeviceID, start.DtTracker.Unix()),
+		DeviceID:      point.DeviceID,
+		StartTime:     start.DtTracker,
+		EndTime:       start.DtTracker,
+		StartLocation: models.Location{Lat: start.Lat, Lng: start.Lng},
+		EndLocation:   models.Location{Lat: start.Lat, Lng: start.Lng},
+		MaxSpeedKmh:   start.Speed,
+		PointCount:    1,
+	}
+	if start.DtTracker.Before(point.DtTracker) {
+		e.addToTrip(state, start, point)
+	}
+}
+
+func (e *Engine) continueTrip(state *deviceState, point models.DevicePointRecord, settings models.DeviceSettings, driftDistance float64) {
+	e.addToTrip(state, *state.lastPoint, point)
+
+	if point.Speed > settings.BeginStoppedSpeed.KilometersPerHour() {
+		state.stopCandidate = nil
+		return
+	}
+
+	if state.stopCandidate == nil {
+		state.stopCandidate = &point
+		state.candidateDistance = state.trip.DistanceMeters
+		return
+	}
+
+	// Slow but drifted away from where it slowed down, it is still driving
+	if driftDistance > 0 && common.DistanceMeters(state.stopCandidate.Lat, state.stopCandidate.Lng, point.Lat, point.Lng) > driftDistance {
+		state.stopCandidate = &point
+		state.candidateDistance = state.trip.DistanceMeters
+		return
+	}
+
+	driveTimeout := time.Duration(settings.DriveTimeout.Seconds() * float64(time.Second))
+	if point.DtTracker.Sub(state.stopCandidate.DtTracker) >= driveTimeout {
+		candidate := *state.stopCandidate
+		e.endTrip(state, candidate, state.candidateDistance, driftDistance)
+		if state.stop == nil {
+			state.stop = &models.Stop{
+				ID:        fmt.Sprintf("%s-%d", point.DeviceID, candidate.DtTracker.Unix()),
+				DeviceID:  point.DeviceID,
+				StartTime: candidate.DtTracker,
+				Location:  models.Location{Lat: candidate.Lat, Lng: candidate.Lng},
+			}
+		}
+		state.stop.EndTime = point.DtTracker // A drift trip resumed the previous stop
+	}
+}
+
+func (e *Engine) addToTrip(state *deviceState, from, to models.DevicePointRecord) {
+	trip := state.trip
+	trip.DistanceMeters += common.DistanceMeters(from.Lat, from.Lng, to.Lat, to.Lng)
+	trip.EndTime = to.DtTracker
+	trip.EndLocation = models.Location{Lat: to.Lat, Lng: to.Lng}
+	trip.PointCount++
+	if to.Speed > trip.MaxSpeedKmh {
+		trip.MaxSpeedKmh = to.Speed
+	}
+}
+
+// endTrip closes the open trip at the given point and persists it together with the stop preceding it.
+// Trips shorter than the drift distance are GPS noise: they are dropped and the previous stop is resumed.
+func (e *Engine) endTrip(state *deviceState, end models.DevicePointRecord, distance, driftDistance float64) {
+	trip := state.trip
+	state.trip = nil
+	state.moving = false
+	state.stopCandidate = nil
+
+	trip.EndTime = end.DtTracker
+	trip.EndLocation = models.Location{Lat: end.Lat, Lng: end.Lng}
+	trip.DistanceMeters = distance
+	trip.DurationSeconds = trip.EndTime.Sub(trip.StartTime).Seconds()
+	if trip.DurationSeconds > 0 {
+		trip.AvgSpeedKmh = trip.DistanceMeters / trip.DurationSeconds * 3.6
+	}
+
+	if trip.DistanceMeters < driftDistance {
+		log.Printf("Discarding %.0f m trip of device %s as GPS drift", trip.DistanceMeters, trip.DeviceID)
+		state.stop = state.pendingStop
+		state.pendingStop = nil
+		return
+	}
+
+	if stop := state.pendingStop; stop != nil {
+		stop.DurationSeconds = stop.EndTime.Sub(stop.StartTime).Seconds()
+		if err := e.Store.SaveStop(*stop); err != nil {
+			log.Printf("Failed to save stop for device %s: %v", stop.DeviceID, err)
+		}
+		state.pendingStop = nil
+	}
+
+	if err := e.Store.SaveTrip(*trip); err != nil {
+		log.Printf("Failed to save trip for device %s: %v", trip.DeviceID, err)
+		return
+	}
+	log.Printf("Trip for device %s: %s to %s, %.0f m", trip.DeviceID,
+		trip.StartTime.Format(time.RFC3339), trip.EndTime.Format(time.RFC3339), trip.DistanceMeters)
+}
+
+// OpenTrip returns the trip in progress for a device, if any.
+func (e *Engine) OpenTrip(deviceID string) (models.Trip, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	state, ok := e.states[deviceID]
+	if !ok || state.trip == nil {
+		return models.Trip{}, false
+	}
+	trip := *state.trip
+	trip.InProgress = true
+	trip.DurationSeconds = trip.EndTime.Sub(trip.StartTime).Seconds()
+	if trip.DurationSeconds > 0 {
+		trip.AvgSpeedKmh = trip.DistanceMeters / trip.DurationSeconds * 3.6
+	}
+	return trip, true
+}
+
+// OpenStop returns the current or not yet saved stop of a device, if any.
+func (e *Engine) OpenStop(deviceID string) (models.Stop, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	state, ok := e.states[deviceID]
+	if !ok {
+		return models.Stop{}, false
+	}
+	var stop models.Stop
+	switch {
+	case state.stop != nil:
+		stop = *state.stop
+		stop.InProgress = true
+	case state.pendingStop != nil:
+		stop = *state.pendingStop // Ended, but only saved once the current trip is confirmed
+	default:
+		return models.Stop{}, false
+	}
+	stop.DurationSeconds = stop.EndTime.Sub(stop.StartTime).Seconds()
+	return stop, true
+}
@@ -0,0 +1,222 @@
+package trips
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"OneStepGPSLeo/models"
+)
+
+var start = time.Date(2024, 11, 13, 6, 0, 0, 0, time.UTC)
+
+// memoryStore keeps the saved trips and stops in the order they were saved.
+type memoryStore struct {
+	trips []models.Trip
+	stops []models.Stop
+}
+
+func (s *memoryStore) SaveTrip(trip models.Trip) error {
+	s.trips = append(s.trips, trip)
+	return nil
+}
+
+func (s *memoryStore) SaveStop(stop models.Stop) error {
+	s.stops = append(s.stops, stop)
+	return nil
+}
+
+// testSettings start trips at 10 km/h, stop them at 5 km/h, ignore 50 m of drift, end trips
+// after 2 minutes stopped and split them at gaps longer than 10 minutes.
+var testSettings = models.DeviceSettings{
+	BeginMovingSpeed:  models.Speed{Value: 10, Unit: "km/h"},
+	BeginStoppedSpeed: models.Speed{Value: 5, Unit: "km/h"},
+	MaxDriftDistance:  models.Speed{Value: 50, Unit: "m"},
+	DriveTimeout:      models.Speed{Value: 2, Unit: "min"},
+	StopTimeout:       models.Speed{Value: 10, Unit: "min"},
+}
+
+// at returns a point second seconds after start, north of the origin by lat degrees
+// (0.001 is about 111 m).
+func at(second int, lat, speed float64) models.DevicePointRecord {
+	return models.DevicePointRecord{
+		DeviceID:  "device",
+		DtTracker: start.Add(time.Duration(second) * time.Second),
+		Lat:       lat,
+		Speed:     speed,
+	}
+}
+
+// span is the expected start and end, in seconds after start, of a trip or stop.
+type span struct {
+	start, end int
+}
+
+func (s span) matches(startTime, endTime time.Time) bool {
+	return startTime.Equal(start.Add(time.Duration(s.start)*time.Second)) && endTime.Equal(start.Add(time.Duration(s.end)*time.Second))
+}
+
+func TestSegmentation(t *testing.T) {
+	tests := []struct {
+		name     string
+		points   []models.DevicePointRecord
+		trips    []span
+		starts   []float64 // Start latitude of each trip
+		meters   []float64 // Distance of each trip
+		stops    []span
+		openStop *span
+		openTrip bool
+	}{
+		{
+			name: "trip between two stops",
+			points: []models.DevicePointRecord{
+				at(0, 0, 0), at(60, 0, 0), at(120, 0, 0),
+				at(180, 0.001, 40), at(240, 0.002, 40), at(300, 0.003, 40),
+				at(360, 0.003, 0), at(420, 0.003, 0), at(480, 0.003, 0),
+			},
+			// The trip starts at the last parked point, where and when the device left
+			trips:    []span{{120, 360}},
+			starts:   []float64{0},
+			meters:   []float64{333.6},
+			stops:    []span{{0, 120}},
+			openStop: &span{360, 480},
+		},
+		{
+			name: "trip in progress",
+			points: []models.DevicePointRecord{
+				at(0, 0, 0), at(60, 0.001, 40), at(120, 0.002, 40),
+			},
+			openStop: &span{0, 0}, // Ended, saved once the trip is confirmed
+			openTrip: true,
+		},
+		{
+			name: "short stop stays part of the trip",
+			points: []models.DevicePointRecord{
+				at(0, 0, 0), at(60, 0.001, 40), at(120, 0.002, 40),
+				at(180, 0.002, 0), at(240, 0.002, 0), // A minute at a traffic light
+				at(300, 0.003, 40), at(360, 0.004, 40),
+				at(420, 0.004, 0), at(480, 0.004, 0), at(540, 0.004, 0),
+			},
+			trips:    []span{{0, 420}},
+			starts:   []float64{0},
+			meters:   []float64{444.8},
+			stops:    []span{{0, 0}},
+			openStop: &span{420, 540},
+		},
+		{
+			name: "drift is discarded and the stop resumed",
+			points: []models.DevicePointRecord{
+				at(0, 0, 0), at(60, 0, 0),
+				at(120, 0.0001, 15), // A speed spike 11 m away
+				at(180, 0.0001, 0), at(240, 0.0001, 0), at(300, 0.0001, 0),
+			},
+			openStop: &span{0, 300},
+		},
+		{
+			name: "creeping beyond the drift distance is a trip",
+			points: []models.DevicePointRecord{
+				at(0, 0, 0), at(60, 0, 0),
+				at(120, 0.001, 3), // Slow, but 111 m from where it stopped
+				at(180, 0.001, 0), at(240, 0.001, 0), at(300, 0.001, 0),
+			},
+			trips:    []span{{60, 180}},
+			starts:   []float64{0},
+			meters:   []float64{111.2},
+			stops:    []span{{0, 60}},
+			openStop: &span{180, 300},
+		},
+		{
+			name: "gap longer than the stop timeout splits trips",
+			points: []models.DevicePointRecord{
+				at(0, 0, 0), at(60, 0.001, 40), at(120, 0.002, 40),
+				// Nothing for 23 minutes, then driving elsewhere
+				at(1500, 0.010, 40), at(1560, 0.011, 40),
+				at(1620, 0.011, 0), at(1680, 0.011, 0), at(1740, 0.011, 0),
+			},
+			trips:    []span{{0, 120}, {1500, 1620}},
+			starts:   []float64{0, 0.010},
+			meters:   []float64{222.4, 111.2},
+			stops:    []span{{0, 0}, {120, 1500}},
+			openStop: &span{1620, 1740},
+		},
+		{
+			name: "older points are ignored",
+			points: []models.DevicePointRecord{
+				at(0, 0, 0), at(60, 0, 0), at(30, 0.005, 80), at(60, 0.005, 80), at(120, 0, 0),
+			},
+			openStop: &span{0, 120},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &memoryStore{}
+			engine := NewEngine(store)
+			for _, point := range test.points {
+				engine.ProcessPoint(point, testSettings)
+			}
+
+			trips := store.trips
+			if len(trips) != len(test.trips) {
+				t.Fatalf("saved %d trips, want %d: %+v", len(trips), len(test.trips), trips)
+			}
+			for i, trip := range trips {
+				if !test.trips[i].matches(trip.StartTime, trip.EndTime) {
+					t.Errorf("trip %d runs %s to %s, want %v", i, trip.StartTime, trip.EndTime, test.trips[i])
+				}
+				if trip.StartLocation.Lat != test.starts[i] {
+					t.Errorf("trip %d starts at %v, want %v", i, trip.StartLocation.Lat, test.starts[i])
+				}
+				if math.Abs(trip.DistanceMeters-test.meters[i]) > 1 {
+					t.Errorf("trip %d is %.1f m, want %.1f m", i, trip.DistanceMeters, test.meters[i])
+				}
+				if want := trip.EndTime.Sub(trip.StartTime).Seconds(); trip.DurationSeconds != want {
+					t.Errorf("trip %d lasts %v s, want %v s", i, trip.DurationSeconds, want)
+				}
+			}
+
+			stops := store.stops
+			if len(stops) != len(test.stops) {
+				t.Fatalf("saved %d stops, want %d: %+v", len(stops), len(test.stops), stops)
+			}
+			for i, stop := range stops {
+				if !test.stops[i].matches(stop.StartTime, stop.EndTime) {
+					t.Errorf("stop %d runs %s to %s, want %v", i, stop.StartTime, stop.EndTime, test.stops[i])
+				}
+			}
+
+			stop, ok := engine.OpenStop("device")
+			if ok != (test.openStop != nil) {
+				t.Fatalf("open stop = %v, want %v", ok, test.openStop != nil)
+			}
+			if ok && !test.openStop.matches(stop.StartTime, stop.EndTime) {
+				t.Errorf("open stop runs %s to %s, want %v", stop.StartTime, stop.EndTime, *test.openStop)
+			}
+			if _, ok := engine.OpenTrip("device"); ok != test.openTrip {
+				t.Errorf("open trip = %v, want %v", ok, test.openTrip)
+			}
+		})
+	}
+}
+
+func TestOpenTripStartsAtTheSameFix(t *testing.T) {
+	engine := NewEngine(&memoryStore{})
+	for _, point := range []models.DevicePointRecord{at(0, 0, 0), at(60, 0.001, 40), at(120, 0.002, 50)} {
+		engine.ProcessPoint(point, testSettings)
+	}
+
+	trip, ok := engine.OpenTrip("device")
+	if !ok {
+		t.Fatal("no trip in progress")
+	}
+	if !trip.StartTime.Equal(start) || trip.StartLocation.Lat != 0 {
+		t.Errorf("trip starts at %v at %s, want the parked point", trip.StartLocation.Lat, trip.StartTime)
+	}
+	if trip.PointCount != 3 || trip.MaxSpeedKmh != 50 || !trip.InProgress {
+		t.Errorf("trip = %+v, want 3 points up to 50 km/h in progress", trip)
+	}
+	// 222 m in 120 s
+	if math.Abs(trip.AvgSpeedKmh-222.4/120*3.6) > 0.1 {
+		t.Errorf("average speed %.1f km/h, want the distance over the duration", trip.AvgSpeedKmh)
+	}
+}